@@ -0,0 +1,248 @@
+// 对账单下载
+
+package alipay
+
+import (
+	"archive/zip"
+	"context"
+	"encoding/csv"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/shengzhi/payment"
+	"golang.org/x/text/encoding/simplifiedchinese"
+	"golang.org/x/text/transform"
+)
+
+// 账单类型
+const (
+	BillTypeTrade        = "trade"        // 商户基于支付宝交易收单的业务账单
+	BillTypeSignCustomer = "signcustomer" // 基于商户支付宝余额收入及支出等资金变动的账务账单
+)
+
+type billDownloadURLRequest struct {
+	BillType string `json:"bill_type"`
+	BillDate string `json:"bill_date"`
+}
+
+type billDownloadURLReply struct {
+	commonReply
+	URL string `json:"bill_download_url"`
+}
+
+// BillDownloadURL 查询对账单下载地址，date 为 yyyy-MM-dd 格式的日账单或 yyyy-MM 格式的月账单
+func (c *AlipayClient) BillDownloadURL(ctx context.Context, billType, date string) (string, error) {
+	var reply billDownloadURLReply
+	err := c.Execute(ctx, "alipay.data.dataservice.bill.downloadurl.query",
+		billDownloadURLRequest{BillType: billType, BillDate: date}, nil, &reply)
+	return reply.URL, err
+}
+
+// DownloadBillFile 下载原始对账单压缩包，使用客户端的HTTP客户端，请求经过已配置的HTTP中间件
+func (c *AlipayClient) DownloadBillFile(ctx context.Context, billType, date string) (io.ReadCloser, error) {
+	uri, err := c.BillDownloadURL(ctx, billType, date)
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequest("GET", uri, nil)
+	if err != nil {
+		return nil, err
+	}
+	res, err := c.client.Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, err
+	}
+	if res.StatusCode != http.StatusOK {
+		res.Body.Close()
+		return nil, fmt.Errorf("download bill failed, status:%s", res.Status)
+	}
+	return res.Body, nil
+}
+
+// DownloadBill 下载并解析业务明细账单(trade)，压缩包先写入临时文件，明细逐条流式解析；
+// 明细的 MerchantID 为合作伙伴身份ID(PID)，未配置时为应用ID
+func (c *AlipayClient) DownloadBill(ctx context.Context, date time.Time, fn payment.BillRecordFunc) (payment.BillSummary, error) {
+	var summary payment.BillSummary
+	body, err := c.DownloadBillFile(ctx, BillTypeTrade, date.Format("2006-01-02"))
+	if err != nil {
+		return summary, err
+	}
+	defer body.Close()
+	tmp, err := ioutil.TempFile("", "alipay_bill_*.zip")
+	if err != nil {
+		return summary, err
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+	size, err := io.Copy(tmp, body)
+	if err != nil {
+		return summary, err
+	}
+	zr, err := zip.NewReader(tmp, size)
+	if err != nil {
+		return summary, err
+	}
+	for _, f := range zr.File {
+		// 压缩包内包含业务明细及业务明细(汇总)两个文件
+		if strings.Contains(f.Name, "汇总") || strings.Contains(f.Name, "(") {
+			continue
+		}
+		rc, err := f.Open()
+		if err != nil {
+			return summary, err
+		}
+		defer rc.Close()
+		return ParseBill(rc, func(record payment.BillRecord) error {
+			record.MerchantID = c.merchantID()
+			return fn(record)
+		})
+	}
+	return summary, fmt.Errorf("bill detail file not found")
+}
+
+// merchantID 商户标识，对账单及对账按该标识区分商户
+func (c *AlipayClient) merchantID() string {
+	if c.cfg.partnerId != "" {
+		return c.cfg.partnerId
+	}
+	return c.cfg.appId
+}
+
+// 业务明细账单列序号
+const (
+	billColTradeNo = iota
+	billColOutTradeNo
+	billColBizType
+	billColSubject
+	billColCreateTime
+	billColFinishTime
+	billColStoreID
+	billColStoreName
+	billColOperator
+	billColTerminal
+	billColBuyerAccount
+	billColTotalAmount
+	billColReceiptAmount
+	billColRedPacket
+	billColPoint
+	billColAlipayDiscount
+	billColMerchantDiscount
+	billColVoucherAmount
+	billColVoucherName
+	billColMerchantRedPacket
+	billColCardAmount
+	billColRefundNo
+	billColServiceFee
+	billColProfit
+	billColRemark
+	billColCount
+)
+
+// ParseBill 流式解析业务明细账单CSV，每条明细调用一次 fn，汇总数据由明细累计得到。
+// 账单为GBK编码，解析时转换为UTF-8，列按位置解析；业务类型转换为 payment.BillStatusSuccess 及
+// payment.BillStatusRefund，账单中无商户号，MerchantID 为空
+func ParseBill(r io.Reader, fn payment.BillRecordFunc) (payment.BillSummary, error) {
+	var summary payment.BillSummary
+	cr := csv.NewReader(transform.NewReader(r, simplifiedchinese.GB18030.NewDecoder()))
+	cr.Comment = '#'
+	cr.FieldsPerRecord = -1
+	cr.LazyQuotes = true
+	if _, err := cr.Read(); err != nil {
+		if err == io.EOF {
+			return summary, nil
+		}
+		return summary, err
+	}
+	for {
+		row, err := cr.Read()
+		if err == io.EOF {
+			return summary, nil
+		}
+		if err != nil {
+			return summary, err
+		}
+		if len(row) < billColCount {
+			continue
+		}
+		record, err := parseBillRecord(row)
+		if err != nil {
+			return summary, err
+		}
+		summary.TotalCount++
+		summary.TotalAmount += record.TotalAmount
+		summary.SettlementAmount += record.SettlementAmount
+		summary.RefundAmount += record.RefundAmount
+		summary.Fee += record.Fee
+		if err = fn(record); err != nil {
+			return summary, err
+		}
+	}
+}
+
+func parseBillRecord(row []string) (record payment.BillRecord, err error) {
+	for i := range row {
+		row[i] = strings.TrimSpace(row[i])
+	}
+	record = payment.BillRecord{
+		Plat:            payment.PayPlatAlipay,
+		TransactionID:   row[billColTradeNo],
+		MerchantOrderNo: row[billColOutTradeNo],
+		Status:          billStatus(row[billColBizType]),
+		Subject:         row[billColSubject],
+		Currency:        "CNY",
+	}
+	record.TradeTime, err = time.ParseInLocation(alipay_time_format, row[billColFinishTime], time.Local)
+	if err != nil {
+		return
+	}
+	amount, err := payment.ParseAmount(row[billColTotalAmount])
+	if err != nil {
+		return
+	}
+	if record.SettlementAmount, err = payment.ParseAmount(row[billColReceiptAmount]); err != nil {
+		return
+	}
+	discount, err := payment.ParseAmount(row[billColMerchantDiscount])
+	if err != nil {
+		return
+	}
+	voucher, err := payment.ParseAmount(row[billColVoucherAmount])
+	if err != nil {
+		return
+	}
+	record.CouponAmount = discount + voucher
+	// 服务费以负数表示支出，转换为正数表示收取的手续费
+	fee, err := payment.ParseAmount(row[billColServiceFee])
+	if err != nil {
+		return
+	}
+	record.Fee = -fee
+	// 退款记录金额为负数，并携带退款请求号
+	if amount < 0 || row[billColRefundNo] != "" {
+		record.IsRefund = true
+		record.MerchantRefundNo = row[billColRefundNo]
+		record.RefundAmount = -amount
+		record.RefundStatus = string(payment.RefundStatusSuccess)
+		record.Status = payment.BillStatusRefund
+	} else {
+		record.TotalAmount = amount
+	}
+	record.Attach = row[billColRemark]
+	return
+}
+
+// billStatus 业务类型转换为交易状态，未知的业务类型保留原值
+func billStatus(bizType string) string {
+	switch bizType {
+	case "交易":
+		return payment.BillStatusSuccess
+	case "退款":
+		return payment.BillStatusRefund
+	}
+	return bizType
+}
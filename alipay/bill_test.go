@@ -0,0 +1,78 @@
+package alipay
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/shengzhi/payment"
+	"golang.org/x/text/encoding/simplifiedchinese"
+)
+
+// testBill 业务明细账单，列依次为 支付宝交易号,商户订单号,业务类型,商品名称,创建时间,完成时间,门店编号,门店名称,操作员,终端号,
+// 对方账户,订单金额,商家实收,支付宝红包,集分宝,支付宝优惠,商家优惠,券核销金额,券名称,商家红包消费金额,卡消费金额,退款批次号/请求号,服务费,分润,备注
+const testBill = `#支付宝业务明细查询
+#账号：[20880000000000000156]
+#起始日期：[2026年10月17日 00:00:00]   终止日期：[2026年10月18日 00:00:00]
+#-----------------------------------------业务明细列表----------------------------------------
+支付宝交易号,商户订单号,业务类型,商品名称,创建时间,完成时间,门店编号,门店名称,操作员,终端号,对方账户,订单金额（元）,商家实收（元）,支付宝红包（元）,集分宝（元）,支付宝优惠（元）,商家优惠（元）,券核销金额（元）,券名称,商家红包消费金额（元）,卡消费金额（元）,退款批次号/请求号,服务费（元）,分润（元）,备注
+2026101722001	,T1	,交易	,会员月卡	,2026-10-17 10:00:00	,2026-10-17 10:00:05	,	,	,	,	,abc***@163.com	,100.00	,95.00	,0.00	,0.00	,0.00	,3.00	,2.00	,满减券	,0.00	,0.00	,	,-0.60	,0.00	,
+2026101722001	,T1	,退款	,会员月卡	,2026-10-17 12:00:00	,2026-10-17 12:00:01	,	,	,	,	,abc***@163.com	,-30.00	,-30.00	,0.00	,0.00	,0.00	,0.00	,0.00	,	,0.00	,0.00	,T1-R1	,0.18	,0.00	,
+#-----------------------------------------业务明细列表结束------------------------------------
+#交易合计：1笔，商家实收：95.00元，商家优惠：3.00元
+#退款合计：1笔，商家实收：-30.00元，商家优惠：0.00元
+#导出时间：[2026年10月18日 09:00:00]
+`
+
+func TestParseBill(t *testing.T) {
+	gbk, err := simplifiedchinese.GBK.NewEncoder().Bytes([]byte(testBill))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var records []payment.BillRecord
+	summary, err := ParseBill(bytes.NewReader(gbk), func(r payment.BillRecord) error {
+		records = append(records, r)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []payment.BillRecord{
+		{
+			Plat: payment.PayPlatAlipay, TransactionID: "2026101722001", MerchantOrderNo: "T1",
+			Status: payment.BillStatusSuccess, Subject: "会员月卡", Currency: "CNY",
+			TotalAmount: 10000, SettlementAmount: 9500, CouponAmount: 500, Fee: 60,
+		},
+		{
+			Plat: payment.PayPlatAlipay, TransactionID: "2026101722001", MerchantOrderNo: "T1",
+			Status: payment.BillStatusRefund, Subject: "会员月卡", Currency: "CNY", IsRefund: true,
+			MerchantRefundNo: "T1-R1", RefundAmount: 3000, RefundStatus: "SUCCESS",
+			SettlementAmount: -3000, Fee: -18,
+		},
+	}
+	if len(records) != len(want) {
+		t.Fatalf("got %d records, want %d", len(records), len(want))
+	}
+	for i := range want {
+		got := records[i]
+		got.TradeTime = want[i].TradeTime
+		if got != want[i] {
+			t.Errorf("record %d:\n got %+v\nwant %+v", i, got, want[i])
+		}
+	}
+	if records[0].TradeTime.Format(alipay_time_format) != "2026-10-17 10:00:05" {
+		t.Errorf("got trade time %v", records[0].TradeTime)
+	}
+	wantSummary := payment.BillSummary{TotalCount: 2, TotalAmount: 10000, SettlementAmount: 6500, RefundAmount: 3000, Fee: 42}
+	if summary != wantSummary {
+		t.Errorf("got summary %+v, want %+v", summary, wantSummary)
+	}
+}
+
+func TestBillStatus(t *testing.T) {
+	tests := map[string]string{"交易": payment.BillStatusSuccess, "退款": payment.BillStatusRefund, "其他": "其他"}
+	for bizType, want := range tests {
+		if got := billStatus(bizType); got != want {
+			t.Errorf("billStatus(%s) = %s, want %s", bizType, got, want)
+		}
+	}
+}
@@ -2,6 +2,7 @@ package alipay
 
 import (
 	"bytes"
+	"context"
 	"crypto"
 	"crypto/rsa"
 	"crypto/tls"
@@ -9,11 +10,11 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
+	"io/ioutil"
 	"log"
+	"net"
 	"net/http"
-	"net/http/httputil"
 	"net/url"
-	"sort"
 	"strings"
 	"sync"
 	"time"
@@ -22,6 +23,7 @@ import (
 )
 
 var _ payment.Provider = &AlipayClient{}
+var _ payment.OrderQuerier = &AlipayClient{}
 
 const api_gateway = "https://openapi.alipay.com/gateway.do"
 
@@ -31,6 +33,7 @@ type aliPayConfig struct {
 	partnerId            string
 	notifyURL            string
 	rsaPubKey, rsaPriKey []byte
+	encryptKey           string
 }
 
 // AlipayClient alipay client
@@ -38,9 +41,19 @@ type AlipayClient struct {
 	client     *http.Client
 	privateKey *rsa.PrivateKey
 	publicKey  *rsa.PublicKey
+	aesKey     []byte
 	bufPool    *sync.Pool
 	cfg        aliPayConfig
 	tracer     *log.Logger
+	redactor   *payment.Redactor
+	auditSink  payment.AuditSink
+
+	refundHandler payment.RefundNotifyHandleFunc
+	closeHandler  payment.NotifyHandleFunc
+	orderStore    payment.OrderStore
+	retryPolicy   payment.RetryPolicy
+
+	httpMiddlewares []payment.HTTPMiddleware
 }
 
 // NewClient 创建支付宝客户端
@@ -55,6 +68,14 @@ func NewClient(appID, partnerID string, options ...OptionHandlerFunc) *AlipayCli
 	for _, fn := range options {
 		fn(client)
 	}
+	mws := client.httpMiddlewares
+	if client.tracer != nil {
+		mws = append(mws[:len(mws):len(mws)], payment.TraceMiddleware(payment.PayPlatAlipay, client.tracer, client.redactor))
+	}
+	if client.auditSink != nil {
+		mws = append(mws[:len(mws):len(mws)], payment.AuditMiddleware(payment.PayPlatAlipay, client.auditSink))
+	}
+	client.client.Transport = payment.ChainHTTP(client.client.Transport, mws...)
 	var err error
 	client.publicKey, err = initRSAPublicKey(client.cfg.rsaPubKey)
 	if err != nil {
@@ -64,6 +85,12 @@ func NewClient(appID, partnerID string, options ...OptionHandlerFunc) *AlipayCli
 	if err != nil {
 		log.Fatalln(err)
 	}
+	if client.cfg.encryptKey != "" {
+		client.aesKey, err = initAESKey(client.cfg.encryptKey)
+		if err != nil {
+			log.Fatalln(err)
+		}
+	}
 	return client
 }
 
@@ -95,25 +122,17 @@ func (c *AlipayClient) makeParams(req actReq) url.Values {
 		}
 	}
 	content, _ := json.Marshal(&req.data)
+	if c.aesKey != nil {
+		p.Add("encrypt_type", "AES")
+		content = []byte(c.aesEncrypt(content))
+	}
 	p.Add("biz_content", string(content))
 	p.Add("sign", c.makeSign(req.signType, c.makePlainTxt(p)))
 	return p
 }
 
 func (c *AlipayClient) makePlainTxt(params url.Values) []byte {
-	var keys = make([]string, 0, len(params))
-	for key := range params {
-		keys = append(keys, key)
-	}
-	sort.Strings(keys)
-	buf := c.getBuf()
-	defer c.bufPool.Put(buf)
-
-	for i := range keys {
-		fmt.Fprintf(buf, "%s=%s&", keys[i], strings.TrimSpace(params.Get(keys[i])))
-	}
-	buf.Truncate(buf.Len() - 1)
-	return buf.Bytes()
+	return PlainText(params)
 }
 
 func (c *AlipayClient) makeSign(signType SignType, src []byte) string {
@@ -148,14 +167,83 @@ func (c *AlipayClient) verifySign(signType SignType, src []byte, sign string) er
 	}
 }
 
-func (c *AlipayClient) do(params url.Values, reply interface{}) error {
+// idempotentMethods 使用相同业务参数可安全重试的接口
+var idempotentMethods = map[string]bool{
+	"alipay.trade.refund":                            true,
+	"alipay.trade.query":                             true,
+	"alipay.trade.close":                             true,
+	"alipay.trade.fastpay.refund.query":              true,
+	"alipay.data.dataservice.bill.downloadurl.query": true,
+}
+
+// retryable 系统繁忙及网络错误可重试
+func retryable(err error) bool {
+	if e, ok := err.(*Error); ok {
+		return e.Temporary()
+	}
+	_, ok := err.(net.Error)
+	return ok
+}
+
+// Execute 调用支付宝开放平台接口，method 为接口名称，bizContent 为业务请求参数，
+// extraParams 为公共参数之外的附加参数(如 notify_url)，验签并校验 code 及 sub_code 后将响应内容解析至 out。
+// 可安全重试的接口按重试策略重试
+func (c *AlipayClient) Execute(ctx context.Context, method string, bizContent interface{}, extraParams url.Values, out interface{}) error {
+	if !idempotentMethods[method] {
+		return c.execute(ctx, method, bizContent, extraParams, out)
+	}
+	return c.retryPolicy.Do(ctx, retryable, func() error {
+		return c.execute(ctx, method, bizContent, extraParams, out)
+	})
+}
+
+func (c *AlipayClient) execute(ctx context.Context, method string, bizContent interface{}, extraParams url.Values, out interface{}) error {
+	params := c.makeParams(actReq{
+		method:   method,
+		data:     bizContent,
+		signType: SignTypeRSA2,
+		params:   extraParams,
+	})
+	var res map[string]json.RawMessage
+	if err := c.do(ctx, params, &res); err != nil {
+		return err
+	}
+	key := responseKey(method)
+	content, has := res[key]
+	if !has {
+		if content, has = res["error_response"]; !has {
+			return fmt.Errorf("missing %s in response", key)
+		}
+	}
+	var reply commonReply
+	if err := json.Unmarshal(content, &reply); err != nil {
+		return err
+	}
+	if err := reply.checkErr(); err != nil {
+		return err
+	}
+	if out == nil {
+		return nil
+	}
+	return json.Unmarshal(content, out)
+}
+
+// responseKey 响应内容节点名称，如 alipay.trade.refund 对应 alipay_trade_refund_response
+func responseKey(method string) string {
+	return strings.Replace(method, ".", "_", -1) + "_response"
+}
+
+func (c *AlipayClient) do(ctx context.Context, params url.Values, reply interface{}) error {
 	buf := c.getBuf()
 	defer c.bufPool.Put(buf)
 	buf.WriteString(params.Encode())
 	req, err := http.NewRequest("POST", c.cfg.apiDomain, buf)
+	if err != nil {
+		return err
+	}
+	req = req.WithContext(ctx)
 	req.Header.Set("Content-Type", "application/x-www-form-urlencoded; charset=utf-8")
 	req.Header.Set("Accept", "application/json")
-	c.dumpRequest(req)
 	rep, err := c.client.Do(req)
 	if rep != nil {
 		defer rep.Body.Close()
@@ -163,22 +251,63 @@ func (c *AlipayClient) do(params url.Values, reply interface{}) error {
 	if err != nil {
 		return err
 	}
-	c.dumpResponse(rep)
-	return json.NewDecoder(rep.Body).Decode(reply)
-}
-
-func (c *AlipayClient) dumpRequest(req *http.Request) {
-	if c.tracer != nil {
-		data, _ := httputil.DumpRequest(req, true)
-		c.tracer.Println(string(data))
+	body, err := ioutil.ReadAll(rep.Body)
+	if err != nil {
+		return err
+	}
+	if body, err = c.openResponse(body); err != nil {
+		return err
 	}
+	return json.Unmarshal(body, reply)
 }
 
-func (c *AlipayClient) dumpResponse(resp *http.Response) {
-	if c.tracer != nil {
-		data, _ := httputil.DumpResponse(resp, true)
-		c.tracer.Println(string(data))
+// openResponse 验证同步响应签名，验签通过后解密响应内容。
+// 网关对 xxx_response 节点在响应中的原始JSON文本签名，启用内容加密时即为带双引号的密文字符串，
+// 因此验签使用 json.RawMessage 保留的原始字节，而非解析后的密文或解密后的明文
+func (c *AlipayClient) openResponse(body []byte) ([]byte, error) {
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(body, &fields); err != nil {
+		return nil, err
+	}
+	var sign string
+	if raw, has := fields["sign"]; has {
+		json.Unmarshal(raw, &sign)
+	}
+	for key, content := range fields {
+		if !strings.HasSuffix(key, "_response") {
+			continue
+		}
+		if sign != "" {
+			if err := c.verifySign(SignTypeRSA2, content, sign); err != nil {
+				return nil, fmt.Errorf("verify sign error %v", err)
+			}
+		} else if key != "error_response" {
+			// 网关在部分业务错误(如参数错误、权限不足)时不签名，优先返回实际的错误码
+			var reply commonReply
+			if json.Unmarshal(content, &reply) == nil && reply.Code != "" {
+				if err := reply.checkErr(); err != nil {
+					return nil, err
+				}
+			}
+			return nil, fmt.Errorf("missing sign of %s", key)
+		}
+		if len(content) == 0 || content[0] != '"' {
+			continue
+		}
+		if c.aesKey == nil {
+			return nil, errors.New("response is encrypted, but encrypt key is not configured")
+		}
+		var cipherTxt string
+		if err := json.Unmarshal(content, &cipherTxt); err != nil {
+			return nil, err
+		}
+		plainTxt, err := c.aesDecrypt(cipherTxt)
+		if err != nil {
+			return nil, fmt.Errorf("decrypt response error %v", err)
+		}
+		fields[key] = plainTxt
 	}
+	return json.Marshal(fields)
 }
 
 func (c *AlipayClient) buildHTML(method string, params url.Values) string {
@@ -0,0 +1,223 @@
+package alipay
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/shengzhi/payment"
+)
+
+var (
+	testKeyOnce sync.Once
+	testPriKey  []byte
+	testPubKey  []byte
+)
+
+// testKeys 测试用RSA密钥，应用私钥与支付宝公钥为同一密钥对，便于构造网关签名
+func testKeys(t *testing.T) (priKey, pubKey []byte) {
+	t.Helper()
+	testKeyOnce.Do(func() {
+		key, err := rsa.GenerateKey(rand.Reader, 2048)
+		if err != nil {
+			t.Fatal(err)
+		}
+		pub, err := x509.MarshalPKIXPublicKey(&key.PublicKey)
+		if err != nil {
+			t.Fatal(err)
+		}
+		testPriKey = pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)})
+		testPubKey = pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: pub})
+	})
+	return testPriKey, testPubKey
+}
+
+func newTestClient(t *testing.T, options ...OptionHandlerFunc) *AlipayClient {
+	t.Helper()
+	priKey, pubKey := testKeys(t)
+	return NewClient("2021000000000000", "2088000000000000", append([]OptionHandlerFunc{WithRSAKey(pubKey, priKey)}, options...)...)
+}
+
+func TestOpenResponse(t *testing.T) {
+	c := newTestClient(t)
+	priKey, _ := testKeys(t)
+	content := `{"code":"10000","msg":"Success","trade_no":"2026101822001"}`
+	sign, err := SignRSA2([]byte(content), priKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name    string
+		body    string
+		subCode string // 期望返回的业务错误
+		err     string // 期望返回的其他错误
+	}{
+		{name: "signed", body: `{"alipay_trade_query_response":` + content + `,"sign":"` + sign + `"}`},
+		{name: "tampered", body: `{"alipay_trade_query_response":` + strings.Replace(content, "22001", "22002", 1) + `,"sign":"` + sign + `"}`, err: "verify sign error"},
+		{name: "error response", body: `{"error_response":{"code":"40002","msg":"Invalid Arguments","sub_code":"isv.invalid-app-id"}}`},
+		{name: "unsigned business error", body: `{"alipay_trade_query_response":{"code":"40006","msg":"Insufficient Permissions","sub_code":"isv.insufficient-isv-permissions","sub_msg":"ISV权限不足"}}`, subCode: "isv.insufficient-isv-permissions"},
+		{name: "unsigned success", body: `{"alipay_trade_query_response":` + content + `}`, err: "missing sign"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := c.openResponse([]byte(tt.body))
+			var e *Error
+			switch {
+			case tt.subCode != "":
+				if !errors.As(err, &e) || e.SubCode != tt.subCode {
+					t.Fatalf("got error %v, want sub_code %s", err, tt.subCode)
+				}
+			case tt.err != "":
+				if err == nil || !strings.Contains(err.Error(), tt.err) {
+					t.Fatalf("got error %v, want %q", err, tt.err)
+				}
+			case err != nil:
+				t.Fatalf("unexpected error %v", err)
+			}
+		})
+	}
+}
+
+func TestOpenEncryptedResponse(t *testing.T) {
+	key := base64.StdEncoding.EncodeToString([]byte("0123456789abcdef"))
+	c := newTestClient(t, WithEncryptKey(key))
+	priKey, _ := testKeys(t)
+	content := `{"code":"10000","msg":"Success","trade_no":"2026101822001"}`
+	// 网关签名规则：对响应节点的原始JSON文本签名，加密时为带双引号的密文
+	gateway := func(cipherTxt string) string {
+		raw := `"` + cipherTxt + `"`
+		sign, err := SignRSA2([]byte(raw), priKey)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return `{"alipay_trade_query_response":` + raw + `,"sign":"` + sign + `"}`
+	}
+	cipherTxt := c.aesEncrypt([]byte(content))
+	body, err := c.openResponse([]byte(gateway(cipherTxt)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var res struct {
+		Response commonReply `json:"alipay_trade_query_response"`
+	}
+	if err = json.Unmarshal(body, &res); err != nil {
+		t.Fatal(err)
+	}
+	if res.Response.Code != "10000" {
+		t.Fatalf("got %s, want decrypted response", body)
+	}
+
+	// 仅对不带引号的密文签名时验签失败
+	sign, err := SignRSA2([]byte(cipherTxt), priKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	unquoted := `{"alipay_trade_query_response":"` + cipherTxt + `","sign":"` + sign + `"}`
+	if _, err = c.openResponse([]byte(unquoted)); err == nil || !strings.Contains(err.Error(), "verify sign error") {
+		t.Fatalf("got error %v, want verify sign error", err)
+	}
+
+	// 篡改密文后验签失败
+	other := c.aesEncrypt([]byte(strings.Replace(content, "22001", "22002", 1)))
+	tampered := strings.Replace(gateway(cipherTxt), cipherTxt, other, 1)
+	if _, err = c.openResponse([]byte(tampered)); err == nil || !strings.Contains(err.Error(), "verify sign error") {
+		t.Fatalf("got error %v, want verify sign error", err)
+	}
+
+	// 未配置加密密钥时无法解密
+	if _, err = newTestClient(t).openResponse([]byte(gateway(cipherTxt))); err == nil {
+		t.Fatal("expected missing encrypt key error")
+	}
+}
+
+// gatewayHandler 模拟支付宝网关，以测试密钥对响应签名，content 为接口响应节点内容
+func gatewayHandler(t *testing.T, handle func(params url.Values) (key, content string)) OptionHandlerFunc {
+	priKey, _ := testKeys(t)
+	return WithHTTPMiddleware(func(http.RoundTripper) http.RoundTripper {
+		return payment.RoundTripperFunc(func(req *http.Request) (*http.Response, error) {
+			body, _ := ioutil.ReadAll(req.Body)
+			params, err := url.ParseQuery(string(body))
+			if err != nil {
+				return nil, err
+			}
+			key, content := handle(params)
+			sign, err := SignRSA2([]byte(content), priKey)
+			if err != nil {
+				return nil, err
+			}
+			reply := `{"` + key + `":` + content + `,"sign":"` + sign + `"}`
+			return &http.Response{StatusCode: http.StatusOK, Body: ioutil.NopCloser(strings.NewReader(reply))}, nil
+		})
+	})
+}
+
+func TestExecute(t *testing.T) {
+	systemError := `{"code":"20000","msg":"Service Currently Unavailable","sub_code":"isp.unknow-error","sub_msg":"系统繁忙"}`
+	tests := []struct {
+		name     string
+		method   string
+		replies  []string // 依次返回的响应内容，超出时返回最后一个
+		attempts int
+		subCode  string
+	}{
+		{name: "success", method: "alipay.trade.query", replies: []string{`{"code":"10000","msg":"Success","trade_no":"2026101822001"}`}, attempts: 1},
+		{name: "retry idempotent method", method: "alipay.trade.query", replies: []string{systemError, `{"code":"10000","msg":"Success","trade_no":"2026101822001"}`}, attempts: 2},
+		{name: "no retry non-idempotent method", method: "alipay.trade.create", replies: []string{systemError}, attempts: 1, subCode: "isp.unknow-error"},
+		{name: "retry exhausted", method: "alipay.trade.refund", replies: []string{systemError}, attempts: 3, subCode: "isp.unknow-error"},
+		{name: "business error", method: "alipay.trade.refund", replies: []string{`{"code":"40004","msg":"Business Failed","sub_code":"ACQ.TRADE_NOT_EXIST","sub_msg":"交易不存在"}`}, attempts: 1, subCode: "ACQ.TRADE_NOT_EXIST"},
+		{name: "sub_code with success code", method: "alipay.trade.query", replies: []string{`{"code":"10000","msg":"Success","sub_code":"ACQ.TRADE_HAS_CLOSE"}`}, attempts: 1, subCode: "ACQ.TRADE_HAS_CLOSE"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			attempts := 0
+			var c *AlipayClient
+			c = newTestClient(t, WithRetryPolicy(payment.RetryPolicy{MaxAttempts: 3, BaseDelay: time.Millisecond, MaxDelay: time.Millisecond}),
+				gatewayHandler(t, func(params url.Values) (string, string) {
+					attempts++
+					sign := params.Get("sign")
+					params.Del("sign")
+					if err := c.verifySign(SignTypeRSA2, PlainText(params), sign); err != nil {
+						t.Errorf("request sign error %v", err)
+					}
+					if params.Get("method") != tt.method || params.Get("app_id") != "2021000000000000" ||
+						params.Get("sign_type") != "RSA2" || params.Get("biz_content") != `{"out_trade_no":"T1"}` || params.Get("notify_url") != "https://example.com/notify" {
+						t.Errorf("unexpected request %v", params)
+					}
+					reply := tt.replies[len(tt.replies)-1]
+					if attempts <= len(tt.replies) {
+						reply = tt.replies[attempts-1]
+					}
+					return responseKey(tt.method), reply
+				}))
+			var out struct {
+				TradeNo string `json:"trade_no"`
+			}
+			err := c.Execute(context.Background(), tt.method, map[string]string{"out_trade_no": "T1"}, url.Values{"notify_url": {"https://example.com/notify"}}, &out)
+			if attempts != tt.attempts {
+				t.Fatalf("got %d attempts, want %d", attempts, tt.attempts)
+			}
+			if tt.subCode != "" {
+				var e *Error
+				if !errors.As(err, &e) || e.SubCode != tt.subCode {
+					t.Fatalf("got error %v, want sub_code %s", err, tt.subCode)
+				}
+				return
+			}
+			if err != nil || out.TradeNo != "2026101822001" {
+				t.Fatalf("got %+v error %v", out, err)
+			}
+		})
+	}
+}
@@ -1,10 +1,14 @@
 package alipay
 
 import (
+	"bytes"
 	"crypto"
+	"crypto/aes"
+	"crypto/cipher"
 	"crypto/rand"
 	"crypto/rsa"
 	"crypto/x509"
+	"encoding/base64"
 	"encoding/pem"
 	"errors"
 )
@@ -104,3 +108,48 @@ func initRSAPrivateKey(private []byte) (*rsa.PrivateKey, error) {
 	}
 	return pri, err
 }
+
+func initAESKey(key string) ([]byte, error) {
+	data, err := base64.StdEncoding.DecodeString(key)
+	if err != nil {
+		return nil, err
+	}
+	switch len(data) {
+	case 16, 24, 32:
+		return data, nil
+	default:
+		return nil, errors.New("aes key error")
+	}
+}
+
+// aesEncrypt 接口内容加密，AES/CBC/PKCS5Padding，IV全零，结果Base64编码
+func (c *AlipayClient) aesEncrypt(plainTxt []byte) string {
+	block, _ := aes.NewCipher(c.aesKey)
+	padding := aes.BlockSize - len(plainTxt)%aes.BlockSize
+	src := append(append([]byte{}, plainTxt...), bytes.Repeat([]byte{byte(padding)}, padding)...)
+	dst := make([]byte, len(src))
+	cipher.NewCBCEncrypter(block, make([]byte, aes.BlockSize)).CryptBlocks(dst, src)
+	return base64.StdEncoding.EncodeToString(dst)
+}
+
+// aesDecrypt 接口内容解密
+func (c *AlipayClient) aesDecrypt(cipherTxt string) ([]byte, error) {
+	src, err := base64.StdEncoding.DecodeString(cipherTxt)
+	if err != nil {
+		return nil, err
+	}
+	if len(src) == 0 || len(src)%aes.BlockSize != 0 {
+		return nil, errors.New("cipher text is not full blocks")
+	}
+	block, err := aes.NewCipher(c.aesKey)
+	if err != nil {
+		return nil, err
+	}
+	dst := make([]byte, len(src))
+	cipher.NewCBCDecrypter(block, make([]byte, aes.BlockSize)).CryptBlocks(dst, src)
+	padding := int(dst[len(dst)-1])
+	if padding <= 0 || padding > aes.BlockSize {
+		return nil, errors.New("invalid padding")
+	}
+	return dst[:len(dst)-padding], nil
+}
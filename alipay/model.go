@@ -1,8 +1,12 @@
 package alipay
 
 import (
+	"encoding/json"
 	"fmt"
+	"strconv"
 	"time"
+
+	"github.com/shengzhi/payment"
 )
 
 type SignType string
@@ -22,11 +26,18 @@ type AlipayTime struct {
 }
 
 func (at AlipayTime) MarshalJSON() ([]byte, error) {
-	return []byte(at.Format(alipay_time_format)), nil
+	return []byte(strconv.Quote(at.Format(alipay_time_format))), nil
 }
 
 func (at *AlipayTime) UnmarshalJSON(data []byte) error {
-	t, err := time.ParseInLocation(alipay_time_format, string(data), time.Local)
+	v, err := strconv.Unquote(string(data))
+	if err != nil {
+		return err
+	}
+	if v == "" {
+		return nil
+	}
+	t, err := time.ParseInLocation(alipay_time_format, v, time.Local)
 	if err != nil {
 		return err
 	}
@@ -54,9 +65,147 @@ type commonReply struct {
 }
 
 func (r commonReply) checkErr() error {
-	if r.Code != success_code {
-		return fmt.Errorf("code:%s,error:%s", r.Code, r.Msg)
+	if r.Code != success_code || r.SubCode != "" {
+		return &Error{Code: r.Code, Msg: r.Msg, SubCode: r.SubCode, SubMsg: r.SubMsg}
+	}
+
+	return nil
+}
+
+// Error 支付宝接口返回的业务错误
+type Error struct {
+	Code, Msg       string
+	SubCode, SubMsg string
+}
+
+func (e *Error) Error() string {
+	if e.SubCode == "" {
+		return fmt.Sprintf("code:%s,error:%s", e.Code, e.Msg)
+	}
+	return fmt.Sprintf("code:%s,error:%s,sub_code:%s,sub_msg:%s", e.Code, e.Msg, e.SubCode, e.SubMsg)
+}
+
+// Temporary 系统错误及服务不可用为瞬时错误，可使用相同参数重试
+func (e *Error) Temporary() bool {
+	switch e.SubCode {
+	case "ACQ.SYSTEM_ERROR", "aop.ACQ.SYSTEM_ERROR", "isp.unknow-error":
+		return true
+	}
+	return e.Code == "20000"
+}
+
+// BusinessError 非瞬时错误均为支付宝明确拒绝的业务错误，用于 payment.IsBusinessError
+func (e *Error) BusinessError() bool { return !e.Temporary() }
+
+// Fen 金额，单位：分，解析以元为单位的字符串或数值金额
+type Fen int64
+
+func (f *Fen) UnmarshalJSON(data []byte) error {
+	v := string(data)
+	if s, err := strconv.Unquote(v); err == nil {
+		v = s
+	}
+	if v == "null" {
+		return nil
+	}
+	amount, err := payment.ParseAmount(v)
+	if err != nil {
+		return err
 	}
+	*f = Fen(amount)
+	return nil
+}
+
+// FundBill 交易支付使用的资金渠道，异步通知字段为驼峰命名，交易查询为下划线命名
+type FundBill struct {
+	FundChannel string // 资金渠道，如 ALIPAYACCOUNT、COUPON、MCOUPON
+	Amount      Fen    // 使用该渠道支付的金额
+	RealAmount  Fen    // 渠道实际付款金额
+}
 
+func (b *FundBill) UnmarshalJSON(data []byte) error {
+	var v struct {
+		FundChannel  string `json:"fund_channel"`
+		FundChannel2 string `json:"fundChannel"`
+		Amount       Fen    `json:"amount"`
+		RealAmount   Fen    `json:"real_amount"`
+		RealAmount2  Fen    `json:"realAmount"`
+	}
+	if err := json.Unmarshal(data, &v); err != nil {
+		return err
+	}
+	*b = FundBill{FundChannel: v.FundChannel + v.FundChannel2, Amount: v.Amount, RealAmount: v.RealAmount + v.RealAmount2}
 	return nil
 }
+
+// VoucherDetail 交易使用的券信息，异步通知字段为驼峰命名，交易查询为下划线命名
+type VoucherDetail struct {
+	ID                 string
+	Name               string
+	Type               string // 券类型，如 ALIPAY_FIX_VOUCHER、ALIPAY_DISCOUNT_VOUCHER、ALIPAY_ITEM_VOUCHER
+	Amount             Fen    // 优惠券面额
+	MerchantContribute Fen    // 商家出资金额
+	OtherContribute    Fen    // 其他出资方出资金额
+	Memo               string
+}
+
+func (d *VoucherDetail) UnmarshalJSON(data []byte) error {
+	var v struct {
+		ID                  string `json:"id"`
+		VoucherID           string `json:"voucherId"`
+		Name                string `json:"name"`
+		Type                string `json:"type"`
+		Amount              Fen    `json:"amount"`
+		MerchantContribute  Fen    `json:"merchant_contribute"`
+		MerchantContribute2 Fen    `json:"merchantContribute"`
+		OtherContribute     Fen    `json:"other_contribute"`
+		OtherContribute2    Fen    `json:"otherContribute"`
+		Memo                string `json:"memo"`
+	}
+	if err := json.Unmarshal(data, &v); err != nil {
+		return err
+	}
+	*d = VoucherDetail{
+		ID: v.ID + v.VoucherID, Name: v.Name, Type: v.Type, Amount: v.Amount,
+		MerchantContribute: v.MerchantContribute + v.MerchantContribute2,
+		OtherContribute:    v.OtherContribute + v.OtherContribute2,
+		Memo:               v.Memo,
+	}
+	return nil
+}
+
+// toDiscounts 优惠明细，按券的商家及其他出资方拆分；未返回券信息时按资金渠道区分红包、折扣券等优惠
+func toDiscounts(vouchers []VoucherDetail, fundBills []FundBill) []payment.Discount {
+	var discounts []payment.Discount
+	for _, v := range vouchers {
+		d := payment.Discount{ID: v.ID, Name: v.Name, Type: v.Type}
+		if v.MerchantContribute > 0 {
+			d.Amount, d.Funding = int64(v.MerchantContribute), payment.DiscountFundingMerchant
+			discounts = append(discounts, d)
+		}
+		if v.OtherContribute > 0 {
+			d.Amount, d.Funding = int64(v.OtherContribute), payment.DiscountFundingPlatform
+			discounts = append(discounts, d)
+		}
+		if v.MerchantContribute == 0 && v.OtherContribute == 0 {
+			d.Amount, d.Funding = int64(v.Amount), payment.DiscountFundingUnknown
+			discounts = append(discounts, d)
+		}
+	}
+	if len(vouchers) > 0 {
+		return discounts
+	}
+	for _, b := range fundBills {
+		d := payment.Discount{Type: b.FundChannel, Amount: int64(b.Amount)}
+		switch b.FundChannel {
+		case "COUPON", "DISCOUNT", "POINT":
+			d.Funding = payment.DiscountFundingPlatform
+		case "MCOUPON", "MDISCOUNT":
+			d.Funding = payment.DiscountFundingMerchant
+		default:
+			continue
+		}
+		discounts = append(discounts, d)
+	}
+	return discounts
+}
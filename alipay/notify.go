@@ -6,43 +6,156 @@ import (
 	"encoding/json"
 	"fmt"
 	"io"
+	"log"
+	"math"
 	"net/url"
 	"reflect"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/shengzhi/payment"
 )
 
+// 交易状态
+const (
+	TradeStatusWaitBuyerPay = "WAIT_BUYER_PAY" // 交易创建，等待买家付款
+	TradeStatusClosed       = "TRADE_CLOSED"   // 未付款交易超时关闭，或支付完成后全额退款
+	TradeStatusSuccess      = "TRADE_SUCCESS"  // 交易支付成功
+	TradeStatusFinished     = "TRADE_FINISHED" // 交易结束，不可退款
+)
+
+// NotifyHandlers 异步通知分发处理函数，未设置的处理函数对应的通知直接应答成功
+type NotifyHandlers struct {
+	Pay    payment.NotifyHandleFunc       // 支付成功
+	Refund payment.RefundNotifyHandleFunc // 退款(部分退款及全额退款)
+	Close  payment.NotifyHandleFunc       // 未支付交易关闭
+}
+
+// NotifyCallback 异步通知处理，支付成功通知交由 f 处理，退款及关闭通知交由
+// WithRefundNotifyHandler, WithCloseNotifyHandler 设置的处理函数处理
 func (c *AlipayClient) NotifyCallback(r io.Reader, f payment.NotifyHandleFunc) interface{} {
+	return c.Dispatch(r, NotifyHandlers{Pay: f, Refund: c.refundHandler, Close: c.closeHandler})
+}
+
+// Dispatch 验证异步通知，并根据 trade_status 及退款字段分发至对应的处理函数
+func (c *AlipayClient) Dispatch(r io.Reader, h NotifyHandlers) interface{} {
 	buf := c.getBuf()
 	defer c.bufPool.Put(buf)
 	io.Copy(buf, r)
-	val, err := url.ParseQuery(buf.String())
+	if c.auditSink == nil {
+		return c.dispatch(buf.String(), h)
+	}
+	// 通知记录失败时不处理通知，以便支付宝重新通知
+	record := payment.AuditRecord{Time: time.Now(), Plat: payment.PayPlatAlipay, Kind: payment.AuditNotify, Body: buf.String()}
+	if err := c.auditSink.Audit(record); err != nil {
+		return fmt.Sprintf("audit error:%v", err)
+	}
+	reply := c.dispatch(buf.String(), h)
+	record = payment.AuditRecord{Time: time.Now(), Plat: payment.PayPlatAlipay, Kind: payment.AuditNotifyReply, Body: reply}
+	if err := c.auditSink.Audit(record); err != nil {
+		payment.OnAuditError(record, err)
+	}
+	return reply
+}
+
+func (c *AlipayClient) dispatch(body string, h NotifyHandlers) string {
+	val, err := url.ParseQuery(body)
 	if err != nil {
 		return err.Error()
 	}
-	var reply appPayReply
+	var reply TradeNotify
 	err = c.Verify(val, &reply)
 	if err != nil {
 		return err.Error()
 	}
+	if reply.APPID != c.cfg.appId {
+		return fmt.Sprintf("app_id %s mismatch", reply.APPID)
+	}
+	if c.cfg.partnerId != "" && reply.SellerID != c.cfg.partnerId {
+		return fmt.Sprintf("seller_id %s mismatch", reply.SellerID)
+	}
+	switch {
+	case reply.isRefund():
+		if h.Refund != nil {
+			err = h.Refund(reply.toRefundNotifyResult())
+		}
+	case reply.TradeStatus == TradeStatusSuccess, reply.TradeStatus == TradeStatusFinished:
+		if h.Pay != nil {
+			err = h.Pay(reply.toNotifyResult(val))
+		}
+	case reply.TradeStatus == TradeStatusClosed:
+		if h.Close != nil {
+			err = h.Close(reply.toNotifyResult(val))
+		}
+	}
+	if err != nil {
+		return err.Error()
+	}
+	return "success"
+}
+
+// isRefund 退款通知携带 out_biz_no 或 refund_fee
+func (r TradeNotify) isRefund() bool {
+	return r.OutBizNo != "" || r.RefundFee > 0
+}
+
+// toNotifyResult 通知结果，Detail 为 *TradeNotify，Raw 为验证签名后的全部通知参数
+func (r TradeNotify) toNotifyResult(params url.Values) *payment.NotifyResult {
 	result := &payment.NotifyResult{
 		Plat:            payment.PayPlatAlipay,
-		MerchantOrderNo: reply.OutTrandeNo,
-		TransactionID:   reply.TradeNo,
-		CompletedTime:   reply.GmtPayment.Time,
-		TotalAmount:     int64(reply.TotalAmount * 100),
+		MerchantOrderNo: r.OutTradeNo,
+		TransactionID:   r.TradeNo,
+		CompletedTime:   r.GmtPayment.Time,
+		TotalAmount:     yuanToFen(r.TotalAmount),
 		Currency:        "CNY",
-		Attach:          reply.PassbackParams,
+		Attach:          r.PassbackParams,
+		Discounts:       toDiscounts(r.VoucherDetailList, r.FundBillList),
 	}
-	result.Alipay.BuyerID = reply.BuyerID
-	result.Alipay.BuyerLoginID = reply.BuyerLoginID
-	result.Alipay.NotifyID = reply.NotifyID
-	if err = f(result); err != nil {
-		return err.Error()
+	if r.TradeStatus == TradeStatusClosed {
+		result.CompletedTime = r.GmtClose.Time
 	}
-	return "success"
+	result.Alipay.BuyerID = r.BuyerID
+	result.Alipay.BuyerLoginID = r.BuyerLoginID
+	result.Alipay.NotifyID = r.NotifyID
+	result.Detail = &r
+	result.Raw = rawParams(params)
+	return result
+}
+
+// rawParams 参数转换为 payment.NotifyResult.Raw
+func rawParams(params url.Values) map[string]string {
+	raw := make(map[string]string, len(params))
+	for k := range params {
+		raw[k] = params.Get(k)
+	}
+	return raw
+}
+
+// toRefundNotifyResult 退款通知，仅在退款成功时通知；支付宝 refund_fee 为该交易累计退款总金额，
+// 记录至 TotalRefundedAmount，通知中无本次退款金额及退款单号，可通过 QueryRefund 查询本次退款金额
+func (r TradeNotify) toRefundNotifyResult() payment.RefundNotifyResult {
+	return payment.RefundNotifyResult{
+		Plat:                payment.PayPlatAlipay,
+		MerchantOrderNo:     r.OutTradeNo,
+		MerchantRefundNo:    r.OutBizNo,
+		TransactionID:       r.TradeNo,
+		TotalRefundedAmount: int32(yuanToFen(r.RefundFee)),
+		TotalAmount:         int32(yuanToFen(r.TotalAmount)),
+		CompletedTime:       r.GmtRefund.Time,
+		Status:              payment.RefundStatusSuccess,
+		IsSuccess:           true,
+	}
+}
+
+// yuanToFen 金额单位元转换为分
+func yuanToFen(amount float32) int64 {
+	return int64(math.Round(float64(amount) * 100))
+}
+
+// fenToYuan 以分为单位的金额转换为精确到分的元金额字符串
+func fenToYuan(amount int64) string {
+	return fmt.Sprintf("%.2f", float64(amount)/100)
 }
 
 // Verify 异步回到通知验证及解析
@@ -111,7 +224,7 @@ func mapToStruct(params url.Values, v interface{}) error {
 			}
 			val.Field(i).SetBool(boolv)
 		case reflect.Struct:
-			if tp.Field(i).Name == "AlipayTime" {
+			if tp.Field(i).Type == reflect.TypeOf(AlipayTime{}) {
 				dv, err := parseAlipayTime(value)
 				if err != nil {
 					return fmt.Errorf("Cant convert value %s to field %s", value, name)
@@ -120,6 +233,12 @@ func mapToStruct(params url.Values, v interface{}) error {
 			} else {
 				json.Unmarshal([]byte(value), val.Field(i).Addr().Interface())
 			}
+		case reflect.Slice:
+			// fund_bill_list、voucher_detail_list 等JSON数组参数，格式错误时记录日志并置空，不影响通知验证
+			if err := json.Unmarshal([]byte(value), val.Field(i).Addr().Interface()); err != nil {
+				log.Printf("payment: alipay field %s is invalid and ignored, value:%s error:%v", name, value, err)
+				val.Field(i).Set(reflect.Zero(tp.Field(i).Type))
+			}
 		default:
 			return fmt.Errorf("Cant convert value %s to field %s", value, name)
 		}
@@ -0,0 +1,131 @@
+package alipay
+
+import (
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/shengzhi/payment"
+)
+
+// signNotify 以测试私钥签名异步通知参数
+func signNotify(t *testing.T, params url.Values) string {
+	t.Helper()
+	priKey, _ := testKeys(t)
+	sign, err := SignRSA2(PlainText(params), priKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	params.Set("sign_type", string(SignTypeRSA2))
+	params.Set("sign", sign)
+	return params.Encode()
+}
+
+func testNotifyParams(c *AlipayClient, fields map[string]string) url.Values {
+	params := url.Values{}
+	params.Set("app_id", c.cfg.appId)
+	params.Set("seller_id", c.cfg.partnerId)
+	params.Set("notify_id", "n1")
+	params.Set("out_trade_no", "T1")
+	params.Set("trade_no", "2026101822001")
+	params.Set("total_amount", "100.00")
+	for k, v := range fields {
+		params.Set(k, v)
+	}
+	return params
+}
+
+func TestRefundCallback(t *testing.T) {
+	c := newTestClient(t)
+	tests := []struct {
+		name     string
+		fields   map[string]string
+		handled  bool
+		refunded int32
+	}{
+		{name: "partial refund", fields: map[string]string{"trade_status": TradeStatusSuccess, "out_biz_no": "T1-R2", "refund_fee": "30.00", "gmt_refund": "2026-10-18 10:00:00.123"}, handled: true, refunded: 3000},
+		{name: "full refund", fields: map[string]string{"trade_status": TradeStatusClosed, "out_biz_no": "T1-R3", "refund_fee": "100.00"}, handled: true, refunded: 10000},
+		{name: "pay notify", fields: map[string]string{"trade_status": TradeStatusSuccess, "gmt_payment": "2026-10-18 09:00:00"}},
+		{name: "close notify", fields: map[string]string{"trade_status": TradeStatusClosed}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var got *payment.RefundNotifyResult
+			reply := c.RefundCallback(strings.NewReader(signNotify(t, testNotifyParams(c, tt.fields))), func(r payment.RefundNotifyResult) error {
+				got = &r
+				return nil
+			})
+			if (reply == "success") != tt.handled || (got != nil) != tt.handled {
+				t.Fatalf("reply %v, handled %v, want handled %v", reply, got != nil, tt.handled)
+			}
+			if got == nil {
+				return
+			}
+			if got.TotalRefundedAmount != tt.refunded || got.RefundAmount != 0 || got.RefundID != "" {
+				t.Errorf("got total refunded %d, refund amount %d, refund id %q", got.TotalRefundedAmount, got.RefundAmount, got.RefundID)
+			}
+			if got.MerchantRefundNo != tt.fields["out_biz_no"] || got.TransactionID != "2026101822001" || !got.IsSuccess {
+				t.Errorf("unexpected result %+v", got)
+			}
+		})
+	}
+}
+
+func TestDispatchRejectsBadSign(t *testing.T) {
+	c := newTestClient(t)
+	body := signNotify(t, testNotifyParams(c, map[string]string{"trade_status": TradeStatusSuccess}))
+	body = strings.Replace(body, "total_amount=100.00", "total_amount=1.00", 1)
+	called := false
+	reply := c.NotifyCallback(strings.NewReader(body), func(*payment.NotifyResult) error {
+		called = true
+		return nil
+	})
+	if reply == "success" || called {
+		t.Fatalf("tampered notify accepted, reply %v", reply)
+	}
+}
+
+func TestMapToStruct(t *testing.T) {
+	tests := []struct {
+		name     string
+		fields   map[string]string
+		vouchers int
+		funds    int
+		wantErr  bool
+	}{
+		{
+			name: "valid lists",
+			fields: map[string]string{
+				"voucher_detail_list": `[{"voucherId":"V1","name":"满减券","amount":"1.00","merchantContribute":"1.00","otherContribute":"0.00"}]`,
+				"fund_bill_list":      `[{"amount":"99.00","fundChannel":"ALIPAYACCOUNT"}]`,
+			},
+			vouchers: 1, funds: 1,
+		},
+		{
+			name: "invalid list ignored",
+			fields: map[string]string{
+				"voucher_detail_list": `[{"voucherId":"V1","amount":1.00`,
+				"fund_bill_list":      `[{"amount":"99.00","fundChannel":"ALIPAYACCOUNT"}]`,
+			},
+			funds: 1,
+		},
+		{name: "list of wrong type ignored", fields: map[string]string{"fund_bill_list": `{"amount":"99.00"}`}},
+		{name: "invalid amount", fields: map[string]string{"total_amount": "abc"}, wantErr: true},
+	}
+	c := newTestClient(t)
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var notify TradeNotify
+			err := mapToStruct(testNotifyParams(c, tt.fields), &notify)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("got error %v, want error %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+			if len(notify.VoucherDetailList) != tt.vouchers || len(notify.FundBillList) != tt.funds || notify.OutTradeNo != "T1" {
+				t.Fatalf("got %+v", notify)
+			}
+		})
+	}
+}
@@ -1,6 +1,10 @@
 package alipay
 
-import "log"
+import (
+	"log"
+
+	"github.com/shengzhi/payment"
+)
 
 // OptionHandlerFunc 配置设置
 type OptionHandlerFunc func(c *AlipayClient)
@@ -22,7 +26,47 @@ func WithNotifyURL(url string) OptionHandlerFunc {
 	return func(c *AlipayClient) { c.cfg.notifyURL = url }
 }
 
-// WithTracer 设置日志跟踪
+// WithTracer 设置日志跟踪，请求及响应字段经脱敏后以JSON格式输出
 func WithTracer(tracer *log.Logger) OptionHandlerFunc {
 	return func(c *AlipayClient) { c.tracer = tracer }
 }
+
+// WithEncryptKey 配置接口内容加密AES密钥(Base64编码)，启用后 biz_content 及响应内容均采用AES加密
+func WithEncryptKey(key string) OptionHandlerFunc {
+	return func(c *AlipayClient) { c.cfg.encryptKey = key }
+}
+
+// WithRefundNotifyHandler 设置 NotifyCallback 收到退款通知时的处理函数
+func WithRefundNotifyHandler(fn payment.RefundNotifyHandleFunc) OptionHandlerFunc {
+	return func(c *AlipayClient) { c.refundHandler = fn }
+}
+
+// WithCloseNotifyHandler 设置 NotifyCallback 收到交易关闭通知时的处理函数
+func WithCloseNotifyHandler(fn payment.NotifyHandleFunc) OptionHandlerFunc {
+	return func(c *AlipayClient) { c.closeHandler = fn }
+}
+
+// WithOrderStore 设置订单存储，用于支付重试时加载原始下单请求
+func WithOrderStore(store payment.OrderStore) OptionHandlerFunc {
+	return func(c *AlipayClient) { c.orderStore = store }
+}
+
+// WithRetryPolicy 设置重试策略，仅对退款、交易查询、交易关闭等可安全重试的接口生效，重试使用相同的业务参数
+func WithRetryPolicy(policy payment.RetryPolicy) OptionHandlerFunc {
+	return func(c *AlipayClient) { c.retryPolicy = policy }
+}
+
+// WithHTTPMiddleware 设置HTTP调用中间件，作用于所有请求支付宝网关的HTTP调用
+func WithHTTPMiddleware(mws ...payment.HTTPMiddleware) OptionHandlerFunc {
+	return func(c *AlipayClient) { c.httpMiddlewares = append(c.httpMiddlewares, mws...) }
+}
+
+// WithRedactor 设置日志跟踪的脱敏规则，默认为 payment.DefaultRedactor
+func WithRedactor(r *payment.Redactor) OptionHandlerFunc {
+	return func(c *AlipayClient) { c.redactor = r }
+}
+
+// WithAuditSink 设置审计记录存储，记录所有请求、响应、异步通知及通知应答的原始报文
+func WithAuditSink(sink payment.AuditSink) OptionHandlerFunc {
+	return func(c *AlipayClient) { c.auditSink = sink }
+}
@@ -2,8 +2,12 @@
 
 package alipay
 
-import "github.com/shengzhi/payment"
-import "fmt"
+import (
+	"errors"
+	"fmt"
+
+	"github.com/shengzhi/payment"
+)
 
 type appPayRequest struct {
 	Body               string       `json:"body,omitempty"`
@@ -31,38 +35,39 @@ type extendParam struct {
 	Remark       string `json:"TRANS_MEMO,omitempty"` //账务备注
 }
 
-type appPayReply struct {
-	NotifyTime        AlipayTime `json:"notify_time"`
-	NotifyType        string     `json:"notify_type"`
-	NotifyID          string     `json:"notify_id"`
-	APPID             string     `json:"app_id"`
-	Charset           string     `json:"charset"`
-	Version           string     `json:"version"`
-	SingType          SignType   `json:"sign_type"`
-	Sign              string     `json:"sign"`
-	TradeNo           string     `json:"trade_no"`
-	OutTrandeNo       string     `json:"out_trade_no"`
-	OutBizNo          string     `json:"out_biz_no"`
-	BuyerID           string     `json:"buyer_id"`
-	BuyerLoginID      string     `json:"buyer_logon_id"`
-	SellerID          string     `json:"seller_id"`
-	SellerEmail       string     `json:"seller_email"`
-	TradeStatus       string     `json:"trade_status"`
-	TotalAmount       float32    `json:"total_amount"`
-	ReceiptAmount     float32    `json:"receipt_amount"`
-	InvoiceAmount     float32    `json:"invoice_amount"`
-	BuyerPayAmount    float32    `json:"buyer_pay_amount"`
-	PointAmount       float32    `json:"point_amount"`
-	RefundFee         float32    `json:"refund_fee"`
-	Subject           string     `json:"subject"`
-	Body              string     `json:"body"`
-	GmtCreate         AlipayTime `json:"gmt_create"`
-	GmtPayment        AlipayTime `json:"gmt_payment"`
-	GmtRefund         AlipayTime `json:"gmt_refund"`
-	GmtClose          AlipayTime `json:"gmt_close"`
-	FundBillList      string     `json:"fund_bill_list"`
-	PassbackParams    string     `json:"passback_params"`
-	VoucherDetailList string     `json:"voucher_detail_list"`
+// TradeNotify 交易异步通知参数，支付及退款通知共用
+type TradeNotify struct {
+	NotifyTime        AlipayTime      `json:"notify_time"`
+	NotifyType        string          `json:"notify_type"`
+	NotifyID          string          `json:"notify_id"`
+	APPID             string          `json:"app_id"`
+	Charset           string          `json:"charset"`
+	Version           string          `json:"version"`
+	SignType          SignType        `json:"sign_type"`
+	Sign              string          `json:"sign"`
+	TradeNo           string          `json:"trade_no"`
+	OutTradeNo        string          `json:"out_trade_no"`
+	OutBizNo          string          `json:"out_biz_no"`
+	BuyerID           string          `json:"buyer_id"`
+	BuyerLoginID      string          `json:"buyer_logon_id"`
+	SellerID          string          `json:"seller_id"`
+	SellerEmail       string          `json:"seller_email"`
+	TradeStatus       string          `json:"trade_status"`
+	TotalAmount       float32         `json:"total_amount"`
+	ReceiptAmount     float32         `json:"receipt_amount"`
+	InvoiceAmount     float32         `json:"invoice_amount"`
+	BuyerPayAmount    float32         `json:"buyer_pay_amount"`
+	PointAmount       float32         `json:"point_amount"`
+	RefundFee         float32         `json:"refund_fee"`
+	Subject           string          `json:"subject"`
+	Body              string          `json:"body"`
+	GmtCreate         AlipayTime      `json:"gmt_create"`
+	GmtPayment        AlipayTime      `json:"gmt_payment"`
+	GmtRefund         AlipayTime      `json:"gmt_refund"`
+	GmtClose          AlipayTime      `json:"gmt_close"`
+	FundBillList      []FundBill      `json:"fund_bill_list"`
+	PassbackParams    string          `json:"passback_params"`
+	VoucherDetailList []VoucherDetail `json:"voucher_detail_list"`
 }
 
 // Order 统一下单
@@ -92,6 +97,31 @@ func (c *AlipayClient) Order(order *payment.OrderRequest) (*payment.OrderRespons
 	return nil, fmt.Errorf("Not Support")
 }
 
-func (c *AlipayClient) Retry(source payment.PaySource, prepayid string) *payment.OrderResponse {
-	return nil
+// Retry 对未支付订单重新生成支付参数，prepayid 为商户订单号，原始下单请求从 WithOrderStore 设置的订单存储加载；
+// 未设置订单存储时，使用 RetryOrder 直接传入原始下单请求
+func (c *AlipayClient) Retry(source payment.PaySource, prepayid string) (*payment.OrderResponse, error) {
+	if c.orderStore == nil {
+		return nil, errors.New("order store is not configured, use RetryOrder with the original order request")
+	}
+	order, err := c.orderStore.LoadOrder(prepayid)
+	if err != nil {
+		return nil, err
+	}
+	if order == nil {
+		return nil, fmt.Errorf("order %s not found", prepayid)
+	}
+	return c.RetryOrder(source, order)
+}
+
+// RetryOrder 使用原始下单请求重新生成支付参数，实现 payment.OrderRetrier；
+// 商户订单号、金额等参数须与原下单请求一致，source 不为0时替换支付来源
+func (c *AlipayClient) RetryOrder(source payment.PaySource, order *payment.OrderRequest) (*payment.OrderResponse, error) {
+	if order == nil || order.MerchanOrderNo == "" {
+		return nil, errors.New("original order request with merchant order no is required")
+	}
+	retry := *order
+	if source != 0 {
+		retry.Source = source
+	}
+	return c.Order(&retry)
 }
@@ -0,0 +1,96 @@
+package alipay
+
+import (
+	"encoding/json"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/shengzhi/payment"
+)
+
+type testOrderStore map[string]*payment.OrderRequest
+
+func (s testOrderStore) LoadOrder(merchantOrderNo string) (*payment.OrderRequest, error) {
+	return s[merchantOrderNo], nil
+}
+
+func TestRetryOrder(t *testing.T) {
+	order := &payment.OrderRequest{MerchanOrderNo: "T1", Subject: "test", Amount: 1999, Source: payment.PaySourceApp}
+	tests := []struct {
+		name    string
+		client  *AlipayClient
+		retry   func(c *AlipayClient) (*payment.OrderResponse, error)
+		method  string
+		wantErr bool
+	}{
+		{
+			name:   "order request",
+			client: newTestClient(t),
+			retry:  func(c *AlipayClient) (*payment.OrderResponse, error) { return c.RetryOrder(0, order) },
+			method: "alipay.trade.app.pay",
+		},
+		{
+			name:   "order request with source",
+			client: newTestClient(t),
+			retry: func(c *AlipayClient) (*payment.OrderResponse, error) {
+				return c.RetryOrder(payment.PaySourceWap, order)
+			},
+			method: "alipay.trade.wap.pay",
+		},
+		{
+			name:   "order store",
+			client: newTestClient(t, WithOrderStore(testOrderStore{"T1": order})),
+			retry:  func(c *AlipayClient) (*payment.OrderResponse, error) { return c.Retry(0, "T1") },
+			method: "alipay.trade.app.pay",
+		},
+		{
+			name:    "order not found",
+			client:  newTestClient(t, WithOrderStore(testOrderStore{})),
+			retry:   func(c *AlipayClient) (*payment.OrderResponse, error) { return c.Retry(0, "T2") },
+			wantErr: true,
+		},
+		{
+			name:    "no order store",
+			client:  newTestClient(t),
+			retry:   func(c *AlipayClient) (*payment.OrderResponse, error) { return c.Retry(0, "T1") },
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resp, err := tt.retry(tt.client)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatal("expected error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			form := resp.Alipay.PayForm
+			if tt.method == "alipay.trade.wap.pay" {
+				// 手机网站支付返回自动提交的表单，校验表单中的接口名称及商户订单号
+				if !strings.Contains(form, tt.method) || !strings.Contains(form, `"out_trade_no":"T1"`) {
+					t.Fatalf("unexpected pay form %s", form)
+				}
+				return
+			}
+			params, err := url.ParseQuery(form)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var biz appPayRequest
+			if err = json.Unmarshal([]byte(params.Get("biz_content")), &biz); err != nil {
+				t.Fatal(err)
+			}
+			if params.Get("method") != tt.method || biz.OutTradeNo != "T1" || biz.TotalAmount != "19.99" {
+				t.Fatalf("unexpected pay params method=%s biz=%+v", params.Get("method"), biz)
+			}
+		})
+	}
+	if order.Source != payment.PaySourceApp {
+		t.Fatal("RetryOrder modified the original order request")
+	}
+}
@@ -0,0 +1,115 @@
+// 交易查询及关闭
+
+package alipay
+
+import (
+	"context"
+	"encoding/json"
+
+	"github.com/shengzhi/payment"
+)
+
+type tradeQueryRequest struct {
+	OutTradeNo   string   `json:"out_trade_no,omitempty"`
+	TradeNo      string   `json:"trade_no,omitempty"`
+	QueryOptions []string `json:"query_options,omitempty"` // 查询选项，返回券信息等字段
+}
+
+// TradeQueryReply 交易查询响应
+type TradeQueryReply struct {
+	commonReply
+	TradeNo           string            `json:"trade_no"`
+	OutTradeNo        string            `json:"out_trade_no"`
+	BuyerLoginID      string            `json:"buyer_logon_id"`
+	BuyerUserID       string            `json:"buyer_user_id"`
+	TradeStatus       string            `json:"trade_status"`
+	TotalAmount       float32           `json:"total_amount,string"`
+	ReceiptAmount     float32           `json:"receipt_amount,string"`
+	BuyerPayAmount    float32           `json:"buyer_pay_amount,string"`
+	SendPayDate       AlipayTime        `json:"send_pay_date"`
+	FundBillList      []FundBill        `json:"fund_bill_list"`
+	VoucherDetailList []VoucherDetail   `json:"voucher_detail_list"`
+	Raw               map[string]string `json:"-"` // 响应的全部参数，对象及数组参数为JSON原文
+}
+
+func (r *TradeQueryReply) UnmarshalJSON(data []byte) error {
+	type reply TradeQueryReply
+	if err := json.Unmarshal(data, (*reply)(r)); err != nil {
+		return err
+	}
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(data, &fields); err != nil {
+		return err
+	}
+	r.Raw = make(map[string]string, len(fields))
+	for k, v := range fields {
+		var s string
+		if json.Unmarshal(v, &s) != nil {
+			s = string(v)
+		}
+		r.Raw[k] = s
+	}
+	return nil
+}
+
+// TradeQuery 交易查询
+func (c *AlipayClient) TradeQuery(ctx context.Context, outTradeNo string) (TradeQueryReply, error) {
+	var reply TradeQueryReply
+	req := tradeQueryRequest{OutTradeNo: outTradeNo, QueryOptions: []string{"fund_bill_list", "voucher_detail_list"}}
+	err := c.Execute(ctx, "alipay.trade.query", req, nil, &reply)
+	return reply, err
+}
+
+// Query 查询订单，交易不存在时视为未支付
+func (c *AlipayClient) Query(merchantOrderNo string) (*payment.QueryResult, error) {
+	return c.QueryContext(context.Background(), merchantOrderNo)
+}
+
+// QueryContext 同 Query，ctx 取消后停止请求及重试
+func (c *AlipayClient) QueryContext(ctx context.Context, merchantOrderNo string) (*payment.QueryResult, error) {
+	result := &payment.QueryResult{State: payment.TradeStateNotPay}
+	result.Plat = payment.PayPlatAlipay
+	result.MerchantOrderNo = merchantOrderNo
+	reply, err := c.TradeQuery(ctx, merchantOrderNo)
+	if e, ok := err.(*Error); ok && e.SubCode == "ACQ.TRADE_NOT_EXIST" {
+		return result, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	switch reply.TradeStatus {
+	case TradeStatusSuccess, TradeStatusFinished:
+		result.State = payment.TradeStateSuccess
+	case TradeStatusClosed:
+		// 支付完成后全额退款的交易同样为关闭状态
+		if reply.SendPayDate.IsZero() {
+			result.State = payment.TradeStateClosed
+		} else {
+			result.State = payment.TradeStateRefund
+		}
+	}
+	result.TransactionID = reply.TradeNo
+	result.TotalAmount = yuanToFen(reply.TotalAmount)
+	result.Currency = "CNY"
+	result.CompletedTime = reply.SendPayDate.Time
+	result.Alipay.BuyerID = reply.BuyerUserID
+	result.Alipay.BuyerLoginID = reply.BuyerLoginID
+	result.Discounts = toDiscounts(reply.VoucherDetailList, reply.FundBillList)
+	result.Detail = &reply
+	result.Raw = reply.Raw
+	return result, nil
+}
+
+// Close 关闭未支付交易，交易不存在时视为关闭成功
+func (c *AlipayClient) Close(merchantOrderNo string) error {
+	return c.CloseContext(context.Background(), merchantOrderNo)
+}
+
+// CloseContext 同 Close，ctx 取消后停止请求及重试
+func (c *AlipayClient) CloseContext(ctx context.Context, merchantOrderNo string) error {
+	err := c.Execute(ctx, "alipay.trade.close", tradeQueryRequest{OutTradeNo: merchantOrderNo}, nil, nil)
+	if e, ok := err.(*Error); ok && e.SubCode == "ACQ.TRADE_NOT_EXIST" {
+		return nil
+	}
+	return err
+}
@@ -1,29 +1,34 @@
 package alipay
 
 import (
-	"encoding/json"
+	"context"
 	"fmt"
 	"io"
-	"net/url"
 	"time"
 
 	"github.com/shengzhi/payment"
 )
 
 type RefundRequest struct {
-	OutTradeNo   string  `json:"out_trade_no"`
-	AliTradeNo   string  `json:"trade_no"`
-	RefundAmount float32 `json:"refund_amount"`
-	Reason       string  `json:"refund_reason"`
-	OutRefundID  string  `json:"out_request_no"`
-	OperatorID   string  `json:"operator_id"`
-	StoreID      string  `json:"store_id"`
-	TerminalID   string  `json:"terminal_id"`
+	OutTradeNo     string              `json:"out_trade_no,omitempty"`
+	AliTradeNo     string              `json:"trade_no,omitempty"`
+	RefundAmount   string              `json:"refund_amount"` // 退款金额，单位：元，精确到小数点后两位
+	RefundCurrency string              `json:"refund_currency,omitempty"`
+	Reason         string              `json:"refund_reason,omitempty"`
+	OutRefundID    string              `json:"out_request_no"`
+	OperatorID     string              `json:"operator_id,omitempty"`
+	StoreID        string              `json:"store_id,omitempty"`
+	TerminalID     string              `json:"terminal_id,omitempty"`
+	GoodsDetail    []RefundGoodsDetail `json:"goods_detail,omitempty"`
 }
 
-type TradeRefundResponse struct {
-	Sign     string
-	Response json.RawMessage `json:"alipay_trade_refund_response"`
+// RefundGoodsDetail 退款商品明细
+type RefundGoodsDetail struct {
+	GoodsID       string `json:"goods_id"`
+	AlipayGoodsID string `json:"alipay_goods_id,omitempty"`
+	GoodsName     string `json:"goods_name"`
+	Quantity      int    `json:"quantity"`
+	Price         string `json:"price"`
 }
 
 type TradeRefundReply struct {
@@ -32,13 +37,13 @@ type TradeRefundReply struct {
 	OutTradeNo    string     `json:"out_trade_no"`
 	BuyerLoginID  string     `json:"buyer_logon_id"`
 	IsFundChanged string     `json:"fund_change"`
-	RefundFee     float32    `json:"refund_fee"`
+	RefundFee     Fen        `json:"refund_fee"` // 该交易累计退款金额
 	CompletedTime AlipayTime `json:"gmt_refund_pay"`
 	ItemList      []struct {
-		Channel    string  `json:"fund_channel"`
-		Amount     float32 `json:"amount"`
-		RealAmount float32 `json:"real_amount"`
-		FundType   string  `json:"fund_type"`
+		Channel    string `json:"fund_channel"`
+		Amount     Fen    `json:"amount"`
+		RealAmount Fen    `json:"real_amount"`
+		FundType   string `json:"fund_type"`
 	} `json:"refund_detail_item_list"`
 	StoreName   string `json:"store_name"`
 	BuyerUserID string `json:"buyer_user_id"`
@@ -46,9 +51,17 @@ type TradeRefundReply struct {
 
 // Refund 退款
 func (c *AlipayClient) Refund(req payment.RefundRequest) (payment.RefundResponse, error) {
+	return c.RefundContext(context.Background(), req)
+}
+
+// RefundContext 同 Refund，ctx 取消后停止请求及重试
+func (c *AlipayClient) RefundContext(ctx context.Context, req payment.RefundRequest) (payment.RefundResponse, error) {
 	var resp payment.RefundResponse
-	if req.MerchantOrderNo == "" {
-		return resp, fmt.Errorf("缺少商户订单号")
+	if req.MerchantOrderNo == "" && req.TransactionID == "" {
+		return resp, fmt.Errorf("缺少商户订单号或支付宝交易号")
+	}
+	if req.FundsAccount != "" {
+		return resp, fmt.Errorf("支付宝不支持指定退款资金来源")
 	}
 	if req.RefundFee <= 0 {
 		return resp, fmt.Errorf("退款金额必须大于0")
@@ -57,12 +70,20 @@ func (c *AlipayClient) Refund(req payment.RefundRequest) (payment.RefundResponse
 		return resp, fmt.Errorf("缺少退款单号")
 	}
 	bizdata := RefundRequest{
-		OutTradeNo:   req.MerchantOrderNo,
-		RefundAmount: float32(req.RefundFee / 100),
-		Reason:       req.Reason,
-		OutRefundID:  req.MerchantRefundNo,
+		OutTradeNo:     req.MerchantOrderNo,
+		AliTradeNo:     req.TransactionID,
+		RefundAmount:   fenToYuan(int64(req.RefundFee)),
+		RefundCurrency: req.Currency,
+		Reason:         req.Reason,
+		OutRefundID:    req.MerchantRefundNo,
 	}
-	reply, err := c.tradeRefund(bizdata)
+	for _, item := range req.Items {
+		bizdata.GoodsDetail = append(bizdata.GoodsDetail, RefundGoodsDetail{
+			GoodsID: item.GoodsID, AlipayGoodsID: item.PlatGoodsID, GoodsName: item.Name,
+			Quantity: item.Quantity, Price: fenToYuan(int64(item.Price)),
+		})
+	}
+	reply, err := c.tradeRefund(ctx, bizdata)
 	if err != nil {
 		return payment.RefundResponse{}, err
 	}
@@ -71,42 +92,70 @@ func (c *AlipayClient) Refund(req payment.RefundRequest) (payment.RefundResponse
 		MerchantOrderNo:  reply.OutTradeNo,
 		MerchantRefundNo: req.MerchantRefundNo,
 		PlatRefundID:     reply.AliRefundID,
-		RefundFee:        int32(reply.RefundFee * 100),
+		RefundFee:        req.RefundFee, // 响应的 refund_fee 为累计退款金额
 		IsInstant:        true,
 		CompletedTime:    time.Now(),
 	}, nil
 }
 
-func (c *AlipayClient) tradeRefund(bizData RefundRequest) (TradeRefundReply, error) {
-	req := actReq{
-		method:   "alipay.trade.refund",
-		data:     bizData,
-		signType: SignTypeRSA2,
-		params:   url.Values{},
-	}
-	params := c.makeParams(req)
-	var resp TradeRefundResponse
-	if err := c.do(params, &resp); err != nil {
-		return TradeRefundReply{}, err
-	}
-	if err := c.verifySign(SignTypeRSA2, resp.Response, resp.Sign); err != nil {
-		return TradeRefundReply{}, fmt.Errorf("Verify signature failed")
-	}
+func (c *AlipayClient) tradeRefund(ctx context.Context, bizData RefundRequest) (TradeRefundReply, error) {
 	var reply TradeRefundReply
-	err := json.Unmarshal(resp.Response, &reply)
-	if err != nil {
-		return reply, err
-	}
-	if err = reply.checkErr(); err != nil {
-		return reply, err
-	}
-	if reply.SubCode != "" {
-		return reply, fmt.Errorf("code:%s, message:%s", reply.SubCode, reply.SubMsg)
-	}
-	return reply, nil
+	err := c.Execute(ctx, "alipay.trade.refund", bizData, nil, &reply)
+	return reply, err
 }
 
-// RefundCallback  支付宝退款为即时退款，不走异步回调通知
+// RefundCallback 支付宝退款为即时退款，退款变更通过支付异步通知地址推送，仅处理其中的退款通知；
+// 支付成功及交易关闭通知应答失败，以免通知被误应答而丢失，此类通知应由 NotifyCallback 或 Dispatch 处理
 func (c *AlipayClient) RefundCallback(in io.Reader, fn payment.RefundNotifyHandleFunc) interface{} {
-	return nil
+	return c.Dispatch(in, NotifyHandlers{Refund: fn, Pay: rejectNotify, Close: rejectNotify})
+}
+
+// rejectNotify 拒绝非退款通知
+func rejectNotify(result *payment.NotifyResult) error {
+	return fmt.Errorf("notify of order %s is not a refund notify", result.MerchantOrderNo)
+}
+
+type refundQueryRequest struct {
+	OutTradeNo   string `json:"out_trade_no"`
+	OutRequestNo string `json:"out_request_no"`
+}
+
+// RefundQueryReply 退款查询响应，未返回退款金额表示退款未成功或不存在
+type RefundQueryReply struct {
+	commonReply
+	TradeNo      string  `json:"trade_no"`
+	OutTradeNo   string  `json:"out_trade_no"`
+	OutRequestNo string  `json:"out_request_no"`
+	RefundReason string  `json:"refund_reason"`
+	TotalAmount  float32 `json:"total_amount,string"`
+	RefundAmount float32 `json:"refund_amount,string"`
+}
+
+// RefundQuery 按商户订单号及退款单号查询退款
+func (c *AlipayClient) RefundQuery(ctx context.Context, outTradeNo, outRefundNo string) (RefundQueryReply, error) {
+	var reply RefundQueryReply
+	err := c.Execute(ctx, "alipay.trade.fastpay.refund.query", refundQueryRequest{OutTradeNo: outTradeNo, OutRequestNo: outRefundNo}, nil, &reply)
+	return reply, err
+}
+
+// QueryRefund 查询退款，实现 payment.RefundQuerier；支付宝退款为同步退款，未返回退款金额的退款视为不存在
+func (c *AlipayClient) QueryRefund(merchantOrderNo, merchantRefundNo string) (payment.RefundNotifyResult, error) {
+	result := payment.RefundNotifyResult{Plat: payment.PayPlatAlipay, MerchantOrderNo: merchantOrderNo, MerchantRefundNo: merchantRefundNo}
+	reply, err := c.RefundQuery(context.Background(), merchantOrderNo, merchantRefundNo)
+	if e, ok := err.(*Error); ok && e.SubCode == "ACQ.TRADE_NOT_EXIST" {
+		return result, payment.ErrRefundNotFound
+	}
+	if err != nil {
+		return result, err
+	}
+	if reply.RefundAmount <= 0 {
+		return result, payment.ErrRefundNotFound
+	}
+	result.TransactionID = reply.TradeNo
+	result.TotalAmount = int32(yuanToFen(reply.TotalAmount))
+	result.RefundAmount = int32(yuanToFen(reply.RefundAmount))
+	result.SettlementRefundAmount = result.RefundAmount
+	result.Status = payment.RefundStatusSuccess
+	result.IsSuccess = true
+	return result, nil
 }
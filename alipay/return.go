@@ -0,0 +1,51 @@
+// 同步跳转(return_url)验证
+
+package alipay
+
+import (
+	"fmt"
+	"net/http"
+
+	"github.com/shengzhi/payment"
+)
+
+// ReturnReply 页面跳转同步通知参数
+type ReturnReply struct {
+	APPID       string     `json:"app_id"`
+	AuthAPPID   string     `json:"auth_app_id"`
+	Method      string     `json:"method"`
+	Charset     string     `json:"charset"`
+	Version     string     `json:"version"`
+	Timestamp   AlipayTime `json:"timestamp"`
+	TradeNo     string     `json:"trade_no"`
+	OutTradeNo  string     `json:"out_trade_no"`
+	SellerID    string     `json:"seller_id"`
+	TotalAmount float32    `json:"total_amount"`
+}
+
+// VerifyReturn 验证手机网站及电脑网站支付完成后跳转至 return_url 携带的签名参数，
+// 结果仅可用于页面展示，订单是否支付成功须以异步通知或交易查询为准；Detail 为 *ReturnReply
+func (c *AlipayClient) VerifyReturn(r *http.Request) (*payment.NotifyResult, error) {
+	var reply ReturnReply
+	params := r.URL.Query()
+	if err := c.Verify(params, &reply); err != nil {
+		return nil, err
+	}
+	if reply.APPID != c.cfg.appId {
+		return nil, fmt.Errorf("app_id %s mismatch", reply.APPID)
+	}
+	if c.cfg.partnerId != "" && reply.SellerID != c.cfg.partnerId {
+		return nil, fmt.Errorf("seller_id %s mismatch", reply.SellerID)
+	}
+	result := &payment.NotifyResult{
+		Plat:            payment.PayPlatAlipay,
+		MerchantOrderNo: reply.OutTradeNo,
+		TransactionID:   reply.TradeNo,
+		CompletedTime:   reply.Timestamp.Time,
+		TotalAmount:     yuanToFen(reply.TotalAmount),
+		Currency:        "CNY",
+		Detail:          &reply,
+		Raw:             rawParams(params),
+	}
+	return result, nil
+}
@@ -0,0 +1,50 @@
+package alipay
+
+import (
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestVerifyReturn(t *testing.T) {
+	c := newTestClient(t)
+	params := func(fields map[string]string) url.Values {
+		p := url.Values{}
+		p.Set("app_id", c.cfg.appId)
+		p.Set("seller_id", c.cfg.partnerId)
+		p.Set("method", "alipay.trade.wap.pay.return")
+		p.Set("timestamp", "2026-10-18 10:00:00")
+		p.Set("out_trade_no", "T1")
+		p.Set("trade_no", "2026101822001")
+		p.Set("total_amount", "19.99")
+		for k, v := range fields {
+			p.Set(k, v)
+		}
+		return p
+	}
+	tests := []struct {
+		name    string
+		query   string
+		wantErr bool
+	}{
+		{name: "valid", query: signNotify(t, params(nil))},
+		{name: "app mismatch", query: signNotify(t, params(map[string]string{"app_id": "2021000000000001"})), wantErr: true},
+		{name: "tampered", query: strings.Replace(signNotify(t, params(nil)), "total_amount=19.99", "total_amount=0.01", 1), wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			result, err := c.VerifyReturn(httptest.NewRequest("GET", "/return?"+tt.query, nil))
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("got error %v, want error %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+			reply, ok := result.Detail.(*ReturnReply)
+			if !ok || reply.Method != "alipay.trade.wap.pay.return" || result.TotalAmount != 1999 || result.MerchantOrderNo != "T1" {
+				t.Fatalf("got result %+v detail %+v", result, result.Detail)
+			}
+		})
+	}
+}
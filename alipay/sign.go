@@ -0,0 +1,63 @@
+// 签名原串及RSA2签名，供离线排查签名问题
+
+package alipay
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/base64"
+	"fmt"
+	"net/url"
+	"sort"
+	"strings"
+)
+
+// PlainText 签名原串，参数按参数名排序以 & 连接，值去除首尾空白；
+// 请求签名时 sign 不参与签名，异步通知验签时 sign 及 sign_type 均不参与验签，调用方需先移除
+func PlainText(params url.Values) []byte {
+	keys := make([]string, 0, len(params))
+	for key := range params {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	var buf bytes.Buffer
+	for i, key := range keys {
+		if i > 0 {
+			buf.WriteByte('&')
+		}
+		fmt.Fprintf(&buf, "%s=%s", key, strings.TrimSpace(params.Get(key)))
+	}
+	return buf.Bytes()
+}
+
+// SignRSA2 以PEM格式的应用私钥计算 RSA2 签名
+func SignRSA2(plainText, privateKey []byte) (string, error) {
+	key, err := initRSAPrivateKey(privateKey)
+	if err != nil {
+		return "", err
+	}
+	hashed := crypto.SHA256.New()
+	hashed.Write(plainText)
+	sig, err := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, hashed.Sum(nil))
+	if err != nil {
+		return "", err
+	}
+	return base64.StdEncoding.EncodeToString(sig), nil
+}
+
+// VerifyRSA2 以PEM格式的支付宝公钥验证 RSA2 签名
+func VerifyRSA2(plainText []byte, sign string, publicKey []byte) error {
+	key, err := initRSAPublicKey(publicKey)
+	if err != nil {
+		return err
+	}
+	sig, err := base64.StdEncoding.DecodeString(sign)
+	if err != nil {
+		return err
+	}
+	hashed := crypto.SHA256.New()
+	hashed.Write(plainText)
+	return rsa.VerifyPKCS1v15(key, crypto.SHA256, hashed.Sum(nil), sig)
+}
@@ -1,9 +1,8 @@
 package alipay
 
 import (
-	"encoding/json"
+	"context"
 	"errors"
-	"fmt"
 	"strings"
 )
 
@@ -23,10 +22,6 @@ type ZhimaCreditVerifyRequest struct {
 	Email       string `json:"email,omitempty"`
 	ProductCode string `json:"product_code"`
 }
-type zhimaCreditVerifyResponse struct {
-	Sign     string
-	Response json.RawMessage `json:"zhima_credit_antifraud_verify_response"`
-}
 type zhimaCreditVerifyReply struct {
 	commonReply
 	BizNo      string   `json:"biz_no"`
@@ -38,22 +33,8 @@ func (c *AlipayClient) ZhimaCreditVerify(r ZhimaCreditVerifyRequest) (err error)
 	r.ProductCode = "w1010100000000002859"
 	r.CertType = "IDENTITY_CARD"
 
-	actReq := actReq{
-		method:   "zhima.credit.antifraud.verify",
-		signType: SignTypeRSA2, data: r,
-	}
-	params := c.makeParams(actReq)
-	var res zhimaCreditVerifyResponse
-	err = c.do(params, &res)
-	if err != nil {
-		return
-	}
-	if err = c.verifySign(SignTypeRSA2, res.Response, res.Sign); err != nil {
-		return fmt.Errorf("verify sign error %v \r\n", err)
-	}
 	var reply zhimaCreditVerifyReply
-	json.Unmarshal(res.Response, &reply)
-	if err = reply.checkErr(); err != nil {
+	if err = c.Execute(context.Background(), "zhima.credit.antifraud.verify", r, nil, &reply); err != nil {
 		return
 	}
 	ismatch, err := verifyCode(reply.VerifyCode)
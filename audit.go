@@ -0,0 +1,185 @@
+// 交易报文审计
+
+package payment
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+)
+
+// 审计记录类型
+const (
+	AuditRequest     = "request"      // 请求支付平台
+	AuditResponse    = "response"     // 支付平台响应
+	AuditNotify      = "notify"       // 支付平台异步通知
+	AuditNotifyReply = "notify_reply" // 异步通知应答
+)
+
+// AuditRecord 审计记录，Body 为原始报文
+type AuditRecord struct {
+	Time   time.Time `json:"time"`
+	Plat   PayPlat   `json:"plat"`
+	Kind   string    `json:"kind"`
+	URL    string    `json:"url,omitempty"`
+	Status int       `json:"status,omitempty"`
+	Error  string    `json:"error,omitempty"`
+	Body   string    `json:"body,omitempty"`
+}
+
+// AuditSink 审计记录存储
+type AuditSink interface {
+	Audit(record AuditRecord) error
+}
+
+// OnAuditError 记录失败但不影响调用结果时的处理函数，如响应、网络错误及通知应答记录失败，默认输出日志
+var OnAuditError = func(record AuditRecord, err error) {
+	log.Printf("payment: audit %s %s %s error:%v", record.Plat, record.Kind, record.URL, err)
+}
+
+// AuditMiddleware 记录每次HTTP调用的原始请求及响应，请求记录失败时不发送请求；
+// 响应及网络错误记录失败时由 OnAuditError 处理，仍返回原响应，以免已成功的交易被误判为失败；
+// 非XML及JSON格式的响应(如账单文件)仅记录状态
+func AuditMiddleware(plat PayPlat, sink AuditSink) HTTPMiddleware {
+	return func(next http.RoundTripper) http.RoundTripper {
+		return RoundTripperFunc(func(req *http.Request) (*http.Response, error) {
+			uri := requestURL(req)
+			err := sink.Audit(AuditRecord{Time: time.Now(), Plat: plat, Kind: AuditRequest, URL: uri, Body: string(requestBody(req))})
+			if err != nil {
+				return nil, fmt.Errorf("payment: audit request error:%v", err)
+			}
+			resp, err := next.RoundTrip(req)
+			record := AuditRecord{Time: time.Now(), Plat: plat, Kind: AuditResponse, URL: uri}
+			if err != nil {
+				record.Error = err.Error()
+				if auditErr := sink.Audit(record); auditErr != nil {
+					OnAuditError(record, auditErr)
+				}
+				return resp, err
+			}
+			record.Status = resp.StatusCode
+			record.Body = string(responseBody(resp))
+			if err = sink.Audit(record); err != nil {
+				OnAuditError(record, err)
+			}
+			return resp, nil
+		})
+	}
+}
+
+// auditEntry 审计日志中的一条记录
+type auditEntry struct {
+	Seq      int64  `json:"seq"`
+	PrevHash string `json:"prev_hash"`
+	AuditRecord
+}
+
+// auditLine 审计日志文件的一行，Hash = SHA256(Entry 原始JSON)，Entry 中包含上一条记录的哈希
+type auditLine struct {
+	Hash  string          `json:"hash"`
+	Entry json.RawMessage `json:"entry"`
+}
+
+// FileAuditSink 文件审计日志，仅追加写入，每条记录以哈希链接上一条记录
+type FileAuditSink struct {
+	mu       sync.Mutex
+	file     *os.File
+	seq      int64
+	lastHash string
+}
+
+// NewFileAuditSink 打开或创建审计日志文件，已有记录须通过哈希链校验
+func NewFileAuditSink(path string) (*FileAuditSink, error) {
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_RDWR|os.O_APPEND, 0600)
+	if err != nil {
+		return nil, err
+	}
+	s := &FileAuditSink{file: file}
+	if s.seq, s.lastHash, err = verifyAuditLog(file); err != nil {
+		file.Close()
+		return nil, err
+	}
+	return s, nil
+}
+
+// Audit 追加审计记录
+func (s *FileAuditSink) Audit(record AuditRecord) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	entry, err := json.Marshal(auditEntry{Seq: s.seq + 1, PrevHash: s.lastHash, AuditRecord: record})
+	if err != nil {
+		return err
+	}
+	sum := sha256.Sum256(entry)
+	hash := hex.EncodeToString(sum[:])
+	line, err := json.Marshal(auditLine{Hash: hash, Entry: entry})
+	if err != nil {
+		return err
+	}
+	if _, err = s.file.Write(append(line, '\n')); err != nil {
+		return err
+	}
+	if err = s.file.Sync(); err != nil {
+		return err
+	}
+	s.seq++
+	s.lastHash = hash
+	return nil
+}
+
+// LastHash 最后一条记录的哈希，应定期保存至日志文件之外，用于校验尾部记录是否被删除
+func (s *FileAuditSink) LastHash() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.lastHash
+}
+
+// Close 关闭审计日志文件
+func (s *FileAuditSink) Close() error { return s.file.Close() }
+
+// VerifyAuditLog 校验审计日志哈希链，返回记录数。任一记录被修改、删除或重排时返回错误；
+// lastHash 非空时同时校验最后一条记录的哈希，以发现尾部记录被删除
+func VerifyAuditLog(r io.Reader, lastHash string) (int64, error) {
+	count, hash, err := verifyAuditLog(r)
+	if err != nil {
+		return count, err
+	}
+	if lastHash != "" && hash != lastHash {
+		return count, fmt.Errorf("audit log: last hash %s mismatch, expected %s", hash, lastHash)
+	}
+	return count, nil
+}
+
+func verifyAuditLog(r io.Reader) (int64, string, error) {
+	var seq int64
+	var lastHash string
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 64*1024*1024)
+	for scanner.Scan() {
+		var line auditLine
+		if err := json.Unmarshal(scanner.Bytes(), &line); err != nil {
+			return seq, lastHash, fmt.Errorf("audit log: record %d malformed: %v", seq+1, err)
+		}
+		sum := sha256.Sum256(line.Entry)
+		if hex.EncodeToString(sum[:]) != line.Hash {
+			return seq, lastHash, fmt.Errorf("audit log: record %d modified", seq+1)
+		}
+		var entry auditEntry
+		if err := json.Unmarshal(line.Entry, &entry); err != nil {
+			return seq, lastHash, fmt.Errorf("audit log: record %d malformed: %v", seq+1, err)
+		}
+		if entry.Seq != seq+1 || entry.PrevHash != lastHash {
+			return seq, lastHash, fmt.Errorf("audit log: chain broken before record %d", entry.Seq)
+		}
+		seq, lastHash = entry.Seq, line.Hash
+	}
+	return seq, lastHash, scanner.Err()
+}
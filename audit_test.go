@@ -0,0 +1,155 @@
+package payment
+
+import (
+	"bytes"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// testAuditSink 内存审计记录，Kind 在 fail 中时返回错误
+type testAuditSink struct {
+	records []AuditRecord
+	fail    map[string]bool
+}
+
+func (s *testAuditSink) Audit(record AuditRecord) error {
+	if s.fail[record.Kind] {
+		return errors.New("disk full")
+	}
+	s.records = append(s.records, record)
+	return nil
+}
+
+func TestAuditMiddleware(t *testing.T) {
+	errNetwork := errors.New("connection reset")
+	tests := []struct {
+		name       string
+		fail       map[string]bool
+		netErr     error
+		wantErr    bool
+		wantResp   bool
+		kinds      []string
+		auditError int // OnAuditError 调用次数
+	}{
+		{name: "recorded", wantResp: true, kinds: []string{AuditRequest, AuditResponse}},
+		{name: "request audit failed", fail: map[string]bool{AuditRequest: true}, wantErr: true},
+		{
+			name: "response audit failed", fail: map[string]bool{AuditResponse: true},
+			wantResp: true, kinds: []string{AuditRequest}, auditError: 1,
+		},
+		{name: "network error", netErr: errNetwork, wantErr: true, kinds: []string{AuditRequest, AuditResponse}},
+		{
+			name: "network error audit failed", fail: map[string]bool{AuditResponse: true}, netErr: errNetwork,
+			wantErr: true, kinds: []string{AuditRequest}, auditError: 1,
+		},
+	}
+	defer func(fn func(AuditRecord, error)) { OnAuditError = fn }(OnAuditError)
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			auditErrors := 0
+			OnAuditError = func(AuditRecord, error) { auditErrors++ }
+			sink := &testAuditSink{fail: tt.fail}
+			sent := false
+			transport := AuditMiddleware(PayPlatWechat, sink)(RoundTripperFunc(func(req *http.Request) (*http.Response, error) {
+				sent = true
+				if tt.netErr != nil {
+					return nil, tt.netErr
+				}
+				return &http.Response{StatusCode: http.StatusOK, Body: ioutil.NopCloser(strings.NewReader("<xml><return_code>SUCCESS</return_code></xml>"))}, nil
+			}))
+			req, _ := http.NewRequest("POST", "https://api.mch.weixin.qq.com/pay/orderquery?x=1", bytes.NewReader([]byte("<xml></xml>")))
+			resp, err := transport.RoundTrip(req)
+			if (err != nil) != tt.wantErr || (resp != nil) != tt.wantResp {
+				t.Fatalf("got resp %v error %v", resp, err)
+			}
+			if sent == tt.fail[AuditRequest] {
+				t.Fatalf("request sent %v with request audit failure %v", sent, tt.fail[AuditRequest])
+			}
+			if resp != nil {
+				body, _ := ioutil.ReadAll(resp.Body)
+				if !strings.Contains(string(body), "SUCCESS") {
+					t.Fatalf("response body not restored: %s", body)
+				}
+			}
+			kinds := make([]string, 0, len(sink.records))
+			for _, r := range sink.records {
+				kinds = append(kinds, r.Kind)
+				if r.URL != "https://api.mch.weixin.qq.com/pay/orderquery" {
+					t.Fatalf("got url %s", r.URL)
+				}
+			}
+			if strings.Join(kinds, ",") != strings.Join(tt.kinds, ",") {
+				t.Fatalf("got records %v, want %v", kinds, tt.kinds)
+			}
+			if tt.netErr != nil && len(sink.records) == 2 && sink.records[1].Error != tt.netErr.Error() {
+				t.Fatalf("network error not recorded: %+v", sink.records[1])
+			}
+			if auditErrors != tt.auditError {
+				t.Fatalf("OnAuditError called %d times, want %d", auditErrors, tt.auditError)
+			}
+		})
+	}
+}
+
+func TestVerifyAuditLog(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.log")
+	sink, err := NewFileAuditSink(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, kind := range []string{AuditRequest, AuditResponse} {
+		if err = sink.Audit(AuditRecord{Plat: PayPlatAlipay, Kind: kind, Body: kind}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	sink.Close()
+	// 重新打开后继续哈希链
+	if sink, err = NewFileAuditSink(path); err != nil {
+		t.Fatal(err)
+	}
+	if err = sink.Audit(AuditRecord{Plat: PayPlatAlipay, Kind: AuditNotify, Body: "notify"}); err != nil {
+		t.Fatal(err)
+	}
+	lastHash := sink.LastHash()
+	sink.Close()
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.SplitAfter(strings.TrimSuffix(string(data), "\n"), "\n")
+	if len(lines) != 3 {
+		t.Fatalf("got %d lines, want 3", len(lines))
+	}
+
+	tests := []struct {
+		name     string
+		log      string
+		lastHash string
+		count    int64
+		wantErr  bool
+	}{
+		{name: "valid", log: string(data), lastHash: lastHash, count: 3},
+		{name: "valid without last hash", log: string(data), count: 3},
+		{name: "modified", log: strings.Replace(string(data), `"body":"response"`, `"body":"forged"`, 1), wantErr: true},
+		{name: "deleted", log: lines[0] + lines[2], wantErr: true},
+		{name: "reordered", log: lines[1] + lines[0] + lines[2], wantErr: true},
+		{name: "tail deleted", log: lines[0] + lines[1], lastHash: lastHash, wantErr: true},
+		{name: "malformed", log: lines[0] + "{\n", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			count, err := VerifyAuditLog(strings.NewReader(tt.log), tt.lastHash)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("got error %v, want error %v", err, tt.wantErr)
+			}
+			if !tt.wantErr && count != tt.count {
+				t.Fatalf("got %d records, want %d", count, tt.count)
+			}
+		})
+	}
+}
@@ -0,0 +1,394 @@
+// 批量退款
+
+package payment
+
+import (
+	"bufio"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// BatchRefundItem 批量退款中的一笔退款
+type BatchRefundItem struct {
+	Plat     PayPlat
+	Merchant string // 商户标识，并发及频率按商户限制，默认为 Plat
+	Request  RefundRequest
+}
+
+func (item BatchRefundItem) merchant() string {
+	if item.Merchant != "" {
+		return item.Merchant
+	}
+	return string(item.Plat)
+}
+
+// BatchRefundStatus 批量退款结果状态
+type BatchRefundStatus string
+
+// 批量退款结果状态定义
+const (
+	BatchRefundSuccess BatchRefundStatus = "SUCCESS" // 支付平台已受理，微信退款结果以退款通知为准
+	BatchRefundFailed  BatchRefundStatus = "FAILED"  // 支付平台明确拒绝的业务错误，重新运行时不再提交
+	BatchRefundPending BatchRefundStatus = "PENDING" // 其他错误或被中断，结果未知，重新运行时以相同的退款单号重新提交
+)
+
+// BatchRefundResult 单笔退款的处理结果
+type BatchRefundResult struct {
+	Plat             PayPlat           `json:"plat"`
+	Merchant         string            `json:"merchant"`
+	MerchantOrderNo  string            `json:"merchant_order_no"`
+	MerchantRefundNo string            `json:"merchant_refund_no"`
+	RefundFee        int32             `json:"refund_fee"`
+	Status           BatchRefundStatus `json:"status"`
+	PlatRefundID     string            `json:"plat_refund_id,omitempty"`
+	Attempts         int               `json:"attempts"`
+	Error            string            `json:"error,omitempty"`
+	Time             time.Time         `json:"time"`
+}
+
+// BatchRefundSummary 批量退款汇总，包含此前运行已完成的退款
+type BatchRefundSummary struct {
+	Total, Success, Failed, Pending int
+	Skipped                         int // 此前运行已成功或失败而跳过的退款数
+}
+
+// DefaultBatchRetryPolicy 批量退款默认重试策略，频率限制时等待较长时间
+var DefaultBatchRetryPolicy = RetryPolicy{MaxAttempts: 5, BaseDelay: time.Second, MaxDelay: 30 * time.Second}
+
+// BatchRefunder 批量退款，按商户限制并发数及每秒请求数，瞬时错误按重试策略重试；
+// 每笔退款的结果追加写入进度文件，重新运行时跳过已成功或失败的退款，退款单号不变因此可安全地重新提交。
+// 仅支付平台明确拒绝的业务错误(IsBusinessError)记为失败，网络错误等结果未知的错误均记为待处理。
+// 重试由 Retry 负责，支付客户端不应再配置 WithRetryPolicy，否则每次尝试内部还会重试，实际请求数为两者之积
+type BatchRefunder struct {
+	Concurrency  int                                                                     // 每个商户的最大并发数，默认 2
+	QPS          float64                                                                 // 每个商户每秒最大请求数，默认 5
+	Retry        RetryPolicy                                                             // 瞬时错误重试策略，默认 DefaultBatchRetryPolicy，与客户端重试策略叠加
+	ProgressFile string                                                                  // 进度文件，JSON Lines 格式，为空时不记录进度
+	ResultFile   string                                                                  // 结果文件，CSV 格式，为空时不输出
+	Refund       func(ctx context.Context, item BatchRefundItem) (RefundResponse, error) // 退款函数，默认调用 RefundContext
+	Logger       *log.Logger                                                             // 错误日志，默认 log 包标准输出
+
+	mu        sync.Mutex
+	results   map[string]BatchRefundResult
+	order     []string
+	progress  *os.File
+	merchants map[string]*merchantQueue
+}
+
+// merchantQueue 商户待处理退款队列，入队不阻塞，慢商户不影响其他商户的分发
+type merchantQueue struct {
+	mu      sync.Mutex
+	cond    *sync.Cond
+	pending []BatchRefundItem
+	closed  bool
+	limiter *rateLimiter
+}
+
+func (q *merchantQueue) push(item BatchRefundItem) {
+	q.mu.Lock()
+	q.pending = append(q.pending, item)
+	q.mu.Unlock()
+	q.cond.Signal()
+}
+
+// pop 取出下一笔退款，队列为空时等待，队列关闭且为空时返回 false
+func (q *merchantQueue) pop() (BatchRefundItem, bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for len(q.pending) == 0 && !q.closed {
+		q.cond.Wait()
+	}
+	if len(q.pending) == 0 {
+		return BatchRefundItem{}, false
+	}
+	item := q.pending[0]
+	q.pending = q.pending[1:]
+	return item, true
+}
+
+func (q *merchantQueue) close() {
+	q.mu.Lock()
+	q.closed = true
+	q.mu.Unlock()
+	q.cond.Broadcast()
+}
+
+// Run 处理 items 中的全部退款直至 items 关闭或 ctx 取消，返回前等待进行中的退款结束并输出结果文件
+func (b *BatchRefunder) Run(ctx context.Context, items <-chan BatchRefundItem) (BatchRefundSummary, error) {
+	if b.Concurrency <= 0 {
+		b.Concurrency = 2
+	}
+	if b.QPS <= 0 {
+		b.QPS = 5
+	}
+	if b.Retry.MaxAttempts == 0 {
+		b.Retry = DefaultBatchRetryPolicy
+	}
+	if b.Refund == nil {
+		b.Refund = func(ctx context.Context, item BatchRefundItem) (RefundResponse, error) {
+			return RefundContext(ctx, item.Plat, item.Request)
+		}
+	}
+	b.results = make(map[string]BatchRefundResult)
+	b.order, b.progress = nil, nil
+	b.merchants = make(map[string]*merchantQueue)
+	var summary BatchRefundSummary
+	if b.ProgressFile != "" {
+		truncated, err := b.loadProgress()
+		if err != nil {
+			return summary, err
+		}
+		f, err := os.OpenFile(b.ProgressFile, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+		if err != nil {
+			return summary, err
+		}
+		// 结束不完整的最后一行，避免与新记录连在一起
+		if truncated {
+			if _, err = f.Write([]byte{'\n'}); err != nil {
+				f.Close()
+				return summary, err
+			}
+		}
+		b.progress = f
+		defer f.Close()
+	}
+
+	var wg sync.WaitGroup
+	seen := make(map[string]bool)
+dispatch:
+	for {
+		var item BatchRefundItem
+		var ok bool
+		select {
+		case item, ok = <-items:
+		case <-ctx.Done():
+			break dispatch
+		}
+		if !ok {
+			break
+		}
+		no := item.Request.MerchantRefundNo
+		if no == "" || seen[no] {
+			b.logf("payment: batch refund skip order %s, merchant refund no is empty or duplicated", item.Request.MerchantOrderNo)
+			continue
+		}
+		seen[no] = true
+		b.mu.Lock()
+		r, has := b.results[no]
+		b.mu.Unlock()
+		if has && r.Status != BatchRefundPending {
+			summary.Skipped++
+			continue
+		}
+		b.record(BatchRefundResult{
+			Plat: item.Plat, Merchant: item.merchant(),
+			MerchantOrderNo: item.Request.MerchantOrderNo, MerchantRefundNo: no,
+			RefundFee: item.Request.RefundFee, Status: BatchRefundPending, Time: time.Now(),
+		}, false)
+		b.queue(ctx, item.merchant(), &wg).push(item)
+	}
+	for _, q := range b.merchants {
+		q.close()
+	}
+	wg.Wait()
+
+	for _, no := range b.order {
+		summary.Total++
+		switch b.results[no].Status {
+		case BatchRefundSuccess:
+			summary.Success++
+		case BatchRefundFailed:
+			summary.Failed++
+		default:
+			summary.Pending++
+		}
+	}
+	if b.ResultFile != "" {
+		if err := b.writeResult(); err != nil {
+			return summary, err
+		}
+	}
+	return summary, ctx.Err()
+}
+
+// queue 获取商户退款队列，首次使用时启动商户的退款协程
+func (b *BatchRefunder) queue(ctx context.Context, merchant string, wg *sync.WaitGroup) *merchantQueue {
+	if q, has := b.merchants[merchant]; has {
+		return q
+	}
+	q := &merchantQueue{limiter: &rateLimiter{interval: time.Duration(float64(time.Second) / b.QPS)}}
+	q.cond = sync.NewCond(&q.mu)
+	b.merchants[merchant] = q
+	for i := 0; i < b.Concurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				item, ok := q.pop()
+				if !ok {
+					return
+				}
+				b.refund(ctx, q.limiter, item)
+			}
+		}()
+	}
+	return q
+}
+
+// refund 提交退款，每次尝试前按商户频率限制等待，瞬时错误按重试策略重试；
+// 仅业务错误记为失败，其他错误退款结果未知，记为待处理以便重新运行时以相同退款单号重新提交
+func (b *BatchRefunder) refund(ctx context.Context, limiter *rateLimiter, item BatchRefundItem) {
+	result := BatchRefundResult{
+		Plat: item.Plat, Merchant: item.merchant(),
+		MerchantOrderNo: item.Request.MerchantOrderNo, MerchantRefundNo: item.Request.MerchantRefundNo,
+		RefundFee: item.Request.RefundFee, Status: BatchRefundPending,
+	}
+	if ctx.Err() != nil {
+		return
+	}
+	err := b.Retry.Do(ctx, IsTransient, func() error {
+		if err := limiter.wait(ctx); err != nil {
+			return err
+		}
+		result.Attempts++
+		resp, err := b.Refund(ctx, item)
+		if err == nil {
+			result.PlatRefundID = resp.PlatRefundID
+		}
+		return err
+	})
+	switch {
+	case err == nil:
+		result.Status = BatchRefundSuccess
+	case ctx.Err() == nil && IsBusinessError(err):
+		result.Status = BatchRefundFailed
+		result.Error = err.Error()
+	default:
+		result.Error = err.Error()
+	}
+	result.Time = time.Now()
+	b.record(result, true)
+}
+
+// record 记录退款结果，persist 为 true 时追加写入进度文件
+func (b *BatchRefunder) record(result BatchRefundResult, persist bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if _, has := b.results[result.MerchantRefundNo]; !has {
+		b.order = append(b.order, result.MerchantRefundNo)
+	}
+	b.results[result.MerchantRefundNo] = result
+	if !persist || b.progress == nil {
+		return
+	}
+	data, _ := json.Marshal(result)
+	if _, err := b.progress.Write(append(data, '\n')); err != nil {
+		b.logf("payment: write batch refund progress error:%v", err)
+	}
+}
+
+// loadProgress 加载进度文件，同一退款单号以最后一条记录为准，返回最后一行是否缺少换行符
+func (b *BatchRefunder) loadProgress() (bool, error) {
+	f, err := os.Open(b.ProgressFile)
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	for line := 1; scanner.Scan(); line++ {
+		if len(scanner.Bytes()) == 0 {
+			continue
+		}
+		var result BatchRefundResult
+		if err = json.Unmarshal(scanner.Bytes(), &result); err != nil {
+			// 中断时可能写入不完整的最后一行
+			b.logf("payment: skip invalid batch refund progress line %d:%v", line, err)
+			continue
+		}
+		b.record(result, false)
+	}
+	if err = scanner.Err(); err != nil {
+		return false, err
+	}
+	info, err := f.Stat()
+	if err != nil || info.Size() == 0 {
+		return false, err
+	}
+	last := make([]byte, 1)
+	if _, err = f.ReadAt(last, info.Size()-1); err != nil {
+		return false, err
+	}
+	return last[0] != '\n', nil
+}
+
+// writeResult 输出结果文件
+func (b *BatchRefunder) writeResult() error {
+	f, err := os.Create(b.ResultFile)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	w := csv.NewWriter(f)
+	w.Write([]string{"plat", "merchant", "merchant_order_no", "merchant_refund_no", "refund_fee", "status", "plat_refund_id", "attempts", "error", "time"})
+	for _, no := range b.order {
+		r := b.results[no]
+		w.Write([]string{
+			string(r.Plat), r.Merchant, r.MerchantOrderNo, r.MerchantRefundNo,
+			strconv.Itoa(int(r.RefundFee)), string(r.Status), r.PlatRefundID,
+			strconv.Itoa(r.Attempts), r.Error, r.Time.Format(time.RFC3339),
+		})
+	}
+	w.Flush()
+	if err = w.Error(); err != nil {
+		return err
+	}
+	return f.Sync()
+}
+
+func (b *BatchRefunder) logf(format string, v ...interface{}) {
+	if b.Logger != nil {
+		b.Logger.Printf(format, v...)
+		return
+	}
+	log.Printf(format, v...)
+}
+
+// rateLimiter 按固定间隔发放请求许可
+type rateLimiter struct {
+	mu       sync.Mutex
+	interval time.Duration
+	next     time.Time
+}
+
+// wait 等待下一个请求许可，ctx 取消时返回错误
+func (l *rateLimiter) wait(ctx context.Context) error {
+	l.mu.Lock()
+	now := time.Now()
+	if l.next.Before(now) {
+		l.next = now
+	}
+	delay := l.next.Sub(now)
+	l.next = l.next.Add(l.interval)
+	l.mu.Unlock()
+	if delay <= 0 {
+		return nil
+	}
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return fmt.Errorf("batch refund interrupted:%v", ctx.Err())
+	case <-timer.C:
+		return nil
+	}
+}
@@ -0,0 +1,207 @@
+package payment
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// testRefundError 支付平台错误，temporary 为 false 时为业务错误
+type testRefundError struct{ temporary bool }
+
+func (e *testRefundError) Error() string       { return "refund error" }
+func (e *testRefundError) Temporary() bool     { return e.temporary }
+func (e *testRefundError) BusinessError() bool { return !e.temporary }
+
+// testBatchRefund 记录提交的退款单号，退款单号在 errs 中时返回对应错误
+type testBatchRefund struct {
+	mu    sync.Mutex
+	nos   []string
+	errs  map[string]error
+	delay func(item BatchRefundItem)
+}
+
+func (r *testBatchRefund) refund(ctx context.Context, item BatchRefundItem) (RefundResponse, error) {
+	if r.delay != nil {
+		r.delay(item)
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.nos = append(r.nos, item.Request.MerchantRefundNo)
+	if err := r.errs[item.Request.MerchantRefundNo]; err != nil {
+		return RefundResponse{}, err
+	}
+	return RefundResponse{MerchantRefundNo: item.Request.MerchantRefundNo, PlatRefundID: "P" + item.Request.MerchantRefundNo}, nil
+}
+
+func (r *testBatchRefund) submitted() []string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]string(nil), r.nos...)
+}
+
+// batchItems 以退款单号生成退款，退款单号格式为 <商户>-<序号>
+func batchItems(nos ...string) <-chan BatchRefundItem {
+	items := make(chan BatchRefundItem, len(nos))
+	for _, no := range nos {
+		merchant := strings.SplitN(no, "-", 2)[0]
+		items <- BatchRefundItem{Plat: testPlat, Merchant: merchant, Request: RefundRequest{MerchantOrderNo: no, MerchantRefundNo: no, RefundFee: 10}}
+	}
+	close(items)
+	return items
+}
+
+var testBatchRetry = RetryPolicy{MaxAttempts: 2, BaseDelay: time.Millisecond, MaxDelay: time.Millisecond}
+
+func TestBatchRefunderResume(t *testing.T) {
+	dir := t.TempDir()
+	progress := filepath.Join(dir, "progress.jsonl")
+	var lines []string
+	for no, status := range map[string]BatchRefundStatus{"A-1": BatchRefundSuccess, "A-2": BatchRefundFailed, "A-3": BatchRefundPending} {
+		data, _ := json.Marshal(BatchRefundResult{Plat: testPlat, Merchant: "A", MerchantRefundNo: no, Status: status})
+		lines = append(lines, string(data))
+	}
+	// 中断时写入不完整的最后一行
+	lines = append(lines, `{"plat":"test","merchant_refund_no":"A-4","sta`)
+	if err := os.WriteFile(progress, []byte(strings.Join(lines, "\n")), 0644); err != nil {
+		t.Fatal(err)
+	}
+	fake := &testBatchRefund{}
+	b := &BatchRefunder{QPS: 1000, Retry: testBatchRetry, ProgressFile: progress, ResultFile: filepath.Join(dir, "result.csv"), Refund: fake.refund}
+	summary, err := b.Run(context.Background(), batchItems("A-1", "A-2", "A-3", "A-4"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := BatchRefundSummary{Total: 4, Success: 3, Failed: 1, Skipped: 2}
+	if summary != want {
+		t.Fatalf("got summary %+v, want %+v", summary, want)
+	}
+	if got := strings.Join(fake.submitted(), ","); got != "A-3,A-4" && got != "A-4,A-3" {
+		t.Fatalf("submitted %s, want A-3 and A-4", got)
+	}
+	result, err := os.ReadFile(b.ResultFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := strings.Count(string(result), "\n"); n != 5 {
+		t.Fatalf("got %d result lines, want 5", n)
+	}
+
+	// 再次运行时全部跳过
+	fake = &testBatchRefund{}
+	b.Refund = fake.refund
+	if summary, err = b.Run(context.Background(), batchItems("A-1", "A-2", "A-3", "A-4")); err != nil {
+		t.Fatal(err)
+	}
+	if summary.Skipped != 4 || len(fake.submitted()) != 0 {
+		t.Fatalf("got summary %+v, submitted %v", summary, fake.submitted())
+	}
+}
+
+func TestBatchRefunderDedup(t *testing.T) {
+	fake := &testBatchRefund{}
+	b := &BatchRefunder{QPS: 1000, Retry: testBatchRetry, Refund: fake.refund}
+	items := make(chan BatchRefundItem, 3)
+	items <- BatchRefundItem{Plat: testPlat, Request: RefundRequest{MerchantOrderNo: "T1", MerchantRefundNo: "T1-R1"}}
+	items <- BatchRefundItem{Plat: testPlat, Request: RefundRequest{MerchantOrderNo: "T1", MerchantRefundNo: "T1-R1"}}
+	items <- BatchRefundItem{Plat: testPlat, Request: RefundRequest{MerchantOrderNo: "T2"}}
+	close(items)
+	summary, err := b.Run(context.Background(), items)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if summary.Total != 1 || summary.Success != 1 || len(fake.submitted()) != 1 {
+		t.Fatalf("got summary %+v, submitted %v", summary, fake.submitted())
+	}
+}
+
+func TestBatchRefunderErrors(t *testing.T) {
+	tests := []struct {
+		name     string
+		err      error
+		status   BatchRefundStatus
+		attempts int
+	}{
+		{name: "business", err: &testRefundError{}, status: BatchRefundFailed, attempts: 1},
+		{name: "transient", err: &testRefundError{temporary: true}, status: BatchRefundPending, attempts: 2},
+		{name: "network", err: &url.Error{Op: "Post", URL: "https://api.mch.weixin.qq.com/secapi/pay/refund", Err: io.EOF}, status: BatchRefundPending, attempts: 1},
+		{name: "provider", err: errors.New("Payment: 不支持的支付方式"), status: BatchRefundPending, attempts: 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fake := &testBatchRefund{errs: map[string]error{"A-1": tt.err}}
+			progress := filepath.Join(t.TempDir(), "progress.jsonl")
+			b := &BatchRefunder{QPS: 1000, Retry: testBatchRetry, ProgressFile: progress, Refund: fake.refund}
+			if _, err := b.Run(context.Background(), batchItems("A-1")); err != nil {
+				t.Fatal(err)
+			}
+			data, err := os.ReadFile(progress)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var result BatchRefundResult
+			if err = json.Unmarshal(data, &result); err != nil {
+				t.Fatal(err)
+			}
+			if result.Status != tt.status || result.Attempts != tt.attempts || result.Error == "" {
+				t.Fatalf("got result %+v, want status %s attempts %d", result, tt.status, tt.attempts)
+			}
+		})
+	}
+}
+
+func TestBatchRefunderRateLimit(t *testing.T) {
+	fake := &testBatchRefund{}
+	b := &BatchRefunder{Concurrency: 4, QPS: 20, Retry: testBatchRetry, Refund: fake.refund}
+	start := time.Now()
+	summary, err := b.Run(context.Background(), batchItems("A-1", "A-2", "A-3", "A-4", "A-5", "B-1", "B-2"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 商户 A 的 5 笔退款间隔 50ms，商户 B 独立限制
+	if elapsed := time.Since(start); elapsed < 200*time.Millisecond || elapsed > time.Second {
+		t.Fatalf("took %v, want about 200ms", elapsed)
+	}
+	if summary.Success != 7 {
+		t.Fatalf("got summary %+v", summary)
+	}
+}
+
+func TestBatchRefunderSlowMerchant(t *testing.T) {
+	release, done := make(chan struct{}), make(chan struct{})
+	fake := &testBatchRefund{delay: func(item BatchRefundItem) {
+		if item.Merchant == "A" {
+			<-release
+		} else {
+			close(done)
+		}
+	}}
+	b := &BatchRefunder{Concurrency: 1, QPS: 1000, Retry: testBatchRetry, Refund: fake.refund}
+	type runResult struct {
+		summary BatchRefundSummary
+		err     error
+	}
+	finished := make(chan runResult, 1)
+	go func() {
+		summary, err := b.Run(context.Background(), batchItems("A-1", "A-2", "A-3", "A-4", "B-1"))
+		finished <- runResult{summary, err}
+	}()
+	select {
+	case <-done:
+	case <-time.After(2 * time.Second):
+		t.Fatal("merchant B blocked by slow merchant A")
+	}
+	close(release)
+	r := <-finished
+	if r.err != nil || r.summary.Success != 5 {
+		t.Fatalf("got summary %+v error %v", r.summary, r.err)
+	}
+}
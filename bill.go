@@ -0,0 +1,104 @@
+// 对账单
+
+package payment
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// BillType 对账单类型
+type BillType string
+
+// 对账单类型定义
+const (
+	BillTypeAll     BillType = "ALL"     // 所有订单信息
+	BillTypeSuccess BillType = "SUCCESS" // 成功支付的订单
+	BillTypeRefund  BillType = "REFUND"  // 退款订单
+)
+
+// 对账单明细交易状态，支付宝账单的业务类型转换为对应的状态
+const (
+	BillStatusSuccess = "SUCCESS" // 支付成功
+	BillStatusRefund  = "REFUND"  // 退款
+	BillStatusRevoked = "REVOKED" // 已撤销
+)
+
+// BillRecord 对账单明细记录，金额单位：分
+type BillRecord struct {
+	Plat             PayPlat
+	TradeTime        time.Time // 交易时间
+	MerchantID       string    // 商户号
+	TransactionID    string    // 支付平台交易号
+	MerchantOrderNo  string    // 商户订单号
+	Status           string    // 交易状态，见 BillStatusSuccess 等定义
+	IsRefund         bool      // 是否退款记录
+	TotalAmount      int64     // 订单金额
+	SettlementAmount int64     // 应结订单金额/商家实收
+	CouponAmount     int64     // 优惠金额
+	RefundID         string    // 支付平台退款单号
+	MerchantRefundNo string    // 商户退款单号
+	RefundAmount     int64     // 退款金额
+	RefundStatus     string    // 退款状态
+	Fee              int64     // 手续费
+	Currency         string    // 币种
+	Subject          string    // 商品名称
+	Attach           string    // 商户数据包
+}
+
+// BillSummary 对账单汇总，金额单位：分
+type BillSummary struct {
+	TotalCount         int   // 总交易单数
+	TotalAmount        int64 // 订单总金额
+	SettlementAmount   int64 // 应结订单总金额
+	RefundAmount       int64 // 退款总金额
+	CouponRefundAmount int64 // 充值券退款总金额
+	Fee                int64 // 手续费总金额
+}
+
+// BillRecordFunc 对账单明细处理函数，返回错误时终止解析
+type BillRecordFunc func(record BillRecord) error
+
+// ParseAmount 解析以元为单位的金额字符串，返回以分为单位的金额
+func ParseAmount(s string) (int64, error) {
+	s = strings.TrimSpace(s)
+	if s == "" {
+		return 0, nil
+	}
+	var negative bool
+	switch s[0] {
+	case '-':
+		negative, s = true, s[1:]
+	case '+':
+		s = s[1:]
+	}
+	yuan, fen := s, "00"
+	if i := strings.IndexByte(s, '.'); i >= 0 {
+		yuan, fen = s[:i], s[i+1:]
+		if len(fen) > 2 {
+			if strings.Trim(fen[2:], "0") != "" {
+				return 0, fmt.Errorf("invalid amount %s", s)
+			}
+			fen = fen[:2]
+		}
+		fen += strings.Repeat("0", 2-len(fen))
+	}
+	if yuan == "" {
+		yuan = "0"
+	}
+	y, err := strconv.ParseUint(yuan, 10, 63)
+	if err != nil {
+		return 0, fmt.Errorf("invalid amount %s", s)
+	}
+	f, err := strconv.ParseUint(fen, 10, 8)
+	if err != nil {
+		return 0, fmt.Errorf("invalid amount %s", s)
+	}
+	amount := int64(y*100 + f)
+	if negative {
+		amount = -amount
+	}
+	return amount, nil
+}
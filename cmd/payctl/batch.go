@@ -0,0 +1,128 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"sync"
+
+	"github.com/shengzhi/payment"
+)
+
+// batchRefundLine 批量退款输入文件的一行
+type batchRefundLine struct {
+	Plat          string `json:"plat"`
+	No            string `json:"no"`
+	TransactionID string `json:"transaction_id"`
+	RefundNo      string `json:"refund_no"`
+	Total         int32  `json:"total"`
+	Amount        int32  `json:"amount"`
+	Currency      string `json:"currency"`
+	Reason        string `json:"reason"`
+}
+
+// runBatchRefund 按 JSON Lines 文件批量退款，中断(Ctrl+C)后以相同的 -progress 重新运行即可继续
+func runBatchRefund(e *env, args []string) (interface{}, error) {
+	fs, _ := newFlagSet("batch-refund", false)
+	in := fs.String("in", "", "退款文件，每行一个JSON对象 {plat,no,transaction_id,refund_no,total,amount,currency,reason}，- 表示标准输入")
+	progress := fs.String("progress", "", "进度文件，默认为 <in>.progress")
+	result := fs.String("result", "", "结果文件(CSV)，默认为 <in>.result.csv")
+	concurrency := fs.Int("concurrency", 2, "每个支付平台商户的最大并发数")
+	qps := fs.Float64("qps", 5, "每个支付平台商户每秒最大请求数")
+	fs.Parse(args)
+	if err := required(fs, "in"); err != nil {
+		return nil, err
+	}
+	r := io.Reader(os.Stdin)
+	if *in != "-" {
+		f, err := os.Open(*in)
+		if err != nil {
+			return nil, err
+		}
+		defer f.Close()
+		r = f
+		if *progress == "" {
+			*progress = *in + ".progress"
+		}
+		if *result == "" {
+			*result = *in + ".result.csv"
+		}
+	}
+	if e.dryRun != nil {
+		// 仅输出已签名的请求，不记录进度
+		*progress, *result = "", ""
+	}
+
+	var mu sync.Mutex
+	providers := make(map[payment.PayPlat]payment.Provider)
+	refunder := &payment.BatchRefunder{
+		Concurrency: *concurrency, QPS: *qps,
+		ProgressFile: *progress, ResultFile: *result,
+		Refund: func(ctx context.Context, item payment.BatchRefundItem) (payment.RefundResponse, error) {
+			mu.Lock()
+			provider, has := providers[item.Plat]
+			if !has {
+				var err error
+				if provider, err = e.provider(item.Plat); err != nil {
+					mu.Unlock()
+					return payment.RefundResponse{}, err
+				}
+				providers[item.Plat] = provider
+			}
+			mu.Unlock()
+			if p, ok := provider.(payment.ContextProvider); ok {
+				return p.RefundContext(ctx, item.Request)
+			}
+			return provider.Refund(item.Request)
+		},
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+	items := make(chan payment.BatchRefundItem)
+	readErr := make(chan error, 1)
+	go func() {
+		defer close(items)
+		readErr <- readBatchRefund(ctx, r, items)
+	}()
+	summary, err := refunder.Run(ctx, items)
+	if err != nil {
+		return nil, err
+	}
+	if err = <-readErr; err != nil {
+		return nil, err
+	}
+	return map[string]interface{}{"summary": summary, "progress": *progress, "result": *result}, nil
+}
+
+// readBatchRefund 逐行读取退款并发送至 items
+func readBatchRefund(ctx context.Context, r io.Reader, items chan<- payment.BatchRefundItem) error {
+	scanner := bufio.NewScanner(r)
+	for n := 1; scanner.Scan(); n++ {
+		if len(scanner.Bytes()) == 0 {
+			continue
+		}
+		var line batchRefundLine
+		if err := json.Unmarshal(scanner.Bytes(), &line); err != nil {
+			return fmt.Errorf("batch-refund: line %d: %v", n, err)
+		}
+		plat, err := parsePlat(line.Plat)
+		if err != nil {
+			return fmt.Errorf("batch-refund: line %d: %v", n, err)
+		}
+		item := payment.BatchRefundItem{Plat: plat, Request: payment.RefundRequest{
+			MerchantOrderNo: line.No, TransactionID: line.TransactionID, MerchantRefundNo: line.RefundNo,
+			TotalFee: line.Total, RefundFee: line.Amount, Currency: line.Currency, Reason: line.Reason,
+		}}
+		select {
+		case items <- item:
+		case <-ctx.Done():
+			return nil
+		}
+	}
+	return scanner.Err()
+}
@@ -0,0 +1,308 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	"github.com/shengzhi/payment"
+	"github.com/shengzhi/payment/alipay"
+	"github.com/shengzhi/payment/wechat"
+)
+
+// newFlagSet 创建子命令参数，platform 为 true 时包含 -plat 参数
+func newFlagSet(name string, platform bool) (*flag.FlagSet, *string) {
+	fs := flag.NewFlagSet(name, flag.ExitOnError)
+	var plat string
+	if platform {
+		fs.StringVar(&plat, "plat", "", "支付平台 wechat/alipay")
+	}
+	return fs, &plat
+}
+
+// required 检查必填参数
+func required(fs *flag.FlagSet, names ...string) error {
+	set := make(map[string]bool)
+	fs.Visit(func(f *flag.Flag) { set[f.Name] = true })
+	for _, name := range names {
+		if !set[name] {
+			return fmt.Errorf("%s: -%s is required", fs.Name(), name)
+		}
+	}
+	return nil
+}
+
+func runOrder(e *env, args []string) (interface{}, error) {
+	fs, plat := newFlagSet("order", true)
+	no := fs.String("no", "", "商户订单号")
+	amount := fs.Int64("amount", 0, "订单金额，单位：分")
+	subject := fs.String("subject", "", "订单标题")
+	desc := fs.String("desc", "", "商品描述")
+	attach := fs.String("attach", "", "附加数据")
+	source := fs.String("source", "app", "支付渠道 app/wap")
+	openid := fs.String("openid", "", "微信用户标识，wap渠道必填")
+	ip := fs.String("ip", "127.0.0.1", "终端IP")
+	returnURL := fs.String("return-url", "", "支付宝手机网站支付完成后的跳转地址")
+	fs.Parse(args)
+	if err := required(fs, "plat", "no", "amount"); err != nil {
+		return nil, err
+	}
+	p, err := parsePlat(*plat)
+	if err != nil {
+		return nil, err
+	}
+	req := &payment.OrderRequest{
+		MerchanOrderNo: *no, Amount: *amount,
+		Subject: *subject, Desc: *desc, Attach: *attach,
+		OpenID: *openid, ClientIP: *ip, ReturnURL: *returnURL,
+	}
+	switch *source {
+	case "app":
+		req.Source = payment.PaySourceApp
+	case "wap":
+		req.Source = payment.PaySourceWap
+	default:
+		return nil, fmt.Errorf("order: unknown source %q", *source)
+	}
+	provider, err := e.provider(p)
+	if err != nil {
+		return nil, err
+	}
+	return provider.Order(req)
+}
+
+func runQuery(e *env, args []string) (interface{}, error) {
+	fs, plat := newFlagSet("query", true)
+	no := fs.String("no", "", "商户订单号")
+	fs.Parse(args)
+	if err := required(fs, "plat", "no"); err != nil {
+		return nil, err
+	}
+	p, err := parsePlat(*plat)
+	if err != nil {
+		return nil, err
+	}
+	provider, err := e.provider(p)
+	if err != nil {
+		return nil, err
+	}
+	return provider.Query(*no)
+}
+
+func runClose(e *env, args []string) (interface{}, error) {
+	fs, plat := newFlagSet("close", true)
+	no := fs.String("no", "", "商户订单号")
+	fs.Parse(args)
+	if err := required(fs, "plat", "no"); err != nil {
+		return nil, err
+	}
+	p, err := parsePlat(*plat)
+	if err != nil {
+		return nil, err
+	}
+	provider, err := e.provider(p)
+	if err != nil {
+		return nil, err
+	}
+	if err = provider.Close(*no); err != nil {
+		return nil, err
+	}
+	return map[string]interface{}{"merchant_order_no": *no, "closed": true}, nil
+}
+
+func runRefund(e *env, args []string) (interface{}, error) {
+	fs, plat := newFlagSet("refund", true)
+	no := fs.String("no", "", "商户订单号")
+	transactionID := fs.String("transaction-id", "", "支付平台交易号，可代替商户订单号")
+	refundNo := fs.String("refund-no", "", "商户退款单号")
+	total := fs.Int("total", 0, "订单金额，单位：分，微信支付必填")
+	amount := fs.Int("amount", 0, "退款金额，单位：分")
+	currency := fs.String("currency", "", "退款币种，默认与下单币种一致")
+	fundsAccount := fs.String("funds-account", "", "微信退款资金来源，REFUND_SOURCE_RECHARGE_FUNDS 为可用余额退款")
+	reason := fs.String("reason", "", "退款原因")
+	notifyURL := fs.String("notify-url", "", "退款结果通知地址")
+	status := fs.Bool("status", false, "查询退款状态而不发起退款")
+	fs.Parse(args)
+	if err := required(fs, "plat", "refund-no"); err != nil {
+		return nil, err
+	}
+	p, err := parsePlat(*plat)
+	if err != nil {
+		return nil, err
+	}
+	if *status {
+		return e.refundStatus(p, *no, *refundNo)
+	}
+	if err = required(fs, "amount"); err != nil {
+		return nil, err
+	}
+	if *no == "" && *transactionID == "" {
+		return nil, fmt.Errorf("refund: -no or -transaction-id is required")
+	}
+	provider, err := e.provider(p)
+	if err != nil {
+		return nil, err
+	}
+	return provider.Refund(payment.RefundRequest{
+		MerchantOrderNo: *no, TransactionID: *transactionID, MerchantRefundNo: *refundNo,
+		TotalFee: int32(*total), RefundFee: int32(*amount), Currency: *currency,
+		FundsAccount: payment.RefundFundsAccount(*fundsAccount),
+		Reason:       *reason, NotifyURL: *notifyURL,
+	})
+}
+
+// refundStatus 查询退款状态，支付宝需要商户订单号
+func (e *env) refundStatus(plat payment.PayPlat, no, refundNo string) (interface{}, error) {
+	if plat == payment.PayPlatWechat {
+		client, err := e.wechatClient()
+		if err != nil {
+			return nil, err
+		}
+		return client.RefundQuery(refundNo)
+	}
+	if no == "" {
+		return nil, fmt.Errorf("refund: -no is required")
+	}
+	client, err := e.alipayClient()
+	if err != nil {
+		return nil, err
+	}
+	return client.RefundQuery(context.Background(), no, refundNo)
+}
+
+func runTransfer(e *env, args []string) (interface{}, error) {
+	fs, _ := newFlagSet("transfer", false)
+	no := fs.String("no", "", "商户付款单号")
+	openid := fs.String("openid", "", "收款用户openid")
+	amount := fs.Int("amount", 0, "付款金额，单位：分")
+	desc := fs.String("desc", "", "付款备注")
+	name := fs.String("name", "", "收款用户真实姓名，设置时校验姓名；付款到银行卡时为收款方姓名")
+	appid := fs.String("appid", "", "openid 所属的公众账号ID，默认为配置的 app_id")
+	ip := fs.String("ip", "127.0.0.1", "调用接口的机器IP")
+	bank := fs.Bool("bank", false, "付款到银行卡")
+	bankNo := fs.String("bank-no", "", "收款方银行卡号")
+	bankCode := fs.String("bank-code", "", "收款方开户行编码，如 1002 工商银行")
+	bankKeyFile := fs.String("bank-key-file", "", "付款到银行卡加密使用的PEM公钥文件，不指定时向微信获取，-dry-run 时必须指定")
+	status := fs.Bool("status", false, "查询付款结果而不发起付款")
+	fs.Parse(args)
+	if err := required(fs, "no"); err != nil {
+		return nil, err
+	}
+	client, err := e.wechatClient()
+	if err != nil {
+		return nil, err
+	}
+	switch {
+	case *status && *bank:
+		return client.QueryBank(*no)
+	case *status:
+		return client.TransferQuery(*no)
+	case *bank:
+		if err = required(fs, "bank-no", "bank-code", "name", "amount"); err != nil {
+			return nil, err
+		}
+		if *bankKeyFile == "" && e.dryRun != nil {
+			return nil, fmt.Errorf("transfer: -bank-key-file is required with -dry-run, the public key request is not sent")
+		}
+		if *bankKeyFile != "" {
+			data, err := os.ReadFile(*bankKeyFile)
+			if err != nil {
+				return nil, err
+			}
+			if err = client.SetBankPublicKey(data); err != nil {
+				return nil, fmt.Errorf("transfer: invalid -bank-key-file:%v", err)
+			}
+		}
+		return client.PayBank(wechat.BankTransfer{
+			OrderNo: *no, BankNo: *bankNo, TrueName: *name, BankCode: *bankCode,
+			Amount: int32(*amount), Desc: *desc,
+		})
+	}
+	if err = required(fs, "openid", "amount", "desc"); err != nil {
+		return nil, err
+	}
+	if *appid == "" {
+		*appid = e.cfg.Wechat.AppID
+	}
+	return client.Transfer(payment.TransferRequest{
+		OrderNo: *no, WXAppID: *appid, WXOpenID: *openid,
+		Amount: int32(*amount), Desc: *desc, ClientIP: *ip,
+		UserName: *name, IsCheckName: *name != "",
+	})
+}
+
+// billResult 账单解析结果
+type billResult struct {
+	Summary payment.BillSummary  `json:"summary"`
+	Records []payment.BillRecord `json:"records"`
+}
+
+func runBill(e *env, args []string) (interface{}, error) {
+	fs, plat := newFlagSet("bill", true)
+	date := fs.String("date", time.Now().AddDate(0, 0, -1).Format("2006-01-02"), "账单日期 yyyy-MM-dd")
+	billType := fs.String("type", string(payment.BillTypeAll), "微信账单类型 ALL/SUCCESS/REFUND")
+	out := fs.String("out", "", "保存原始账单文件而不解析，支付宝为zip压缩包")
+	fs.Parse(args)
+	if err := required(fs, "plat"); err != nil {
+		return nil, err
+	}
+	p, err := parsePlat(*plat)
+	if err != nil {
+		return nil, err
+	}
+	day, err := time.ParseInLocation("2006-01-02", *date, time.Local)
+	if err != nil {
+		return nil, fmt.Errorf("bill: invalid date %q", *date)
+	}
+	var result billResult
+	collect := func(record payment.BillRecord) error {
+		result.Records = append(result.Records, record)
+		return nil
+	}
+	if p == payment.PayPlatAlipay {
+		client, err := e.alipayClient()
+		if err != nil {
+			return nil, err
+		}
+		if *out != "" {
+			body, err := client.DownloadBillFile(context.Background(), alipay.BillTypeTrade, *date)
+			if err != nil {
+				return nil, err
+			}
+			defer body.Close()
+			return saveFile(*out, body)
+		}
+		result.Summary, err = client.DownloadBill(context.Background(), day, collect)
+		return result, err
+	}
+	client, err := e.wechatClient()
+	if err != nil {
+		return nil, err
+	}
+	body, err := client.DownloadBill(context.Background(), day, payment.BillType(*billType), true)
+	if err != nil {
+		return nil, err
+	}
+	defer body.Close()
+	if *out != "" {
+		return saveFile(*out, body)
+	}
+	result.Summary, err = wechat.ParseBill(body, collect)
+	return result, err
+}
+
+func saveFile(name string, r io.Reader) (interface{}, error) {
+	f, err := os.Create(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	size, err := io.Copy(f, r)
+	if err != nil {
+		return nil, err
+	}
+	return map[string]interface{}{"file": name, "size": size}, nil
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+
+	"github.com/shengzhi/payment"
+	"github.com/shengzhi/payment/alipay"
+	"github.com/shengzhi/payment/wechat"
+)
+
+// Config 商户配置文件
+type Config struct {
+	Wechat *WechatConfig `json:"wechat"`
+	Alipay *AlipayConfig `json:"alipay"`
+}
+
+// WechatConfig 微信支付商户配置
+type WechatConfig struct {
+	AppID      string `json:"app_id"`
+	APIKey     string `json:"api_key"` // 商户平台API密钥
+	MerchantID string `json:"mch_id"`
+	CertFile   string `json:"cert_file"` // 商户证书
+	KeyFile    string `json:"key_file"`  // 商户证书私钥
+	CAFile     string `json:"ca_file"`   // 可选，根证书
+	NotifyURL  string `json:"notify_url"`
+}
+
+// AlipayConfig 支付宝商户配置
+type AlipayConfig struct {
+	AppID          string `json:"app_id"`
+	PartnerID      string `json:"partner_id"`
+	PrivateKeyFile string `json:"private_key_file"` // 应用私钥
+	PublicKeyFile  string `json:"public_key_file"`  // 支付宝公钥
+	EncryptKey     string `json:"encrypt_key"`      // 可选，接口内容加密密钥
+	NotifyURL      string `json:"notify_url"`
+	Sandbox        bool   `json:"sandbox"`
+}
+
+func loadConfig(path string) (*Config, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var cfg Config
+	if err = json.Unmarshal(data, &cfg); err != nil {
+		return nil, fmt.Errorf("parse config %s error:%v", path, err)
+	}
+	return &cfg, nil
+}
+
+// wechatClient 创建微信支付客户端，mws 作用于全部HTTP调用
+func (cfg *Config) wechatClient(mws ...payment.HTTPMiddleware) (*wechat.Client, error) {
+	wc := cfg.Wechat
+	if wc == nil {
+		return nil, fmt.Errorf("wechat is not configured")
+	}
+	for _, file := range []string{wc.CertFile, wc.KeyFile} {
+		if _, err := os.Stat(file); err != nil {
+			return nil, fmt.Errorf("wechat cert: %v", err)
+		}
+	}
+	return wechat.NewClient(wc.AppID, wc.APIKey, wc.MerchantID,
+		wechat.WithCertFile(wc.CAFile, wc.CertFile, wc.KeyFile),
+		wechat.WithNotifyURL(wc.NotifyURL),
+		wechat.WithHTTPMiddleware(mws...),
+	), nil
+}
+
+// alipayClient 创建支付宝客户端，mws 作用于全部HTTP调用
+func (cfg *Config) alipayClient(mws ...payment.HTTPMiddleware) (*alipay.AlipayClient, error) {
+	ac := cfg.Alipay
+	if ac == nil {
+		return nil, fmt.Errorf("alipay is not configured")
+	}
+	priKey, err := ioutil.ReadFile(ac.PrivateKeyFile)
+	if err != nil {
+		return nil, fmt.Errorf("alipay private key: %v", err)
+	}
+	pubKey, err := ioutil.ReadFile(ac.PublicKeyFile)
+	if err != nil {
+		return nil, fmt.Errorf("alipay public key: %v", err)
+	}
+	options := []alipay.OptionHandlerFunc{
+		alipay.WithRSAKey(pubKey, priKey),
+		alipay.WithNotifyURL(ac.NotifyURL),
+		alipay.WithHTTPMiddleware(mws...),
+	}
+	if ac.EncryptKey != "" {
+		options = append(options, alipay.WithEncryptKey(ac.EncryptKey))
+	}
+	if ac.Sandbox {
+		options = append(options, alipay.EnableSandBox())
+	}
+	return alipay.NewClient(ac.AppID, ac.PartnerID, options...), nil
+}
@@ -0,0 +1,219 @@
+// payctl 支付运维命令行工具，用于下单测试、订单查询及关闭、退款及退款查询、批量退款、企业付款、对账单下载、签名排查及通知回放
+//
+// 用法:
+//
+//	payctl [-config payctl.json] [-dry-run] <command> [flags]
+//
+// 全部命令以JSON格式输出结果，-dry-run 时输出已签名的请求而不发送任何请求；
+// 付款到银行卡需以加密公钥加密卡号及姓名，-dry-run 时须以 -bank-key-file 指定本地保存的公钥
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/shengzhi/payment"
+	"github.com/shengzhi/payment/alipay"
+	"github.com/shengzhi/payment/wechat"
+)
+
+type command struct {
+	name, usage string
+	run         func(env *env, args []string) (interface{}, error)
+}
+
+var commands = []command{
+	{"order", "下单，微信支付返回预支付交易标识及调起支付参数，支付宝返回已签名的支付参数", runOrder},
+	{"query", "查询订单支付状态", runQuery},
+	{"close", "关闭未支付订单", runClose},
+	{"refund", "退款，-status 查询退款状态", runRefund},
+	{"batch-refund", "按文件批量退款，限制并发及频率，可中断后继续", runBatchRefund},
+	{"transfer", "微信企业付款到零钱或银行卡，-status 查询付款结果", runTransfer},
+	{"bill", "下载交易账单", runBill},
+	{"sign", "计算报文签名，输出签名原串及签名", runSign},
+	{"verify", "验证报文签名并说明不一致的原因，解密微信退款通知 req_info", runVerify},
+	{"replay", "向本地地址回放异步通知，可修改字段并以测试密钥重新签名", runReplay},
+}
+
+// env 命令执行环境
+type env struct {
+	configFile string
+	cfg        *Config
+	dryRun     *dryRun
+}
+
+// config 首次使用时加载商户配置文件
+func (e *env) config() (*Config, error) {
+	if e.cfg == nil {
+		cfg, err := loadConfig(e.configFile)
+		if err != nil {
+			return nil, err
+		}
+		e.cfg = cfg
+	}
+	return e.cfg, nil
+}
+
+func (e *env) wechatClient() (*wechat.Client, error) {
+	cfg, err := e.config()
+	if err != nil {
+		return nil, err
+	}
+	return cfg.wechatClient(e.middlewares()...)
+}
+
+func (e *env) alipayClient() (*alipay.AlipayClient, error) {
+	cfg, err := e.config()
+	if err != nil {
+		return nil, err
+	}
+	return cfg.alipayClient(e.middlewares()...)
+}
+
+// middlewares 客户端HTTP调用中间件
+func (e *env) middlewares() []payment.HTTPMiddleware {
+	if e.dryRun == nil {
+		return nil
+	}
+	return []payment.HTTPMiddleware{e.dryRun.middleware}
+}
+
+func main() {
+	fs := flag.NewFlagSet("payctl", flag.ExitOnError)
+	configFile := fs.String("config", defaultConfigFile(), "商户配置文件，默认读取环境变量 PAYCTL_CONFIG")
+	dry := fs.Bool("dry-run", false, "输出已签名的请求而不发送")
+	fs.Usage = func() {
+		fmt.Fprintln(os.Stderr, "usage: payctl [-config file] [-dry-run] <command> [flags]")
+		fs.PrintDefaults()
+		fmt.Fprintln(os.Stderr, "\ncommands:")
+		for _, cmd := range commands {
+			fmt.Fprintf(os.Stderr, "  %-10s %s\n", cmd.name, cmd.usage)
+		}
+	}
+	fs.Parse(os.Args[1:])
+	if fs.NArg() == 0 {
+		fs.Usage()
+		os.Exit(2)
+	}
+	var cmd *command
+	for i := range commands {
+		if commands[i].name == fs.Arg(0) {
+			cmd = &commands[i]
+		}
+	}
+	if cmd == nil {
+		fmt.Fprintf(os.Stderr, "payctl: unknown command %q\n", fs.Arg(0))
+		fs.Usage()
+		os.Exit(2)
+	}
+	e := &env{configFile: *configFile}
+	if *dry {
+		e.dryRun = new(dryRun)
+	}
+	result, err := cmd.run(e, fs.Args()[1:])
+	if e.dryRun != nil && len(e.dryRun.requests) > 0 {
+		// 请求被拦截导致的错误不再输出
+		result, err = dryRunResult{DryRun: true, Requests: e.dryRun.requests}, nil
+	}
+	if err != nil {
+		fail(err)
+	}
+	printJSON(result)
+}
+
+func defaultConfigFile() string {
+	if file := os.Getenv("PAYCTL_CONFIG"); file != "" {
+		return file
+	}
+	return "payctl.json"
+}
+
+func printJSON(v interface{}) {
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetEscapeHTML(false)
+	enc.SetIndent("", "  ")
+	enc.Encode(v)
+}
+
+func fail(err error) {
+	printJSON(map[string]string{"error": err.Error()})
+	os.Exit(1)
+}
+
+// parsePlat 解析支付平台参数
+func parsePlat(plat string) (payment.PayPlat, error) {
+	switch p := payment.PayPlat(plat); p {
+	case payment.PayPlatWechat, payment.PayPlatAlipay:
+		return p, nil
+	}
+	return "", fmt.Errorf("unknown plat %q, must be wechat or alipay", plat)
+}
+
+// orderProvider 支持订单查询及关闭的支付提供程序，微信及支付宝客户端均已实现
+type orderProvider interface {
+	payment.Provider
+	payment.OrderQuerier
+}
+
+// provider 创建支付平台对应的支付提供程序
+func (e *env) provider(plat payment.PayPlat) (orderProvider, error) {
+	if plat == payment.PayPlatAlipay {
+		return e.alipayClient()
+	}
+	return e.wechatClient()
+}
+
+var errDryRun = errors.New("dry run, request not sent")
+
+// dryRun 拦截并记录已签名的请求
+type dryRun struct {
+	mu       sync.Mutex
+	requests []signedRequest
+}
+
+type signedRequest struct {
+	Method string            `json:"method"`
+	URL    string            `json:"url"`
+	Header map[string]string `json:"header,omitempty"`
+	Body   string            `json:"body,omitempty"`
+	Params map[string]string `json:"params,omitempty"` // 表单请求参数
+}
+
+type dryRunResult struct {
+	DryRun   bool            `json:"dry_run"`
+	Requests []signedRequest `json:"requests"`
+}
+
+func (d *dryRun) middleware(next http.RoundTripper) http.RoundTripper {
+	return payment.RoundTripperFunc(func(req *http.Request) (*http.Response, error) {
+		r := signedRequest{Method: req.Method, URL: req.URL.String(), Header: make(map[string]string)}
+		for k := range req.Header {
+			r.Header[k] = req.Header.Get(k)
+		}
+		if req.Body != nil {
+			data, _ := ioutil.ReadAll(req.Body)
+			req.Body.Close()
+			r.Body = string(bytes.TrimSpace(data))
+		}
+		if strings.HasPrefix(req.Header.Get("Content-Type"), "application/x-www-form-urlencoded") {
+			values, _ := url.ParseQuery(r.Body)
+			r.Params = make(map[string]string, len(values))
+			for k := range values {
+				r.Params[k] = values.Get(k)
+			}
+		}
+		d.mu.Lock()
+		d.requests = append(d.requests, r)
+		d.mu.Unlock()
+		return nil, errDryRun
+	})
+}
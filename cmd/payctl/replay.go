@@ -0,0 +1,101 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/shengzhi/payment"
+	"github.com/shengzhi/payment/paytest"
+)
+
+// fieldsFlag 可重复的 name=value 参数
+type fieldsFlag map[string]string
+
+func (f fieldsFlag) String() string { return fmt.Sprint(map[string]string(f)) }
+
+func (f fieldsFlag) Set(v string) error {
+	i := strings.IndexByte(v, '=')
+	if i <= 0 {
+		return fmt.Errorf("invalid field %q, must be name=value", v)
+	}
+	f[v[:i]] = v[i+1:]
+	return nil
+}
+
+// replayResult 通知回放结果
+type replayResult struct {
+	URL      string `json:"url"`
+	Status   int    `json:"status"`
+	Request  string `json:"request"`
+	Response string `json:"response"`
+}
+
+func runReplay(e *env, args []string) (interface{}, error) {
+	fs, f := newSignFlags("replay", "支付宝测试私钥文件，用于重新签名，仅配置为沙箱环境时默认为配置的 private_key_file")
+	fs.Lookup("key").Usage = "微信测试商户API密钥，用于重新签名，不使用配置的 api_key"
+	target := fs.String("url", "", "接收通知的本地地址")
+	fields := make(fieldsFlag)
+	fs.Var(fields, "set", "修改通知字段 name=value 并重新签名，可重复，值为空时删除字段；微信退款通知以 req_info.name 修改退款信息")
+	resign := fs.Bool("resign", false, "未修改字段时同样以测试密钥重新签名")
+	fs.Parse(args)
+	if err := required(fs, "plat", "url"); err != nil {
+		return nil, err
+	}
+	plat, body, err := f.read()
+	if err != nil {
+		return nil, err
+	}
+	contentType := "text/xml"
+	if plat == payment.PayPlatAlipay {
+		contentType = "application/x-www-form-urlencoded; charset=utf-8"
+	}
+	if len(fields) > 0 || *resign {
+		if body, err = edit(e, f, plat, body, fields); err != nil {
+			return nil, err
+		}
+	}
+	client := &http.Client{
+		Transport: payment.ChainHTTP(http.DefaultTransport, e.middlewares()...),
+		Timeout:   30 * time.Second,
+	}
+	res, err := client.Post(*target, contentType, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	reply, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return nil, err
+	}
+	return replayResult{URL: *target, Status: res.StatusCode, Request: string(body), Response: string(reply)}, nil
+}
+
+// edit 修改通知字段并以测试密钥重新签名；测试密钥须以 -key、-key-file 显式指定，
+// 支付宝配置为沙箱环境时可使用配置的私钥，以免以生产密钥签名伪造的通知
+func edit(e *env, f *signFlags, plat payment.PayPlat, body []byte, fields map[string]string) ([]byte, error) {
+	if plat == payment.PayPlatWechat {
+		if *f.key == "" {
+			return nil, fmt.Errorf("-key is required to re-sign, the configured api_key is never used")
+		}
+		return paytest.Wechat{Secret: *f.key}.Edit(body, fields)
+	}
+	if *f.keyFile == "" {
+		cfg, err := e.config()
+		if err != nil {
+			return nil, fmt.Errorf("-key-file is required to re-sign: %v", err)
+		}
+		if cfg.Alipay == nil || !cfg.Alipay.Sandbox {
+			return nil, fmt.Errorf("-key-file is required to re-sign unless alipay is configured as sandbox")
+		}
+	}
+	priKey, err := f.alipayKey(e, true)
+	if err != nil {
+		return nil, err
+	}
+	form, err := paytest.Alipay{PrivateKey: priKey}.Edit(string(body), fields)
+	return []byte(form), err
+}
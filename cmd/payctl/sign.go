@@ -0,0 +1,353 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/md5"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/shengzhi/payment"
+	"github.com/shengzhi/payment/alipay"
+	"github.com/shengzhi/payment/wechat"
+)
+
+// signReport 签名计算及验签结果，签名原串中的商户API密钥以 *** 代替
+type signReport struct {
+	Plat            payment.PayPlat   `json:"plat"`
+	SignType        string            `json:"sign_type"`
+	CanonicalString string            `json:"canonical_string,omitempty"`
+	Sign            string            `json:"sign,omitempty"`
+	ExpectedSign    string            `json:"expected_sign,omitempty"`
+	Valid           *bool             `json:"valid,omitempty"`
+	Problems        []string          `json:"problems,omitempty"`
+	RefundInfo      map[string]string `json:"refund_info,omitempty"` // 解密后的微信退款通知 req_info
+}
+
+func (r *signReport) problem(format string, v ...interface{}) {
+	r.Problems = append(r.Problems, fmt.Sprintf(format, v...))
+}
+
+// signFlags sign 及 verify 命令的公共参数
+type signFlags struct {
+	plat, body, key, keyFile *string
+}
+
+func newSignFlags(name, keyFileUsage string) (*flag.FlagSet, *signFlags) {
+	fs, plat := newFlagSet(name, true)
+	f := &signFlags{plat: plat}
+	f.body = fs.String("body", "-", "原始报文文件，微信为XML，支付宝为表单，- 表示标准输入")
+	f.key = fs.String("key", "", "微信商户API密钥，默认为配置的 api_key")
+	f.keyFile = fs.String("key-file", "", keyFileUsage)
+	return fs, f
+}
+
+// read 读取支付平台及原始报文
+func (f *signFlags) read() (payment.PayPlat, []byte, error) {
+	p, err := parsePlat(*f.plat)
+	if err != nil {
+		return "", nil, err
+	}
+	var body []byte
+	if *f.body == "-" {
+		body, err = ioutil.ReadAll(os.Stdin)
+	} else {
+		body, err = ioutil.ReadFile(*f.body)
+	}
+	return p, bytes.TrimSpace(body), err
+}
+
+// wechatKey 商户API密钥，未指定时读取配置文件
+func (f *signFlags) wechatKey(e *env) (string, error) {
+	if *f.key != "" {
+		return *f.key, nil
+	}
+	cfg, err := e.config()
+	if err != nil {
+		return "", fmt.Errorf("-key is required: %v", err)
+	}
+	if cfg.Wechat == nil {
+		return "", fmt.Errorf("-key is required: wechat is not configured")
+	}
+	return cfg.Wechat.APIKey, nil
+}
+
+// alipayKey 读取PEM格式的密钥文件，未指定时读取配置文件中的 private_key_file 或 public_key_file
+func (f *signFlags) alipayKey(e *env, private bool) ([]byte, error) {
+	file := *f.keyFile
+	if file == "" {
+		cfg, err := e.config()
+		if err != nil {
+			return nil, fmt.Errorf("-key-file is required: %v", err)
+		}
+		if cfg.Alipay == nil {
+			return nil, fmt.Errorf("-key-file is required: alipay is not configured")
+		}
+		file = cfg.Alipay.PublicKeyFile
+		if private {
+			file = cfg.Alipay.PrivateKeyFile
+		}
+	}
+	return ioutil.ReadFile(file)
+}
+
+// maskKey 签名原串末尾的 key=secret 以 key=*** 代替
+func maskKey(canonical, secret string) string {
+	return strings.TrimSuffix(canonical, "key="+secret) + "key=***"
+}
+
+func runSign(e *env, args []string) (interface{}, error) {
+	fs, f := newSignFlags("sign", "支付宝应用私钥文件，默认为配置的 private_key_file")
+	signType := fs.String("sign-type", "", "微信签名类型 MD5/HMAC-SHA256，默认为报文中的 sign_type 或 MD5")
+	notify := fs.Bool("notify", false, "支付宝按异步通知规则计算，sign_type 不参与签名")
+	fs.Parse(args)
+	if err := required(fs, "plat"); err != nil {
+		return nil, err
+	}
+	plat, body, err := f.read()
+	if err != nil {
+		return nil, err
+	}
+	report := &signReport{Plat: plat}
+	if plat == payment.PayPlatWechat {
+		key, err := f.wechatKey(e)
+		if err != nil {
+			return nil, err
+		}
+		params, err := wechat.ParseParams(body)
+		if err != nil {
+			return nil, fmt.Errorf("parse xml error:%v", err)
+		}
+		report.SignType = wechatSignType(*signType, params)
+		report.CanonicalString = maskKey(wechat.SignString(params, key), key)
+		report.Sign = wechat.Sign(params, key, report.SignType)
+		return report, nil
+	}
+	priKey, err := f.alipayKey(e, true)
+	if err != nil {
+		return nil, err
+	}
+	values, err := url.ParseQuery(string(body))
+	if err != nil {
+		return nil, fmt.Errorf("parse form error:%v", err)
+	}
+	values.Del("sign")
+	if *notify {
+		values.Del("sign_type")
+	}
+	plainText := alipay.PlainText(values)
+	report.SignType = string(alipay.SignTypeRSA2)
+	report.CanonicalString = string(plainText)
+	if report.Sign, err = alipay.SignRSA2(plainText, priKey); err != nil {
+		return nil, err
+	}
+	return report, nil
+}
+
+func runVerify(e *env, args []string) (interface{}, error) {
+	fs, f := newSignFlags("verify", "支付宝公钥文件，默认为配置的 public_key_file")
+	fs.Parse(args)
+	if err := required(fs, "plat"); err != nil {
+		return nil, err
+	}
+	plat, body, err := f.read()
+	if err != nil {
+		return nil, err
+	}
+	report := &signReport{Plat: plat}
+	if !utf8.Valid(body) {
+		report.problem("报文不是有效的UTF-8编码，签名基于UTF-8编码的原始报文计算，请确认读取报文时未做编码转换")
+	}
+	if plat == payment.PayPlatWechat {
+		key, err := f.wechatKey(e)
+		if err != nil {
+			return nil, err
+		}
+		params, err := wechat.ParseParams(body)
+		if err != nil {
+			return nil, fmt.Errorf("parse xml error:%v", err)
+		}
+		verifyWechat(report, params, key)
+		return report, nil
+	}
+	pubKey, err := f.alipayKey(e, false)
+	if err != nil {
+		return nil, err
+	}
+	values, err := url.ParseQuery(string(body))
+	if err != nil {
+		return nil, fmt.Errorf("parse form error:%v", err)
+	}
+	verifyAlipay(report, values, pubKey)
+	return report, nil
+}
+
+func wechatSignType(signType string, params map[string]string) string {
+	if signType == "" {
+		signType = params["sign_type"]
+	}
+	if signType == "" {
+		signType = wechat.SignTypeMD5
+	}
+	return signType
+}
+
+// verifyWechat 验证微信报文签名，退款通知不含签名，以能否解密 req_info 判断商户API密钥是否正确
+func verifyWechat(report *signReport, params map[string]string, key string) {
+	valid := false
+	report.Valid = &valid
+	report.SignType = wechatSignType("", params)
+	report.CanonicalString = maskKey(wechat.SignString(params, key), key)
+	if len(key) != 32 {
+		report.problem("商户API密钥长度为%d，应为32位", len(key))
+	}
+	if reqInfo, has := params["req_info"]; has {
+		report.SignType, report.CanonicalString = "AES-256-ECB", ""
+		plainText, err := wechat.DecryptRefundInfo(reqInfo, key)
+		if err != nil {
+			report.problem("req_info 解密失败(%v)：密钥为商户API密钥的MD5值，请确认密钥正确且 req_info 未被截断或转义", err)
+			return
+		}
+		if report.RefundInfo, err = wechat.ParseParams(plainText); err != nil {
+			report.problem("req_info 解密后不是有效的XML(%v)，商户API密钥可能错误", err)
+			return
+		}
+		valid = true
+		return
+	}
+	report.Sign = params["sign"]
+	if report.Sign == "" {
+		report.problem("报文缺少 sign 参数")
+		return
+	}
+	report.ExpectedSign = wechat.Sign(params, key, report.SignType)
+	if valid = report.Sign == report.ExpectedSign; valid {
+		return
+	}
+	if strings.EqualFold(report.Sign, report.ExpectedSign) {
+		report.problem("签名大小写不一致，微信签名须转换为大写")
+		return
+	}
+	other := wechat.SignTypeHMACSHA256
+	if report.SignType == wechat.SignTypeHMACSHA256 {
+		other = wechat.SignTypeMD5
+	}
+	if wechat.Sign(params, key, other) == report.Sign {
+		report.problem("签名实际使用 %s 计算，与 sign_type(%s) 不一致", other, report.SignType)
+		return
+	}
+	if trimmed := strings.TrimSpace(key); trimmed != key && wechat.Sign(params, trimmed, report.SignType) == report.Sign {
+		report.problem("商户API密钥包含首尾空白字符")
+		return
+	}
+	if signWithEmpty(params, key, report.SignType) == report.Sign {
+		report.problem("签名原串包含了空值参数，微信签名时空值参数不参与签名")
+		return
+	}
+	report.problem("签名不一致：商户API密钥错误，或报文在签名后被修改(如字段被增删、XML转义或空白被改写)")
+}
+
+// signWithEmpty 空值参数参与签名时的签名，用于识别签名方未忽略空值参数的错误
+func signWithEmpty(params map[string]string, key, signType string) string {
+	keys := make([]string, 0, len(params))
+	for k := range params {
+		if k != "sign" {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+	var buf bytes.Buffer
+	for _, k := range keys {
+		fmt.Fprintf(&buf, "%s=%s&", k, params[k])
+	}
+	buf.WriteString("key=" + key)
+	if signType == wechat.SignTypeHMACSHA256 {
+		m := hmac.New(sha256.New, []byte(key))
+		m.Write(buf.Bytes())
+		return strings.ToUpper(hex.EncodeToString(m.Sum(nil)))
+	}
+	sum := md5.Sum(buf.Bytes())
+	return strings.ToUpper(hex.EncodeToString(sum[:]))
+}
+
+// verifyAlipay 验证支付宝异步通知签名，sign 及 sign_type 不参与验签
+func verifyAlipay(report *signReport, values url.Values, pubKey []byte) {
+	valid := false
+	report.Valid = &valid
+	report.Sign = values.Get("sign")
+	report.SignType = values.Get("sign_type")
+	params := url.Values{}
+	for k, v := range values {
+		if k != "sign" && k != "sign_type" {
+			params[k] = v
+		}
+	}
+	plainText := alipay.PlainText(params)
+	report.CanonicalString = string(plainText)
+	if report.Sign == "" {
+		report.problem("报文缺少 sign 参数")
+		return
+	}
+	if report.SignType != string(alipay.SignTypeRSA2) {
+		report.problem("sign_type 为 %q，仅支持 RSA2", report.SignType)
+	}
+	err := alipay.VerifyRSA2(plainText, report.Sign, pubKey)
+	if valid = err == nil; valid {
+		return
+	}
+	if strings.Contains(report.Sign, " ") && alipay.VerifyRSA2(plainText, strings.Replace(report.Sign, " ", "+", -1), pubKey) == nil {
+		report.problem("签名中的 '+' 被解码为空格，请以 application/x-www-form-urlencoded 格式读取原始报文，不要对报文重复解码或未编码拼接")
+		return
+	}
+	if err != rsa.ErrVerification {
+		report.problem("验签失败(%v)：支付宝公钥应为PEM格式，签名应为Base64编码", err)
+		return
+	}
+	if report.SignType != "" {
+		withType := copyValues(params)
+		withType.Set("sign_type", report.SignType)
+		if alipay.VerifyRSA2(alipay.PlainText(withType), report.Sign, pubKey) == nil {
+			report.problem("签名原串包含 sign_type：该报文按同步请求规则签名，异步通知验签时 sign 及 sign_type 均不参与验签")
+			return
+		}
+	}
+	if decoded, changed := unescapeValues(params); changed && alipay.VerifyRSA2(alipay.PlainText(decoded), report.Sign, pubKey) == nil {
+		report.problem("报文被重复URL编码，参数值需再解码一次后验签")
+		return
+	}
+	if charset := values.Get("charset"); charset != "" && !strings.EqualFold(charset, "utf-8") {
+		report.problem("charset 为 %s，需以该编码解析报文后再验签", charset)
+	}
+	report.problem("验签失败(%v)：请确认使用支付宝公钥而非应用公钥，且报文在签名后未被修改", err)
+}
+
+func copyValues(values url.Values) url.Values {
+	c := make(url.Values, len(values))
+	for k, v := range values {
+		c[k] = append([]string(nil), v...)
+	}
+	return c
+}
+
+// unescapeValues 对参数值再做一次URL解码，返回是否有参数值发生变化
+func unescapeValues(values url.Values) (url.Values, bool) {
+	decoded := copyValues(values)
+	changed := false
+	for k := range decoded {
+		v := decoded.Get(k)
+		if u, err := url.QueryUnescape(v); err == nil && u != v {
+			decoded.Set(k, u)
+			changed = true
+		}
+	}
+	return decoded, changed
+}
@@ -0,0 +1,191 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/shengzhi/payment/alipay"
+	"github.com/shengzhi/payment/wechat"
+)
+
+const testSecret = "0123456789abcdef0123456789abcdef"
+
+// hasProblem 是否包含期望的诊断，want 为空时要求无诊断
+func hasProblem(r *signReport, want string) bool {
+	if want == "" {
+		return len(r.Problems) == 0
+	}
+	for _, p := range r.Problems {
+		if strings.Contains(p, want) {
+			return true
+		}
+	}
+	return false
+}
+
+func TestVerifyWechat(t *testing.T) {
+	params := func(fields map[string]string) map[string]string {
+		p := map[string]string{"appid": "wx2421b1c4370ec43b", "mch_id": "1900000109", "nonce_str": "5K8264ILTKCH16CQ", "out_trade_no": "T1", "total_fee": "100"}
+		for k, v := range fields {
+			p[k] = v
+		}
+		return p
+	}
+	signed := func(p map[string]string, key, signType string) map[string]string {
+		p["sign"] = wechat.Sign(p, key, signType)
+		return p
+	}
+	lower := signed(params(nil), testSecret, wechat.SignTypeMD5)
+	lower["sign"] = strings.ToLower(lower["sign"])
+	withEmpty := params(map[string]string{"attach": ""})
+	withEmpty["sign"] = signWithEmpty(withEmpty, testSecret, wechat.SignTypeMD5)
+	tests := []struct {
+		name   string
+		params map[string]string
+		key    string
+		want   string // 期望的诊断，为空表示验签通过
+	}{
+		{name: "valid", params: signed(params(nil), testSecret, wechat.SignTypeMD5), key: testSecret},
+		{name: "case folding", params: lower, key: testSecret, want: "签名大小写不一致"},
+		{name: "sign_type mismatch", params: signed(params(map[string]string{"sign_type": wechat.SignTypeHMACSHA256}), testSecret, wechat.SignTypeMD5), key: testSecret, want: "与 sign_type(HMAC-SHA256) 不一致"},
+		{name: "whitespace in key", params: signed(params(nil), testSecret, wechat.SignTypeMD5), key: testSecret + "\n", want: "首尾空白字符"},
+		{name: "empty value signed", params: withEmpty, key: testSecret, want: "包含了空值参数"},
+		{name: "wrong key", params: signed(params(nil), strings.Repeat("x", 32), wechat.SignTypeMD5), key: testSecret, want: "商户API密钥错误"},
+		{name: "missing sign", params: params(nil), key: testSecret, want: "缺少 sign"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			report := &signReport{}
+			verifyWechat(report, tt.params, tt.key)
+			if *report.Valid != (tt.want == "") {
+				t.Fatalf("got valid %v, problems %v", *report.Valid, report.Problems)
+			}
+			if !hasProblem(report, tt.want) {
+				t.Fatalf("got problems %v, want %q", report.Problems, tt.want)
+			}
+		})
+	}
+
+	// 退款通知以能否解密 req_info 判断密钥是否正确
+	reqInfo, err := wechat.EncryptRefundInfo([]byte("<root><out_refund_no>T1-R1</out_refund_no></root>"), testSecret)
+	if err != nil {
+		t.Fatal(err)
+	}
+	report := &signReport{}
+	verifyWechat(report, map[string]string{"return_code": "SUCCESS", "req_info": reqInfo}, testSecret)
+	if !*report.Valid || report.RefundInfo["out_refund_no"] != "T1-R1" {
+		t.Fatalf("got report %+v", report)
+	}
+	report = &signReport{}
+	verifyWechat(report, map[string]string{"return_code": "SUCCESS", "req_info": reqInfo}, strings.Repeat("x", 32))
+	if *report.Valid || !hasProblem(report, "req_info 解密失败") {
+		t.Fatalf("got report %+v", report)
+	}
+}
+
+func TestVerifyAlipay(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	priKey := pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)})
+	pub, err := x509.MarshalPKIXPublicKey(&key.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pubKey := pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: pub})
+	notify := func(fields map[string]string) url.Values {
+		values := url.Values{
+			"app_id": {"2021000000000000"}, "notify_id": {"N1"}, "out_trade_no": {"T1"},
+			"subject": {"测试 商品"}, "trade_status": {"TRADE_SUCCESS"}, "charset": {"utf-8"},
+		}
+		for k, v := range fields {
+			values.Set(k, v)
+		}
+		return values
+	}
+	// signed 按异步通知规则签名并输出 sign_type，withType 为 true 时 sign_type 参与签名
+	signed := func(values url.Values, signType string, withType bool) url.Values {
+		plain := copyValues(values)
+		if withType {
+			plain.Set("sign_type", signType)
+		}
+		sign, err := alipay.SignRSA2(alipay.PlainText(plain), priKey)
+		if err != nil {
+			t.Fatal(err)
+		}
+		values.Set("sign", sign)
+		if signType != "" {
+			values.Set("sign_type", signType)
+		}
+		return values
+	}
+	// 签名确定，更换 notify_id 直至签名中包含 '+'
+	var plusSpace url.Values
+	for i := 0; plusSpace == nil; i++ {
+		values := signed(notify(map[string]string{"notify_id": "N" + strings.Repeat("1", i)}), "RSA2", false)
+		if sign := values.Get("sign"); strings.Contains(sign, "+") {
+			values.Set("sign", strings.Replace(sign, "+", " ", -1))
+			plusSpace = values
+		}
+	}
+	doubleEncoded := signed(notify(nil), "RSA2", false)
+	doubleEncoded.Set("subject", url.QueryEscape("测试 商品"))
+	gbk := signed(notify(map[string]string{"charset": "GBK"}), "RSA2", false)
+	gbk.Set("subject", "乱码")
+	tampered := signed(notify(nil), "RSA2", false)
+	tampered.Set("out_trade_no", "T2")
+	badSign := signed(notify(nil), "RSA2", false)
+	badSign.Set("sign", "not base64!")
+	tests := []struct {
+		name   string
+		values url.Values
+		want   string // 期望的诊断，为空表示验签通过
+	}{
+		{name: "valid", values: signed(notify(nil), "RSA2", false)},
+		{name: "plus decoded as space", values: plusSpace, want: "'+' 被解码为空格"},
+		{name: "sign_type signed", values: signed(notify(nil), "RSA2", true), want: "签名原串包含 sign_type"},
+		{name: "double encoding", values: doubleEncoded, want: "重复URL编码"},
+		{name: "charset", values: gbk, want: "charset 为 GBK"},
+		{name: "tampered", values: tampered, want: "请确认使用支付宝公钥"},
+		{name: "invalid sign", values: badSign, want: "签名应为Base64编码"},
+		{name: "missing sign", values: notify(nil), want: "缺少 sign"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			report := &signReport{}
+			verifyAlipay(report, tt.values, pubKey)
+			if *report.Valid != (tt.want == "") {
+				t.Fatalf("got valid %v, problems %v", *report.Valid, report.Problems)
+			}
+			if !hasProblem(report, tt.want) {
+				t.Fatalf("got problems %v, want %q", report.Problems, tt.want)
+			}
+		})
+	}
+
+	// 原始报文不是UTF-8编码
+	dir := t.TempDir()
+	keyFile, bodyFile := filepath.Join(dir, "alipay_public_key.pem"), filepath.Join(dir, "notify.txt")
+	body := signed(notify(nil), "RSA2", false).Encode() + "&body=\xb2\xe2"
+	if err = os.WriteFile(keyFile, pubKey, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err = os.WriteFile(bodyFile, []byte(body), 0600); err != nil {
+		t.Fatal(err)
+	}
+	result, err := runVerify(&env{}, []string{"-plat", "alipay", "-body", bodyFile, "-key-file", keyFile})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report := result.(*signReport); *report.Valid || !hasProblem(report, "不是有效的UTF-8编码") {
+		t.Fatalf("got report %+v", report)
+	}
+}
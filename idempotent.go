@@ -0,0 +1,196 @@
+// 异步通知幂等处理
+
+package payment
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	// ErrEventDone 事件已处理成功
+	ErrEventDone = errors.New("事件已处理")
+	// ErrEventProcessing 事件正在处理中
+	ErrEventProcessing = errors.New("事件正在处理中")
+)
+
+// processingTimeout 处理中锁定的超时时长，超时后允许重新处理
+const processingTimeout = 5 * time.Minute
+
+// IdempotencyStore 幂等存储
+type IdempotencyStore interface {
+	// Acquire 锁定事件，事件已处理成功返回 ErrEventDone，正在处理返回 ErrEventProcessing
+	Acquire(key string) error
+	// Done 标记事件处理成功
+	Done(key string) error
+	// Release 事件处理失败，释放锁定以便通知重发时重新处理
+	Release(key string) error
+}
+
+// IdempotentNotify 包装支付通知处理函数，同一事件(平台+交易号，支付宝为 notify_id)至多成功处理一次，
+// 已处理的事件直接应答成功，正在处理的事件应答失败以等待平台重发
+func IdempotentNotify(store IdempotencyStore, fn NotifyHandleFunc) NotifyHandleFunc {
+	return func(result *NotifyResult) error {
+		key := fmt.Sprintf("%s:pay:%s", result.Plat, result.TransactionID)
+		if result.Alipay.NotifyID != "" {
+			key = fmt.Sprintf("%s:notify:%s", result.Plat, result.Alipay.NotifyID)
+		}
+		return idempotent(store, key, func() error { return fn(result) })
+	}
+}
+
+// IdempotentRefundNotify 包装退款通知处理函数，同一退款事件至多成功处理一次
+func IdempotentRefundNotify(store IdempotencyStore, fn RefundNotifyHandleFunc) RefundNotifyHandleFunc {
+	return func(result RefundNotifyResult) error {
+		key := fmt.Sprintf("%s:refund:%s:%s:%t", result.Plat, result.RefundID, result.MerchantRefundNo, result.IsSuccess)
+		if !result.IsSuccess && result.Status != "" {
+			// 退款异常与退款关闭为不同的退款事件
+			key += ":" + string(result.Status)
+		}
+		return idempotent(store, key, func() error { return fn(result) })
+	}
+}
+
+func idempotent(store IdempotencyStore, key string, fn func() error) error {
+	switch err := store.Acquire(key); err {
+	case nil:
+	case ErrEventDone:
+		return nil
+	default:
+		return err
+	}
+	if err := fn(); err != nil {
+		store.Release(key)
+		return err
+	}
+	// 事件已处理成功，标记失败时重试并记录日志，仍应答成功以免平台重发导致重复处理
+	err := DefaultRetryPolicy.Do(context.Background(), func(error) bool { return true }, func() error { return store.Done(key) })
+	if err != nil {
+		log.Printf("payment: mark event %s done error:%v", key, err)
+	}
+	return nil
+}
+
+type idempotencyEntry struct {
+	done   bool
+	expire time.Time
+}
+
+// MemoryIdempotencyStore 内存幂等存储，处理成功的事件保留 ttl 时长
+type MemoryIdempotencyStore struct {
+	mu        sync.Mutex
+	ttl       time.Duration
+	entries   map[string]idempotencyEntry
+	lastEvict time.Time
+}
+
+// NewMemoryIdempotencyStore 创建内存幂等存储
+func NewMemoryIdempotencyStore(ttl time.Duration) *MemoryIdempotencyStore {
+	return &MemoryIdempotencyStore{ttl: ttl, entries: make(map[string]idempotencyEntry)}
+}
+
+// Acquire 锁定事件
+func (s *MemoryIdempotencyStore) Acquire(key string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := time.Now()
+	if e, has := s.entries[key]; has && now.Before(e.expire) {
+		if e.done {
+			return ErrEventDone
+		}
+		return ErrEventProcessing
+	}
+	s.entries[key] = idempotencyEntry{expire: now.Add(processingTimeout)}
+	s.evict(now)
+	return nil
+}
+
+// Done 标记事件处理成功
+func (s *MemoryIdempotencyStore) Done(key string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.entries[key] = idempotencyEntry{done: true, expire: time.Now().Add(s.ttl)}
+	return nil
+}
+
+// Release 释放事件锁定
+func (s *MemoryIdempotencyStore) Release(key string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if e, has := s.entries[key]; has && !e.done {
+		delete(s.entries, key)
+	}
+	return nil
+}
+
+// evict 清理过期记录，每分钟至多清理一次
+func (s *MemoryIdempotencyStore) evict(now time.Time) {
+	if now.Sub(s.lastEvict) < time.Minute {
+		return
+	}
+	s.lastEvict = now
+	for k, e := range s.entries {
+		if !now.Before(e.expire) {
+			delete(s.entries, k)
+		}
+	}
+}
+
+// FileIdempotencyStore 文件幂等存储，处理成功的事件追加写入文件，重启后重新加载；
+// 处理中锁定仅在当前进程内有效
+type FileIdempotencyStore struct {
+	*MemoryIdempotencyStore
+	file *os.File
+}
+
+// NewFileIdempotencyStore 创建文件幂等存储，加载文件中未过期的事件
+func NewFileIdempotencyStore(path string, ttl time.Duration) (*FileIdempotencyStore, error) {
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_RDWR|os.O_APPEND, 0600)
+	if err != nil {
+		return nil, err
+	}
+	s := &FileIdempotencyStore{MemoryIdempotencyStore: NewMemoryIdempotencyStore(ttl), file: file}
+	now := time.Now()
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		fields := strings.SplitN(scanner.Text(), "\t", 2)
+		if len(fields) != 2 {
+			continue
+		}
+		sec, err := strconv.ParseInt(fields[0], 10, 64)
+		if err != nil {
+			continue
+		}
+		if expire := time.Unix(sec, 0).Add(ttl); now.Before(expire) {
+			s.entries[fields[1]] = idempotencyEntry{done: true, expire: expire}
+		}
+	}
+	if err = scanner.Err(); err != nil {
+		file.Close()
+		return nil, err
+	}
+	return s, nil
+}
+
+// Done 标记事件处理成功并写入文件，写入失败时事件仍在当前进程内标记为已处理
+func (s *FileIdempotencyStore) Done(key string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := time.Now()
+	s.entries[key] = idempotencyEntry{done: true, expire: now.Add(s.ttl)}
+	if _, err := fmt.Fprintf(s.file, "%d\t%s\n", now.Unix(), key); err != nil {
+		return err
+	}
+	return s.file.Sync()
+}
+
+// Close 关闭文件
+func (s *FileIdempotencyStore) Close() error { return s.file.Close() }
@@ -0,0 +1,143 @@
+package payment
+
+import (
+	"errors"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// failingDoneStore 标记处理成功时返回错误的幂等存储
+type failingDoneStore struct {
+	*MemoryIdempotencyStore
+	failures int
+	calls    int
+}
+
+func (s *failingDoneStore) Done(key string) error {
+	s.calls++
+	if s.calls <= s.failures {
+		return errors.New("store unavailable")
+	}
+	return s.MemoryIdempotencyStore.Done(key)
+}
+
+func TestIdempotentNotify(t *testing.T) {
+	errHandle := errors.New("handle error")
+	tests := []struct {
+		name     string
+		store    func() IdempotencyStore
+		results  []error // 每次处理函数的返回值
+		want     []error // 每次通知的返回值
+		executed int
+	}{
+		{
+			name:     "handled once",
+			store:    func() IdempotencyStore { return NewMemoryIdempotencyStore(time.Hour) },
+			results:  []error{nil, nil},
+			want:     []error{nil, nil},
+			executed: 1,
+		},
+		{
+			name:     "retry after handler error",
+			store:    func() IdempotencyStore { return NewMemoryIdempotencyStore(time.Hour) },
+			results:  []error{errHandle, nil, nil},
+			want:     []error{errHandle, nil, nil},
+			executed: 2,
+		},
+		{
+			name: "done recovers after retry",
+			store: func() IdempotencyStore {
+				return &failingDoneStore{MemoryIdempotencyStore: NewMemoryIdempotencyStore(time.Hour), failures: 1}
+			},
+			results:  []error{nil, nil},
+			want:     []error{nil, nil},
+			executed: 1,
+		},
+		{
+			name: "done keeps failing",
+			store: func() IdempotencyStore {
+				return &failingDoneStore{MemoryIdempotencyStore: NewMemoryIdempotencyStore(time.Hour), failures: 100}
+			},
+			results: []error{nil, nil},
+			// 首次处理成功后仍应答成功，锁定未释放，重发的通知在锁定期内应答处理中
+			want:     []error{nil, ErrEventProcessing},
+			executed: 1,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			executed := 0
+			handler := IdempotentNotify(tt.store(), func(*NotifyResult) error {
+				err := tt.results[executed]
+				executed++
+				return err
+			})
+			for i, want := range tt.want {
+				if err := handler(&NotifyResult{Plat: PayPlatWechat, TransactionID: "4200001"}); err != want {
+					t.Fatalf("notify %d: got %v, want %v", i, err, want)
+				}
+			}
+			if executed != tt.executed {
+				t.Fatalf("handler executed %d times, want %d", executed, tt.executed)
+			}
+		})
+	}
+}
+
+func TestIdempotentRefundNotifyKeys(t *testing.T) {
+	store := NewMemoryIdempotencyStore(time.Hour)
+	var handled []RefundStatus
+	handler := IdempotentRefundNotify(store, func(r RefundNotifyResult) error {
+		handled = append(handled, r.Status)
+		return nil
+	})
+	results := []RefundNotifyResult{
+		{Plat: PayPlatWechat, MerchantRefundNo: "T1-R1", Status: RefundStatusChange},
+		{Plat: PayPlatWechat, MerchantRefundNo: "T1-R1", Status: RefundStatusChange},
+		{Plat: PayPlatWechat, MerchantRefundNo: "T1-R1", Status: RefundStatusClosed},
+		{Plat: PayPlatWechat, MerchantRefundNo: "T1-R1", Status: RefundStatusSuccess, IsSuccess: true},
+		{Plat: PayPlatWechat, MerchantRefundNo: "T1-R2", Status: RefundStatusSuccess, IsSuccess: true},
+	}
+	for _, r := range results {
+		if err := handler(r); err != nil {
+			t.Fatal(err)
+		}
+	}
+	want := []RefundStatus{RefundStatusChange, RefundStatusClosed, RefundStatusSuccess, RefundStatusSuccess}
+	if !reflect.DeepEqual(handled, want) {
+		t.Fatalf("handled %v, want %v", handled, want)
+	}
+}
+
+func TestFileIdempotencyStore(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "events")
+	store, err := NewFileIdempotencyStore(path, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = store.Acquire("k1"); err != nil {
+		t.Fatal(err)
+	}
+	if err = store.Done("k1"); err != nil {
+		t.Fatal(err)
+	}
+	if err = store.Acquire("k2"); err != nil {
+		t.Fatal(err)
+	}
+	store.Close()
+
+	// 重新加载后已处理的事件仍为已处理，处理中的锁定不保留
+	store, err = NewFileIdempotencyStore(path, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+	if err = store.Acquire("k1"); err != ErrEventDone {
+		t.Fatalf("got %v, want ErrEventDone", err)
+	}
+	if err = store.Acquire("k2"); err != nil {
+		t.Fatalf("got %v, want nil", err)
+	}
+}
@@ -0,0 +1,241 @@
+// 中间件
+
+package payment
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Middleware 支付提供程序中间件
+type Middleware func(next Provider) Provider
+
+// Chain 依次以中间件包装 provider，第一个中间件位于最外层
+func Chain(provider Provider, mws ...Middleware) Provider {
+	for i := len(mws) - 1; i >= 0; i-- {
+		provider = mws[i](provider)
+	}
+	return provider
+}
+
+// Interceptor 拦截 Provider 方法调用，op 为方法名，call 执行被拦截的调用并返回其错误
+type Interceptor func(op string, call func() error) error
+
+// Intercept 创建以 fn 拦截全部 Provider 方法的中间件，同时转发 ContextProvider、OrderQuerier、
+// OrderRetrier 及 RefundQuerier 的方法，被包装的支付提供实现不支持时返回错误
+func Intercept(fn Interceptor) Middleware {
+	return func(next Provider) Provider {
+		return &interceptedProvider{next: next, fn: fn}
+	}
+}
+
+type interceptedProvider struct {
+	next Provider
+	fn   Interceptor
+}
+
+func (p *interceptedProvider) Order(r *OrderRequest) (resp *OrderResponse, err error) {
+	err = p.fn("Order", func() error {
+		resp, err = p.next.Order(r)
+		return err
+	})
+	return
+}
+
+func (p *interceptedProvider) NotifyCallback(r io.Reader, f NotifyHandleFunc) (reply interface{}) {
+	p.fn("NotifyCallback", func() error {
+		reply = p.next.NotifyCallback(r, f)
+		return nil
+	})
+	return
+}
+
+func (p *interceptedProvider) Refund(r RefundRequest) (resp RefundResponse, err error) {
+	err = p.fn("Refund", func() error {
+		resp, err = p.next.Refund(r)
+		return err
+	})
+	return
+}
+
+func (p *interceptedProvider) RefundCallback(r io.Reader, f RefundNotifyHandleFunc) (reply interface{}) {
+	p.fn("RefundCallback", func() error {
+		reply = p.next.RefundCallback(r, f)
+		return nil
+	})
+	return
+}
+
+func (p *interceptedProvider) Retry(source PaySource, prepayid string) (resp *OrderResponse, err error) {
+	err = p.fn("Retry", func() error {
+		resp, err = p.next.Retry(source, prepayid)
+		return err
+	})
+	return
+}
+
+func (p *interceptedProvider) Query(merchantOrderNo string) (result *QueryResult, err error) {
+	err = p.fn("Query", func() error {
+		result, err = queryContext(context.Background(), p.next, merchantOrderNo)
+		return err
+	})
+	return
+}
+
+func (p *interceptedProvider) Close(merchantOrderNo string) error {
+	return p.fn("Close", func() error { return closeContext(context.Background(), p.next, merchantOrderNo) })
+}
+
+func (p *interceptedProvider) RefundContext(ctx context.Context, r RefundRequest) (resp RefundResponse, err error) {
+	err = p.fn("Refund", func() error {
+		resp, err = refundContext(ctx, p.next, r)
+		return err
+	})
+	return
+}
+
+func (p *interceptedProvider) QueryContext(ctx context.Context, merchantOrderNo string) (result *QueryResult, err error) {
+	err = p.fn("Query", func() error {
+		result, err = queryContext(ctx, p.next, merchantOrderNo)
+		return err
+	})
+	return
+}
+
+func (p *interceptedProvider) CloseContext(ctx context.Context, merchantOrderNo string) error {
+	return p.fn("Close", func() error { return closeContext(ctx, p.next, merchantOrderNo) })
+}
+
+func (p *interceptedProvider) RetryOrder(source PaySource, order *OrderRequest) (resp *OrderResponse, err error) {
+	retrier, ok := p.next.(OrderRetrier)
+	if !ok {
+		return nil, fmt.Errorf("Payment: provider %T does not support retry with order request", p.next)
+	}
+	err = p.fn("RetryOrder", func() error {
+		resp, err = retrier.RetryOrder(source, order)
+		return err
+	})
+	return
+}
+
+func (p *interceptedProvider) QueryRefund(merchantOrderNo, merchantRefundNo string) (result RefundNotifyResult, err error) {
+	querier, ok := p.next.(RefundQuerier)
+	if !ok {
+		return result, fmt.Errorf("Payment: provider %T does not support refund query", p.next)
+	}
+	err = p.fn("QueryRefund", func() error {
+		result, err = querier.QueryRefund(merchantOrderNo, merchantRefundNo)
+		return err
+	})
+	return
+}
+
+// LoggingMiddleware 记录每次调用的方法名、耗时及错误
+func LoggingMiddleware(plat PayPlat, logger *log.Logger) Middleware {
+	return Intercept(func(op string, call func() error) error {
+		start := time.Now()
+		err := call()
+		if err != nil {
+			logger.Printf("payment: %s %s failed in %v, error:%v", plat, op, time.Since(start), err)
+		} else {
+			logger.Printf("payment: %s %s succeeded in %v", plat, op, time.Since(start))
+		}
+		return err
+	})
+}
+
+// Metrics 调用指标收集
+type Metrics interface {
+	Observe(plat PayPlat, op string, elapsed time.Duration, err error)
+}
+
+// MetricsMiddleware 以 m 收集每次调用的耗时及结果
+func MetricsMiddleware(plat PayPlat, m Metrics) Middleware {
+	return Intercept(func(op string, call func() error) error {
+		start := time.Now()
+		err := call()
+		m.Observe(plat, op, time.Since(start), err)
+		return err
+	})
+}
+
+// MetricStat 单个方法的调用统计
+type MetricStat struct {
+	Plat    PayPlat
+	Op      string
+	Count   int64
+	Errors  int64
+	Elapsed time.Duration // 累计耗时
+	Max     time.Duration // 最大耗时
+}
+
+// MemoryMetrics 内存调用指标
+type MemoryMetrics struct {
+	mu    sync.Mutex
+	stats map[[2]string]*MetricStat
+}
+
+// NewMemoryMetrics 创建内存调用指标
+func NewMemoryMetrics() *MemoryMetrics {
+	return &MemoryMetrics{stats: make(map[[2]string]*MetricStat)}
+}
+
+// Observe 记录一次调用
+func (m *MemoryMetrics) Observe(plat PayPlat, op string, elapsed time.Duration, err error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	key := [2]string{string(plat), op}
+	stat, has := m.stats[key]
+	if !has {
+		stat = &MetricStat{Plat: plat, Op: op}
+		m.stats[key] = stat
+	}
+	stat.Count++
+	if err != nil {
+		stat.Errors++
+	}
+	stat.Elapsed += elapsed
+	if elapsed > stat.Max {
+		stat.Max = elapsed
+	}
+}
+
+// Snapshot 获取当前统计数据
+func (m *MemoryMetrics) Snapshot() []MetricStat {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	stats := make([]MetricStat, 0, len(m.stats))
+	for _, stat := range m.stats {
+		stats = append(stats, *stat)
+	}
+	sort.Slice(stats, func(i, j int) bool {
+		if stats[i].Plat != stats[j].Plat {
+			return stats[i].Plat < stats[j].Plat
+		}
+		return stats[i].Op < stats[j].Op
+	})
+	return stats
+}
+
+// HTTPMiddleware 客户端HTTP调用中间件，用于在每次请求支付平台时记录日志、指标、链路跟踪、限流及审计
+type HTTPMiddleware func(next http.RoundTripper) http.RoundTripper
+
+// RoundTripperFunc 函数形式的 http.RoundTripper
+type RoundTripperFunc func(req *http.Request) (*http.Response, error)
+
+// RoundTrip 执行HTTP请求
+func (f RoundTripperFunc) RoundTrip(req *http.Request) (*http.Response, error) { return f(req) }
+
+// ChainHTTP 依次以中间件包装 transport，第一个中间件位于最外层
+func ChainHTTP(transport http.RoundTripper, mws ...HTTPMiddleware) http.RoundTripper {
+	for i := len(mws) - 1; i >= 0; i-- {
+		transport = mws[i](transport)
+	}
+	return transport
+}
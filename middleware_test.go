@@ -0,0 +1,150 @@
+package payment
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+// retryTestProvider 在 testProvider 基础上实现 OrderRetrier
+type retryTestProvider struct {
+	*testProvider
+	retried []*OrderRequest
+}
+
+func (p *retryTestProvider) RetryOrder(source PaySource, order *OrderRequest) (*OrderResponse, error) {
+	p.retried = append(p.retried, order)
+	return &OrderResponse{}, nil
+}
+
+// recordOps 记录被拦截的方法名，name 为中间件名称
+func recordOps(name string, ops *[]string) Middleware {
+	return Intercept(func(op string, call func() error) error {
+		*ops = append(*ops, name+":"+op)
+		return call()
+	})
+}
+
+func TestChain(t *testing.T) {
+	var ops []string
+	p := Chain(&testProvider{}, recordOps("outer", &ops), recordOps("inner", &ops))
+	p.Order(&OrderRequest{})
+	if got := strings.Join(ops, ","); got != "outer:Order,inner:Order" {
+		t.Fatalf("got %s, want outer before inner", got)
+	}
+}
+
+func TestInterceptOps(t *testing.T) {
+	ctx := context.Background()
+	inner := &retryTestProvider{testProvider: &testProvider{queries: map[string]RefundNotifyResult{"T1-R1": {MerchantRefundNo: "T1-R1"}}}}
+	var ops []string
+	p := Chain(inner, recordOps("m", &ops))
+	cp := p.(ContextProvider)
+	tests := []struct {
+		op   string
+		call func() error
+	}{
+		{"Order", func() error { _, err := p.Order(&OrderRequest{}); return err }},
+		{"NotifyCallback", func() error { p.NotifyCallback(strings.NewReader(""), nil); return nil }},
+		{"Refund", func() error { _, err := p.Refund(RefundRequest{}); return err }},
+		{"RefundCallback", func() error { p.RefundCallback(strings.NewReader(""), nil); return nil }},
+		{"Retry", func() error { _, err := p.Retry(PaySourceApp, "P1"); return err }},
+		{"Query", func() error { _, err := p.(OrderQuerier).Query("T1"); return err }},
+		{"Close", func() error { return p.(OrderQuerier).Close("T1") }},
+		{"Refund", func() error { _, err := cp.RefundContext(ctx, RefundRequest{}); return err }},
+		{"Query", func() error { _, err := cp.QueryContext(ctx, "T1"); return err }},
+		{"Close", func() error { return cp.CloseContext(ctx, "T1") }},
+		{"RetryOrder", func() error { _, err := p.(OrderRetrier).RetryOrder(PaySourceApp, &OrderRequest{}); return err }},
+		{"QueryRefund", func() error { _, err := p.(RefundQuerier).QueryRefund("T1", "T1-R1"); return err }},
+	}
+	for _, tt := range tests {
+		ops = nil
+		if err := tt.call(); err != nil {
+			t.Fatalf("%s: %v", tt.op, err)
+		}
+		if len(ops) != 1 || ops[0] != "m:"+tt.op {
+			t.Fatalf("got ops %v, want m:%s", ops, tt.op)
+		}
+	}
+}
+
+func TestChainOptionalInterfaces(t *testing.T) {
+	inner := &retryTestProvider{testProvider: &testProvider{queries: map[string]RefundNotifyResult{
+		"T1-R1": {Plat: testPlat, MerchantOrderNo: "T1", MerchantRefundNo: "T1-R1", Status: RefundStatusSuccess},
+	}}}
+	var ops []string
+	Register(testPlat, Chain(inner, recordOps("m", &ops)))
+	t.Cleanup(func() { delete(providerMap, testPlat) })
+
+	order := &OrderRequest{MerchanOrderNo: "T1"}
+	if _, err := RetryOrder(testPlat, PaySourceApp, order); err != nil {
+		t.Fatal(err)
+	}
+	if len(inner.retried) != 1 || inner.retried[0] != order {
+		t.Fatalf("RetryOrder not forwarded, got %v", inner.retried)
+	}
+	result, err := QueryRefund(testPlat, "T1", "T1-R1")
+	if err != nil || result.Status != RefundStatusSuccess {
+		t.Fatalf("got result %+v error %v", result, err)
+	}
+	if _, err = QueryRefund(testPlat, "T1", "T1-R9"); err != ErrRefundNotFound {
+		t.Fatalf("got %v, want ErrRefundNotFound", err)
+	}
+	if got := strings.Join(ops, ","); got != "m:RetryOrder,m:QueryRefund,m:QueryRefund" {
+		t.Fatalf("got ops %s", got)
+	}
+
+	// 被包装的支付提供实现不支持 OrderRetrier
+	Register(testPlat, Chain(&testProvider{}, recordOps("m", &ops)))
+	if _, err = RetryOrder(testPlat, PaySourceApp, order); err == nil {
+		t.Fatal("expected unsupported error")
+	}
+}
+
+func TestMemoryMetrics(t *testing.T) {
+	inner := &testProvider{}
+	m := NewMemoryMetrics()
+	p := Chain(inner, MetricsMiddleware(testPlat, m))
+	p.Refund(RefundRequest{})
+	inner.refundErr = errors.New("timeout")
+	p.Refund(RefundRequest{})
+	p.Order(&OrderRequest{})
+	stats := m.Snapshot()
+	if len(stats) != 2 || stats[0].Op != "Order" || stats[1].Op != "Refund" {
+		t.Fatalf("got stats %+v, want Order and Refund sorted", stats)
+	}
+	refund := stats[1]
+	if refund.Plat != testPlat || refund.Count != 2 || refund.Errors != 1 || refund.Max > refund.Elapsed {
+		t.Fatalf("got refund stat %+v", refund)
+	}
+	m.Observe(testPlat, "Refund", time.Hour, nil)
+	if refund = m.Snapshot()[1]; refund.Count != 3 || refund.Max != time.Hour {
+		t.Fatalf("got refund stat %+v after observe", refund)
+	}
+}
+
+func TestChainHTTP(t *testing.T) {
+	var calls []string
+	mw := func(name string) HTTPMiddleware {
+		return func(next http.RoundTripper) http.RoundTripper {
+			return RoundTripperFunc(func(req *http.Request) (*http.Response, error) {
+				calls = append(calls, name)
+				return next.RoundTrip(req)
+			})
+		}
+	}
+	transport := ChainHTTP(RoundTripperFunc(func(req *http.Request) (*http.Response, error) {
+		calls = append(calls, "transport")
+		return &http.Response{StatusCode: http.StatusOK}, nil
+	}), mw("outer"), mw("inner"))
+	req, _ := http.NewRequest("GET", "https://example.com", nil)
+	if _, err := transport.RoundTrip(req); err != nil {
+		t.Fatal(err)
+	}
+	if got := strings.Join(calls, ","); got != "outer,inner,transport" {
+		t.Fatalf("got %s", got)
+	}
+}
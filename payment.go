@@ -2,6 +2,7 @@
 package payment
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"io"
@@ -19,10 +20,31 @@ func Register(plat PayPlat, provider Provider) {
 	providerMap[plat] = provider
 }
 
-// Retry 对已有订单进行支付重试
-func Retry(source PaySource, prepayid string) *OrderResponse {
-	v := providerMap[PayPlatWechat]
-	return v.Retry(source, prepayid)
+// Retry 对已有订单进行支付重试，微信支付 prepayid 为预支付交易会话标识，支付宝为商户订单号
+func Retry(plat PayPlat, source PaySource, prepayid string) (*OrderResponse, error) {
+	if v, ok := providerMap[plat]; ok {
+		return v.Retry(source, prepayid)
+	}
+	return nil, fnNoProviderErr(plat)
+}
+
+// OrderRetrier 支持使用原始下单请求进行支付重试的支付提供实现
+type OrderRetrier interface {
+	// RetryOrder 使用原始下单请求重新生成支付参数，source 不为0时替换原下单请求的支付来源
+	RetryOrder(source PaySource, order *OrderRequest) (*OrderResponse, error)
+}
+
+// RetryOrder 使用原始下单请求对未支付订单进行支付重试，无需配置订单存储
+func RetryOrder(plat PayPlat, source PaySource, order *OrderRequest) (*OrderResponse, error) {
+	v, ok := providerMap[plat]
+	if !ok {
+		return nil, fnNoProviderErr(plat)
+	}
+	retrier, ok := v.(OrderRetrier)
+	if !ok {
+		return nil, fmt.Errorf("Payment: %s does not support retry with order request", plat)
+	}
+	return retrier.RetryOrder(source, order)
 }
 
 // Order 提交支付请求
@@ -49,6 +71,97 @@ func Refund(plat PayPlat, r RefundRequest) (RefundResponse, error) {
 	return RefundResponse{}, fnNoProviderErr(plat)
 }
 
+// Query 查询订单，支付提供实现需支持 OrderQuerier
+func Query(plat PayPlat, merchantOrderNo string) (*QueryResult, error) {
+	return QueryContext(context.Background(), plat, merchantOrderNo)
+}
+
+// Close 关闭未支付订单，支付提供实现需支持 OrderQuerier
+func Close(plat PayPlat, merchantOrderNo string) error {
+	return CloseContext(context.Background(), plat, merchantOrderNo)
+}
+
+// OrderQuerier 支持查询及关闭订单的支付提供实现，微信及支付宝客户端均已实现
+type OrderQuerier interface {
+	// Query 查询订单
+	Query(merchantOrderNo string) (*QueryResult, error)
+	// Close 关闭未支付订单
+	Close(merchantOrderNo string) error
+}
+
+// ContextProvider 支持以 ctx 控制请求及重试的支付提供实现，ctx 取消后停止请求，不再重试
+type ContextProvider interface {
+	RefundContext(ctx context.Context, r RefundRequest) (RefundResponse, error)
+	QueryContext(ctx context.Context, merchantOrderNo string) (*QueryResult, error)
+	CloseContext(ctx context.Context, merchantOrderNo string) error
+}
+
+// RefundContext 同 Refund，支付提供实现不支持 ContextProvider 时仅在调用前检查 ctx
+func RefundContext(ctx context.Context, plat PayPlat, r RefundRequest) (RefundResponse, error) {
+	if v, ok := providerMap[plat]; ok {
+		return refundContext(ctx, v, r)
+	}
+	return RefundResponse{}, fnNoProviderErr(plat)
+}
+
+// QueryContext 同 Query，支付提供实现不支持 ContextProvider 时仅在调用前检查 ctx
+func QueryContext(ctx context.Context, plat PayPlat, merchantOrderNo string) (*QueryResult, error) {
+	if v, ok := providerMap[plat]; ok {
+		return queryContext(ctx, v, merchantOrderNo)
+	}
+	return nil, fnNoProviderErr(plat)
+}
+
+// CloseContext 同 Close，支付提供实现不支持 ContextProvider 时仅在调用前检查 ctx
+func CloseContext(ctx context.Context, plat PayPlat, merchantOrderNo string) error {
+	if v, ok := providerMap[plat]; ok {
+		return closeContext(ctx, v, merchantOrderNo)
+	}
+	return fnNoProviderErr(plat)
+}
+
+func refundContext(ctx context.Context, p Provider, r RefundRequest) (RefundResponse, error) {
+	if v, ok := p.(ContextProvider); ok {
+		return v.RefundContext(ctx, r)
+	}
+	if err := ctx.Err(); err != nil {
+		return RefundResponse{}, err
+	}
+	return p.Refund(r)
+}
+
+func queryContext(ctx context.Context, p Provider, merchantOrderNo string) (*QueryResult, error) {
+	if v, ok := p.(ContextProvider); ok {
+		return v.QueryContext(ctx, merchantOrderNo)
+	}
+	querier, ok := p.(OrderQuerier)
+	if !ok {
+		return nil, errNoOrderQuery(p)
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return querier.Query(merchantOrderNo)
+}
+
+func closeContext(ctx context.Context, p Provider, merchantOrderNo string) error {
+	if v, ok := p.(ContextProvider); ok {
+		return v.CloseContext(ctx, merchantOrderNo)
+	}
+	querier, ok := p.(OrderQuerier)
+	if !ok {
+		return errNoOrderQuery(p)
+	}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return querier.Close(merchantOrderNo)
+}
+
+func errNoOrderQuery(p Provider) error {
+	return fmt.Errorf("Payment: provider %T does not support order query and close", p)
+}
+
 func RefundCallback(plat PayPlat, r io.Reader, fn RefundNotifyHandleFunc) (interface{}, error) {
 	if v, ok := providerMap[plat]; ok {
 		return v.RefundCallback(r, fn), nil
@@ -56,6 +169,28 @@ func RefundCallback(plat PayPlat, r io.Reader, fn RefundNotifyHandleFunc) (inter
 	return nil, fnNoProviderErr(plat)
 }
 
+// ErrRefundNotFound 退款不存在
+var ErrRefundNotFound = errors.New("退款不存在")
+
+// RefundQuerier 支持按商户退款单号查询退款的支付提供实现
+type RefundQuerier interface {
+	// QueryRefund 查询退款，结果与退款通知一致，退款不存在时返回 ErrRefundNotFound
+	QueryRefund(merchantOrderNo, merchantRefundNo string) (RefundNotifyResult, error)
+}
+
+// QueryRefund 查询退款
+func QueryRefund(plat PayPlat, merchantOrderNo, merchantRefundNo string) (RefundNotifyResult, error) {
+	v, ok := providerMap[plat]
+	if !ok {
+		return RefundNotifyResult{}, fnNoProviderErr(plat)
+	}
+	querier, ok := v.(RefundQuerier)
+	if !ok {
+		return RefundNotifyResult{}, fmt.Errorf("Payment: %s does not support refund query", plat)
+	}
+	return querier.QueryRefund(merchantOrderNo, merchantRefundNo)
+}
+
 // Provider 支付提供实现
 type Provider interface {
 	// Order 下单提交支付请求
@@ -67,7 +202,12 @@ type Provider interface {
 	// RefundCallback 退款后台异步结果通知回调函数
 	RefundCallback(io.Reader, RefundNotifyHandleFunc) interface{}
 	// Retry 对已有订单进行支付重试
-	Retry(source PaySource, prepayid string) *OrderResponse
+	Retry(source PaySource, prepayid string) (*OrderResponse, error)
+}
+
+// OrderStore 订单存储，用于按商户订单号加载原始下单请求
+type OrderStore interface {
+	LoadOrder(merchantOrderNo string) (*OrderRequest, error)
 }
 
 // PayPlat 第三方支付平台
@@ -82,13 +222,14 @@ const (
 
 // NotifyResult 异步通知结果
 type NotifyResult struct {
-	Plat            PayPlat   //支付平台
-	MerchantOrderNo string    //商户订单号
-	TransactionID   string    // 交易ID
-	CompletedTime   time.Time //完成时间
-	TotalAmount     int64     //支付金额，单位：分
-	Currency        string    //币种
-	Attach          string    //附加数据
+	Plat            PayPlat    //支付平台
+	MerchantOrderNo string     //商户订单号
+	TransactionID   string     // 交易ID
+	CompletedTime   time.Time  //完成时间
+	TotalAmount     int64      //支付金额，单位：分
+	Currency        string     //币种
+	Attach          string     //附加数据
+	Discounts       []Discount // 优惠明细
 	Wechat          struct {
 		OpenID string
 	}
@@ -96,17 +237,90 @@ type NotifyResult struct {
 		BuyerID, BuyerLoginID string
 		NotifyID              string
 	}
+	// Detail 平台结构化的全部参数，微信异步通知为 *wechat.WXNotifyResult、订单查询为 *wechat.OrderQueryReply，
+	// 支付宝异步通知为 *alipay.TradeNotify、交易查询为 *alipay.TradeQueryReply
+	Detail interface{}
+	// Raw 验证签名后的全部原始参数，如 bank_type、cash_fee、receipt_amount，可读取未结构化的字段
+	Raw map[string]string
+}
+
+// DiscountFunding 优惠出资方
+type DiscountFunding string
+
+// 优惠出资方定义
+const (
+	DiscountFundingMerchant DiscountFunding = "MERCHANT" // 商户出资，从商户结算金额中扣除
+	DiscountFundingPlatform DiscountFunding = "PLATFORM" // 支付平台或第三方出资
+	DiscountFundingPrepaid  DiscountFunding = "PREPAID"  // 出资方预充值，如微信充值代金券，不影响结算金额
+	DiscountFundingUnknown  DiscountFunding = "UNKNOWN"
+)
+
+// Discount 订单优惠明细
+type Discount struct {
+	ID, Name string
+	Type     string          // 平台优惠类型，如微信 CASH、NO_CASH，支付宝 ALIPAY_FIX_VOUCHER、MCOUPON
+	Amount   int64           // 优惠金额，单位：分
+	Funding  DiscountFunding // 出资方
 }
 
+// TradeState 交易状态
+type TradeState string
+
+// 交易状态定义
+const (
+	TradeStateSuccess    TradeState = "SUCCESS"    // 支付成功
+	TradeStateRefund     TradeState = "REFUND"     // 转入退款
+	TradeStateNotPay     TradeState = "NOTPAY"     // 未支付
+	TradeStateClosed     TradeState = "CLOSED"     // 已关闭
+	TradeStateRevoked    TradeState = "REVOKED"    // 已撤销
+	TradeStateUserPaying TradeState = "USERPAYING" // 用户支付中
+	TradeStatePayError   TradeState = "PAYERROR"   // 支付失败
+)
+
+// IsFinal 是否为最终状态
+func (s TradeState) IsFinal() bool {
+	return s != TradeStateNotPay && s != TradeStateUserPaying
+}
+
+// QueryResult 订单查询结果，支付成功时 NotifyResult 与异步通知结果一致
+type QueryResult struct {
+	NotifyResult
+	State TradeState
+}
+
+// RefundStatus 退款状态
+type RefundStatus string
+
+// 退款状态定义
+const (
+	RefundStatusSuccess    RefundStatus = "SUCCESS"     // 退款成功
+	RefundStatusProcessing RefundStatus = "PROCESSING"  // 退款处理中
+	RefundStatusChange     RefundStatus = "CHANGE"      // 退款异常，如用户银行卡作废，需商户人工处理
+	RefundStatusClosed     RefundStatus = "REFUNDCLOSE" // 退款关闭
+)
+
+// IsFinal 是否为最终状态
+func (s RefundStatus) IsFinal() bool {
+	return s == RefundStatusSuccess || s == RefundStatusClosed
+}
+
+// RefundNotifyResult 退款结果通知，金额单位：分
 type RefundNotifyResult struct {
-	Plat             PayPlat
-	MerchantOrderNo  string    // 商户订单号
-	MerchantRefundNo string    // 商户退款单号
-	RefundID         string    // 支付平台退款单号
-	RefundAmount     int32     // 退款金额
-	TotalAmount      int32     // 订单总金额
-	CompletedTime    time.Time // 退款完成时间
-	IsSuccess        bool      // 是否退款成功
+	Plat                   PayPlat
+	MerchantOrderNo        string       // 商户订单号
+	MerchantRefundNo       string       // 商户退款单号
+	TransactionID          string       // 支付平台交易号
+	RefundID               string       // 支付平台退款单号，支付宝无退款单号，为空
+	RefundAmount           int32        // 本次申请退款金额，支付宝退款通知不提供本次退款金额，为0
+	TotalRefundedAmount    int32        // 订单累计退款金额，仅支付宝退款通知提供
+	SettlementRefundAmount int32        // 实际退款金额，扣除非充值代金券退款金额后的金额
+	TotalAmount            int32        // 订单总金额
+	Status                 RefundStatus // 退款状态
+	RecvAccount            string       // 退款入账账户，如 支付用户零钱、招商银行信用卡0403
+	RefundAccount          string       // 退款资金来源
+	Initiator              string       // 退款发起来源，API 或 VENDOR_PLATFORM(商户平台)
+	CompletedTime          time.Time    // 退款完成时间
+	IsSuccess              bool         // 是否退款成功，与 Status == RefundStatusSuccess 一致
 }
 
 // NotifyHandleFunc 业务回调处理函数
@@ -178,12 +392,35 @@ type ProductDetail struct {
 
 type RefundRequest struct {
 	MerchantOrderNo     string
+	TransactionID       string // 支付平台交易号，与商户订单号至少指定一个，均指定时以交易号为准
 	MerchantRefundNo    string
 	TotalFee, RefundFee int32
+	Currency            string // 退款币种，默认与下单币种一致
+	FundsAccount        RefundFundsAccount
+	Items               []RefundItem // 退款商品明细，微信单品优惠订单按商品退款时必填
 	Reason              string
 	NotifyURL           string
 }
 
+// RefundFundsAccount 退款资金来源，仅微信支付支持
+type RefundFundsAccount string
+
+// 退款资金来源定义
+const (
+	RefundFundsUnsettled RefundFundsAccount = "REFUND_SOURCE_UNSETTLED_FUNDS" // 未结算资金退款，默认
+	RefundFundsRecharge  RefundFundsAccount = "REFUND_SOURCE_RECHARGE_FUNDS"  // 可用余额退款，未结算资金不足时使用
+)
+
+// RefundItem 退款商品明细
+type RefundItem struct {
+	GoodsID      string // 商户侧商品编码
+	PlatGoodsID  string // 支付平台商品编码，如微信 wxpay_goods_id
+	Name         string
+	Price        int32 // 商品单价，单位：分
+	Quantity     int   // 退款数量
+	RefundAmount int32 // 商品退款金额，单位：分
+}
+
 type RefundResponse struct {
 	MerchantOrderNo, MerchantRefundNo string
 	PlatRefundID                      string
@@ -0,0 +1,315 @@
+// Package paytest 构造已签名的微信及支付宝异步通知，用于本地开发及测试时回放通知
+package paytest
+
+import (
+	"bytes"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/shengzhi/payment"
+	"github.com/shengzhi/payment/alipay"
+	"github.com/shengzhi/payment/wechat"
+)
+
+// refundInfoPrefix 编辑微信退款通知时，以该前缀指定 req_info 中的字段
+const refundInfoPrefix = "req_info."
+
+// Wechat 微信支付测试商户
+type Wechat struct {
+	AppID, MerchantID string
+	Secret            string // 商户API密钥
+}
+
+// PayNotify 构造已签名的支付成功通知，Discounts 按 coupon_*_$n 输出代金券明细，
+// 出资方为 PREPAID 的为充值代金券，其余为免充值代金券
+func (w Wechat) PayNotify(r *payment.NotifyResult) []byte {
+	params := map[string]string{
+		"return_code":    "SUCCESS",
+		"result_code":    "SUCCESS",
+		"appid":          w.AppID,
+		"mch_id":         w.MerchantID,
+		"nonce_str":      nonce(),
+		"trade_type":     "APP",
+		"openid":         r.Wechat.OpenID,
+		"bank_type":      "CFT",
+		"total_fee":      strconv.FormatInt(r.TotalAmount, 10),
+		"cash_fee":       strconv.FormatInt(r.TotalAmount, 10),
+		"fee_type":       "CNY",
+		"transaction_id": r.TransactionID,
+		"out_trade_no":   r.MerchantOrderNo,
+		"attach":         r.Attach,
+		"time_end":       formatTime(r.CompletedTime, "20060102150405"),
+	}
+	if r.Currency != "" {
+		params["fee_type"] = r.Currency
+	}
+	var couponFee int64
+	for n, d := range r.Discounts {
+		couponType := "NO_CASH"
+		if d.Funding == payment.DiscountFundingPrepaid {
+			couponType = "CASH"
+		}
+		params[fmt.Sprintf("coupon_id_%d", n)] = d.ID
+		params[fmt.Sprintf("coupon_type_%d", n)] = couponType
+		params[fmt.Sprintf("coupon_fee_%d", n)] = strconv.FormatInt(d.Amount, 10)
+		couponFee += d.Amount
+	}
+	if len(r.Discounts) > 0 {
+		params["coupon_count"] = strconv.Itoa(len(r.Discounts))
+		params["coupon_fee"] = strconv.FormatInt(couponFee, 10)
+		params["cash_fee"] = strconv.FormatInt(r.TotalAmount-couponFee, 10)
+	}
+	params["sign"] = wechat.Sign(params, w.Secret, wechat.SignTypeMD5)
+	return encodeXML("xml", params)
+}
+
+// RefundNotify 构造退款结果通知，退款信息以 AES-256-ECB 加密至 req_info；
+// 未设置的退款状态、实际退款金额、入账账户等字段按退款成功至用户零钱填充
+func (w Wechat) RefundNotify(r payment.RefundNotifyResult) ([]byte, error) {
+	status := r.Status
+	if status == "" {
+		status = payment.RefundStatusClosed
+		if r.IsSuccess {
+			status = payment.RefundStatusSuccess
+		}
+	}
+	settlement := r.SettlementRefundAmount
+	if settlement == 0 {
+		settlement = r.RefundAmount
+	}
+	info := map[string]string{
+		"transaction_id":        r.TransactionID,
+		"out_trade_no":          r.MerchantOrderNo,
+		"refund_id":             r.RefundID,
+		"out_refund_no":         r.MerchantRefundNo,
+		"total_fee":             strconv.Itoa(int(r.TotalAmount)),
+		"refund_fee":            strconv.Itoa(int(r.RefundAmount)),
+		"settlement_refund_fee": strconv.Itoa(int(settlement)),
+		"refund_status":         string(status),
+		"success_time":          formatTime(r.CompletedTime, "2006-01-02 15:04:05"),
+		"refund_recv_accout":    orDefault(r.RecvAccount, "支付用户零钱"),
+		"refund_account":        orDefault(r.RefundAccount, "REFUND_SOURCE_RECHARGE_FUNDS"),
+		"refund_request_source": orDefault(r.Initiator, "API"),
+	}
+	reqInfo, err := wechat.EncryptRefundInfo(encodeXML("root", info), w.Secret)
+	if err != nil {
+		return nil, err
+	}
+	return encodeXML("xml", map[string]string{
+		"return_code": "SUCCESS",
+		"appid":       w.AppID,
+		"mch_id":      w.MerchantID,
+		"nonce_str":   nonce(),
+		"req_info":    reqInfo,
+	}), nil
+}
+
+// Edit 修改已有通知的字段并重新签名，退款通知中 req_info 的字段以 "req_info." 前缀指定，并重新加密；
+// 值为空的字段将被删除
+func (w Wechat) Edit(body []byte, fields map[string]string) ([]byte, error) {
+	params, err := wechat.ParseParams(body)
+	if err != nil {
+		return nil, err
+	}
+	if reqInfo, has := params["req_info"]; has {
+		plainTxt, err := wechat.DecryptRefundInfo(reqInfo, w.Secret)
+		if err != nil {
+			return nil, fmt.Errorf("decrypt req_info error:%v", err)
+		}
+		info, err := wechat.ParseParams(plainTxt)
+		if err != nil {
+			return nil, err
+		}
+		for k, v := range fields {
+			if strings.HasPrefix(k, refundInfoPrefix) {
+				set(info, strings.TrimPrefix(k, refundInfoPrefix), v)
+			}
+		}
+		if params["req_info"], err = wechat.EncryptRefundInfo(encodeXML("root", info), w.Secret); err != nil {
+			return nil, err
+		}
+	}
+	for k, v := range fields {
+		if !strings.HasPrefix(k, refundInfoPrefix) {
+			set(params, k, v)
+		}
+	}
+	if _, signed := params["sign"]; signed {
+		params["sign"] = wechat.Sign(params, w.Secret, params["sign_type"])
+	}
+	return encodeXML("xml", params), nil
+}
+
+// Alipay 支付宝测试商户，PrivateKey 为PEM格式的测试私钥，
+// 接收通知的客户端需以对应的公钥作为支付宝公钥
+type Alipay struct {
+	AppID, SellerID string
+	PrivateKey      []byte
+}
+
+// PayNotify 构造已签名的支付成功通知表单，Discounts 输出至 voucher_detail_list，
+// 出资方为 MERCHANT 的计入商家出资，其余计入其他出资方
+func (a Alipay) PayNotify(r *payment.NotifyResult) (string, error) {
+	params := a.notifyParams(r.CompletedTime)
+	params.Set("trade_no", r.TransactionID)
+	params.Set("out_trade_no", r.MerchantOrderNo)
+	params.Set("trade_status", alipay.TradeStatusSuccess)
+	params.Set("total_amount", fenToYuan(r.TotalAmount))
+	params.Set("receipt_amount", fenToYuan(r.TotalAmount))
+	params.Set("buyer_pay_amount", fenToYuan(r.TotalAmount))
+	params.Set("gmt_create", formatTime(r.CompletedTime, "2006-01-02 15:04:05"))
+	params.Set("gmt_payment", formatTime(r.CompletedTime, "2006-01-02 15:04:05"))
+	if r.Alipay.NotifyID != "" {
+		params.Set("notify_id", r.Alipay.NotifyID)
+	}
+	params.Set("buyer_id", r.Alipay.BuyerID)
+	params.Set("buyer_logon_id", r.Alipay.BuyerLoginID)
+	params.Set("passback_params", r.Attach)
+	if len(r.Discounts) > 0 {
+		var discount int64
+		vouchers := make([]map[string]string, 0, len(r.Discounts))
+		for _, d := range r.Discounts {
+			v := map[string]string{
+				"voucherId": d.ID, "name": d.Name, "type": orDefault(d.Type, "ALIPAY_FIX_VOUCHER"),
+				"amount": fenToYuan(d.Amount), "merchantContribute": "0.00", "otherContribute": "0.00",
+			}
+			if d.Funding == payment.DiscountFundingMerchant {
+				v["merchantContribute"] = fenToYuan(d.Amount)
+			} else {
+				v["otherContribute"] = fenToYuan(d.Amount)
+			}
+			vouchers = append(vouchers, v)
+			discount += d.Amount
+		}
+		data, err := json.Marshal(vouchers)
+		if err != nil {
+			return "", err
+		}
+		params.Set("voucher_detail_list", string(data))
+		params.Set("buyer_pay_amount", fenToYuan(r.TotalAmount-discount))
+	}
+	return a.sign(params)
+}
+
+// RefundNotify 构造已签名的退款通知表单，支付宝 refund_fee 为交易累计退款金额，取 TotalRefundedAmount，
+// 未设置时取 RefundAmount；全额退款时交易状态为关闭
+func (a Alipay) RefundNotify(r payment.RefundNotifyResult) (string, error) {
+	refunded := r.TotalRefundedAmount
+	if refunded == 0 {
+		refunded = r.RefundAmount
+	}
+	params := a.notifyParams(r.CompletedTime)
+	params.Set("trade_no", r.TransactionID)
+	params.Set("out_trade_no", r.MerchantOrderNo)
+	params.Set("out_biz_no", r.MerchantRefundNo)
+	params.Set("trade_status", alipay.TradeStatusSuccess)
+	if refunded >= r.TotalAmount {
+		params.Set("trade_status", alipay.TradeStatusClosed)
+	}
+	params.Set("total_amount", fenToYuan(int64(r.TotalAmount)))
+	params.Set("refund_fee", fenToYuan(int64(refunded)))
+	params.Set("gmt_refund", formatTime(r.CompletedTime, "2006-01-02 15:04:05"))
+	return a.sign(params)
+}
+
+// Edit 修改已有通知表单的字段并重新签名，值为空的字段将被删除
+func (a Alipay) Edit(body string, fields map[string]string) (string, error) {
+	params, err := url.ParseQuery(body)
+	if err != nil {
+		return "", err
+	}
+	for k, v := range fields {
+		if v == "" {
+			params.Del(k)
+		} else {
+			params.Set(k, v)
+		}
+	}
+	return a.sign(params)
+}
+
+func (a Alipay) notifyParams(t time.Time) url.Values {
+	params := url.Values{}
+	params.Set("notify_time", formatTime(t, "2006-01-02 15:04:05"))
+	params.Set("notify_type", "trade_status_sync")
+	params.Set("notify_id", nonce())
+	params.Set("app_id", a.AppID)
+	params.Set("seller_id", a.SellerID)
+	params.Set("charset", "utf-8")
+	params.Set("version", "1.0")
+	return params
+}
+
+// sign 按异步通知规则签名，sign 及 sign_type 不参与签名
+func (a Alipay) sign(params url.Values) (string, error) {
+	for k := range params {
+		if params.Get(k) == "" {
+			params.Del(k)
+		}
+	}
+	params.Del("sign")
+	params.Del("sign_type")
+	sign, err := alipay.SignRSA2(alipay.PlainText(params), a.PrivateKey)
+	if err != nil {
+		return "", err
+	}
+	params.Set("sign_type", string(alipay.SignTypeRSA2))
+	params.Set("sign", sign)
+	return params.Encode(), nil
+}
+
+func set(params map[string]string, k, v string) {
+	if v == "" {
+		delete(params, k)
+	} else {
+		params[k] = v
+	}
+}
+
+// encodeXML 按参数名排序输出XML报文
+func encodeXML(root string, params map[string]string) []byte {
+	keys := make([]string, 0, len(params))
+	for k, v := range params {
+		if v != "" {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "<%s>", root)
+	for _, k := range keys {
+		fmt.Fprintf(&buf, "<%s>", k)
+		xml.EscapeText(&buf, []byte(params[k]))
+		fmt.Fprintf(&buf, "</%s>", k)
+	}
+	fmt.Fprintf(&buf, "</%s>", root)
+	return buf.Bytes()
+}
+
+func orDefault(v, def string) string {
+	if v == "" {
+		return def
+	}
+	return v
+}
+
+func formatTime(t time.Time, layout string) string {
+	if t.IsZero() {
+		t = time.Now()
+	}
+	return t.Format(layout)
+}
+
+func fenToYuan(amount int64) string {
+	return fmt.Sprintf("%.2f", float64(amount)/100)
+}
+
+func nonce() string {
+	return strconv.FormatInt(time.Now().UnixNano(), 36)
+}
@@ -0,0 +1,357 @@
+package paytest
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"math/big"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/shengzhi/payment"
+	"github.com/shengzhi/payment/alipay"
+	"github.com/shengzhi/payment/wechat"
+)
+
+const testSecret = "0123456789abcdef0123456789abcdef"
+
+var testWechat = Wechat{AppID: "wx2421b1c4370ec43b", MerchantID: "1900000109", Secret: testSecret}
+
+// verifyWechat 解析微信通知并校验签名
+func verifyWechat(t *testing.T, body []byte) map[string]string {
+	t.Helper()
+	params, err := wechat.ParseParams(body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sign, has := params["sign"]; has && sign != wechat.Sign(params, testSecret, params["sign_type"]) {
+		t.Fatalf("invalid sign in %s", body)
+	}
+	return params
+}
+
+// refundInfo 解密微信退款通知的 req_info
+func refundInfo(t *testing.T, params map[string]string) map[string]string {
+	t.Helper()
+	plainTxt, err := wechat.DecryptRefundInfo(params["req_info"], testSecret)
+	if err != nil {
+		t.Fatal(err)
+	}
+	info, err := wechat.ParseParams(plainTxt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return info
+}
+
+func TestWechatPayNotify(t *testing.T) {
+	params := verifyWechat(t, testWechat.PayNotify(&payment.NotifyResult{
+		MerchantOrderNo: "T1", TransactionID: "4200001", TotalAmount: 1000, Attach: "a=1",
+		CompletedTime: time.Date(2026, 10, 18, 10, 0, 0, 0, time.Local),
+		Discounts: []payment.Discount{
+			{ID: "C1", Amount: 100, Funding: payment.DiscountFundingPrepaid},
+			{ID: "C2", Amount: 50},
+		},
+	}))
+	want := map[string]string{
+		"out_trade_no": "T1", "transaction_id": "4200001", "total_fee": "1000", "cash_fee": "850", "attach": "a=1",
+		"time_end": "20261018100000", "coupon_count": "2", "coupon_fee": "150",
+		"coupon_id_0": "C1", "coupon_type_0": "CASH", "coupon_fee_0": "100",
+		"coupon_id_1": "C2", "coupon_type_1": "NO_CASH", "coupon_fee_1": "50",
+	}
+	for k, v := range want {
+		if params[k] != v {
+			t.Errorf("%s = %q, want %q", k, params[k], v)
+		}
+	}
+}
+
+func TestWechatRefundNotify(t *testing.T) {
+	tests := []struct {
+		name   string
+		result payment.RefundNotifyResult
+		want   map[string]string
+	}{
+		{
+			name:   "success defaults",
+			result: payment.RefundNotifyResult{MerchantOrderNo: "T1", MerchantRefundNo: "T1-R1", TotalAmount: 1000, RefundAmount: 300, IsSuccess: true},
+			want:   map[string]string{"refund_status": "SUCCESS", "refund_fee": "300", "settlement_refund_fee": "300", "refund_recv_accout": "支付用户零钱"},
+		},
+		{
+			name:   "closed",
+			result: payment.RefundNotifyResult{MerchantOrderNo: "T1", MerchantRefundNo: "T1-R2", TotalAmount: 1000, RefundAmount: 300},
+			want:   map[string]string{"refund_status": "REFUNDCLOSE", "out_refund_no": "T1-R2"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			body, err := testWechat.RefundNotify(tt.result)
+			if err != nil {
+				t.Fatal(err)
+			}
+			info := refundInfo(t, verifyWechat(t, body))
+			for k, v := range tt.want {
+				if info[k] != v {
+					t.Errorf("req_info %s = %q, want %q", k, info[k], v)
+				}
+			}
+		})
+	}
+}
+
+func TestWechatEdit(t *testing.T) {
+	pay := testWechat.PayNotify(&payment.NotifyResult{MerchantOrderNo: "T1", TransactionID: "4200001", TotalAmount: 1000})
+	refund, err := testWechat.RefundNotify(payment.RefundNotifyResult{MerchantOrderNo: "T1", MerchantRefundNo: "T1-R1", TotalAmount: 1000, RefundAmount: 300, IsSuccess: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name    string
+		body    []byte
+		fields  map[string]string
+		want    map[string]string
+		wantReq map[string]string // req_info 中的字段
+	}{
+		{name: "modify", body: pay, fields: map[string]string{"total_fee": "1", "attach": "x"}, want: map[string]string{"total_fee": "1", "attach": "x"}},
+		{name: "delete", body: pay, fields: map[string]string{"bank_type": ""}, want: map[string]string{"bank_type": ""}},
+		{
+			name: "refund info", body: refund,
+			fields:  map[string]string{"req_info.refund_status": "CHANGE", "req_info.refund_fee": "200"},
+			wantReq: map[string]string{"refund_status": "CHANGE", "refund_fee": "200", "out_refund_no": "T1-R1"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			body, err := testWechat.Edit(tt.body, tt.fields)
+			if err != nil {
+				t.Fatal(err)
+			}
+			params := verifyWechat(t, body)
+			for k, v := range tt.want {
+				if params[k] != v {
+					t.Errorf("%s = %q, want %q", k, params[k], v)
+				}
+			}
+			if tt.wantReq == nil {
+				return
+			}
+			info := refundInfo(t, params)
+			for k, v := range tt.wantReq {
+				if info[k] != v {
+					t.Errorf("req_info %s = %q, want %q", k, info[k], v)
+				}
+			}
+		})
+	}
+}
+
+// testWechatClient 以自签名商户证书创建接收测试商户通知的客户端
+func testWechatClient(t *testing.T) *wechat.Client {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{SerialNumber: big.NewInt(1), NotBefore: time.Now().Add(-time.Hour), NotAfter: time.Now().Add(time.Hour)}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir := t.TempDir()
+	crt, keyFile := filepath.Join(dir, "apiclient_cert.pem"), filepath.Join(dir, "apiclient_key.pem")
+	if err = os.WriteFile(crt, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err = os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return wechat.NewClient(testWechat.AppID, testSecret, testWechat.MerchantID, wechat.WithCertFile("", crt, keyFile))
+}
+
+// TestWechatRefundCallback 以构造的退款通知回放至 wechat.Client，校验字段映射及商户校验
+func TestWechatRefundCallback(t *testing.T) {
+	completed := time.Date(2026, 10, 18, 10, 0, 0, 0, time.Local)
+	refund, err := testWechat.RefundNotify(payment.RefundNotifyResult{
+		MerchantOrderNo: "T1", MerchantRefundNo: "T1-R1", TransactionID: "4200001", RefundID: "5000001",
+		TotalAmount: 1000, RefundAmount: 300, SettlementRefundAmount: 250, Status: payment.RefundStatusSuccess,
+		RecvAccount: "招商银行信用卡0403", RefundAccount: "REFUND_SOURCE_UNSETTLED_FUNDS", Initiator: "VENDOR_PLATFORM",
+		CompletedTime: completed,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	changed, err := testWechat.Edit(refund, map[string]string{"req_info.refund_status": "CHANGE"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	otherApp, err := testWechat.Edit(refund, map[string]string{"appid": "wx0000000000000000"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	otherMch, err := testWechat.Edit(refund, map[string]string{"mch_id": "1900000000"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name    string
+		body    []byte
+		code    string
+		want    payment.RefundNotifyResult // code 为 SUCCESS 时期望的回调结果
+		handled bool
+	}{
+		{
+			name: "success", body: refund, code: "SUCCESS", handled: true,
+			want: payment.RefundNotifyResult{
+				Plat: payment.PayPlatWechat, MerchantOrderNo: "T1", MerchantRefundNo: "T1-R1", TransactionID: "4200001", RefundID: "5000001",
+				TotalAmount: 1000, RefundAmount: 300, SettlementRefundAmount: 250, Status: payment.RefundStatusSuccess,
+				RecvAccount: "招商银行信用卡0403", RefundAccount: "REFUND_SOURCE_UNSETTLED_FUNDS", Initiator: "VENDOR_PLATFORM",
+				CompletedTime: completed, IsSuccess: true,
+			},
+		},
+		{
+			name: "refund exception", body: changed, code: "SUCCESS", handled: true,
+			want: payment.RefundNotifyResult{
+				Plat: payment.PayPlatWechat, MerchantOrderNo: "T1", MerchantRefundNo: "T1-R1", TransactionID: "4200001", RefundID: "5000001",
+				TotalAmount: 1000, RefundAmount: 300, SettlementRefundAmount: 250, Status: payment.RefundStatusChange,
+				RecvAccount: "招商银行信用卡0403", RefundAccount: "REFUND_SOURCE_UNSETTLED_FUNDS", Initiator: "VENDOR_PLATFORM",
+				CompletedTime: completed,
+			},
+		},
+		{name: "appid mismatch", body: otherApp, code: "FAIL"},
+		{name: "mch_id mismatch", body: otherMch, code: "FAIL"},
+	}
+	c := testWechatClient(t)
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var got payment.RefundNotifyResult
+			handled := false
+			reply, _ := c.RefundCallback(bytes.NewReader(tt.body), func(r payment.RefundNotifyResult) error {
+				got, handled = r, true
+				return nil
+			}).(wechat.WXNotifyReply)
+			if reply.Code != tt.code || handled != tt.handled {
+				t.Fatalf("got reply %+v handled %v, want %s", reply, handled, tt.code)
+			}
+			if tt.handled && got != tt.want {
+				t.Fatalf("got %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+// testAlipay 创建测试商户及以其公钥为支付宝公钥的客户端
+func testAlipay(t *testing.T) (Alipay, *alipay.AlipayClient) {
+	t.Helper()
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pub, err := x509.MarshalPKIXPublicKey(&key.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	priKey := pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)})
+	pubKey := pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: pub})
+	merchant := Alipay{AppID: "2021000000000000", SellerID: "2088000000000000", PrivateKey: priKey}
+	return merchant, alipay.NewClient(merchant.AppID, merchant.SellerID, alipay.WithRSAKey(pubKey, priKey))
+}
+
+func TestAlipayNotify(t *testing.T) {
+	merchant, client := testAlipay(t)
+	paid := time.Date(2026, 10, 18, 10, 0, 0, 0, time.Local)
+	form, err := merchant.PayNotify(&payment.NotifyResult{
+		MerchantOrderNo: "T1", TransactionID: "2026101822001", TotalAmount: 1000, Attach: "a=1", CompletedTime: paid,
+		Discounts: []payment.Discount{{ID: "V1", Name: "满减券", Amount: 100, Funding: payment.DiscountFundingMerchant}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got *payment.NotifyResult
+	reply := client.NotifyCallback(strings.NewReader(form), func(r *payment.NotifyResult) error {
+		got = r
+		return nil
+	})
+	if reply != "success" || got == nil {
+		t.Fatalf("pay notify reply %v", reply)
+	}
+	if got.MerchantOrderNo != "T1" || got.TotalAmount != 1000 || got.Attach != "a=1" || !got.CompletedTime.Equal(paid) ||
+		len(got.Discounts) != 1 || got.Discounts[0].Amount != 100 || got.Discounts[0].Funding != payment.DiscountFundingMerchant {
+		t.Fatalf("unexpected pay notify %+v", got)
+	}
+
+	tests := []struct {
+		name     string
+		result   payment.RefundNotifyResult
+		refunded int32
+	}{
+		{name: "cumulative", result: payment.RefundNotifyResult{MerchantOrderNo: "T1", MerchantRefundNo: "T1-R2", TotalAmount: 1000, TotalRefundedAmount: 500}, refunded: 500},
+		{name: "refund amount fallback", result: payment.RefundNotifyResult{MerchantOrderNo: "T1", MerchantRefundNo: "T1-R1", TotalAmount: 1000, RefundAmount: 300}, refunded: 300},
+		{name: "full refund", result: payment.RefundNotifyResult{MerchantOrderNo: "T1", MerchantRefundNo: "T1-R3", TotalAmount: 1000, TotalRefundedAmount: 1000}, refunded: 1000},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			form, err := merchant.RefundNotify(tt.result)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var got *payment.RefundNotifyResult
+			reply := client.RefundCallback(strings.NewReader(form), func(r payment.RefundNotifyResult) error {
+				got = &r
+				return nil
+			})
+			if reply != "success" || got == nil {
+				t.Fatalf("refund notify reply %v", reply)
+			}
+			if got.MerchantRefundNo != tt.result.MerchantRefundNo || got.TotalRefundedAmount != tt.refunded {
+				t.Fatalf("unexpected refund notify %+v", got)
+			}
+		})
+	}
+}
+
+func TestAlipayEdit(t *testing.T) {
+	merchant, client := testAlipay(t)
+	form, err := merchant.PayNotify(&payment.NotifyResult{MerchantOrderNo: "T1", TransactionID: "2026101822001", TotalAmount: 1000})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name   string
+		fields map[string]string
+		check  func(params url.Values) bool
+	}{
+		{name: "modify", fields: map[string]string{"total_amount": "0.01"}, check: func(p url.Values) bool { return p.Get("total_amount") == "0.01" }},
+		{name: "delete", fields: map[string]string{"notify_id": ""}, check: func(p url.Values) bool { _, has := p["notify_id"]; return !has }},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			edited, err := merchant.Edit(form, tt.fields)
+			if err != nil {
+				t.Fatal(err)
+			}
+			params, err := url.ParseQuery(edited)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !tt.check(params) {
+				t.Fatalf("unexpected form %s", edited)
+			}
+			var notify alipay.TradeNotify
+			if err = client.Verify(params, &notify); err != nil {
+				t.Fatalf("verify edited notify: %v", err)
+			}
+		})
+	}
+}
@@ -0,0 +1,165 @@
+// 支付结果补偿查询
+
+package payment
+
+import (
+	"context"
+	"log"
+	"sync"
+	"time"
+)
+
+// PendingOrder 待确认支付结果的订单
+type PendingOrder struct {
+	Plat            PayPlat
+	MerchantOrderNo string
+	CreatedTime     time.Time
+	ExpireTime      time.Time // 过期时间，过期仍未支付的订单将被关闭，零值表示不过期
+}
+
+// PendingSource 待确认订单来源
+type PendingSource interface {
+	// Pending 获取全部待确认订单
+	Pending(ctx context.Context) ([]PendingOrder, error)
+	// Settle 订单已确定最终状态，此后不应再由 Pending 返回
+	Settle(order PendingOrder, state TradeState) error
+}
+
+// DefaultPollBackoff 默认查询间隔，第N次查询在上次查询后间隔 Backoff[N-1]，超出部分沿用最后一个间隔
+var DefaultPollBackoff = []time.Duration{15 * time.Second, time.Minute, 5 * time.Minute, 30 * time.Minute}
+
+// Poller 支付结果补偿查询，定期查询待确认订单，支付成功时调用与 HandleNotify 相同的 Handler，过期未支付时关闭订单
+type Poller struct {
+	Source      PendingSource
+	Handler     NotifyHandleFunc
+	Backoff     []time.Duration // 查询间隔，默认 DefaultPollBackoff
+	Concurrency int             // 最大并发查询数，默认 4
+	Interval    time.Duration   // 扫描待确认订单的间隔，默认 Backoff[0]
+	Logger      *log.Logger     // 错误日志，默认 log 包标准输出
+
+	mu       sync.Mutex
+	schedule map[string]*pollState
+}
+
+type pollState struct {
+	attempts int
+	next     time.Time
+	running  bool
+}
+
+// Run 运行补偿查询直至 ctx 取消，返回前等待进行中的查询结束
+func (p *Poller) Run(ctx context.Context) error {
+	if len(p.Backoff) == 0 {
+		p.Backoff = DefaultPollBackoff
+	}
+	if p.Concurrency <= 0 {
+		p.Concurrency = 4
+	}
+	if p.Interval <= 0 {
+		p.Interval = p.Backoff[0]
+	}
+	p.schedule = make(map[string]*pollState)
+	sem := make(chan struct{}, p.Concurrency)
+	var wg sync.WaitGroup
+	ticker := time.NewTicker(p.Interval)
+	defer ticker.Stop()
+	for {
+		p.poll(ctx, sem, &wg)
+		select {
+		case <-ctx.Done():
+			wg.Wait()
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
+
+func (p *Poller) poll(ctx context.Context, sem chan struct{}, wg *sync.WaitGroup) {
+	orders, err := p.Source.Pending(ctx)
+	if err != nil {
+		p.logf("payment: load pending orders error:%v", err)
+		return
+	}
+	now := time.Now()
+	seen := make(map[string]bool, len(orders))
+	for _, order := range orders {
+		key := string(order.Plat) + ":" + order.MerchantOrderNo
+		seen[key] = true
+		p.mu.Lock()
+		st, has := p.schedule[key]
+		if !has {
+			st = &pollState{next: order.CreatedTime.Add(p.Backoff[0])}
+			p.schedule[key] = st
+		}
+		due := !st.running && !now.Before(st.next)
+		if due {
+			st.running = true
+		}
+		p.mu.Unlock()
+		if !due {
+			continue
+		}
+		select {
+		case sem <- struct{}{}:
+		case <-ctx.Done():
+			p.mu.Lock()
+			st.running = false
+			p.mu.Unlock()
+			return
+		}
+		wg.Add(1)
+		go func(order PendingOrder, st *pollState) {
+			defer func() { <-sem; wg.Done() }()
+			if err := p.check(ctx, order); err != nil {
+				p.logf("payment: check order %s %s error:%v", order.Plat, order.MerchantOrderNo, err)
+			}
+			p.mu.Lock()
+			defer p.mu.Unlock()
+			st.attempts++
+			i := st.attempts
+			if i >= len(p.Backoff) {
+				i = len(p.Backoff) - 1
+			}
+			st.next = time.Now().Add(p.Backoff[i])
+			st.running = false
+		}(order, st)
+	}
+	p.mu.Lock()
+	for key, st := range p.schedule {
+		if !seen[key] && !st.running {
+			delete(p.schedule, key)
+		}
+	}
+	p.mu.Unlock()
+}
+
+// check 查询订单，支付成功调用 Handler，其他最终状态直接结束，过期未支付则关闭订单
+func (p *Poller) check(ctx context.Context, order PendingOrder) error {
+	result, err := QueryContext(ctx, order.Plat, order.MerchantOrderNo)
+	if err != nil {
+		return err
+	}
+	switch {
+	case result.State == TradeStateSuccess, result.State == TradeStateRefund:
+		if err = p.Handler(&result.NotifyResult); err != nil {
+			return err
+		}
+		return p.Source.Settle(order, result.State)
+	case result.State.IsFinal():
+		return p.Source.Settle(order, result.State)
+	case !order.ExpireTime.IsZero() && time.Now().After(order.ExpireTime):
+		if err = CloseContext(ctx, order.Plat, order.MerchantOrderNo); err != nil {
+			return err
+		}
+		return p.Source.Settle(order, TradeStateClosed)
+	}
+	return nil
+}
+
+func (p *Poller) logf(format string, v ...interface{}) {
+	if p.Logger != nil {
+		p.Logger.Printf(format, v...)
+		return
+	}
+	log.Printf(format, v...)
+}
@@ -0,0 +1,239 @@
+package payment
+
+import (
+	"context"
+	"errors"
+	"io"
+	"sync"
+	"testing"
+	"time"
+)
+
+const pollPlat PayPlat = "poll"
+
+// pollProvider 订单状态可配置的支付提供实现，仅实现 OrderQuerier
+type pollProvider struct {
+	mu       sync.Mutex
+	states   map[string]TradeState
+	queryErr error
+	delay    time.Duration
+	queries  map[string][]time.Time
+	closed   []string
+	running  int
+	maxRun   int
+}
+
+func (p *pollProvider) Order(*OrderRequest) (*OrderResponse, error)                  { return &OrderResponse{}, nil }
+func (p *pollProvider) NotifyCallback(io.Reader, NotifyHandleFunc) interface{}       { return nil }
+func (p *pollProvider) Refund(RefundRequest) (RefundResponse, error)                 { return RefundResponse{}, nil }
+func (p *pollProvider) RefundCallback(io.Reader, RefundNotifyHandleFunc) interface{} { return nil }
+func (p *pollProvider) Retry(PaySource, string) (*OrderResponse, error)              { return &OrderResponse{}, nil }
+
+func (p *pollProvider) Query(merchantOrderNo string) (*QueryResult, error) {
+	p.mu.Lock()
+	p.queries[merchantOrderNo] = append(p.queries[merchantOrderNo], time.Now())
+	p.running++
+	if p.running > p.maxRun {
+		p.maxRun = p.running
+	}
+	state, err := p.states[merchantOrderNo], p.queryErr
+	p.mu.Unlock()
+	time.Sleep(p.delay)
+	p.mu.Lock()
+	p.running--
+	p.mu.Unlock()
+	if err != nil {
+		return nil, err
+	}
+	result := &QueryResult{State: state}
+	result.Plat, result.MerchantOrderNo = pollPlat, merchantOrderNo
+	return result, nil
+}
+
+func (p *pollProvider) Close(merchantOrderNo string) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.closed = append(p.closed, merchantOrderNo)
+	return nil
+}
+
+func (p *pollProvider) queried(merchantOrderNo string) []time.Time {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return append([]time.Time(nil), p.queries[merchantOrderNo]...)
+}
+
+func registerPollProvider(t *testing.T) *pollProvider {
+	t.Helper()
+	p := &pollProvider{states: make(map[string]TradeState), queries: make(map[string][]time.Time)}
+	Register(pollPlat, p)
+	t.Cleanup(func() { delete(providerMap, pollPlat) })
+	return p
+}
+
+// testPendingSource 内存待确认订单，Settle 后不再返回
+type testPendingSource struct {
+	mu      sync.Mutex
+	orders  []PendingOrder
+	settled map[string]TradeState
+}
+
+func newTestPendingSource(orders ...PendingOrder) *testPendingSource {
+	return &testPendingSource{orders: orders, settled: make(map[string]TradeState)}
+}
+
+func (s *testPendingSource) Pending(ctx context.Context) ([]PendingOrder, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var orders []PendingOrder
+	for _, o := range s.orders {
+		if _, has := s.settled[o.MerchantOrderNo]; !has {
+			orders = append(orders, o)
+		}
+	}
+	return orders, nil
+}
+
+func (s *testPendingSource) Settle(order PendingOrder, state TradeState) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.settled[order.MerchantOrderNo] = state
+	return nil
+}
+
+func TestPollerCheck(t *testing.T) {
+	tests := []struct {
+		name     string
+		state    TradeState
+		queryErr error
+		expire   time.Duration // 相对当前时间的过期时间，0 表示不过期
+		handled  bool
+		closed   bool
+		settled  TradeState // 为空表示未结束
+		wantErr  bool
+	}{
+		{name: "paid", state: TradeStateSuccess, handled: true, settled: TradeStateSuccess},
+		{name: "refund", state: TradeStateRefund, handled: true, settled: TradeStateRefund},
+		{name: "closed", state: TradeStateClosed, settled: TradeStateClosed},
+		{name: "not paid", state: TradeStateNotPay, expire: time.Hour},
+		{name: "user paying without expiry", state: TradeStateUserPaying},
+		{name: "expired", state: TradeStateNotPay, expire: -time.Minute, closed: true, settled: TradeStateClosed},
+		{name: "query error", queryErr: errors.New("timeout"), expire: -time.Minute, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			provider := registerPollProvider(t)
+			provider.states["T1"], provider.queryErr = tt.state, tt.queryErr
+			order := PendingOrder{Plat: pollPlat, MerchantOrderNo: "T1", CreatedTime: time.Now()}
+			if tt.expire != 0 {
+				order.ExpireTime = time.Now().Add(tt.expire)
+			}
+			source := newTestPendingSource(order)
+			handled := false
+			p := &Poller{Source: source, Handler: func(r *NotifyResult) error {
+				handled = r.MerchantOrderNo == "T1"
+				return nil
+			}}
+			if err := p.check(context.Background(), order); (err != nil) != tt.wantErr {
+				t.Fatalf("got error %v, want error %v", err, tt.wantErr)
+			}
+			if handled != tt.handled || (len(provider.closed) == 1) != tt.closed || source.settled["T1"] != tt.settled {
+				t.Fatalf("got handled %v closed %v settled %q", handled, provider.closed, source.settled["T1"])
+			}
+		})
+	}
+}
+
+func TestPollerHandlerError(t *testing.T) {
+	provider := registerPollProvider(t)
+	provider.states["T1"] = TradeStateSuccess
+	order := PendingOrder{Plat: pollPlat, MerchantOrderNo: "T1", CreatedTime: time.Now()}
+	source := newTestPendingSource(order)
+	p := &Poller{Source: source, Handler: func(*NotifyResult) error { return errors.New("db down") }}
+	if err := p.check(context.Background(), order); err == nil {
+		t.Fatal("expected handler error")
+	}
+	// 处理失败的订单保留，下次继续查询
+	if _, has := source.settled["T1"]; has {
+		t.Fatal("order settled after handler error")
+	}
+}
+
+func TestPollerBackoff(t *testing.T) {
+	provider := registerPollProvider(t)
+	provider.states["T1"] = TradeStateNotPay
+	created := time.Now()
+	source := newTestPendingSource(PendingOrder{Plat: pollPlat, MerchantOrderNo: "T1", CreatedTime: created})
+	p := &Poller{
+		Source: source, Handler: func(*NotifyResult) error { return nil },
+		Backoff:  []time.Duration{30 * time.Millisecond, 60 * time.Millisecond, time.Hour},
+		Interval: 5 * time.Millisecond,
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 250*time.Millisecond)
+	defer cancel()
+	if err := p.Run(ctx); err != context.DeadlineExceeded {
+		t.Fatalf("got error %v, want DeadlineExceeded", err)
+	}
+	// 创建 30ms 后首次查询，间隔 60ms 后第二次查询，此后间隔 1h
+	queries := provider.queried("T1")
+	if len(queries) != 2 {
+		t.Fatalf("got %d queries, want 2", len(queries))
+	}
+	if d := queries[0].Sub(created); d < 30*time.Millisecond {
+		t.Errorf("first query after %v, want at least 30ms", d)
+	}
+	if d := queries[1].Sub(queries[0]); d < 60*time.Millisecond {
+		t.Errorf("second query after %v, want at least 60ms", d)
+	}
+}
+
+func TestPollerConcurrency(t *testing.T) {
+	provider := registerPollProvider(t)
+	provider.delay = 30 * time.Millisecond
+	var orders []PendingOrder
+	for _, no := range []string{"T1", "T2", "T3", "T4", "T5", "T6"} {
+		provider.states[no] = TradeStateClosed
+		orders = append(orders, PendingOrder{Plat: pollPlat, MerchantOrderNo: no, CreatedTime: time.Now().Add(-time.Minute)})
+	}
+	source := newTestPendingSource(orders...)
+	p := &Poller{
+		Source: source, Handler: func(*NotifyResult) error { return nil },
+		Backoff: []time.Duration{time.Millisecond}, Concurrency: 2, Interval: 5 * time.Millisecond,
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 300*time.Millisecond)
+	defer cancel()
+	p.Run(ctx)
+	if provider.maxRun != 2 {
+		t.Fatalf("got %d concurrent queries, want 2", provider.maxRun)
+	}
+	if len(source.settled) != len(orders) {
+		t.Fatalf("settled %d orders, want %d", len(source.settled), len(orders))
+	}
+}
+
+func TestPollerCancel(t *testing.T) {
+	provider := registerPollProvider(t)
+	provider.states["T1"] = TradeStateSuccess
+	provider.delay = 50 * time.Millisecond
+	source := newTestPendingSource(PendingOrder{Plat: pollPlat, MerchantOrderNo: "T1", CreatedTime: time.Now().Add(-time.Minute)})
+	var mu sync.Mutex
+	handled := false
+	p := &Poller{Source: source, Backoff: []time.Duration{time.Millisecond}, Interval: time.Hour, Handler: func(*NotifyResult) error {
+		mu.Lock()
+		handled = true
+		mu.Unlock()
+		return nil
+	}}
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(10*time.Millisecond, cancel)
+	start := time.Now()
+	if err := p.Run(ctx); err != context.Canceled {
+		t.Fatalf("got error %v, want Canceled", err)
+	}
+	// 返回前等待进行中的查询结束，且不等待下一次扫描
+	mu.Lock()
+	defer mu.Unlock()
+	if !handled || time.Since(start) > time.Second {
+		t.Fatalf("handled %v after %v", handled, time.Since(start))
+	}
+}
@@ -0,0 +1,311 @@
+// Package reconcile 实现支付平台对账单与本地订单记录的对账
+package reconcile
+
+import (
+	"encoding/json"
+	"io"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/shengzhi/payment"
+)
+
+// Status 记录状态
+type Status string
+
+// 记录状态定义
+const (
+	StatusSuccess Status = "SUCCESS" // 支付或退款成功
+	StatusPending Status = "PENDING" // 处理中
+	StatusClosed  Status = "CLOSED"  // 已关闭、已撤销或退款失败
+)
+
+// LocalRecord 本地订单记录，金额单位：分
+type LocalRecord struct {
+	MerchantID       string
+	MerchantOrderNo  string
+	MerchantRefundNo string // 退款记录的商户退款单号
+	IsRefund         bool
+	Amount           int64 // 支付金额或退款金额
+	Status           Status
+	TradeTime        time.Time
+}
+
+// Ledger 本地账本
+type Ledger interface {
+	// Records 读取指定平台指定日期的本地记录，每条记录调用一次 fn
+	Records(plat payment.PayPlat, date time.Time, fn func(record LocalRecord) error) error
+}
+
+// BillSource 平台账单明细来源，每条明细调用一次 fn，
+// 如 func(fn payment.BillRecordFunc) error { _, err := wechat.ParseBill(r, fn); return err }
+type BillSource func(fn payment.BillRecordFunc) error
+
+// DiffType 差异类型
+type DiffType string
+
+// 差异类型定义
+const (
+	DiffMissingLocal   DiffType = "missing_local"   // 平台有记录，本地无记录
+	DiffMissingRemote  DiffType = "missing_remote"  // 本地有记录，平台无记录
+	DiffAmountMismatch DiffType = "amount_mismatch" // 金额不一致
+	DiffStatusMismatch DiffType = "status_mismatch" // 状态不一致
+	DiffDuplicate      DiffType = "duplicate"       // 重复记录
+)
+
+// Diff 对账差异
+type Diff struct {
+	Type             DiffType `json:"type"`
+	Source           string   `json:"source,omitempty"` // 重复记录来源 local/remote
+	MerchantID       string   `json:"merchant_id,omitempty"`
+	MerchantOrderNo  string   `json:"merchant_order_no"`
+	MerchantRefundNo string   `json:"merchant_refund_no,omitempty"`
+	TransactionID    string   `json:"transaction_id,omitempty"`
+	IsRefund         bool     `json:"is_refund"`
+	LocalAmount      int64    `json:"local_amount"`
+	RemoteAmount     int64    `json:"remote_amount"`
+	LocalStatus      Status   `json:"local_status,omitempty"`
+	RemoteStatus     Status   `json:"remote_status,omitempty"`
+}
+
+// Total 商户单日汇总，金额单位：分
+type Total struct {
+	MerchantID         string `json:"merchant_id"`
+	Date               string `json:"date"`
+	LocalPayCount      int    `json:"local_pay_count"`
+	LocalPayAmount     int64  `json:"local_pay_amount"`
+	LocalRefundCount   int    `json:"local_refund_count"`
+	LocalRefundAmount  int64  `json:"local_refund_amount"`
+	RemotePayCount     int    `json:"remote_pay_count"`
+	RemotePayAmount    int64  `json:"remote_pay_amount"`
+	RemoteRefundCount  int    `json:"remote_refund_count"`
+	RemoteRefundAmount int64  `json:"remote_refund_amount"`
+	RemoteFee          int64  `json:"remote_fee"`
+}
+
+// Report 对账报告
+type Report struct {
+	Plat    payment.PayPlat `json:"plat"`
+	Date    string          `json:"date"`
+	Matched int             `json:"matched"`
+	Diffs   []Diff          `json:"diffs"`
+	Totals  []Total         `json:"totals"`
+}
+
+// WriteJSON 以JSON格式输出对账报告
+func (r *Report) WriteJSON(w io.Writer) error {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(r)
+}
+
+type recordKey struct {
+	orderNo, refundNo string
+	isRefund          bool
+}
+
+type remoteEntry struct {
+	record     payment.BillRecord
+	merchantID string // 归一后的商户号
+	matched    bool
+	origin     *remoteEntry // 重复记录对应的首条记录
+}
+
+// Run 对指定平台指定日期的账单与本地账本进行对账。平台账单明细按订单号索引于内存，本地记录流式比对。
+// 账单或本地记录缺少商户号时，按匹配记录的商户号归一，未匹配的账单记录在本地仅有一个商户时归入该商户
+func Run(ledger Ledger, plat payment.PayPlat, date time.Time, bill BillSource) (*Report, error) {
+	report := &Report{Plat: plat, Date: date.Format("2006-01-02"), Diffs: make([]Diff, 0)}
+	totals := make(map[[2]string]*Total)
+	total := func(merchantID string, t time.Time) *Total {
+		key := [2]string{merchantID, t.Format("2006-01-02")}
+		if v, has := totals[key]; has {
+			return v
+		}
+		v := &Total{MerchantID: key[0], Date: key[1]}
+		totals[key] = v
+		return v
+	}
+
+	remotes := make(map[recordKey]*remoteEntry)
+	var duplicates []*remoteEntry
+	err := bill(func(r payment.BillRecord) error {
+		r.MerchantID = strings.TrimSpace(r.MerchantID)
+		key := recordKey{orderNo: r.MerchantOrderNo, isRefund: r.IsRefund}
+		if r.IsRefund {
+			key.refundNo = r.MerchantRefundNo
+		}
+		if origin, has := remotes[key]; has {
+			duplicates = append(duplicates, &remoteEntry{record: r, merchantID: r.MerchantID, origin: origin})
+			return nil
+		}
+		remotes[key] = &remoteEntry{record: r, merchantID: r.MerchantID}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	locals := make(map[recordKey]bool)
+	localMerchants := make(map[string]bool)
+	err = ledger.Records(plat, date, func(l LocalRecord) error {
+		key := recordKey{orderNo: l.MerchantOrderNo, isRefund: l.IsRefund}
+		if l.IsRefund {
+			key.refundNo = l.MerchantRefundNo
+		}
+		entry, has := remotes[key]
+		merchantID := strings.TrimSpace(l.MerchantID)
+		if has {
+			if merchantID == "" {
+				merchantID = entry.merchantID
+			} else if entry.merchantID == "" {
+				entry.merchantID = merchantID
+			}
+		}
+		if merchantID != "" {
+			localMerchants[merchantID] = true
+		}
+		t := total(merchantID, l.TradeTime)
+		if l.IsRefund {
+			t.LocalRefundCount++
+			t.LocalRefundAmount += l.Amount
+		} else {
+			t.LocalPayCount++
+			t.LocalPayAmount += l.Amount
+		}
+		diff := Diff{
+			MerchantID:       merchantID,
+			MerchantOrderNo:  l.MerchantOrderNo,
+			MerchantRefundNo: l.MerchantRefundNo,
+			IsRefund:         l.IsRefund,
+			LocalAmount:      l.Amount,
+			LocalStatus:      l.Status,
+		}
+		if locals[key] {
+			diff.Type, diff.Source = DiffDuplicate, "local"
+			report.Diffs = append(report.Diffs, diff)
+			return nil
+		}
+		locals[key] = true
+		if !has {
+			if l.Status == StatusSuccess {
+				diff.Type = DiffMissingRemote
+				report.Diffs = append(report.Diffs, diff)
+			}
+			return nil
+		}
+		entry.matched = true
+		diff.TransactionID = entry.record.TransactionID
+		diff.RemoteAmount = remoteAmount(entry.record)
+		diff.RemoteStatus = remoteStatus(entry.record)
+		switch {
+		case diff.LocalStatus != diff.RemoteStatus:
+			diff.Type = DiffStatusMismatch
+		case diff.LocalAmount != diff.RemoteAmount:
+			diff.Type = DiffAmountMismatch
+		default:
+			report.Matched++
+			return nil
+		}
+		report.Diffs = append(report.Diffs, diff)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	var defaultMerchant string
+	if len(localMerchants) == 1 {
+		for id := range localMerchants {
+			defaultMerchant = id
+		}
+	}
+	remoteTotal := func(entry *remoteEntry) {
+		if entry.merchantID == "" && entry.origin != nil {
+			entry.merchantID = entry.origin.merchantID
+		}
+		if entry.merchantID == "" {
+			entry.merchantID = defaultMerchant
+		}
+		r := entry.record
+		t := total(entry.merchantID, r.TradeTime)
+		if r.IsRefund {
+			t.RemoteRefundCount++
+			t.RemoteRefundAmount += r.RefundAmount
+		} else {
+			t.RemotePayCount++
+			t.RemotePayAmount += r.TotalAmount
+		}
+		t.RemoteFee += r.Fee
+	}
+	for _, entry := range remotes {
+		remoteTotal(entry)
+		if !entry.matched {
+			report.Diffs = append(report.Diffs, remoteDiff(DiffMissingLocal, entry))
+		}
+	}
+	for _, entry := range duplicates {
+		remoteTotal(entry)
+		report.Diffs = append(report.Diffs, remoteDiff(DiffDuplicate, entry))
+	}
+	sort.SliceStable(report.Diffs, func(i, j int) bool {
+		if report.Diffs[i].Type != report.Diffs[j].Type {
+			return report.Diffs[i].Type < report.Diffs[j].Type
+		}
+		return report.Diffs[i].MerchantOrderNo < report.Diffs[j].MerchantOrderNo
+	})
+	report.Totals = make([]Total, 0, len(totals))
+	for _, t := range totals {
+		report.Totals = append(report.Totals, *t)
+	}
+	sort.Slice(report.Totals, func(i, j int) bool {
+		if report.Totals[i].Date != report.Totals[j].Date {
+			return report.Totals[i].Date < report.Totals[j].Date
+		}
+		return report.Totals[i].MerchantID < report.Totals[j].MerchantID
+	})
+	return report, nil
+}
+
+func remoteDiff(tp DiffType, entry *remoteEntry) Diff {
+	r := entry.record
+	diff := Diff{
+		Type:             tp,
+		MerchantID:       entry.merchantID,
+		MerchantOrderNo:  r.MerchantOrderNo,
+		MerchantRefundNo: r.MerchantRefundNo,
+		TransactionID:    r.TransactionID,
+		IsRefund:         r.IsRefund,
+		RemoteAmount:     remoteAmount(r),
+		RemoteStatus:     remoteStatus(r),
+	}
+	if tp == DiffDuplicate {
+		diff.Source = "remote"
+	}
+	return diff
+}
+
+func remoteAmount(r payment.BillRecord) int64 {
+	if r.IsRefund {
+		return r.RefundAmount
+	}
+	return r.TotalAmount
+}
+
+// remoteStatus 账单记录状态，微信撤销订单及退款失败视为关闭
+func remoteStatus(r payment.BillRecord) Status {
+	if r.IsRefund {
+		switch r.RefundStatus {
+		case "", "SUCCESS":
+			return StatusSuccess
+		case "PROCESSING":
+			return StatusPending
+		default:
+			return StatusClosed
+		}
+	}
+	if r.Status == payment.BillStatusRevoked {
+		return StatusClosed
+	}
+	return StatusSuccess
+}
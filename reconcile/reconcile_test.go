@@ -0,0 +1,167 @@
+package reconcile
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/shengzhi/payment"
+)
+
+type testLedger []LocalRecord
+
+func (l testLedger) Records(plat payment.PayPlat, date time.Time, fn func(record LocalRecord) error) error {
+	for _, r := range l {
+		if err := fn(r); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func billSource(records ...payment.BillRecord) BillSource {
+	return func(fn payment.BillRecordFunc) error {
+		for _, r := range records {
+			if err := fn(r); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+}
+
+var testDate = time.Date(2026, 10, 17, 10, 0, 0, 0, time.Local)
+
+func pay(merchantID, orderNo string, amount int64) payment.BillRecord {
+	return payment.BillRecord{MerchantID: merchantID, MerchantOrderNo: orderNo, TransactionID: "TX" + orderNo, Status: payment.BillStatusSuccess, TotalAmount: amount, TradeTime: testDate}
+}
+
+func refund(merchantID, orderNo, refundNo string, amount int64) payment.BillRecord {
+	return payment.BillRecord{MerchantID: merchantID, MerchantOrderNo: orderNo, TransactionID: "TX" + orderNo, Status: payment.BillStatusRefund, IsRefund: true, MerchantRefundNo: refundNo, RefundAmount: amount, RefundStatus: "SUCCESS", TradeTime: testDate}
+}
+
+func local(merchantID, orderNo string, amount int64) LocalRecord {
+	return LocalRecord{MerchantID: merchantID, MerchantOrderNo: orderNo, Amount: amount, Status: StatusSuccess, TradeTime: testDate}
+}
+
+func localRefund(merchantID, orderNo, refundNo string, amount int64) LocalRecord {
+	return LocalRecord{MerchantID: merchantID, MerchantOrderNo: orderNo, MerchantRefundNo: refundNo, IsRefund: true, Amount: amount, Status: StatusSuccess, TradeTime: testDate}
+}
+
+type diffKey struct {
+	Type     DiffType
+	OrderNo  string
+	Merchant string
+}
+
+func TestRun(t *testing.T) {
+	tests := []struct {
+		name    string
+		remote  []payment.BillRecord
+		local   testLedger
+		matched int
+		diffs   []diffKey
+		totals  []Total
+	}{
+		{
+			name:    "matched",
+			remote:  []payment.BillRecord{pay("M1", "T1", 100), refund("M1", "T1", "T1-R1", 30)},
+			local:   testLedger{local("M1", "T1", 100), localRefund("M1", "T1", "T1-R1", 30)},
+			matched: 2,
+			totals: []Total{{
+				MerchantID: "M1", Date: "2026-10-17",
+				LocalPayCount: 1, LocalPayAmount: 100, LocalRefundCount: 1, LocalRefundAmount: 30,
+				RemotePayCount: 1, RemotePayAmount: 100, RemoteRefundCount: 1, RemoteRefundAmount: 30,
+			}},
+		},
+		{
+			name:   "missing local",
+			remote: []payment.BillRecord{pay("M1", "T1", 100), pay("M1", "T2", 200)},
+			local:  testLedger{local("M1", "T1", 100)},
+			diffs:  []diffKey{{DiffMissingLocal, "T2", "M1"}},
+		},
+		{
+			name:   "missing remote",
+			remote: []payment.BillRecord{pay("M1", "T1", 100)},
+			local:  testLedger{local("M1", "T1", 100), local("M1", "T2", 200), {MerchantID: "M1", MerchantOrderNo: "T3", Amount: 300, Status: StatusClosed}},
+			diffs:  []diffKey{{DiffMissingRemote, "T2", "M1"}},
+		},
+		{
+			name:   "amount mismatch",
+			remote: []payment.BillRecord{pay("M1", "T1", 100), refund("M1", "T1", "T1-R1", 30)},
+			local:  testLedger{local("M1", "T1", 101), localRefund("M1", "T1", "T1-R1", 30)},
+			diffs:  []diffKey{{DiffAmountMismatch, "T1", "M1"}},
+		},
+		{
+			name:   "status mismatch",
+			remote: []payment.BillRecord{{MerchantID: "M1", MerchantOrderNo: "T1", Status: payment.BillStatusRevoked, TotalAmount: 100, TradeTime: testDate}},
+			local:  testLedger{local("M1", "T1", 100)},
+			diffs:  []diffKey{{DiffStatusMismatch, "T1", "M1"}},
+		},
+		{
+			name:   "duplicate",
+			remote: []payment.BillRecord{pay("M1", "T1", 100), pay("M1", "T1", 100)},
+			local:  testLedger{local("M1", "T1", 100), local("M1", "T1", 100)},
+			diffs:  []diffKey{{DiffDuplicate, "T1", "M1"}, {DiffDuplicate, "T1", "M1"}},
+		},
+		{
+			name:   "remote without merchant id",
+			remote: []payment.BillRecord{pay("", "T1", 100), pay("", "T2", 200)},
+			local:  testLedger{local("2088001", "T1", 100)},
+			diffs:  []diffKey{{DiffMissingLocal, "T2", "2088001"}},
+			totals: []Total{{
+				MerchantID: "2088001", Date: "2026-10-17",
+				LocalPayCount: 1, LocalPayAmount: 100, RemotePayCount: 2, RemotePayAmount: 300,
+			}},
+		},
+		{
+			name:   "local without merchant id",
+			remote: []payment.BillRecord{pay("M1", "T1", 100)},
+			local:  testLedger{local("", "T1", 100), local("", "T2", 200)},
+			diffs:  []diffKey{{DiffMissingRemote, "T2", ""}},
+			totals: []Total{
+				{MerchantID: "", Date: "2026-10-17", LocalPayCount: 1, LocalPayAmount: 200},
+				{MerchantID: "M1", Date: "2026-10-17", LocalPayCount: 1, LocalPayAmount: 100, RemotePayCount: 1, RemotePayAmount: 100},
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			report, err := Run(tt.local, payment.PayPlatAlipay, testDate, billSource(tt.remote...))
+			if err != nil {
+				t.Fatal(err)
+			}
+			diffs := make([]diffKey, 0, len(report.Diffs))
+			for _, d := range report.Diffs {
+				diffs = append(diffs, diffKey{d.Type, d.MerchantOrderNo, d.MerchantID})
+			}
+			if tt.diffs == nil {
+				tt.diffs = []diffKey{}
+			}
+			if !reflect.DeepEqual(diffs, tt.diffs) {
+				t.Errorf("got diffs %v, want %v", diffs, tt.diffs)
+			}
+			if tt.matched != 0 && report.Matched != tt.matched {
+				t.Errorf("got matched %d, want %d", report.Matched, tt.matched)
+			}
+			if tt.totals != nil && !reflect.DeepEqual(report.Totals, tt.totals) {
+				t.Errorf("got totals %+v, want %+v", report.Totals, tt.totals)
+			}
+		})
+	}
+}
+
+func TestRunAmountMismatchDetail(t *testing.T) {
+	report, err := Run(testLedger{localRefund("M1", "T1", "T1-R1", 50)}, payment.PayPlatWechat, testDate,
+		billSource(refund("M1", "T1", "T1-R1", 30)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := Diff{
+		Type: DiffAmountMismatch, MerchantID: "M1", MerchantOrderNo: "T1", MerchantRefundNo: "T1-R1", TransactionID: "TXT1",
+		IsRefund: true, LocalAmount: 50, RemoteAmount: 30, LocalStatus: StatusSuccess, RemoteStatus: StatusSuccess,
+	}
+	if len(report.Diffs) != 1 || report.Diffs[0] != want {
+		t.Fatalf("got diffs %+v, want %+v", report.Diffs, want)
+	}
+}
@@ -0,0 +1,72 @@
+// 瞬时错误重试
+
+package payment
+
+import (
+	"context"
+	"errors"
+	"math/rand"
+	"time"
+)
+
+// RetryPolicy 重试策略，零值表示不重试
+type RetryPolicy struct {
+	MaxAttempts int           // 最大尝试次数，包含首次调用
+	BaseDelay   time.Duration // 首次重试前的等待时长
+	MaxDelay    time.Duration // 最大等待时长
+}
+
+// DefaultRetryPolicy 默认重试策略
+var DefaultRetryPolicy = RetryPolicy{MaxAttempts: 3, BaseDelay: 200 * time.Millisecond, MaxDelay: 2 * time.Second}
+
+// Backoff 第 attempt 次重试(从0开始)前的等待时长，按指数增长并在后半段随机抖动
+func (p RetryPolicy) Backoff(attempt int) time.Duration {
+	delay := p.BaseDelay
+	for i := 0; i < attempt && (p.MaxDelay <= 0 || delay < p.MaxDelay); i++ {
+		delay *= 2
+	}
+	if p.MaxDelay > 0 && delay > p.MaxDelay {
+		delay = p.MaxDelay
+	}
+	if delay <= 0 {
+		return 0
+	}
+	half := delay / 2
+	return half + time.Duration(rand.Int63n(int64(delay-half)+1))
+}
+
+// Do 执行 fn，返回 retryable 判定可重试的错误时按策略重试；
+// ctx 取消或剩余时间不足以等待下一次重试时，返回最后一次的错误
+func (p RetryPolicy) Do(ctx context.Context, retryable func(error) bool, fn func() error) error {
+	for attempt := 0; ; attempt++ {
+		err := fn()
+		if err == nil || attempt+1 >= p.MaxAttempts || !retryable(err) {
+			return err
+		}
+		delay := p.Backoff(attempt)
+		if deadline, ok := ctx.Deadline(); ok && time.Until(deadline) < delay {
+			return err
+		}
+		timer := time.NewTimer(delay)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return err
+		case <-timer.C:
+		}
+	}
+}
+
+// IsBusinessError 判断是否为支付平台明确拒绝的业务错误，即实现 BusinessError() bool 并返回 true 的错误，
+// 如余额不足、退款金额超过可退金额，业务错误使用相同参数重试不会成功
+func IsBusinessError(err error) bool {
+	var e interface{ BusinessError() bool }
+	return errors.As(err, &e) && e.BusinessError()
+}
+
+// IsTransient 判断是否为瞬时错误，即实现 Temporary() bool 并返回 true 的错误，
+// 如网络超时及支付平台系统繁忙、频率限制，瞬时错误可使用相同参数重试
+func IsTransient(err error) bool {
+	var e interface{ Temporary() bool }
+	return errors.As(err, &e) && e.Temporary()
+}
@@ -0,0 +1,267 @@
+// 请求跟踪及敏感信息脱敏
+
+package payment
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"encoding/xml"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// MaskFunc 字段值脱敏函数
+type MaskFunc func(value string) string
+
+// MaskAll 完全隐藏字段值
+func MaskAll(value string) string { return "***" }
+
+// MaskMiddle 保留前 prefix 位及后 suffix 位字符，隐藏中间部分
+func MaskMiddle(prefix, suffix int) MaskFunc {
+	return func(value string) string {
+		runes := []rune(value)
+		if len(runes) <= prefix+suffix {
+			return "***"
+		}
+		return string(runes[:prefix]) + "***" + string(runes[len(runes)-suffix:])
+	}
+}
+
+// Redactor 按字段名脱敏，嵌套字段以最后一级字段名匹配规则，数组元素以所在数组的字段名匹配
+type Redactor struct {
+	rules map[string]MaskFunc
+}
+
+// NewRedactor 创建脱敏规则
+func NewRedactor(rules map[string]MaskFunc) *Redactor {
+	r := &Redactor{rules: make(map[string]MaskFunc, len(rules))}
+	for field, fn := range rules {
+		r.rules[field] = fn
+	}
+	return r
+}
+
+// DefaultRedactor 默认脱敏规则，隐藏签名、密钥及密文，部分隐藏证件号、手机号、姓名、用户标识等个人信息
+func DefaultRedactor() *Redactor {
+	return NewRedactor(map[string]MaskFunc{
+		"sign":            MaskAll,
+		"paySign":         MaskAll,
+		"key":             MaskAll,
+		"secret":          MaskAll,
+		"req_info":        MaskAll,
+		"enc_bank_no":     MaskAll,
+		"enc_true_name":   MaskAll,
+		"cert_no":         MaskMiddle(3, 4),
+		"mobile":          MaskMiddle(3, 4),
+		"bank_no":         MaskMiddle(0, 4),
+		"email":           MaskMiddle(2, 0),
+		"name":            MaskMiddle(1, 0),
+		"re_user_name":    MaskMiddle(1, 0),
+		"true_name":       MaskMiddle(1, 0),
+		"payee_account":   MaskMiddle(3, 4),
+		"payee_real_name": MaskMiddle(1, 0),
+		"openid":          MaskMiddle(4, 4),
+		"re_openid":       MaskMiddle(4, 4),
+		"sub_openid":      MaskMiddle(4, 4),
+		"buyer_id":        MaskMiddle(4, 4),
+		"buyer_user_id":   MaskMiddle(4, 4),
+		"buyer_logon_id":  MaskMiddle(3, 4),
+	})
+}
+
+// With 返回增加或覆盖字段规则后的新规则
+func (r *Redactor) With(field string, fn MaskFunc) *Redactor {
+	n := NewRedactor(r.rules)
+	n.rules[field] = fn
+	return n
+}
+
+// Redact 对单个字段脱敏
+func (r *Redactor) Redact(field, value string) string {
+	for {
+		i := strings.LastIndexByte(field, '.')
+		if i < 0 {
+			break
+		}
+		// 数组元素 list.0 以数组字段名 list 匹配
+		if _, err := strconv.Atoi(field[i+1:]); err != nil {
+			field = field[i+1:]
+			break
+		}
+		field = field[:i]
+	}
+	if fn, has := r.rules[field]; has && value != "" {
+		return fn(value)
+	}
+	return value
+}
+
+// RedactBody 解析XML、JSON或表单格式的报文并返回脱敏后的字段，JSON嵌套字段及数组下标以.连接
+func (r *Redactor) RedactBody(body []byte) map[string]string {
+	fields := make(map[string]string)
+	body = bytes.TrimSpace(body)
+	switch {
+	case len(body) == 0:
+	case body[0] == '<':
+		r.flattenXML(body, fields)
+	case body[0] == '{':
+		var v interface{}
+		if json.Unmarshal(body, &v) == nil {
+			r.flattenJSON("", v, fields)
+		}
+	default:
+		values, err := url.ParseQuery(string(body))
+		if err != nil {
+			break
+		}
+		for k := range values {
+			v := values.Get(k)
+			var obj map[string]interface{}
+			if strings.HasPrefix(v, "{") && json.Unmarshal([]byte(v), &obj) == nil {
+				r.flattenJSON(k, obj, fields)
+				continue
+			}
+			fields[k] = r.Redact(k, v)
+		}
+	}
+	return fields
+}
+
+func (r *Redactor) flattenJSON(prefix string, v interface{}, fields map[string]string) {
+	switch t := v.(type) {
+	case map[string]interface{}:
+		for k, child := range t {
+			if prefix != "" {
+				k = prefix + "." + k
+			}
+			r.flattenJSON(k, child, fields)
+		}
+	case []interface{}:
+		for i, child := range t {
+			r.flattenJSON(prefix+"."+strconv.Itoa(i), child, fields)
+		}
+	case string:
+		// 加密的响应内容等JSON字符串值
+		var obj map[string]interface{}
+		if strings.HasPrefix(t, "{") && json.Unmarshal([]byte(t), &obj) == nil {
+			r.flattenJSON(prefix, obj, fields)
+			return
+		}
+		fields[prefix] = r.Redact(prefix, t)
+	default:
+		data, _ := json.Marshal(t)
+		fields[prefix] = r.Redact(prefix, string(data))
+	}
+}
+
+func (r *Redactor) flattenXML(body []byte, fields map[string]string) {
+	d := xml.NewDecoder(bytes.NewReader(body))
+	var name string
+	for {
+		token, err := d.Token()
+		if err != nil {
+			return
+		}
+		switch t := token.(type) {
+		case xml.StartElement:
+			name = t.Name.Local
+		case xml.CharData:
+			if v := strings.TrimSpace(string(t)); name != "" && v != "" {
+				fields[name] = r.Redact(name, v)
+			}
+		case xml.EndElement:
+			name = ""
+		}
+	}
+}
+
+// TraceEvent 结构化跟踪记录
+type TraceEvent struct {
+	Plat    PayPlat           `json:"plat"`
+	Type    string            `json:"type"` // request/response
+	Method  string            `json:"method"`
+	URL     string            `json:"url"`
+	Status  int               `json:"status,omitempty"`
+	Elapsed string            `json:"elapsed,omitempty"`
+	Error   string            `json:"error,omitempty"`
+	Fields  map[string]string `json:"fields,omitempty"`
+}
+
+// TraceMiddleware 以 logger 输出每次HTTP调用脱敏后的请求及响应字段，每条记录为一行JSON；
+// URL 不含查询参数，非XML及JSON格式的响应(如账单文件)不读取内容
+func TraceMiddleware(plat PayPlat, logger *log.Logger, redactor *Redactor) HTTPMiddleware {
+	if redactor == nil {
+		redactor = DefaultRedactor()
+	}
+	emit := func(e TraceEvent) {
+		data, _ := json.Marshal(e)
+		logger.Println(string(data))
+	}
+	return func(next http.RoundTripper) http.RoundTripper {
+		return RoundTripperFunc(func(req *http.Request) (*http.Response, error) {
+			event := TraceEvent{Plat: plat, Type: "request", Method: req.Method, URL: requestURL(req)}
+			if data := requestBody(req); data != nil {
+				event.Fields = redactor.RedactBody(data)
+			}
+			emit(event)
+			start := time.Now()
+			resp, err := next.RoundTrip(req)
+			event = TraceEvent{Plat: plat, Type: "response", Method: req.Method, URL: event.URL, Elapsed: time.Since(start).String()}
+			if err != nil {
+				event.Error = err.Error()
+				emit(event)
+				return resp, err
+			}
+			event.Status = resp.StatusCode
+			if data := responseBody(resp); data != nil {
+				event.Fields = redactor.RedactBody(data)
+			}
+			emit(event)
+			return resp, nil
+		})
+	}
+}
+
+// requestURL 不含查询参数的请求地址
+func requestURL(req *http.Request) string {
+	return req.URL.Scheme + "://" + req.URL.Host + req.URL.Path
+}
+
+// requestBody 读取可重复读取的请求报文
+func requestBody(req *http.Request) []byte {
+	if req.Body == nil || req.GetBody == nil {
+		return nil
+	}
+	body, err := req.GetBody()
+	if err != nil {
+		return nil
+	}
+	defer body.Close()
+	data, _ := ioutil.ReadAll(body)
+	return data
+}
+
+// responseBody 读取XML及JSON格式的响应报文并重置 resp.Body，其他格式(如账单文件)返回 nil 且不读取内容
+func responseBody(resp *http.Response) []byte {
+	br := bufio.NewReader(resp.Body)
+	if head, _ := br.Peek(1); len(head) == 0 || head[0] != '<' && head[0] != '{' {
+		resp.Body = readCloser{br, resp.Body}
+		return nil
+	}
+	data, _ := ioutil.ReadAll(br)
+	resp.Body.Close()
+	resp.Body = ioutil.NopCloser(bytes.NewReader(data))
+	return data
+}
+
+type readCloser struct {
+	io.Reader
+	io.Closer
+}
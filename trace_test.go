@@ -0,0 +1,82 @@
+package payment
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestRedactBody(t *testing.T) {
+	tests := []struct {
+		name string
+		body string
+		want map[string]string
+	}{
+		{
+			name: "xml",
+			body: `<xml><openid><![CDATA[oUpF8uMuAJO_M2pxb1Q9zNjWeS6o]]></openid><sign>ABC</sign><total_fee>100</total_fee></xml>`,
+			want: map[string]string{"openid": "oUpF***eS6o", "sign": "***", "total_fee": "100"},
+		},
+		{
+			name: "json nested",
+			body: `{"alipay_trade_query_response":{"buyer_logon_id":"159****5620","total_amount":"88.88"},"sign":"ERITJKEIJKJHKKKKKKKHJEREEEEEEEEEEE"}`,
+			want: map[string]string{
+				"alipay_trade_query_response.buyer_logon_id": "159***5620",
+				"alipay_trade_query_response.total_amount":   "88.88",
+				"sign": "***",
+			},
+		},
+		{
+			name: "json array of objects",
+			body: `{"trans_list":[{"payee_account":"13800138000","payee_real_name":"张三","amount":"1.00"},{"payee_account":"abc@example.com"}]}`,
+			want: map[string]string{
+				"trans_list.0.payee_account":   "138***8000",
+				"trans_list.0.payee_real_name": "张***",
+				"trans_list.0.amount":          "1.00",
+				"trans_list.1.payee_account":   "abc***.com",
+			},
+		},
+		{
+			name: "json array of values",
+			body: `{"mobile":["13800138000","13900139000"],"count":2}`,
+			want: map[string]string{"mobile.0": "138***8000", "mobile.1": "139***9000", "count": "2"},
+		},
+		{
+			name: "form with biz_content",
+			body: `app_id=2021000000000000&sign=abc&biz_content=%7B%22payee_account%22%3A%2213800138000%22%2C%22out_biz_no%22%3A%22T1%22%7D`,
+			want: map[string]string{
+				"app_id":                    "2021000000000000",
+				"sign":                      "***",
+				"biz_content.payee_account": "138***8000",
+				"biz_content.out_biz_no":    "T1",
+			},
+		},
+	}
+	r := DefaultRedactor()
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := r.RedactBody([]byte(tt.body)); !reflect.DeepEqual(got, tt.want) {
+				t.Fatalf("got %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRedact(t *testing.T) {
+	r := DefaultRedactor().With("coupon_id_0", MaskAll)
+	tests := []struct {
+		field, value, want string
+	}{
+		{"payee_account", "13800138000", "138***8000"},
+		{"payee_real_name", "张三", "张***"},
+		{"list.2.mobile", "13800138000", "138***8000"},
+		{"mobile.10", "13800138000", "138***8000"},
+		{"coupon_id_0", "10001", "***"},
+		{"name", "", ""},
+		{"out_trade_no", "T1", "T1"},
+	}
+	for _, tt := range tests {
+		if got := r.Redact(tt.field, tt.value); got != tt.want {
+			t.Errorf("Redact(%s, %s) = %s, want %s", tt.field, tt.value, got, tt.want)
+		}
+	}
+}
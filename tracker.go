@@ -0,0 +1,374 @@
+// 订单状态跟踪
+
+package payment
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+)
+
+// OrderState 订单状态
+type OrderState string
+
+// 订单状态定义
+const (
+	OrderStateCreated           OrderState = "CREATED"            // 已创建
+	OrderStatePaying            OrderState = "PAYING"             // 支付中
+	OrderStatePaid              OrderState = "PAID"               // 已支付
+	OrderStatePartiallyRefunded OrderState = "PARTIALLY_REFUNDED" // 部分退款
+	OrderStateRefunded          OrderState = "REFUNDED"           // 全额退款
+	OrderStateClosed            OrderState = "CLOSED"             // 已关闭
+)
+
+// orderTransitions 允许的状态变更
+var orderTransitions = map[OrderState][]OrderState{
+	OrderStateCreated:           {OrderStatePaying, OrderStatePaid, OrderStateClosed},
+	OrderStatePaying:            {OrderStatePaying, OrderStatePaid, OrderStateClosed},
+	OrderStatePaid:              {OrderStatePartiallyRefunded, OrderStateRefunded},
+	OrderStatePartiallyRefunded: {OrderStatePartiallyRefunded, OrderStateRefunded},
+}
+
+// CanTransit 判断订单状态是否允许变更为 to
+func (s OrderState) CanTransit(to OrderState) bool {
+	for _, v := range orderTransitions[s] {
+		if v == to {
+			return true
+		}
+	}
+	return false
+}
+
+var (
+	// ErrOrderNotFound 订单不存在
+	ErrOrderNotFound = errors.New("订单不存在")
+	// ErrOrderConflict 订单已被并发修改
+	ErrOrderConflict = errors.New("订单已被并发修改")
+
+	// errNoChange 重复事件，订单无需变更
+	errNoChange = errors.New("no change")
+)
+
+// TransitionError 无效的订单状态变更
+type TransitionError struct {
+	MerchantOrderNo string
+	From, To        OrderState
+}
+
+func (e *TransitionError) Error() string {
+	return fmt.Sprintf("订单 %s 状态不允许从 %s 变更为 %s", e.MerchantOrderNo, e.From, e.To)
+}
+
+// TrackedOrder 跟踪订单，金额单位：分
+type TrackedOrder struct {
+	Plat           PayPlat
+	Request        OrderRequest
+	State          OrderState
+	TransactionID  string // 支付平台交易号
+	PaidAmount     int64
+	RefundedAmount int64         // 已退款成功的金额
+	Refunds        []RefundEntry // 退款记录，按商户退款单号去重
+	PaidTime       time.Time
+	CreatedTime    time.Time
+	UpdatedTime    time.Time
+	Version        int64 // 版本号，用于乐观锁
+}
+
+// OrderStorage 跟踪订单存储
+type OrderStorage interface {
+	// Get 按商户订单号获取订单，不存在时返回 ErrOrderNotFound
+	Get(merchantOrderNo string) (*TrackedOrder, error)
+	// Save 保存订单，order.Version 为存储中的当前版本，不一致时返回 ErrOrderConflict，保存成功后版本号加1
+	Save(order *TrackedOrder) error
+}
+
+// OrderTracker 订单状态跟踪，同时按商户退款单号记录订单的部分及多次退款
+type OrderTracker struct {
+	mu      sync.Mutex
+	storage OrderStorage
+	orders  OrderStore // 业务订单存储，用于跟踪未跟踪订单的支付通知
+}
+
+// TrackerOption 订单状态跟踪选项
+type TrackerOption func(*OrderTracker)
+
+// WithUntrackedOrderStore 设置业务订单存储，收到未跟踪订单(如跟踪上线前创建的订单)的支付通知时，
+// 从中加载原始下单请求创建跟踪订单，再按支付通知校验金额
+func WithUntrackedOrderStore(store OrderStore) TrackerOption {
+	return func(t *OrderTracker) { t.orders = store }
+}
+
+// NewOrderTracker 创建订单状态跟踪
+func NewOrderTracker(storage OrderStorage, opts ...TrackerOption) *OrderTracker {
+	t := &OrderTracker{storage: storage}
+	for _, fn := range opts {
+		fn(t)
+	}
+	return t
+}
+
+// Order 记录下单请求并提交支付，下单成功后订单状态变更为支付中
+func (t *OrderTracker) Order(plat PayPlat, r *OrderRequest) (*OrderResponse, error) {
+	if _, err := t.Track(plat, r); err != nil {
+		return nil, err
+	}
+	resp, err := Order(plat, r)
+	if err != nil {
+		return nil, err
+	}
+	return resp, t.ApplyPaying(r.MerchanOrderNo)
+}
+
+// Track 记录下单请求，订单已存在时返回已有订单
+func (t *OrderTracker) Track(plat PayPlat, r *OrderRequest) (*TrackedOrder, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	order, err := t.storage.Get(r.MerchanOrderNo)
+	if err == nil {
+		return order, nil
+	}
+	if err != ErrOrderNotFound {
+		return nil, err
+	}
+	now := time.Now()
+	order = &TrackedOrder{Plat: plat, Request: *r, State: OrderStateCreated, CreatedTime: now, UpdatedTime: now}
+	if err = t.storage.Save(order); err != nil {
+		return nil, err
+	}
+	return order, nil
+}
+
+// Get 获取跟踪订单
+func (t *OrderTracker) Get(merchantOrderNo string) (*TrackedOrder, error) {
+	return t.storage.Get(merchantOrderNo)
+}
+
+// ApplyPaying 订单变更为支付中
+func (t *OrderTracker) ApplyPaying(merchantOrderNo string) error {
+	return t.apply(merchantOrderNo, func(order *TrackedOrder) (OrderState, error) {
+		return OrderStatePaying, nil
+	})
+}
+
+// ApplyPaid 根据支付通知或订单查询结果将订单变更为已支付，同一交易的重复通知忽略
+func (t *OrderTracker) ApplyPaid(result *NotifyResult) error {
+	return t.apply(result.MerchantOrderNo, func(order *TrackedOrder) (OrderState, error) {
+		if order.TransactionID != "" {
+			if order.TransactionID == result.TransactionID {
+				return "", errNoChange
+			}
+			return "", fmt.Errorf("订单 %s 已由交易 %s 支付", order.Request.MerchanOrderNo, order.TransactionID)
+		}
+		if result.TotalAmount != order.Request.Amount {
+			return "", fmt.Errorf("订单 %s 支付金额 %d 与订单金额 %d 不一致", order.Request.MerchanOrderNo, result.TotalAmount, order.Request.Amount)
+		}
+		order.TransactionID = result.TransactionID
+		order.PaidAmount = result.TotalAmount
+		order.PaidTime = result.CompletedTime
+		return OrderStatePaid, nil
+	})
+}
+
+// ApplyRefund 根据退款通知或退款查询结果按商户退款单号记录退款，重复通知及已是最终状态的退款忽略；
+// 支付宝通知金额为累计退款金额，新的退款按累计金额与已记录退款的差额记录。退款总额不得超过支付金额
+func (t *OrderTracker) ApplyRefund(result RefundNotifyResult) error {
+	return t.apply(result.MerchantOrderNo, func(order *TrackedOrder) (OrderState, error) {
+		if order.TransactionID == "" {
+			return "", fmt.Errorf("订单 %s 未支付", result.MerchantOrderNo)
+		}
+		status := result.Status
+		if status == "" {
+			status = RefundStatusClosed
+			if result.IsSuccess {
+				status = RefundStatusSuccess
+			}
+		}
+		r := order.findRefund(result.MerchantRefundNo)
+		if r == nil {
+			amount := int64(result.RefundAmount)
+			if result.Plat == PayPlatAlipay {
+				amount = int64(result.TotalRefundedAmount) - order.occupiedAmount()
+			}
+			if amount <= 0 {
+				return "", errNoChange
+			}
+			order.Refunds = append(order.Refunds, RefundEntry{MerchantRefundNo: result.MerchantRefundNo, Amount: amount, CreatedTime: time.Now()})
+			r = &order.Refunds[len(order.Refunds)-1]
+		} else if r.Status.IsFinal() || r.Status == status && r.RefundID == result.RefundID {
+			return "", errNoChange
+		}
+		r.Status = status
+		if result.RefundID != "" {
+			r.RefundID = result.RefundID
+		}
+		r.UpdatedTime = time.Now()
+		return order.refundState()
+	})
+}
+
+// RefundNotifyHandler 包装退款通知处理函数，先记录退款再调用 fn；未跟踪的订单记录日志后直接调用 fn，以免平台重复通知
+func (t *OrderTracker) RefundNotifyHandler(fn RefundNotifyHandleFunc) RefundNotifyHandleFunc {
+	return func(result RefundNotifyResult) error {
+		err := t.ApplyRefund(result)
+		if err == ErrOrderNotFound {
+			log.Printf("payment: refund %s of untracked order %s", result.MerchantRefundNo, result.MerchantOrderNo)
+		} else if err != nil {
+			return err
+		}
+		return fn(result)
+	}
+}
+
+func (o *TrackedOrder) findRefund(merchantRefundNo string) *RefundEntry {
+	for i := range o.Refunds {
+		if o.Refunds[i].MerchantRefundNo == merchantRefundNo {
+			return &o.Refunds[i]
+		}
+	}
+	return nil
+}
+
+// occupiedAmount 未关闭的退款金额，处理中及退款异常的退款同样占用可退金额
+func (o *TrackedOrder) occupiedAmount() int64 {
+	var amount int64
+	for _, r := range o.Refunds {
+		if r.Status != RefundStatusClosed {
+			amount += r.Amount
+		}
+	}
+	return amount
+}
+
+// refundState 根据退款成功的金额更新已退款金额并返回订单状态
+func (o *TrackedOrder) refundState() (OrderState, error) {
+	var refunded int64
+	for _, r := range o.Refunds {
+		if r.Status == RefundStatusSuccess {
+			refunded += r.Amount
+		}
+	}
+	if refunded > o.PaidAmount {
+		return "", fmt.Errorf("订单 %s 退款总额 %d 超过支付金额 %d: %w", o.Request.MerchanOrderNo, refunded, o.PaidAmount, ErrRefundExceeded)
+	}
+	o.RefundedAmount = refunded
+	switch {
+	case refunded == 0:
+		return o.State, nil
+	case refunded == o.PaidAmount:
+		return OrderStateRefunded, nil
+	default:
+		return OrderStatePartiallyRefunded, nil
+	}
+}
+
+// ApplyClose 关闭未支付订单
+func (t *OrderTracker) ApplyClose(merchantOrderNo string) error {
+	return t.apply(merchantOrderNo, func(order *TrackedOrder) (OrderState, error) {
+		if order.State == OrderStateClosed {
+			return "", errNoChange
+		}
+		return OrderStateClosed, nil
+	})
+}
+
+// NotifyHandler 包装支付通知处理函数，先变更订单状态再调用 fn；
+// 未跟踪的订单仅在设置 WithUntrackedOrderStore 且能加载原始下单请求时创建跟踪订单，否则返回 ErrOrderNotFound，
+// 不按通知内容创建订单
+func (t *OrderTracker) NotifyHandler(fn NotifyHandleFunc) NotifyHandleFunc {
+	return func(result *NotifyResult) error {
+		err := t.ApplyPaid(result)
+		if err == ErrOrderNotFound && t.orders != nil {
+			err = t.trackPaid(result)
+		}
+		if err != nil {
+			return err
+		}
+		return fn(result)
+	}
+}
+
+// trackPaid 从业务订单存储加载未跟踪订单的原始下单请求并创建跟踪订单，由 ApplyPaid 校验支付金额
+func (t *OrderTracker) trackPaid(result *NotifyResult) error {
+	r, err := t.orders.LoadOrder(result.MerchantOrderNo)
+	if err != nil {
+		return err
+	}
+	log.Printf("payment: track paid order %s from notify", result.MerchantOrderNo)
+	if _, err = t.Track(result.Plat, r); err != nil {
+		return err
+	}
+	return t.ApplyPaid(result)
+}
+
+// apply 加载订单，由 fn 修改订单并返回目标状态，校验状态变更后保存，目标状态与当前状态相同时仅保存修改
+func (t *OrderTracker) apply(merchantOrderNo string, fn func(order *TrackedOrder) (OrderState, error)) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	order, err := t.storage.Get(merchantOrderNo)
+	if err != nil {
+		return err
+	}
+	from := order.State
+	to, err := fn(order)
+	if err == errNoChange {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if to != from && !from.CanTransit(to) {
+		return &TransitionError{MerchantOrderNo: merchantOrderNo, From: from, To: to}
+	}
+	order.State = to
+	order.UpdatedTime = time.Now()
+	return t.storage.Save(order)
+}
+
+// MemoryOrderStorage 内存订单存储
+type MemoryOrderStorage struct {
+	mu     sync.RWMutex
+	orders map[string]TrackedOrder
+}
+
+// NewMemoryOrderStorage 创建内存订单存储
+func NewMemoryOrderStorage() *MemoryOrderStorage {
+	return &MemoryOrderStorage{orders: make(map[string]TrackedOrder)}
+}
+
+// Get 按商户订单号获取订单
+func (s *MemoryOrderStorage) Get(merchantOrderNo string) (*TrackedOrder, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	order, has := s.orders[merchantOrderNo]
+	if !has {
+		return nil, ErrOrderNotFound
+	}
+	order.Refunds = append([]RefundEntry(nil), order.Refunds...)
+	return &order, nil
+}
+
+// Save 保存订单
+func (s *MemoryOrderStorage) Save(order *TrackedOrder) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	no := order.Request.MerchanOrderNo
+	if current, has := s.orders[no]; has && current.Version != order.Version || !has && order.Version != 0 {
+		return ErrOrderConflict
+	}
+	order.Version++
+	saved := *order
+	saved.Refunds = append([]RefundEntry(nil), order.Refunds...)
+	s.orders[no] = saved
+	return nil
+}
+
+// LoadOrder 加载原始下单请求，实现 OrderStore
+func (s *MemoryOrderStorage) LoadOrder(merchantOrderNo string) (*OrderRequest, error) {
+	order, err := s.Get(merchantOrderNo)
+	if err != nil {
+		return nil, err
+	}
+	return &order.Request, nil
+}
@@ -0,0 +1,152 @@
+// 跟踪订单退款
+
+package payment
+
+import (
+	"errors"
+	"fmt"
+	"time"
+)
+
+// ErrRefundExceeded 退款总额超过支付金额
+var ErrRefundExceeded = errors.New("退款总额超过支付金额")
+
+// refundSyncGrace 退款提交后的查询宽限期，期间查询不到的退款仍视为处理中，以免请求尚未到达支付平台时误判为关闭
+const refundSyncGrace = time.Minute
+
+// RefundEntry 订单的一笔退款，金额单位：分
+type RefundEntry struct {
+	MerchantRefundNo string
+	Seq              int // 退款序号，从1开始，未经 OrderTracker.Refund 发起(如商户平台手工退款)的退款为0
+	Amount           int64
+	Reason           string
+	Status           RefundStatus
+	RefundID         string // 支付平台退款单号
+	CreatedTime      time.Time
+	UpdatedTime      time.Time
+}
+
+// RefundNo 第 seq 笔退款的商户退款单号
+func RefundNo(merchantOrderNo string, seq int) string {
+	return fmt.Sprintf("%s-R%d", merchantOrderNo, seq)
+}
+
+// RefundableAmount 可退款金额，处理中及退款异常的退款同样占用可退金额
+func (o *TrackedOrder) RefundableAmount() int64 {
+	return o.PaidAmount - o.occupiedAmount()
+}
+
+func (o *TrackedOrder) nextRefundSeq() int {
+	seq := 0
+	for _, r := range o.Refunds {
+		if r.Seq > seq {
+			seq = r.Seq
+		}
+	}
+	return seq + 1
+}
+
+// Refund 按 商户订单号-R序号 分配退款单号并提交退款，支持部分及多次退款，
+// 退款金额超过可退金额时返回的错误可通过 errors.Is 判断为 ErrRefundExceeded。
+// 提交失败时退款结果未知，退款保持处理中并占用可退金额，可通过 RetryRefund 以相同的退款单号重新提交，或通过 SyncRefunds 查询退款结果
+func (t *OrderTracker) Refund(merchantOrderNo string, amount int64, reason string) (RefundEntry, error) {
+	var entry RefundEntry
+	var order TrackedOrder
+	err := t.apply(merchantOrderNo, func(o *TrackedOrder) (OrderState, error) {
+		if o.TransactionID == "" {
+			return "", fmt.Errorf("订单 %s 未支付", merchantOrderNo)
+		}
+		if amount <= 0 {
+			return "", fmt.Errorf("退款金额必须大于0")
+		}
+		if amount > o.RefundableAmount() {
+			return "", fmt.Errorf("订单 %s 退款金额 %d 超过可退金额 %d: %w", merchantOrderNo, amount, o.RefundableAmount(), ErrRefundExceeded)
+		}
+		seq := o.nextRefundSeq()
+		now := time.Now()
+		entry = RefundEntry{
+			MerchantRefundNo: RefundNo(merchantOrderNo, seq), Seq: seq,
+			Amount: amount, Reason: reason, Status: RefundStatusProcessing,
+			CreatedTime: now, UpdatedTime: now,
+		}
+		o.Refunds = append(o.Refunds, entry)
+		order = *o
+		return o.State, nil
+	})
+	if err != nil {
+		return entry, err
+	}
+	return t.submitRefund(&order, entry)
+}
+
+// RetryRefund 以相同的退款单号及金额重新提交处理中的退款
+func (t *OrderTracker) RetryRefund(merchantOrderNo, merchantRefundNo string) (RefundEntry, error) {
+	order, err := t.storage.Get(merchantOrderNo)
+	if err != nil {
+		return RefundEntry{}, err
+	}
+	entry := order.findRefund(merchantRefundNo)
+	if entry == nil {
+		return RefundEntry{}, ErrRefundNotFound
+	}
+	if entry.Status != RefundStatusProcessing {
+		return *entry, fmt.Errorf("退款 %s 状态为 %s，不允许重新提交", merchantRefundNo, entry.Status)
+	}
+	return t.submitRefund(order, *entry)
+}
+
+// submitRefund 提交退款并记录支付平台退款单号，即时退款成功时变更为退款成功
+func (t *OrderTracker) submitRefund(order *TrackedOrder, entry RefundEntry) (RefundEntry, error) {
+	resp, err := Refund(order.Plat, RefundRequest{
+		MerchantOrderNo:  order.Request.MerchanOrderNo,
+		TransactionID:    order.TransactionID,
+		MerchantRefundNo: entry.MerchantRefundNo,
+		TotalFee:         int32(order.PaidAmount),
+		RefundFee:        int32(entry.Amount),
+		Reason:           entry.Reason,
+	})
+	if err != nil {
+		return entry, err
+	}
+	err = t.apply(order.Request.MerchanOrderNo, func(o *TrackedOrder) (OrderState, error) {
+		r := o.findRefund(entry.MerchantRefundNo)
+		if r == nil {
+			return "", ErrRefundNotFound
+		}
+		r.RefundID = resp.PlatRefundID
+		if resp.IsInstant && !r.Status.IsFinal() {
+			r.Status = RefundStatusSuccess
+		}
+		r.UpdatedTime = time.Now()
+		entry = *r
+		return o.refundState()
+	})
+	return entry, err
+}
+
+// SyncRefunds 查询订单全部未完成的退款并更新状态，支付平台需实现 RefundQuerier；
+// 超过宽限期仍查询不到的退款视为未提交成功，变更为退款关闭并释放可退金额
+func (t *OrderTracker) SyncRefunds(merchantOrderNo string) error {
+	order, err := t.storage.Get(merchantOrderNo)
+	if err != nil {
+		return err
+	}
+	for _, entry := range order.Refunds {
+		if entry.Status.IsFinal() {
+			continue
+		}
+		result, err := QueryRefund(order.Plat, merchantOrderNo, entry.MerchantRefundNo)
+		if err == ErrRefundNotFound {
+			if entry.Status != RefundStatusProcessing || time.Since(entry.UpdatedTime) < refundSyncGrace {
+				continue
+			}
+			result = RefundNotifyResult{Plat: order.Plat, MerchantOrderNo: merchantOrderNo, MerchantRefundNo: entry.MerchantRefundNo, Status: RefundStatusClosed}
+		} else if err != nil {
+			return fmt.Errorf("查询退款 %s 失败:%v", entry.MerchantRefundNo, err)
+		}
+		if err = t.ApplyRefund(result); err != nil {
+			return err
+		}
+	}
+	return nil
+}
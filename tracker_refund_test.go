@@ -0,0 +1,201 @@
+package payment
+
+import (
+	"errors"
+	"io"
+	"testing"
+	"time"
+)
+
+const testPlat PayPlat = "test"
+
+// testProvider 退款及退款查询结果可配置的支付提供实现
+type testProvider struct {
+	refunds   []RefundRequest
+	refundErr error
+	instant   bool
+	queries   map[string]RefundNotifyResult
+}
+
+func (p *testProvider) Order(*OrderRequest) (*OrderResponse, error)            { return &OrderResponse{}, nil }
+func (p *testProvider) NotifyCallback(io.Reader, NotifyHandleFunc) interface{} { return nil }
+func (p *testProvider) RefundCallback(io.Reader, RefundNotifyHandleFunc) interface{} {
+	return nil
+}
+func (p *testProvider) Retry(PaySource, string) (*OrderResponse, error) { return &OrderResponse{}, nil }
+func (p *testProvider) Query(string) (*QueryResult, error)              { return &QueryResult{}, nil }
+func (p *testProvider) Close(string) error                              { return nil }
+
+func (p *testProvider) Refund(r RefundRequest) (RefundResponse, error) {
+	p.refunds = append(p.refunds, r)
+	if p.refundErr != nil {
+		return RefundResponse{}, p.refundErr
+	}
+	return RefundResponse{MerchantRefundNo: r.MerchantRefundNo, PlatRefundID: "P" + r.MerchantRefundNo, IsInstant: p.instant}, nil
+}
+
+func (p *testProvider) QueryRefund(merchantOrderNo, merchantRefundNo string) (RefundNotifyResult, error) {
+	result, has := p.queries[merchantRefundNo]
+	if !has {
+		return RefundNotifyResult{}, ErrRefundNotFound
+	}
+	return result, nil
+}
+
+func registerTestProvider(t *testing.T) *testProvider {
+	t.Helper()
+	p := &testProvider{queries: make(map[string]RefundNotifyResult)}
+	Register(testPlat, p)
+	t.Cleanup(func() { delete(providerMap, testPlat) })
+	return p
+}
+
+func TestOrderTrackerRefund(t *testing.T) {
+	errNetwork := errors.New("connection reset")
+	tests := []struct {
+		name      string
+		instant   bool
+		refundErr error
+		amounts   []int64
+		wantErr   error
+		refundNos []string // 提交至支付平台的退款单号
+		status    RefundStatus
+		state     OrderState
+		left      int64 // 可退金额
+	}{
+		{name: "partial", amounts: []int64{30}, refundNos: []string{"T1-R1"}, status: RefundStatusProcessing, state: OrderStatePaid, left: 70},
+		{name: "multiple", amounts: []int64{30, 70}, refundNos: []string{"T1-R1", "T1-R2"}, status: RefundStatusProcessing, state: OrderStatePaid, left: 0},
+		{name: "exceeded", amounts: []int64{30, 80}, wantErr: ErrRefundExceeded, refundNos: []string{"T1-R1"}, status: RefundStatusProcessing, state: OrderStatePaid, left: 70},
+		{name: "instant", instant: true, amounts: []int64{30}, refundNos: []string{"T1-R1"}, status: RefundStatusSuccess, state: OrderStatePartiallyRefunded, left: 70},
+		{name: "instant full", instant: true, amounts: []int64{100}, refundNos: []string{"T1-R1"}, status: RefundStatusSuccess, state: OrderStateRefunded, left: 0},
+		{name: "submit failed", refundErr: errNetwork, amounts: []int64{30}, wantErr: errNetwork, refundNos: []string{"T1-R1"}, status: RefundStatusProcessing, state: OrderStatePaid, left: 70},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := registerTestProvider(t)
+			p.instant, p.refundErr = tt.instant, tt.refundErr
+			tracker := newPaidTracker(t, testPlat, 100)
+			var err error
+			for _, amount := range tt.amounts {
+				if _, err = tracker.Refund("T1", amount, "test"); err != nil {
+					break
+				}
+			}
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("got error %v, want %v", err, tt.wantErr)
+			}
+			if len(p.refunds) != len(tt.refundNos) {
+				t.Fatalf("submitted %d refunds, want %d", len(p.refunds), len(tt.refundNos))
+			}
+			for i, r := range p.refunds {
+				if r.MerchantRefundNo != tt.refundNos[i] || r.TransactionID != "TX1" || r.TotalFee != 100 {
+					t.Fatalf("unexpected refund request %+v", r)
+				}
+			}
+			order, _ := tracker.Get("T1")
+			if order.Refunds[0].Status != tt.status || order.State != tt.state || order.RefundableAmount() != tt.left {
+				t.Fatalf("got refund %s state %s refundable %d, want %s %s %d",
+					order.Refunds[0].Status, order.State, order.RefundableAmount(), tt.status, tt.state, tt.left)
+			}
+		})
+	}
+}
+
+func TestOrderTrackerRefundUnpaid(t *testing.T) {
+	registerTestProvider(t)
+	tracker := NewOrderTracker(NewMemoryOrderStorage())
+	if _, err := tracker.Track(testPlat, &OrderRequest{MerchanOrderNo: "T1", Amount: 100}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := tracker.Refund("T1", 10, ""); err == nil {
+		t.Fatal("refund of unpaid order should fail")
+	}
+	if _, err := tracker.Refund("T2", 10, ""); err != ErrOrderNotFound {
+		t.Fatalf("got %v, want ErrOrderNotFound", err)
+	}
+}
+
+func TestOrderTrackerRetryRefund(t *testing.T) {
+	p := registerTestProvider(t)
+	p.refundErr = errors.New("timeout")
+	tracker := newPaidTracker(t, testPlat, 100)
+	if _, err := tracker.Refund("T1", 30, "test"); err == nil {
+		t.Fatal("expected submit error")
+	}
+	p.refundErr, p.instant = nil, true
+	entry, err := tracker.RetryRefund("T1", "T1-R1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if entry.Status != RefundStatusSuccess || entry.RefundID != "PT1-R1" || len(p.refunds) != 2 || p.refunds[1].MerchantRefundNo != "T1-R1" {
+		t.Fatalf("got entry %+v, refunds %+v", entry, p.refunds)
+	}
+	if _, err = tracker.RetryRefund("T1", "T1-R1"); err == nil {
+		t.Fatal("retry of a successful refund should fail")
+	}
+	if _, err = tracker.RetryRefund("T1", "T1-R9"); err != ErrRefundNotFound {
+		t.Fatalf("got %v, want ErrRefundNotFound", err)
+	}
+}
+
+func TestOrderTrackerSyncRefunds(t *testing.T) {
+	tests := []struct {
+		name    string
+		query   *RefundNotifyResult
+		age     time.Duration // 退款最后更新距今时长
+		status  RefundStatus
+		left    int64
+		wantErr bool
+	}{
+		{
+			name:   "success",
+			query:  &RefundNotifyResult{Plat: testPlat, MerchantOrderNo: "T1", MerchantRefundNo: "T1-R1", RefundAmount: 30, Status: RefundStatusSuccess, IsSuccess: true},
+			status: RefundStatusSuccess, left: 70,
+		},
+		{name: "not found within grace", status: RefundStatusProcessing, left: 70},
+		{name: "not found after grace", age: 2 * refundSyncGrace, status: RefundStatusClosed, left: 100},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := registerTestProvider(t)
+			p.refundErr = errors.New("timeout")
+			tracker := newPaidTracker(t, testPlat, 100)
+			tracker.Refund("T1", 30, "test")
+			if tt.age > 0 {
+				order, _ := tracker.Get("T1")
+				order.Refunds[0].UpdatedTime = time.Now().Add(-tt.age)
+				if err := tracker.storage.Save(order); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if tt.query != nil {
+				p.queries["T1-R1"] = *tt.query
+			}
+			if err := tracker.SyncRefunds("T1"); (err != nil) != tt.wantErr {
+				t.Fatalf("got error %v, want error %v", err, tt.wantErr)
+			}
+			order, _ := tracker.Get("T1")
+			if order.Refunds[0].Status != tt.status || order.RefundableAmount() != tt.left {
+				t.Fatalf("got refund %s refundable %d, want %s %d", order.Refunds[0].Status, order.RefundableAmount(), tt.status, tt.left)
+			}
+		})
+	}
+}
+
+func TestOrderTrackerAlipayRefundWithPending(t *testing.T) {
+	tracker := newPaidTracker(t, PayPlatAlipay, 100)
+	order, _ := tracker.Get("T1")
+	order.Refunds = append(order.Refunds, RefundEntry{MerchantRefundNo: "T1-R1", Seq: 1, Amount: 30, Status: RefundStatusProcessing})
+	if err := tracker.storage.Save(order); err != nil {
+		t.Fatal(err)
+	}
+	// 商户平台手工退款 20，累计退款金额包含处理中的 30
+	result := RefundNotifyResult{Plat: PayPlatAlipay, MerchantOrderNo: "T1", MerchantRefundNo: "M1", TotalRefundedAmount: 50, Status: RefundStatusSuccess, IsSuccess: true}
+	if err := tracker.ApplyRefund(result); err != nil {
+		t.Fatal(err)
+	}
+	order, _ = tracker.Get("T1")
+	if r := order.findRefund("M1"); r == nil || r.Amount != 20 || order.RefundableAmount() != 50 {
+		t.Fatalf("got refunds %+v", order.Refunds)
+	}
+}
@@ -0,0 +1,201 @@
+package payment
+
+import (
+	"errors"
+	"testing"
+)
+
+func newPaidTracker(t *testing.T, plat PayPlat, amount int64) *OrderTracker {
+	t.Helper()
+	tracker := NewOrderTracker(NewMemoryOrderStorage())
+	if _, err := tracker.Track(plat, &OrderRequest{MerchanOrderNo: "T1", Amount: amount}); err != nil {
+		t.Fatal(err)
+	}
+	if err := tracker.ApplyPaid(&NotifyResult{Plat: plat, MerchantOrderNo: "T1", TransactionID: "TX1", TotalAmount: amount}); err != nil {
+		t.Fatal(err)
+	}
+	return tracker
+}
+
+func TestOrderTrackerTransitions(t *testing.T) {
+	tests := []struct {
+		name    string
+		apply   func(tracker *OrderTracker) error
+		state   OrderState
+		wantErr bool
+	}{
+		{name: "paying", apply: func(tr *OrderTracker) error { return tr.ApplyPaying("T1") }, state: OrderStatePaying},
+		{name: "close", apply: func(tr *OrderTracker) error { return tr.ApplyClose("T1") }, state: OrderStateClosed},
+		{
+			name: "paid",
+			apply: func(tr *OrderTracker) error {
+				return tr.ApplyPaid(&NotifyResult{MerchantOrderNo: "T1", TransactionID: "TX1", TotalAmount: 100})
+			},
+			state: OrderStatePaid,
+		},
+		{
+			name: "paid amount mismatch",
+			apply: func(tr *OrderTracker) error {
+				return tr.ApplyPaid(&NotifyResult{MerchantOrderNo: "T1", TransactionID: "TX1", TotalAmount: 99})
+			},
+			state: OrderStateCreated, wantErr: true,
+		},
+		{
+			name: "refund unpaid",
+			apply: func(tr *OrderTracker) error {
+				return tr.ApplyRefund(RefundNotifyResult{MerchantOrderNo: "T1", MerchantRefundNo: "T1-R1", RefundAmount: 10, IsSuccess: true})
+			},
+			state: OrderStateCreated, wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tracker := NewOrderTracker(NewMemoryOrderStorage())
+			if _, err := tracker.Track(PayPlatWechat, &OrderRequest{MerchanOrderNo: "T1", Amount: 100}); err != nil {
+				t.Fatal(err)
+			}
+			if err := tt.apply(tracker); (err != nil) != tt.wantErr {
+				t.Fatalf("got error %v, want error %v", err, tt.wantErr)
+			}
+			order, _ := tracker.Get("T1")
+			if order.State != tt.state {
+				t.Fatalf("got state %s, want %s", order.State, tt.state)
+			}
+		})
+	}
+}
+
+func TestOrderTrackerApplyRefund(t *testing.T) {
+	wechatRefund := func(no string, amount int32, status RefundStatus) RefundNotifyResult {
+		return RefundNotifyResult{Plat: PayPlatWechat, MerchantOrderNo: "T1", MerchantRefundNo: no, RefundAmount: amount, Status: status, IsSuccess: status == RefundStatusSuccess}
+	}
+	alipayRefund := func(no string, total int32) RefundNotifyResult {
+		return RefundNotifyResult{Plat: PayPlatAlipay, MerchantOrderNo: "T1", MerchantRefundNo: no, TotalRefundedAmount: total, Status: RefundStatusSuccess, IsSuccess: true}
+	}
+	tests := []struct {
+		name     string
+		plat     PayPlat
+		results  []RefundNotifyResult
+		refunded int64
+		state    OrderState
+		wantErr  error
+	}{
+		{
+			name:     "partial",
+			plat:     PayPlatWechat,
+			results:  []RefundNotifyResult{wechatRefund("T1-R1", 30, RefundStatusSuccess)},
+			refunded: 30, state: OrderStatePartiallyRefunded,
+		},
+		{
+			name:     "duplicate notify",
+			plat:     PayPlatWechat,
+			results:  []RefundNotifyResult{wechatRefund("T1-R1", 30, RefundStatusSuccess), wechatRefund("T1-R1", 30, RefundStatusSuccess)},
+			refunded: 30, state: OrderStatePartiallyRefunded,
+		},
+		{
+			name:     "full in two refunds",
+			plat:     PayPlatWechat,
+			results:  []RefundNotifyResult{wechatRefund("T1-R1", 30, RefundStatusSuccess), wechatRefund("T1-R2", 70, RefundStatusSuccess)},
+			refunded: 100, state: OrderStateRefunded,
+		},
+		{
+			name:     "closed refund",
+			plat:     PayPlatWechat,
+			results:  []RefundNotifyResult{wechatRefund("T1-R1", 30, RefundStatusClosed)},
+			refunded: 0, state: OrderStatePaid,
+		},
+		{
+			name:     "exceeded",
+			plat:     PayPlatWechat,
+			results:  []RefundNotifyResult{wechatRefund("T1-R1", 60, RefundStatusSuccess), wechatRefund("T1-R2", 60, RefundStatusSuccess)},
+			refunded: 60, state: OrderStatePartiallyRefunded, wantErr: ErrRefundExceeded,
+		},
+		{
+			name:     "alipay cumulative",
+			plat:     PayPlatAlipay,
+			results:  []RefundNotifyResult{alipayRefund("T1-R1", 30), alipayRefund("T1-R1", 30), alipayRefund("T1-R2", 50)},
+			refunded: 50, state: OrderStatePartiallyRefunded,
+		},
+		{
+			name:     "alipay full",
+			plat:     PayPlatAlipay,
+			results:  []RefundNotifyResult{alipayRefund("T1-R1", 40), alipayRefund("T1-R2", 100)},
+			refunded: 100, state: OrderStateRefunded,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tracker := newPaidTracker(t, tt.plat, 100)
+			var err error
+			for _, r := range tt.results {
+				if err = tracker.ApplyRefund(r); err != nil {
+					break
+				}
+			}
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("got error %v, want %v", err, tt.wantErr)
+			}
+			order, _ := tracker.Get("T1")
+			if order.RefundedAmount != tt.refunded || order.State != tt.state {
+				t.Fatalf("got refunded %d state %s, want %d %s", order.RefundedAmount, order.State, tt.refunded, tt.state)
+			}
+		})
+	}
+}
+
+func TestOrderTrackerNotifyHandlers(t *testing.T) {
+	// 业务订单存储中的原始下单请求
+	orders := NewMemoryOrderStorage()
+	for no, amount := range map[string]int64{"T9": 500, "T7": 100} {
+		if err := orders.Save(&TrackedOrder{Request: OrderRequest{MerchanOrderNo: no, Amount: amount}}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	tracker := NewOrderTracker(NewMemoryOrderStorage(), WithUntrackedOrderStore(orders))
+	called := 0
+	handler := tracker.NotifyHandler(func(*NotifyResult) error {
+		called++
+		return nil
+	})
+	// 未跟踪的订单按原始下单请求创建
+	result := &NotifyResult{Plat: PayPlatWechat, MerchantOrderNo: "T9", TransactionID: "TX9", TotalAmount: 500}
+	for i := 0; i < 2; i++ {
+		if err := handler(result); err != nil {
+			t.Fatal(err)
+		}
+	}
+	order, err := tracker.Get("T9")
+	if err != nil || order.State != OrderStatePaid || order.PaidAmount != 500 || called != 2 {
+		t.Fatalf("got order %+v, error %v, called %d", order, err, called)
+	}
+	// 支付金额与原始下单请求不一致
+	if err = handler(&NotifyResult{Plat: PayPlatWechat, MerchantOrderNo: "T7", TransactionID: "TX7", TotalAmount: 1}); err == nil {
+		t.Fatal("notify with mismatched amount accepted")
+	}
+	if order, _ = tracker.Get("T7"); order.State != OrderStateCreated || called != 2 {
+		t.Fatalf("got order %+v, called %d", order, called)
+	}
+	// 业务订单存储中不存在的订单
+	if err = handler(&NotifyResult{Plat: PayPlatWechat, MerchantOrderNo: "T6", TransactionID: "TX6", TotalAmount: 500}); err != ErrOrderNotFound {
+		t.Fatalf("got %v, want ErrOrderNotFound", err)
+	}
+	// 未设置业务订单存储时不按通知创建订单
+	untracked := NewOrderTracker(NewMemoryOrderStorage()).NotifyHandler(func(*NotifyResult) error {
+		called++
+		return nil
+	})
+	if err = untracked(result); err != ErrOrderNotFound || called != 2 {
+		t.Fatalf("got %v, called %d, want ErrOrderNotFound", err, called)
+	}
+
+	refundHandler := tracker.RefundNotifyHandler(func(RefundNotifyResult) error {
+		called++
+		return nil
+	})
+	if err = refundHandler(RefundNotifyResult{Plat: PayPlatWechat, MerchantOrderNo: "T8", MerchantRefundNo: "T8-R1", RefundAmount: 10, IsSuccess: true}); err != nil {
+		t.Fatalf("refund of untracked order: %v", err)
+	}
+	if called != 3 {
+		t.Fatalf("refund handler not called for untracked order")
+	}
+}
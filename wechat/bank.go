@@ -0,0 +1,220 @@
+// 企业付款到银行卡
+
+package wechat
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha1"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"encoding/xml"
+	"fmt"
+)
+
+const (
+	wx_bank_public_key_url = "https://fraud.mch.weixin.qq.com/risk/getpublickey"
+	wx_pay_bank_url        = "https://api.mch.weixin.qq.com/mmpaysptrans/pay_bank"
+	wx_query_bank_url      = "https://api.mch.weixin.qq.com/mmpaysptrans/query_bank"
+)
+
+// publicKeyRequest 获取RSA加密公钥请求
+type publicKeyRequest struct {
+	XMLName    xml.Name `xml:"xml"`
+	MerchantID string   `xml:"mch_id" sign:"mch_id"`
+	Noncestr   string   `xml:"nonce_str" sign:"nonce_str"`
+	Sign       string   `xml:"sign"`
+	SignType   string   `xml:"sign_type" sign:"sign_type"`
+}
+
+func (r *publicKeyRequest) setSign(sign string) { r.Sign = sign }
+
+// BankPublicKey 获取企业付款到银行卡加密收款方银行卡号及姓名使用的RSA公钥，首次获取成功后缓存；
+// 获取公钥时不持有锁，获取失败不缓存，下次调用重新获取
+func (c *Client) BankPublicKey() (*rsa.PublicKey, error) {
+	return c.BankPublicKeyContext(context.Background())
+}
+
+// BankPublicKeyContext 同 BankPublicKey，ctx 取消后停止请求及重试
+func (c *Client) BankPublicKeyContext(ctx context.Context) (*rsa.PublicKey, error) {
+	c.bankKeyMu.Lock()
+	key := c.bankKey
+	c.bankKeyMu.Unlock()
+	if key != nil {
+		return key, nil
+	}
+	req := publicKeyRequest{MerchantID: c.payOption.MerchantID, SignType: "MD5"}
+	var reply struct {
+		XMLName xml.Name `xml:"xml"`
+		PubKey  string   `xml:"pub_key"`
+	}
+	err := c.retry(ctx, func() error {
+		req.Noncestr = c.genNonceStr(24)
+		c.makePaySign(&req)
+		return c.postXML(ctx, c.certClient, wx_bank_public_key_url, &req, &reply, false)
+	})
+	if err != nil {
+		return nil, err
+	}
+	if key, err = parseRSAPublicKey([]byte(reply.PubKey)); err != nil {
+		return nil, err
+	}
+	// 并发获取时以先缓存的公钥为准
+	c.bankKeyMu.Lock()
+	defer c.bankKeyMu.Unlock()
+	if c.bankKey == nil {
+		c.bankKey = key
+	}
+	return c.bankKey, nil
+}
+
+// SetBankPublicKey 设置已保存的PEM格式公钥，设置后 BankPublicKey 不再请求获取公钥
+func (c *Client) SetBankPublicKey(data []byte) error {
+	key, err := parseRSAPublicKey(data)
+	if err != nil {
+		return err
+	}
+	c.bankKeyMu.Lock()
+	c.bankKey = key
+	c.bankKeyMu.Unlock()
+	return nil
+}
+
+// parseRSAPublicKey 解析PKCS#1或PKIX格式的PEM公钥，微信返回的公钥为PKCS#1格式
+func parseRSAPublicKey(data []byte) (*rsa.PublicKey, error) {
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("Payment: invalid public key PEM")
+	}
+	if key, err := x509.ParsePKCS1PublicKey(block.Bytes); err == nil {
+		return key, nil
+	}
+	key, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("Payment: parse public key error:%v", err)
+	}
+	rsaKey, ok := key.(*rsa.PublicKey)
+	if !ok {
+		return nil, fmt.Errorf("Payment: public key is not RSA")
+	}
+	return rsaKey, nil
+}
+
+// encryptOAEP RSA-OAEP(SHA-1) 加密并以Base64编码
+func encryptOAEP(key *rsa.PublicKey, plainText string) (string, error) {
+	cipherText, err := rsa.EncryptOAEP(sha1.New(), rand.Reader, key, []byte(plainText), nil)
+	if err != nil {
+		return "", err
+	}
+	return base64.StdEncoding.EncodeToString(cipherText), nil
+}
+
+// PayBankRequest 企业付款到银行卡请求
+type PayBankRequest struct {
+	XMLName     xml.Name `xml:"xml"`
+	MerchantID  string   `xml:"mch_id" sign:"mch_id"`
+	OrderNo     string   `xml:"partner_trade_no" sign:"partner_trade_no"`
+	Noncestr    string   `xml:"nonce_str" sign:"nonce_str"`
+	Sign        string   `xml:"sign"`
+	EncBankNo   string   `xml:"enc_bank_no" sign:"enc_bank_no"`     // 加密的收款方银行卡号
+	EncTrueName string   `xml:"enc_true_name" sign:"enc_true_name"` // 加密的收款方姓名
+	BankCode    string   `xml:"bank_code" sign:"bank_code"`         // 收款方开户行，如 1002 工商银行
+	Amount      int32    `xml:"amount" sign:"amount"`
+	Desc        string   `xml:"desc,omitempty" sign:"desc"`
+}
+
+func (r *PayBankRequest) setSign(sign string) { r.Sign = sign }
+
+// BankTransfer 企业付款到银行卡，金额单位：分
+type BankTransfer struct {
+	OrderNo  string // 商户付款单号
+	BankNo   string // 收款方银行卡号
+	TrueName string // 收款方姓名
+	BankCode string // 收款方开户行编码
+	Amount   int32
+	Desc     string
+}
+
+// PayBankReply 企业付款到银行卡响应，付款受理成功，最终结果以 QueryBank 为准
+type PayBankReply struct {
+	XMLName    xml.Name `xml:"xml"`
+	MerchantID string   `xml:"mch_id"`
+	OrderNo    string   `xml:"partner_trade_no"`
+	Amount     int32    `xml:"amount"`
+	WXOrderNo  string   `xml:"payment_no"` // 微信付款单号
+	CmmsAmount int32    `xml:"cmms_amt"`   // 手续费
+}
+
+// PayBank 企业付款到银行卡，收款方银行卡号及姓名使用 BankPublicKey 加密；
+// 系统繁忙等错误以原商户付款单号重试，付款单号相同的请求不会重复付款
+func (c *Client) PayBank(r BankTransfer) (PayBankReply, error) {
+	return c.PayBankContext(context.Background(), r)
+}
+
+// PayBankContext 同 PayBank，ctx 取消后停止请求及重试
+func (c *Client) PayBankContext(ctx context.Context, r BankTransfer) (PayBankReply, error) {
+	var reply PayBankReply
+	key, err := c.BankPublicKeyContext(ctx)
+	if err != nil {
+		return reply, err
+	}
+	req := PayBankRequest{MerchantID: c.payOption.MerchantID, OrderNo: r.OrderNo, BankCode: r.BankCode, Amount: r.Amount, Desc: r.Desc}
+	if req.EncBankNo, err = encryptOAEP(key, r.BankNo); err != nil {
+		return reply, fmt.Errorf("Payment: encrypt bank no error:%v", err)
+	}
+	if req.EncTrueName, err = encryptOAEP(key, r.TrueName); err != nil {
+		return reply, fmt.Errorf("Payment: encrypt true name error:%v", err)
+	}
+	err = c.retry(ctx, func() error {
+		req.Noncestr = c.genNonceStr(24)
+		c.makePaySign(&req)
+		return c.postXML(ctx, c.certClient, wx_pay_bank_url, &req, &reply, false)
+	})
+	return reply, err
+}
+
+// QueryBankRequest 企业付款到银行卡查询请求
+type QueryBankRequest struct {
+	XMLName    xml.Name `xml:"xml"`
+	MerchantID string   `xml:"mch_id" sign:"mch_id"`
+	OrderNo    string   `xml:"partner_trade_no" sign:"partner_trade_no"`
+	Noncestr   string   `xml:"nonce_str" sign:"nonce_str"`
+	Sign       string   `xml:"sign"`
+}
+
+func (r *QueryBankRequest) setSign(sign string) { r.Sign = sign }
+
+// QueryBankReply 企业付款到银行卡查询响应
+type QueryBankReply struct {
+	XMLName     xml.Name `xml:"xml"`
+	MerchantID  string   `xml:"mch_id"`
+	OrderNo     string   `xml:"partner_trade_no"`
+	WXOrderNo   string   `xml:"payment_no"`
+	BankNoMD5   string   `xml:"bank_no_md5"`
+	TrueNameMD5 string   `xml:"true_name_md5"`
+	Amount      int32    `xml:"amount"`
+	Status      string   `xml:"status"` // PROCESSING、SUCCESS、FAILED、BANK_FAIL
+	CmmsAmount  int32    `xml:"cmms_amt"`
+	CreateTime  string   `xml:"create_time"`
+	PayTime     string   `xml:"pay_succ_time"`
+	Reason      string   `xml:"reason"` // 失败原因
+}
+
+// QueryBank 按商户付款单号查询企业付款到银行卡的结果
+func (c *Client) QueryBank(orderNo string) (QueryBankReply, error) {
+	return c.QueryBankContext(context.Background(), orderNo)
+}
+
+// QueryBankContext 同 QueryBank，ctx 取消后停止请求及重试
+func (c *Client) QueryBankContext(ctx context.Context, orderNo string) (QueryBankReply, error) {
+	req := QueryBankRequest{MerchantID: c.payOption.MerchantID, OrderNo: orderNo}
+	var reply QueryBankReply
+	err := c.retry(ctx, func() error {
+		req.Noncestr = c.genNonceStr(24)
+		c.makePaySign(&req)
+		return c.postXML(ctx, c.certClient, wx_query_bank_url, &req, &reply, false)
+	})
+	return reply, err
+}
@@ -0,0 +1,184 @@
+package wechat
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha1"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"encoding/xml"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestBankPublicKey(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pubKey := pem.EncodeToMemory(&pem.Block{Type: "RSA PUBLIC KEY", Bytes: x509.MarshalPKCS1PublicKey(&key.PublicKey)})
+	var requests int32
+	fetching := make(chan struct{})
+	c := newTestClient(t, func(req *http.Request) (*http.Response, error) {
+		// 首次请求失败，第二次请求等待 fetching 关闭后返回公钥
+		switch atomic.AddInt32(&requests, 1) {
+		case 1:
+			return nil, errors.New("connection reset")
+		case 2:
+			<-fetching
+		}
+		return xmlReply(map[string]string{"return_code": "SUCCESS", "result_code": "SUCCESS", "mch_id": "1900000109", "pub_key": string(pubKey)}), nil
+	})
+	if _, err = c.BankPublicKey(); err == nil {
+		t.Fatal("expected fetch error")
+	}
+
+	// 获取公钥期间不持有锁，其他调用不被阻塞
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		if _, err := c.BankPublicKey(); err != nil {
+			t.Error(err)
+		}
+	}()
+	for atomic.LoadInt32(&requests) < 2 {
+		time.Sleep(time.Millisecond)
+	}
+	done := make(chan struct{})
+	go func() {
+		c.bankKeyMu.Lock()
+		c.bankKeyMu.Unlock()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("bank key lock held during fetch")
+	}
+	close(fetching)
+	wg.Wait()
+
+	got, err := c.BankPublicKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !got.Equal(&key.PublicKey) {
+		t.Fatal("unexpected public key")
+	}
+	if n := atomic.LoadInt32(&requests); n != 2 {
+		t.Fatalf("got %d requests, public key should be cached", n)
+	}
+}
+
+func TestQueryBank(t *testing.T) {
+	tests := []struct {
+		name     string
+		reply    map[string]string
+		wantCode string
+		want     QueryBankReply
+	}{
+		{
+			name: "success",
+			reply: map[string]string{
+				"return_code": "SUCCESS", "result_code": "SUCCESS", "mch_id": "1900000109", "partner_trade_no": "B1",
+				"payment_no": "10000600500852017030900000020006012", "amount": "500", "cmms_amt": "100", "status": "SUCCESS",
+				"create_time": "2026-10-18 10:00:00", "pay_succ_time": "2026-10-18 10:05:00",
+			},
+			want: QueryBankReply{
+				MerchantID: "1900000109", OrderNo: "B1", WXOrderNo: "10000600500852017030900000020006012",
+				Amount: 500, CmmsAmount: 100, Status: TransferStatusSuccess, CreateTime: "2026-10-18 10:00:00", PayTime: "2026-10-18 10:05:00",
+			},
+		},
+		{
+			name:  "bank fail",
+			reply: map[string]string{"return_code": "SUCCESS", "result_code": "SUCCESS", "partner_trade_no": "B1", "status": "BANK_FAIL", "reason": "银行卡已注销"},
+			want:  QueryBankReply{OrderNo: "B1", Status: TransferStatusBankFail, Reason: "银行卡已注销"},
+		},
+		{
+			name:     "not found",
+			reply:    map[string]string{"return_code": "SUCCESS", "result_code": "FAIL", "err_code": "NOT_FOUND", "err_code_des": "数据不存在"},
+			wantCode: "NOT_FOUND",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := newTestClient(t, func(req *http.Request) (*http.Response, error) {
+				body, _ := ioutil.ReadAll(req.Body)
+				params, err := ParseParams(body)
+				if err != nil {
+					return nil, err
+				}
+				if req.URL.Path != "/mmpaysptrans/query_bank" || params["mch_id"] != "1900000109" ||
+					params["partner_trade_no"] != "B1" || !xmlMap(params).verify(testSecret) {
+					t.Errorf("unexpected request %s %s", req.URL, body)
+				}
+				return xmlReply(tt.reply), nil
+			})
+			reply, err := c.QueryBankContext(context.Background(), "B1")
+			if tt.wantCode != "" {
+				var e *Error
+				if !errors.As(err, &e) || e.Code != tt.wantCode {
+					t.Fatalf("got error %v, want %s", err, tt.wantCode)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			reply.XMLName = xml.Name{}
+			if reply != tt.want {
+				t.Fatalf("got %+v, want %+v", reply, tt.want)
+			}
+		})
+	}
+}
+
+func TestPayBankWithSavedKey(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var paths []string
+	c := newTestClient(t, func(req *http.Request) (*http.Response, error) {
+		paths = append(paths, req.URL.Path)
+		body, _ := ioutil.ReadAll(req.Body)
+		params, err := ParseParams(body)
+		if err != nil {
+			return nil, err
+		}
+		bankNo, err := base64.StdEncoding.DecodeString(params["enc_bank_no"])
+		if err != nil {
+			return nil, err
+		}
+		if plain, err := rsa.DecryptOAEP(sha1.New(), rand.Reader, key, bankNo, nil); err != nil || string(plain) != "6222020000000000000" {
+			t.Errorf("bank no not encrypted with saved key: %v", err)
+		}
+		if !xmlMap(params).verify(testSecret) {
+			t.Errorf("invalid sign %s", body)
+		}
+		return xmlReply(map[string]string{"return_code": "SUCCESS", "result_code": "SUCCESS", "partner_trade_no": "B1", "amount": "500", "payment_no": "P1"}), nil
+	})
+	if err = c.SetBankPublicKey([]byte("invalid")); err == nil {
+		t.Fatal("expected invalid key error")
+	}
+	pubKey := pem.EncodeToMemory(&pem.Block{Type: "RSA PUBLIC KEY", Bytes: x509.MarshalPKCS1PublicKey(&key.PublicKey)})
+	if err = c.SetBankPublicKey(pubKey); err != nil {
+		t.Fatal(err)
+	}
+	reply, err := c.PayBankContext(context.Background(), BankTransfer{OrderNo: "B1", BankNo: "6222020000000000000", TrueName: "张三", BankCode: "1002", Amount: 500})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 已设置公钥时不再请求获取公钥
+	if len(paths) != 1 || paths[0] != "/mmpaysptrans/pay_bank" || reply.WXOrderNo != "P1" {
+		t.Fatalf("got requests %v reply %+v", paths, reply)
+	}
+}
@@ -0,0 +1,356 @@
+// 下载对账单及资金账单
+
+package wechat
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/csv"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/shengzhi/payment"
+)
+
+const (
+	wx_pay_bill_url     = "https://api.mch.weixin.qq.com/pay/downloadbill"
+	wx_pay_fundflow_url = "https://api.mch.weixin.qq.com/pay/downloadfundflow"
+)
+
+// 资金账户类型
+const (
+	AccountTypeBasic     = "Basic"     // 基本账户
+	AccountTypeOperation = "Operation" // 运营账户
+	AccountTypeFees      = "Fees"      // 手续费账户
+)
+
+// BillRequest 下载对账单请求
+type BillRequest struct {
+	XMLName    xml.Name `xml:"xml"`
+	APPID      string   `xml:"appid" sign:"appid"`
+	MerchantID string   `xml:"mch_id" sign:"mch_id"`
+	Noncestr   string   `xml:"nonce_str" sign:"nonce_str"`
+	Sign       string   `xml:"sign"`
+	SignType   string   `xml:"sign_type,omitempty" sign:"sign_type"`
+	BillDate   string   `xml:"bill_date" sign:"bill_date"`
+	BillType   string   `xml:"bill_type,omitempty" sign:"bill_type"`
+	Account    string   `xml:"account_type,omitempty" sign:"account_type"`
+	TarType    string   `xml:"tar_type,omitempty" sign:"tar_type"`
+}
+
+func (r *BillRequest) setSign(sign string) { r.Sign = sign }
+
+// billErrReply 下载失败时返回的XML
+type billErrReply struct {
+	XMLName    xml.Name `xml:"xml"`
+	ReturnCode string   `xml:"return_code"`
+	ReturnMsg  string   `xml:"return_msg"`
+	ErrCode    string   `xml:"error_code"`
+}
+
+type readCloser struct {
+	io.Reader
+	io.Closer
+}
+
+// DownloadBill 下载交易账单，date 为账单日期，compress 为 true 时以GZIP压缩传输，返回内容均已解压
+func (c *Client) DownloadBill(ctx context.Context, date time.Time, billType payment.BillType, compress bool) (io.ReadCloser, error) {
+	req := BillRequest{
+		APPID: c.appid, MerchantID: c.payOption.MerchantID,
+		Noncestr: c.genNonceStr(24),
+		BillDate: date.Format("20060102"), BillType: string(billType),
+	}
+	if compress {
+		req.TarType = "GZIP"
+	}
+	c.makePaySign(&req)
+	return c.download(ctx, c.httpClient, wx_pay_bill_url, &req, compress)
+}
+
+// DownloadFundFlow 下载资金账单，accountType 为资金账户类型，需要商户证书及HMAC-SHA256签名
+func (c *Client) DownloadFundFlow(ctx context.Context, date time.Time, accountType string, compress bool) (io.ReadCloser, error) {
+	req := BillRequest{
+		APPID: c.appid, MerchantID: c.payOption.MerchantID,
+		Noncestr: c.genNonceStr(24), SignType: "HMAC-SHA256",
+		BillDate: date.Format("20060102"), Account: accountType,
+	}
+	if compress {
+		req.TarType = "GZIP"
+	}
+	c.makeHMACSign(&req)
+	return c.download(ctx, c.certClient, wx_pay_fundflow_url, &req, compress)
+}
+
+func (c *Client) download(ctx context.Context, client *http.Client, uri string, req *BillRequest, compress bool) (io.ReadCloser, error) {
+	var buf bytes.Buffer
+	if err := xml.NewEncoder(&buf).Encode(req); err != nil {
+		return nil, fmt.Errorf("Payment: marshal struct to xml error:%v", err)
+	}
+	httpReq, err := http.NewRequestWithContext(ctx, "POST", uri, &buf)
+	if err != nil {
+		return nil, err
+	}
+	httpReq.Header.Set("Content-Type", "application/xml")
+	res, err := client.Do(httpReq)
+	if err != nil {
+		return nil, err
+	}
+	if res.StatusCode != http.StatusOK {
+		res.Body.Close()
+		return nil, fmt.Errorf("download bill failed, status:%s", res.Status)
+	}
+	br := bufio.NewReader(res.Body)
+	head, _ := br.Peek(5)
+	if len(head) == 0 {
+		res.Body.Close()
+		return nil, fmt.Errorf("download bill failed, empty response")
+	}
+	if string(head) == "<xml>" {
+		defer res.Body.Close()
+		var reply billErrReply
+		if err = xml.NewDecoder(br).Decode(&reply); err != nil {
+			return nil, fmt.Errorf("Payment: decode xml to struct error:%v", err)
+		}
+		return nil, fmt.Errorf("Payment: %s-%s", reply.ReturnCode, reply.ReturnMsg)
+	}
+	if !compress {
+		return readCloser{br, res.Body}, nil
+	}
+	gr, err := gzip.NewReader(br)
+	if err != nil {
+		res.Body.Close()
+		return nil, err
+	}
+	return readCloser{gr, res.Body}, nil
+}
+
+// billColumns 账单列名与列序号映射
+type billColumns map[string]int
+
+func newBillColumns(header []string) billColumns {
+	cols := make(billColumns, len(header))
+	for i, name := range header {
+		cols[strings.TrimPrefix(strings.TrimSpace(name), "\ufeff")] = i
+	}
+	return cols
+}
+
+// get 获取列值，去除数据前的`符号
+func (cols billColumns) get(row []string, names ...string) string {
+	for _, name := range names {
+		if i, has := cols[name]; has && i < len(row) {
+			return strings.TrimPrefix(strings.TrimSpace(row[i]), "`")
+		}
+	}
+	return ""
+}
+
+func (cols billColumns) amount(row []string, names ...string) (int64, error) {
+	return payment.ParseAmount(cols.get(row, names...))
+}
+
+func newBillReader(r io.Reader) *csv.Reader {
+	cr := csv.NewReader(r)
+	cr.FieldsPerRecord = -1
+	cr.LazyQuotes = true
+	return cr
+}
+
+// ParseBill 流式解析交易账单，每条明细调用一次 fn，返回账单汇总数据
+func ParseBill(r io.Reader, fn payment.BillRecordFunc) (payment.BillSummary, error) {
+	var summary payment.BillSummary
+	cr := newBillReader(r)
+	header, err := cr.Read()
+	if err == io.EOF {
+		return summary, nil
+	}
+	if err != nil {
+		return summary, err
+	}
+	cols := newBillColumns(header)
+	for {
+		row, err := cr.Read()
+		if err == io.EOF {
+			return summary, nil
+		}
+		if err != nil {
+			return summary, err
+		}
+		if strings.TrimSpace(row[0]) == "总交易单数" {
+			total, err := cr.Read()
+			if err != nil {
+				return summary, err
+			}
+			return summary, parseBillSummary(newBillColumns(row), total, &summary)
+		}
+		record, err := parseBillRecord(cols, row)
+		if err != nil {
+			return summary, err
+		}
+		if err = fn(record); err != nil {
+			return summary, err
+		}
+	}
+}
+
+func parseBillRecord(cols billColumns, row []string) (record payment.BillRecord, err error) {
+	record = payment.BillRecord{
+		Plat:             payment.PayPlatWechat,
+		MerchantID:       cols.get(row, "商户号"),
+		TransactionID:    cols.get(row, "微信订单号"),
+		MerchantOrderNo:  cols.get(row, "商户订单号"),
+		Status:           cols.get(row, "交易状态"),
+		RefundID:         cols.get(row, "微信退款单号"),
+		MerchantRefundNo: cols.get(row, "商户退款单号"),
+		RefundStatus:     cols.get(row, "退款状态"),
+		Currency:         cols.get(row, "货币种类"),
+		Subject:          cols.get(row, "商品名称"),
+		Attach:           cols.get(row, "商户数据包"),
+	}
+	record.IsRefund = record.Status == payment.BillStatusRefund
+	record.TradeTime, err = time.ParseInLocation("2006-01-02 15:04:05", cols.get(row, "交易时间"), time.Local)
+	if err != nil {
+		return
+	}
+	if record.TotalAmount, err = cols.amount(row, "订单金额", "总金额"); err != nil {
+		return
+	}
+	if record.SettlementAmount, err = cols.amount(row, "应结订单金额", "总金额"); err != nil {
+		return
+	}
+	if record.CouponAmount, err = cols.amount(row, "代金券金额", "代金券或立减优惠金额"); err != nil {
+		return
+	}
+	if record.RefundAmount, err = cols.amount(row, "退款金额"); err != nil {
+		return
+	}
+	record.Fee, err = cols.amount(row, "手续费")
+	return
+}
+
+func parseBillSummary(cols billColumns, row []string, summary *payment.BillSummary) (err error) {
+	if summary.TotalCount, err = strconv.Atoi(cols.get(row, "总交易单数")); err != nil {
+		return
+	}
+	if summary.SettlementAmount, err = cols.amount(row, "应结订单总金额", "总交易额"); err != nil {
+		return
+	}
+	if summary.TotalAmount, err = cols.amount(row, "订单总金额", "总交易额"); err != nil {
+		return
+	}
+	if summary.RefundAmount, err = cols.amount(row, "退款总金额"); err != nil {
+		return
+	}
+	if summary.CouponRefundAmount, err = cols.amount(row, "充值券退款总金额", "企业红包退款总金额"); err != nil {
+		return
+	}
+	summary.Fee, err = cols.amount(row, "手续费总金额")
+	return
+}
+
+// FundFlowRecord 资金账单明细，金额单位：分
+type FundFlowRecord struct {
+	Time       time.Time // 记账时间
+	BizOrderNo string    // 微信支付业务单号
+	FlowNo     string    // 资金流水单号
+	BizName    string    // 业务名称
+	BizType    string    // 业务类型
+	Direction  string    // 收支类型 收入/支出
+	Amount     int64     // 收支金额
+	Balance    int64     // 账户结余
+	Applicant  string    // 资金变更提交申请人
+	Remark     string    // 备注
+	VoucherNo  string    // 业务凭证号
+}
+
+// FundFlowSummary 资金账单汇总，金额单位：分
+type FundFlowSummary struct {
+	TotalCount    int
+	IncomeCount   int
+	IncomeAmount  int64
+	ExpenseCount  int
+	ExpenseAmount int64
+}
+
+// ParseFundFlow 流式解析资金账单，每条明细调用一次 fn，返回账单汇总数据
+func ParseFundFlow(r io.Reader, fn func(record FundFlowRecord) error) (FundFlowSummary, error) {
+	var summary FundFlowSummary
+	cr := newBillReader(r)
+	header, err := cr.Read()
+	if err == io.EOF {
+		return summary, nil
+	}
+	if err != nil {
+		return summary, err
+	}
+	cols := newBillColumns(header)
+	for {
+		row, err := cr.Read()
+		if err == io.EOF {
+			return summary, nil
+		}
+		if err != nil {
+			return summary, err
+		}
+		if strings.TrimSpace(row[0]) == "资金流水总笔数" {
+			total, err := cr.Read()
+			if err != nil {
+				return summary, err
+			}
+			return summary, parseFundFlowSummary(newBillColumns(row), total, &summary)
+		}
+		record, err := parseFundFlowRecord(cols, row)
+		if err != nil {
+			return summary, err
+		}
+		if err = fn(record); err != nil {
+			return summary, err
+		}
+	}
+}
+
+func parseFundFlowRecord(cols billColumns, row []string) (record FundFlowRecord, err error) {
+	record = FundFlowRecord{
+		BizOrderNo: cols.get(row, "微信支付业务单号"),
+		FlowNo:     cols.get(row, "资金流水单号"),
+		BizName:    cols.get(row, "业务名称"),
+		BizType:    cols.get(row, "业务类型"),
+		Direction:  cols.get(row, "收支类型"),
+		Applicant:  cols.get(row, "资金变更提交申请人"),
+		Remark:     cols.get(row, "备注"),
+		VoucherNo:  cols.get(row, "业务凭证号"),
+	}
+	record.Time, err = time.ParseInLocation("2006-01-02 15:04:05", cols.get(row, "记账时间"), time.Local)
+	if err != nil {
+		return
+	}
+	if record.Amount, err = cols.amount(row, "收支金额（元）", "收支金额(元)"); err != nil {
+		return
+	}
+	record.Balance, err = cols.amount(row, "账户结余（元）", "账户结余(元)")
+	return
+}
+
+func parseFundFlowSummary(cols billColumns, row []string, summary *FundFlowSummary) (err error) {
+	if summary.TotalCount, err = strconv.Atoi(cols.get(row, "资金流水总笔数")); err != nil {
+		return
+	}
+	if summary.IncomeCount, err = strconv.Atoi(cols.get(row, "收入笔数")); err != nil {
+		return
+	}
+	if summary.IncomeAmount, err = cols.amount(row, "收入金额"); err != nil {
+		return
+	}
+	if summary.ExpenseCount, err = strconv.Atoi(cols.get(row, "支出笔数")); err != nil {
+		return
+	}
+	summary.ExpenseAmount, err = cols.amount(row, "支出金额")
+	return
+}
@@ -0,0 +1,164 @@
+package wechat
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/shengzhi/payment"
+)
+
+const testBill = "\ufeff交易时间,公众账号ID,商户号,特约商户号,设备号,微信订单号,商户订单号,用户标识,交易类型,交易状态,付款银行,货币种类,应结订单金额,代金券金额,微信退款单号,商户退款单号,退款金额,充值券退款金额,退款类型,退款状态,商品名称,商户数据包,手续费,费率,订单金额,申请退款金额,费率备注\n" +
+	"`2026-10-17 10:00:05,`wx01,`1900000001,`0,`,`4200001,`T1,`o1,`APP,`SUCCESS,`CFT,`CNY,`100.00,`5.00,`0,`0,`0.00,`0.00,`,`,`会员月卡,`a=1,`0.60000,`0.60%,`100.00,`0.00,`\n" +
+	"`2026-10-17 12:00:01,`wx01,`1900000001,`0,`,`4200001,`T1,`o1,`APP,`REFUND,`CFT,`CNY,`0.00,`0.00,`5030001,`T1-R1,`30.00,`0.00,`ORIGINAL,`SUCCESS,`会员月卡,`a=1,`-0.18000,`0.60%,`0.00,`30.00,`\n" +
+	"`2026-10-17 13:00:00,`wx01,`1900000001,`0,`,`4200002,`T2,`o2,`NATIVE,`REVOKED,`CFT,`CNY,`0.00,`0.00,`0,`0,`0.00,`0.00,`,`,`会员月卡,`,`0.00000,`0.60%,`20.00,`0.00,`\n" +
+	"总交易单数,应结订单总金额,退款总金额,充值券退款总金额,手续费总金额,订单总金额,申请退款总金额\n" +
+	"`3,`100.00,`30.00,`0.00,`0.42000,`120.00,`30.00\n"
+
+func TestParseBill(t *testing.T) {
+	var records []payment.BillRecord
+	summary, err := ParseBill(strings.NewReader(testBill), func(r payment.BillRecord) error {
+		records = append(records, r)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		status           string
+		isRefund         bool
+		orderNo          string
+		totalAmount      int64
+		settlementAmount int64
+		refundAmount     int64
+		fee              int64
+	}{
+		{status: payment.BillStatusSuccess, orderNo: "T1", totalAmount: 10000, settlementAmount: 10000, fee: 60},
+		{status: payment.BillStatusRefund, isRefund: true, orderNo: "T1", refundAmount: 3000, fee: -18},
+		{status: payment.BillStatusRevoked, orderNo: "T2", totalAmount: 2000},
+	}
+	if len(records) != len(tests) {
+		t.Fatalf("got %d records, want %d", len(records), len(tests))
+	}
+	for i, tt := range tests {
+		r := records[i]
+		if r.Status != tt.status || r.IsRefund != tt.isRefund || r.MerchantOrderNo != tt.orderNo ||
+			r.TotalAmount != tt.totalAmount || r.SettlementAmount != tt.settlementAmount ||
+			r.RefundAmount != tt.refundAmount || r.Fee != tt.fee {
+			t.Errorf("record %d: got %+v", i, r)
+		}
+		if r.MerchantID != "1900000001" || r.Plat != payment.PayPlatWechat {
+			t.Errorf("record %d: got merchant %s plat %s", i, r.MerchantID, r.Plat)
+		}
+	}
+	if records[1].MerchantRefundNo != "T1-R1" || records[1].RefundID != "5030001" || records[1].RefundStatus != "SUCCESS" {
+		t.Errorf("unexpected refund record %+v", records[1])
+	}
+	want := payment.BillSummary{TotalCount: 3, TotalAmount: 12000, SettlementAmount: 10000, RefundAmount: 3000, Fee: 42}
+	if summary != want {
+		t.Errorf("got summary %+v, want %+v", summary, want)
+	}
+}
+
+func TestDownloadClient(t *testing.T) {
+	c := newTestClient(t, nil)
+	var used string
+	client := func(name string) *http.Client {
+		return &http.Client{Transport: payment.RoundTripperFunc(func(req *http.Request) (*http.Response, error) {
+			used = name
+			return &http.Response{StatusCode: http.StatusOK, Body: ioutil.NopCloser(strings.NewReader(testBill)), Header: make(http.Header)}, nil
+		})}
+	}
+	c.httpClient, c.certClient = client("http"), client("cert")
+	tests := []struct {
+		name     string
+		download func() error
+		want     string
+	}{
+		{
+			name: "trade bill",
+			download: func() error {
+				_, err := c.DownloadBill(context.Background(), time.Now(), payment.BillTypeAll, false)
+				return err
+			},
+			want: "http",
+		},
+		{
+			name: "fund flow",
+			download: func() error {
+				_, err := c.DownloadFundFlow(context.Background(), time.Now(), "Basic", false)
+				return err
+			},
+			want: "cert",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			used = ""
+			if err := tt.download(); err != nil {
+				t.Fatal(err)
+			}
+			if used != tt.want {
+				t.Fatalf("downloaded with %s client, want %s", used, tt.want)
+			}
+		})
+	}
+}
+
+func TestDownloadBillResponse(t *testing.T) {
+	var gz bytes.Buffer
+	w := gzip.NewWriter(&gz)
+	w.Write([]byte(testBill))
+	w.Close()
+	tests := []struct {
+		name     string
+		status   int
+		body     string
+		compress bool
+		cancel   bool
+		wantErr  string
+	}{
+		{name: "plain", status: http.StatusOK, body: testBill},
+		{name: "gzip", status: http.StatusOK, body: gz.String(), compress: true},
+		{name: "error xml", status: http.StatusOK, body: "<xml><return_code>FAIL</return_code><return_msg>No Bill Exist</return_msg></xml>", wantErr: "No Bill Exist"},
+		{name: "bad gateway", status: http.StatusBadGateway, body: "<html>502 Bad Gateway</html>", compress: true, wantErr: "502"},
+		{name: "empty body", status: http.StatusOK, compress: true, wantErr: "empty response"},
+		{name: "canceled", status: http.StatusOK, body: testBill, cancel: true, wantErr: "canceled"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := newTestClient(t, func(req *http.Request) (*http.Response, error) {
+				if err := req.Context().Err(); err != nil {
+					return nil, err
+				}
+				return &http.Response{StatusCode: tt.status, Status: fmt.Sprintf("%d %s", tt.status, http.StatusText(tt.status)), Body: ioutil.NopCloser(strings.NewReader(tt.body)), Header: make(http.Header)}, nil
+			})
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			if tt.cancel {
+				cancel()
+			}
+			body, err := c.DownloadBill(ctx, time.Now(), payment.BillTypeAll, tt.compress)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("got error %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer body.Close()
+			data, _ := ioutil.ReadAll(body)
+			if string(data) != testBill {
+				t.Fatalf("got bill %q", data)
+			}
+		})
+	}
+}
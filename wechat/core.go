@@ -3,15 +3,21 @@ package wechat
 
 import (
 	"bytes"
+	"context"
+	"crypto/hmac"
 	"crypto/md5"
+	"crypto/rsa"
+	"crypto/sha256"
 	"crypto/tls"
 	"crypto/x509"
 	"encoding/hex"
 	"encoding/json"
+	"encoding/xml"
 	"fmt"
 	"io/ioutil"
 	"log"
 	"math/rand"
+	"net"
 	"net/http"
 	"reflect"
 	"sort"
@@ -24,6 +30,7 @@ import (
 )
 
 var _ payment.Provider = &Client{}
+var _ payment.OrderQuerier = &Client{}
 
 // WechatPayClient 微信支付客服端
 type Client struct {
@@ -31,9 +38,17 @@ type Client struct {
 	payOption                    Config
 	bufpool                      *sync.Pool
 	httpClient                   *http.Client
+	certClient                   *http.Client // 携带商户证书的HTTP客户端
+	httpMiddlewares              []payment.HTTPMiddleware
+	tracer                       *log.Logger
+	redactor                     *payment.Redactor
+	auditSink                    payment.AuditSink
 	caroot, clientcrt, clientkey string
 	tlsCfg                       *tls.Config
 	refundKey                    []byte
+	retryPolicy                  payment.RetryPolicy
+	bankKeyMu                    sync.Mutex
+	bankKey                      *rsa.PublicKey // 企业付款到银行卡加密使用的RSA公钥
 }
 
 // NewClient 创建微信支付客服端
@@ -59,6 +74,18 @@ func NewClient(appid, secret, merchid string, options ...OptionFunc) *Client {
 	if err := c.loadCert(); err != nil {
 		log.Fatalln(err)
 	}
+	mws := c.httpMiddlewares
+	if c.tracer != nil {
+		mws = append(mws[:len(mws):len(mws)], payment.TraceMiddleware(payment.PayPlatWechat, c.tracer, c.redactor))
+	}
+	if c.auditSink != nil {
+		mws = append(mws[:len(mws):len(mws)], payment.AuditMiddleware(payment.PayPlatWechat, c.auditSink))
+	}
+	c.certClient = &http.Client{
+		Transport: payment.ChainHTTP(&http.Transport{TLSClientConfig: c.tlsCfg}, mws...),
+		Timeout:   c.httpClient.Timeout,
+	}
+	c.httpClient.Transport = payment.ChainHTTP(c.httpClient.Transport, mws...)
 	return c
 }
 func (c *Client) loadCert() error {
@@ -114,9 +141,10 @@ func (c *Client) makePaySign(req signRequest) {
 	req.setSign(strings.ToUpper(md5Encrypt(b)))
 }
 
-func (c *Client) validatePayRes(res signResponse) bool {
-	p := structToSignMap(res).signString(c.secret)
-	return res.getSign() == strings.ToUpper(md5Encrypt(p))
+// makeHMACSign HMAC-SHA256 签名
+func (c *Client) makeHMACSign(req signRequest) {
+	b := structToSignMap(req).signString(c.secret)
+	req.setSign(strings.ToUpper(hmacSHA256(b, c.secret)))
 }
 
 // SetPayOption 配置微信支付
@@ -137,8 +165,9 @@ type signRequest interface {
 	setSign(sign string)
 }
 
-type signResponse interface {
-	getSign() string
+// paramsReply 需要按应答的全部参数解析动态字段的应答，如 coupon_*_$n
+type paramsReply interface {
+	setParams(params xmlMap)
 }
 
 type signMap map[string]string
@@ -201,6 +230,124 @@ func md5Encrypt(plainText []byte) string {
 	return hex.EncodeToString(m.Sum(nil))
 }
 
+func hmacSHA256(plainText []byte, key string) string {
+	m := hmac.New(sha256.New, []byte(key))
+	m.Write(plainText)
+	return hex.EncodeToString(m.Sum(nil))
+}
+
+// Error 微信支付业务错误
+type Error struct {
+	Code, Desc string
+}
+
+func (e *Error) Error() string { return fmt.Sprintf("Payment:%s-%s", e.Code, e.Desc) }
+
+// Temporary 系统繁忙及频率限制为瞬时错误，可使用相同参数重试
+func (e *Error) Temporary() bool {
+	switch e.Code {
+	case "SYSTEMERROR", "BIZERR_NEED_RETRY", "FREQUENCY_LIMITED":
+		return true
+	}
+	return false
+}
+
+// BusinessError 非瞬时错误均为微信明确拒绝的业务错误，用于 payment.IsBusinessError
+func (e *Error) BusinessError() bool { return !e.Temporary() }
+
+// xmlMap 微信XML报文全部参数
+type xmlMap map[string]string
+
+// UnmarshalXML xml decoding
+func (m *xmlMap) UnmarshalXML(d *xml.Decoder, start xml.StartElement) error {
+	*m = make(xmlMap)
+	for {
+		token, err := d.Token()
+		if err != nil {
+			return err
+		}
+		switch t := token.(type) {
+		case xml.StartElement:
+			var v string
+			if err = d.DecodeElement(&v, &t); err != nil {
+				return err
+			}
+			(*m)[t.Name.Local] = v
+		case xml.EndElement:
+			return nil
+		}
+	}
+}
+
+// verify 基于全部参数验证签名
+func (m xmlMap) verify(secret string) bool {
+	return m["sign"] == Sign(m, secret, m["sign_type"])
+}
+
+// post 提交XML请求，验证响应签名后将响应解析至 reply，业务失败时返回 *Error
+func (c *Client) post(ctx context.Context, client *http.Client, uri string, req interface{}, reply interface{}) error {
+	return c.postXML(ctx, client, uri, req, reply, true)
+}
+
+// postXML 提交XML请求，requireSign 为 false 时仅验证响应中携带的签名，用于企业付款等不返回签名的接口
+func (c *Client) postXML(ctx context.Context, client *http.Client, uri string, req interface{}, reply interface{}, requireSign bool) error {
+	var buf bytes.Buffer
+	if err := xml.NewEncoder(&buf).Encode(req); err != nil {
+		return fmt.Errorf("Payment: marshal struct to xml error:%v", err)
+	}
+	httpReq, err := http.NewRequestWithContext(ctx, "POST", uri, &buf)
+	if err != nil {
+		return err
+	}
+	httpReq.Header.Set("Content-Type", "application/xml")
+	res, err := client.Do(httpReq)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	body, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return err
+	}
+	var params xmlMap
+	if err = xml.Unmarshal(body, &params); err != nil {
+		return fmt.Errorf("Payment: decode xml to struct error:%v", err)
+	}
+	if params["return_code"] != "SUCCESS" {
+		return fmt.Errorf("Payment: %s-%s", params["return_code"], params["return_msg"])
+	}
+	if (requireSign || params["sign"] != "") && !params.verify(c.secret) {
+		return fmt.Errorf("Payment: verify sign failed")
+	}
+	if params["result_code"] == "FAIL" {
+		return &Error{Code: params["err_code"], Desc: params["err_code_des"]}
+	}
+	if err = xml.Unmarshal(body, reply); err != nil {
+		return fmt.Errorf("Payment: decode xml to struct error:%v", err)
+	}
+	if r, ok := reply.(paramsReply); ok {
+		r.setParams(params)
+	}
+	return nil
+}
+
+// retry 按重试策略执行可安全重试的操作，ctx 取消或剩余时间不足以等待下一次重试时停止重试
+func (c *Client) retry(ctx context.Context, fn func() error) error {
+	return c.retryPolicy.Do(ctx, retryable, fn)
+}
+
+// retryable 系统繁忙、频率限制及网络错误可重试
+func retryable(err error) bool {
+	if err == ErrRefundRetry {
+		return true
+	}
+	if e, ok := err.(*Error); ok {
+		return e.Temporary()
+	}
+	_, ok := err.(net.Error)
+	return ok
+}
+
 func toJSON(v interface{}) []byte {
 	data, _ := json.Marshal(v)
 	return data
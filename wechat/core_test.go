@@ -0,0 +1,151 @@
+package wechat
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/shengzhi/payment"
+)
+
+const testSecret = "0123456789abcdef0123456789abcdef"
+
+// testCert 生成自签名的商户证书，返回证书及私钥文件路径
+func testCert(t *testing.T) (string, string) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "1900000109"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir := t.TempDir()
+	crt, keyFile := filepath.Join(dir, "apiclient_cert.pem"), filepath.Join(dir, "apiclient_key.pem")
+	if err = os.WriteFile(crt, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err = os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return crt, keyFile
+}
+
+// newTestClient 创建以 handle 代替微信支付接口应答的客户端
+func newTestClient(t *testing.T, handle func(req *http.Request) (*http.Response, error), opts ...OptionFunc) *Client {
+	t.Helper()
+	crt, key := testCert(t)
+	fake := func(http.RoundTripper) http.RoundTripper { return payment.RoundTripperFunc(handle) }
+	opts = append([]OptionFunc{WithCertFile("", crt, key), WithHTTPMiddleware(fake)}, opts...)
+	return NewClient("wx2421b1c4370ec43b", testSecret, "1900000109", opts...)
+}
+
+// xmlReply 以 params 签名后生成XML应答
+func xmlReply(params map[string]string) *http.Response {
+	signed := make(map[string]string, len(params)+1)
+	for k, v := range params {
+		signed[k] = v
+	}
+	signed["sign"] = Sign(signed, testSecret, "")
+	keys := make([]string, 0, len(signed))
+	for k := range signed {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	var buf bytes.Buffer
+	buf.WriteString("<xml>")
+	for _, k := range keys {
+		fmt.Fprintf(&buf, "<%s><![CDATA[%s]]></%s>", k, signed[k], k)
+	}
+	buf.WriteString("</xml>")
+	return &http.Response{StatusCode: http.StatusOK, Body: ioutil.NopCloser(&buf), Header: make(http.Header)}
+}
+
+func systemError() *http.Response {
+	return xmlReply(map[string]string{"return_code": "SUCCESS", "result_code": "FAIL", "err_code": "SYSTEMERROR", "err_code_des": "系统繁忙"})
+}
+
+func TestQueryContext(t *testing.T) {
+	success := map[string]string{"return_code": "SUCCESS", "result_code": "SUCCESS", "out_trade_no": "T1", "trade_state": "SUCCESS", "total_fee": "100"}
+	tests := []struct {
+		name     string
+		ctx      func() (context.Context, context.CancelFunc)
+		failures int // 前 failures 次请求返回系统繁忙
+		cancel   bool
+		attempts int
+		wantErr  bool
+	}{
+		{
+			name:     "retry until success",
+			ctx:      func() (context.Context, context.CancelFunc) { return context.WithCancel(context.Background()) },
+			failures: 2, attempts: 3,
+		},
+		{
+			name:     "cancel stops retry",
+			ctx:      func() (context.Context, context.CancelFunc) { return context.WithCancel(context.Background()) },
+			failures: 3, cancel: true, attempts: 1, wantErr: true,
+		},
+		{
+			name: "deadline shorter than backoff",
+			ctx: func() (context.Context, context.CancelFunc) {
+				return context.WithTimeout(context.Background(), 50*time.Millisecond)
+			},
+			failures: 3, attempts: 1, wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx, cancel := tt.ctx()
+			defer cancel()
+			attempts := 0
+			c := newTestClient(t, func(req *http.Request) (*http.Response, error) {
+				attempts++
+				if err := req.Context().Err(); err != nil {
+					return nil, err
+				}
+				if attempts <= tt.failures {
+					if tt.cancel {
+						cancel()
+					}
+					return systemError(), nil
+				}
+				return xmlReply(success), nil
+			}, WithRetryPolicy(payment.RetryPolicy{MaxAttempts: 3, BaseDelay: 100 * time.Millisecond, MaxDelay: 100 * time.Millisecond}))
+			result, err := c.QueryContext(ctx, "T1")
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("got error %v, want error %v", err, tt.wantErr)
+			}
+			if attempts != tt.attempts {
+				t.Fatalf("got %d attempts, want %d", attempts, tt.attempts)
+			}
+			if err == nil && result.State != payment.TradeStateSuccess {
+				t.Fatalf("got state %s", result.State)
+			}
+		})
+	}
+}
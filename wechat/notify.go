@@ -1,8 +1,13 @@
 package wechat
 
 import (
+	"bytes"
 	"encoding/xml"
+	"fmt"
 	"io"
+	"io/ioutil"
+	"log"
+	"strconv"
 	"time"
 
 	"github.com/shengzhi/payment"
@@ -10,45 +15,78 @@ import (
 
 // WXNotifyResult 异步通知结果
 type WXNotifyResult struct {
-	XMLName         xml.Name `xml:"xml"`
-	ReturnCode      string   `xml:"return_code" sign:"return_code"`
-	ReturnMsg       string   `xml:"return_msg" sign:"return_msg"`
-	AppID           string   `xml:"appid" sign:"appid"`
-	MerchantID      string   `xml:"mch_id" sign:"mch_id"`
-	DeviceInfo      string   `xml:"device_info" sign:"device_info"`
-	NonceStr        string   `xml:"nonce_str" sign:"nonce_str"`
-	Sign            string   `xml:"sign"`
-	ResultCode      string   `xml:"result_code" sign:"result_code"`
-	ErrCode         string   `xml:"err_code" sign:"err_code"`
-	ErrDesc         string   `xml:"err_code_des" sign:"err_code_des"`
-	TradeType       string   `xml:"trade_type" sign:"trade_type"`
-	OpenID          string   `xml:"openid" sign:"openid"`
-	IsSubscribe     string   `xml:"is_subscribe" sign:"is_subscribe"`
-	BankType        string   `xml:"bank_type" sign:"bank_type"`
-	TotalAmount     int64    `xml:"total_fee" sign:"total_fee"`
-	AccountAmount   int64    `xml:"settlement_total_fee" sign:"settlement_total_fee"` //结算金额
-	Currency        string   `xml:"fee_type" sign:"fee_type"`
-	CashAmount      int64    `xml:"cash_fee" sign:"cash_fee"`
-	CashCurrency    string   `xml:"cash_fee_type" sign:"cash_fee_type"`
-	CouponAmount    int64    `xml:"coupon_fee" sign:"coupon_fee"`
-	CouponNum       int      `xml:"coupon_count" sign:"coupon_count"`
-	CouponType0     string   `xml:"coupon_type_0" sign:"coupon_type_0"`
-	CounponFee0     int64    `xml:"coupon_fee_0" sign:"coupon_fee_0"`
-	CounponFee1     int64    `xml:"coupon_fee_1" sign:"coupon_fee_1"`
-	CounponFee2     int64    `xml:"coupon_fee_2" sign:"coupon_fee_2"`
-	CounponFee3     int64    `xml:"coupon_fee_3" sign:"coupon_fee_3"`
-	CouponType1     string   `xml:"coupon_type_1" sign:"coupon_type_1"`
-	CouponId0       string   `xml:"coupon_id_0" sign:"coupon_id_0"`
-	CouponId1       string   `xml:"coupon_id_1" sign:"coupon_id_1"`
-	CouponId2       string   `xml:"coupon_id_2" sign:"coupon_id_2"`
-	CouponId3       string   `xml:"coupon_id_3" sign:"coupon_id_3"`
-	TransactionID   string   `xml:"transaction_id" sign:"transaction_id"`
-	MerchantOrderNo string   `xml:"out_trade_no" sign:"out_trade_no"`
-	Attach          string   `xml:"attach" sign:"attach"`
-	CompletedTime   string   `xml:"time_end" sign:"time_end"`
+	XMLName         xml.Name   `xml:"xml"`
+	ReturnCode      string     `xml:"return_code" sign:"return_code"`
+	ReturnMsg       string     `xml:"return_msg" sign:"return_msg"`
+	AppID           string     `xml:"appid" sign:"appid"`
+	MerchantID      string     `xml:"mch_id" sign:"mch_id"`
+	DeviceInfo      string     `xml:"device_info" sign:"device_info"`
+	NonceStr        string     `xml:"nonce_str" sign:"nonce_str"`
+	Sign            string     `xml:"sign"`
+	ResultCode      string     `xml:"result_code" sign:"result_code"`
+	ErrCode         string     `xml:"err_code" sign:"err_code"`
+	ErrDesc         string     `xml:"err_code_des" sign:"err_code_des"`
+	TradeType       string     `xml:"trade_type" sign:"trade_type"`
+	OpenID          string     `xml:"openid" sign:"openid"`
+	IsSubscribe     string     `xml:"is_subscribe" sign:"is_subscribe"`
+	BankType        string     `xml:"bank_type" sign:"bank_type"`
+	TotalAmount     int64      `xml:"total_fee" sign:"total_fee"`
+	AccountAmount   int64      `xml:"settlement_total_fee" sign:"settlement_total_fee"` //结算金额
+	Currency        string     `xml:"fee_type" sign:"fee_type"`
+	CashAmount      int64      `xml:"cash_fee" sign:"cash_fee"`
+	CashCurrency    string     `xml:"cash_fee_type" sign:"cash_fee_type"`
+	CouponAmount    int64      `xml:"coupon_fee" sign:"coupon_fee"`
+	CouponNum       int        `xml:"coupon_count" sign:"coupon_count"`
+	Coupons         []WXCoupon `xml:"-"` // 代金券明细，按 coupon_*_$n 解析
+	params          xmlMap
+	TransactionID   string `xml:"transaction_id" sign:"transaction_id"`
+	MerchantOrderNo string `xml:"out_trade_no" sign:"out_trade_no"`
+	Attach          string `xml:"attach" sign:"attach"`
+	CompletedTime   string `xml:"time_end" sign:"time_end"`
 }
 
-func (n WXNotifyResult) getSign() string { return n.Sign }
+// WXCoupon 代金券或立减优惠
+type WXCoupon struct {
+	ID   string
+	Type string // CASH 充值代金券，NO_CASH 免充值代金券
+	Fee  int64
+}
+
+func (n *WXNotifyResult) setParams(params xmlMap) {
+	n.Coupons = parseCoupons(params)
+	n.params = params
+}
+
+// parseCoupons 解析 coupon_id_$n、coupon_type_$n、coupon_fee_$n 代金券明细
+func parseCoupons(params xmlMap) []WXCoupon {
+	var coupons []WXCoupon
+	for n := 0; ; n++ {
+		id, hasID := params[fmt.Sprintf("coupon_id_%d", n)]
+		fee, hasFee := params[fmt.Sprintf("coupon_fee_%d", n)]
+		if !hasID && !hasFee {
+			return coupons
+		}
+		coupon := WXCoupon{ID: id, Type: params[fmt.Sprintf("coupon_type_%d", n)]}
+		coupon.Fee, _ = strconv.ParseInt(fee, 10, 64)
+		coupons = append(coupons, coupon)
+	}
+}
+
+// toDiscounts 代金券转换为优惠明细，免充值代金券从商户结算金额中扣除，充值代金券由出资方预充值
+func toDiscounts(coupons []WXCoupon) []payment.Discount {
+	var discounts []payment.Discount
+	for _, coupon := range coupons {
+		d := payment.Discount{ID: coupon.ID, Type: coupon.Type, Amount: coupon.Fee, Funding: payment.DiscountFundingUnknown}
+		switch coupon.Type {
+		case "NO_CASH":
+			d.Funding = payment.DiscountFundingMerchant
+		case "CASH":
+			d.Funding = payment.DiscountFundingPrepaid
+		}
+		discounts = append(discounts, d)
+	}
+	return discounts
+}
 
 func (n WXNotifyResult) toNotifyResult() *payment.NotifyResult {
 	rslt := &payment.NotifyResult{
@@ -58,6 +96,9 @@ func (n WXNotifyResult) toNotifyResult() *payment.NotifyResult {
 		TotalAmount:     n.TotalAmount,
 		Currency:        n.Currency,
 		Attach:          n.Attach,
+		Discounts:       toDiscounts(n.Coupons),
+		Detail:          &n,
+		Raw:             n.params,
 	}
 	rslt.CompletedTime, _ = time.ParseInLocation("20060102150405", n.CompletedTime, time.Local)
 	rslt.Wechat.OpenID = n.OpenID
@@ -72,17 +113,59 @@ type WXNotifyReply struct {
 
 // NotifyCallback 异步通知处理
 func (c *Client) NotifyCallback(body io.Reader, f payment.NotifyHandleFunc) interface{} {
-	var result WXNotifyResult
-	d := xml.NewDecoder(body)
-	err := d.Decode(&result)
+	return c.auditNotify(body, func(r io.Reader) WXNotifyReply { return c.notifyCallback(r, f) })
+}
+
+func (c *Client) notifyCallback(body io.Reader, f payment.NotifyHandleFunc) WXNotifyReply {
+	data, err := ioutil.ReadAll(body)
 	if err != nil {
+		return WXNotifyReply{Code: "FAIL", Message: err.Error()}
+	}
+	// 按通知的全部参数验证签名，新增字段及代金券明细同样受签名保护
+	var params xmlMap
+	var result WXNotifyResult
+	if xml.Unmarshal(data, &params) != nil || xml.Unmarshal(data, &result) != nil {
 		return WXNotifyReply{Code: "FAIL", Message: "序列化失败"}
 	}
-	if !c.validatePayRes(result) {
+	if !params.verify(c.secret) {
 		return WXNotifyReply{Code: "FAIL", Message: "签名失败"}
 	}
+	if result.ReturnCode != "SUCCESS" {
+		return WXNotifyReply{Code: "FAIL", Message: fmt.Sprintf("通知失败:%s", result.ReturnMsg)}
+	}
+	if result.AppID != c.appid || result.MerchantID != c.payOption.MerchantID {
+		return WXNotifyReply{Code: "FAIL", Message: fmt.Sprintf("appid %s 或 mch_id %s 不匹配", result.AppID, result.MerchantID)}
+	}
+	// 支付失败的通知无需处理，应答成功以免重复通知
+	if result.ResultCode != "SUCCESS" {
+		log.Printf("payment: skip wechat notify of order %s, result:%s-%s", result.MerchantOrderNo, result.ErrCode, result.ErrDesc)
+		return WXNotifyReply{Code: "SUCCESS", Message: "OK"}
+	}
+	result.setParams(params)
 	if err = f(result.toNotifyResult()); err != nil {
 		return WXNotifyReply{Code: "FAIL", Message: err.Error()}
 	}
 	return WXNotifyReply{Code: "SUCCESS", Message: "OK"}
 }
+
+// auditNotify 设置审计记录存储时，记录异步通知及应答的原始报文；通知记录失败时不处理通知并应答失败，以便微信重新通知
+func (c *Client) auditNotify(body io.Reader, handle func(io.Reader) WXNotifyReply) interface{} {
+	if c.auditSink == nil {
+		return handle(body)
+	}
+	data, err := ioutil.ReadAll(body)
+	if err != nil {
+		return WXNotifyReply{Code: "FAIL", Message: err.Error()}
+	}
+	record := payment.AuditRecord{Time: time.Now(), Plat: payment.PayPlatWechat, Kind: payment.AuditNotify, Body: string(data)}
+	if err = c.auditSink.Audit(record); err != nil {
+		return WXNotifyReply{Code: "FAIL", Message: "审计记录失败"}
+	}
+	reply := handle(bytes.NewReader(data))
+	data, _ = xml.Marshal(reply)
+	record = payment.AuditRecord{Time: time.Now(), Plat: payment.PayPlatWechat, Kind: payment.AuditNotifyReply, Body: string(data)}
+	if err = c.auditSink.Audit(record); err != nil {
+		payment.OnAuditError(record, err)
+	}
+	return reply
+}
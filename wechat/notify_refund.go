@@ -2,7 +2,6 @@ package wechat
 
 import (
 	"bytes"
-	"crypto/aes"
 	"crypto/cipher"
 	"encoding/base64"
 	"encoding/xml"
@@ -42,6 +41,10 @@ type WXRefundNotifyInfo struct {
 
 // RefundCallback 退款异步通知回调处理
 func (c *Client) RefundCallback(in io.Reader, fn payment.RefundNotifyHandleFunc) interface{} {
+	return c.auditNotify(in, func(r io.Reader) WXNotifyReply { return c.refundCallback(r, fn) })
+}
+
+func (c *Client) refundCallback(in io.Reader, fn payment.RefundNotifyHandleFunc) WXNotifyReply {
 	var notifyResult WXRefundNotifyResult
 	err := xml.NewDecoder(in).Decode(&notifyResult)
 	if err != nil {
@@ -50,6 +53,9 @@ func (c *Client) RefundCallback(in io.Reader, fn payment.RefundNotifyHandleFunc)
 	if notifyResult.ReturnCode != "SUCCESS" {
 		return WXNotifyReply{Code: "FAIL", Message: fmt.Sprintf("退款失败:%s", notifyResult.ReturnMsg)}
 	}
+	if notifyResult.AppID != c.appid || notifyResult.MerchantID != c.payOption.MerchantID {
+		return WXNotifyReply{Code: "FAIL", Message: fmt.Sprintf("appid %s 或 mch_id %s 不匹配", notifyResult.AppID, notifyResult.MerchantID)}
+	}
 	cipherTxt, err := base64.StdEncoding.DecodeString(notifyResult.ReqInfo)
 	if err != nil {
 		return WXNotifyReply{Code: "FAIL", Message: fmt.Sprintf("Base64 decode error: %v", err)}
@@ -59,15 +65,21 @@ func (c *Client) RefundCallback(in io.Reader, fn payment.RefundNotifyHandleFunc)
 		return WXNotifyReply{Code: "FAIL", Message: fmt.Sprintf("AES-256-ECB decrypt error: %v", err)}
 	}
 	refundResult := payment.RefundNotifyResult{
-		Plat:             payment.PayPlatWechat,
-		MerchantOrderNo:  info.OutOrderNo,
-		MerchantRefundNo: info.OutRefundNo,
-		RefundID:         info.WXRefundID,
-		RefundAmount:     info.ActualRefundAmout,
-		TotalAmount:      info.TotalAmount,
+		Plat:                   payment.PayPlatWechat,
+		MerchantOrderNo:        info.OutOrderNo,
+		MerchantRefundNo:       info.OutRefundNo,
+		TransactionID:          info.WXTransID,
+		RefundID:               info.WXRefundID,
+		RefundAmount:           info.RefundAmount,
+		SettlementRefundAmount: info.ActualRefundAmout,
+		TotalAmount:            info.TotalAmount,
+		Status:                 payment.RefundStatus(info.Status),
+		RecvAccount:            info.RecAccount,
+		RefundAccount:          info.RefundAccount,
+		Initiator:              info.Source,
 	}
 	refundResult.CompletedTime, _ = time.ParseInLocation("2006-01-02 15:04:05", info.CompletedTime, time.Local)
-	refundResult.IsSuccess = info.Status == "SUCCESS"
+	refundResult.IsSuccess = refundResult.Status == payment.RefundStatusSuccess
 	if err = fn(refundResult); err != nil {
 		return WXNotifyReply{Code: "FAIL", Message: err.Error()}
 	}
@@ -75,14 +87,10 @@ func (c *Client) RefundCallback(in io.Reader, fn payment.RefundNotifyHandleFunc)
 }
 
 func (c *Client) decrypteRefundInfo(cipherTxt []byte) (WXRefundNotifyInfo, error) {
-	block, err := aes.NewCipher(c.refundKey)
+	plainTxt, err := decryptAES256ECB(c.refundKey, cipherTxt)
 	if err != nil {
 		return WXRefundNotifyInfo{}, err
 	}
-	ecbMode := NewECBDecrypter(block)
-	plainTxt := make([]byte, len(cipherTxt))
-	ecbMode.CryptBlocks(plainTxt, cipherTxt)
-	plainTxt = pkcs5UnPadding(plainTxt)
 	var result WXRefundNotifyInfo
 	err = xml.NewDecoder(bytes.NewReader(plainTxt)).Decode(&result)
 	return result, err
@@ -94,13 +102,6 @@ func pkcs5Padding(ciphertext []byte, blockSize int) []byte {
 	return append(ciphertext, padtext...)
 }
 
-func pkcs5UnPadding(origData []byte) []byte {
-	length := len(origData)
-	// 去掉最后一个字节 unpadding 次
-	unpadding := int(origData[length-1])
-	return origData[:(length - unpadding)]
-}
-
 type ecb struct {
 	b         cipher.Block
 	blockSize int
@@ -0,0 +1,105 @@
+package wechat
+
+import (
+	"bytes"
+	"io/ioutil"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/shengzhi/payment"
+)
+
+func TestParseCoupons(t *testing.T) {
+	tests := []struct {
+		name      string
+		params    xmlMap
+		coupons   []WXCoupon
+		discounts []payment.Discount
+	}{
+		{name: "no coupon", params: xmlMap{"total_fee": "100"}},
+		{
+			name: "cash and no cash",
+			params: xmlMap{
+				"coupon_count": "2", "coupon_fee": "30",
+				"coupon_id_0": "C1", "coupon_type_0": "CASH", "coupon_fee_0": "10",
+				"coupon_id_1": "C2", "coupon_type_1": "NO_CASH", "coupon_fee_1": "20",
+			},
+			coupons: []WXCoupon{{ID: "C1", Type: "CASH", Fee: 10}, {ID: "C2", Type: "NO_CASH", Fee: 20}},
+			discounts: []payment.Discount{
+				{ID: "C1", Type: "CASH", Amount: 10, Funding: payment.DiscountFundingPrepaid},
+				{ID: "C2", Type: "NO_CASH", Amount: 20, Funding: payment.DiscountFundingMerchant},
+			},
+		},
+		{
+			name:      "type missing",
+			params:    xmlMap{"coupon_id_0": "C1", "coupon_fee_0": "10"},
+			coupons:   []WXCoupon{{ID: "C1", Fee: 10}},
+			discounts: []payment.Discount{{ID: "C1", Amount: 10, Funding: payment.DiscountFundingUnknown}},
+		},
+		{
+			name:      "stops at gap",
+			params:    xmlMap{"coupon_id_0": "C1", "coupon_fee_0": "10", "coupon_id_2": "C3", "coupon_fee_2": "30"},
+			coupons:   []WXCoupon{{ID: "C1", Fee: 10}},
+			discounts: []payment.Discount{{ID: "C1", Amount: 10, Funding: payment.DiscountFundingUnknown}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			coupons := parseCoupons(tt.params)
+			if !reflect.DeepEqual(coupons, tt.coupons) {
+				t.Fatalf("got coupons %+v, want %+v", coupons, tt.coupons)
+			}
+			if discounts := toDiscounts(coupons); !reflect.DeepEqual(discounts, tt.discounts) {
+				t.Fatalf("got discounts %+v, want %+v", discounts, tt.discounts)
+			}
+		})
+	}
+}
+
+func TestNotifyCallback(t *testing.T) {
+	c := newTestClient(t, nil)
+	notify := func(fields map[string]string) map[string]string {
+		params := map[string]string{
+			"return_code": "SUCCESS", "result_code": "SUCCESS", "appid": "wx2421b1c4370ec43b", "mch_id": "1900000109",
+			"nonce_str": "n1", "out_trade_no": "T1", "transaction_id": "4200001", "total_fee": "100", "time_end": "20261018100000",
+		}
+		for k, v := range fields {
+			params[k] = v
+		}
+		return params
+	}
+	tests := []struct {
+		name    string
+		params  map[string]string
+		tamper  bool
+		code    string
+		handled bool
+	}{
+		{name: "paid", params: notify(nil), code: "SUCCESS", handled: true},
+		{name: "pay failed", params: notify(map[string]string{"result_code": "FAIL", "err_code": "ORDERPAID"}), code: "SUCCESS"},
+		{name: "return failed", params: notify(map[string]string{"return_code": "FAIL", "return_msg": "签名失败"}), code: "FAIL"},
+		{name: "other appid", params: notify(map[string]string{"appid": "wx0000000000000000"}), code: "FAIL"},
+		{name: "other merchant", params: notify(map[string]string{"mch_id": "1900000000"}), code: "FAIL"},
+		{name: "bad sign", params: notify(nil), tamper: true, code: "FAIL"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			body, _ := ioutil.ReadAll(xmlReply(tt.params).Body)
+			if tt.tamper {
+				body = []byte(strings.Replace(string(body), "<total_fee><![CDATA[100]]>", "<total_fee><![CDATA[1]]>", 1))
+			}
+			var got *payment.NotifyResult
+			reply := c.NotifyCallback(bytes.NewReader(body), func(r *payment.NotifyResult) error {
+				got = r
+				return nil
+			}).(WXNotifyReply)
+			if reply.Code != tt.code || (got != nil) != tt.handled {
+				t.Fatalf("got reply %+v handled %v", reply, got != nil)
+			}
+			if got != nil && (got.MerchantOrderNo != "T1" || got.TotalAmount != 100) {
+				t.Fatalf("unexpected result %+v", got)
+			}
+		})
+	}
+}
@@ -1,7 +1,10 @@
 package wechat
 
 import (
+	"log"
 	"time"
+
+	"github.com/shengzhi/payment"
 )
 
 type OptionFunc func(c *Client)
@@ -29,3 +32,28 @@ func WithCertFile(caroot, clientCrt, clientKey string) OptionFunc {
 		c.caroot, c.clientcrt, c.clientkey = caroot, clientCrt, clientKey
 	}
 }
+
+// WithRetryPolicy 设置重试策略，仅对退款、订单查询及关闭订单等可安全重试的操作生效，重试使用相同的商户单号
+func WithRetryPolicy(policy payment.RetryPolicy) OptionFunc {
+	return func(c *Client) { c.retryPolicy = policy }
+}
+
+// WithHTTPMiddleware 设置HTTP调用中间件，作用于所有请求微信支付的HTTP调用
+func WithHTTPMiddleware(mws ...payment.HTTPMiddleware) OptionFunc {
+	return func(c *Client) { c.httpMiddlewares = append(c.httpMiddlewares, mws...) }
+}
+
+// WithTracer 设置日志跟踪，请求及响应字段经脱敏后以JSON格式输出
+func WithTracer(tracer *log.Logger) OptionFunc {
+	return func(c *Client) { c.tracer = tracer }
+}
+
+// WithRedactor 设置日志跟踪的脱敏规则，默认为 payment.DefaultRedactor
+func WithRedactor(r *payment.Redactor) OptionFunc {
+	return func(c *Client) { c.redactor = r }
+}
+
+// WithAuditSink 设置审计记录存储，记录所有请求、响应、异步通知及通知应答的原始报文
+func WithAuditSink(sink payment.AuditSink) OptionFunc {
+	return func(c *Client) { c.auditSink = sink }
+}
@@ -4,11 +4,10 @@
 package wechat
 
 import (
+	"bytes"
 	"encoding/xml"
 	"errors"
 	"fmt"
-	"io"
-	"log"
 	"strconv"
 	"strings"
 	"time"
@@ -95,8 +94,6 @@ type WXOrderResponse struct {
 	CodeURL    string   `xml:"code_url" sign:"code_url"`
 }
 
-func (r WXOrderResponse) getSign() string { return r.Sign }
-
 func (r WXOrderResponse) toSignMap(secret string) signMap {
 	m := make(signMap, 0)
 	m["return_code"] = r.ReturnCode
@@ -175,15 +172,11 @@ func (c *Client) Order(order *payment.OrderRequest) (*payment.OrderResponse, err
 	}
 
 	c.makePaySign(wxOrderReq)
-	pr, pw := io.Pipe()
-	go func() {
-		defer pw.Close()
-		enc := xml.NewEncoder(pw)
-		if err := enc.Encode(wxOrderReq); err != nil {
-			log.Println(fmt.Errorf("Payment: marshal struct to xml error:%v", err))
-		}
-	}()
-	res, err := c.httpClient.Post(wx_pay_order_url, "application/xml", pr)
+	var buf bytes.Buffer
+	if err := xml.NewEncoder(&buf).Encode(wxOrderReq); err != nil {
+		return nil, fmt.Errorf("Payment: marshal struct to xml error:%v", err)
+	}
+	res, err := c.httpClient.Post(wx_pay_order_url, "application/xml", &buf)
 
 	if err != nil {
 		return nil, err
@@ -215,7 +208,7 @@ func (c *Client) Order(order *payment.OrderRequest) (*payment.OrderResponse, err
 }
 
 // Retry 支付重试
-func (c *Client) Retry(source payment.PaySource, prepayid string) *payment.OrderResponse {
+func (c *Client) Retry(source payment.PaySource, prepayid string) (*payment.OrderResponse, error) {
 	or := payment.OrderResponse{}
 	or.Wechat.PrepayID = prepayid
 	if source == payment.PaySourceApp {
@@ -223,7 +216,7 @@ func (c *Client) Retry(source payment.PaySource, prepayid string) *payment.Order
 	} else {
 		or.Wechat.PayForm = c.genWebPayArgs(prepayid)
 	}
-	return &or
+	return &or, nil
 }
 
 func (c *Client) genAppPayArgs(prepayid string) payment.WXPayObject {
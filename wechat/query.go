@@ -0,0 +1,121 @@
+// 订单查询及关闭订单
+
+package wechat
+
+import (
+	"context"
+	"encoding/xml"
+	"time"
+
+	"github.com/shengzhi/payment"
+)
+
+const (
+	wx_pay_query_url = "https://api.mch.weixin.qq.com/pay/orderquery"
+	wx_pay_close_url = "https://api.mch.weixin.qq.com/pay/closeorder"
+)
+
+// OrderQueryRequest 订单查询及关闭订单请求
+type OrderQueryRequest struct {
+	XMLName       xml.Name `xml:"xml"`
+	APPID         string   `xml:"appid" sign:"appid"`
+	MerchantID    string   `xml:"mch_id" sign:"mch_id"`
+	Noncestr      string   `xml:"nonce_str" sign:"nonce_str"`
+	Sign          string   `xml:"sign"`
+	TransactionID string   `xml:"transaction_id,omitempty" sign:"transaction_id"`
+	OutTradeNo    string   `xml:"out_trade_no" sign:"out_trade_no"`
+}
+
+func (r *OrderQueryRequest) setSign(sign string) { r.Sign = sign }
+
+// OrderQueryReply 订单查询响应
+type OrderQueryReply struct {
+	XMLName        xml.Name   `xml:"xml"`
+	AppID          string     `xml:"appid"`
+	MerchantID     string     `xml:"mch_id"`
+	OpenID         string     `xml:"openid"`
+	TradeType      string     `xml:"trade_type"`
+	TradeState     string     `xml:"trade_state"`
+	TradeStateDesc string     `xml:"trade_state_desc"`
+	BankType       string     `xml:"bank_type"`
+	TotalAmount    int64      `xml:"total_fee"`
+	Currency       string     `xml:"fee_type"`
+	CashAmount     int64      `xml:"cash_fee"`
+	CouponAmount   int64      `xml:"coupon_fee"`
+	Coupons        []WXCoupon `xml:"-"`
+	params         xmlMap
+	TransactionID  string `xml:"transaction_id"`
+	OutTradeNo     string `xml:"out_trade_no"`
+	Attach         string `xml:"attach"`
+	CompletedTime  string `xml:"time_end"`
+}
+
+func (r *OrderQueryReply) setParams(params xmlMap) {
+	r.Coupons = parseCoupons(params)
+	r.params = params
+}
+
+// Query 查询订单，订单不存在时视为未支付
+func (c *Client) Query(merchantOrderNo string) (*payment.QueryResult, error) {
+	return c.QueryContext(context.Background(), merchantOrderNo)
+}
+
+// QueryContext 同 Query，ctx 取消后停止请求及重试
+func (c *Client) QueryContext(ctx context.Context, merchantOrderNo string) (*payment.QueryResult, error) {
+	req := OrderQueryRequest{
+		APPID: c.appid, MerchantID: c.payOption.MerchantID,
+		OutTradeNo: merchantOrderNo,
+	}
+	result := &payment.QueryResult{State: payment.TradeStateNotPay}
+	result.Plat = payment.PayPlatWechat
+	var reply OrderQueryReply
+	err := c.retry(ctx, func() error {
+		req.Noncestr = c.genNonceStr(24)
+		c.makePaySign(&req)
+		return c.post(ctx, c.httpClient, wx_pay_query_url, &req, &reply)
+	})
+	if e, ok := err.(*Error); ok && e.Code == "ORDERNOTEXIST" {
+		result.MerchantOrderNo = merchantOrderNo
+		return result, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	result.State = payment.TradeState(reply.TradeState)
+	result.MerchantOrderNo = reply.OutTradeNo
+	result.TransactionID = reply.TransactionID
+	result.TotalAmount = reply.TotalAmount
+	result.Currency = reply.Currency
+	result.Attach = reply.Attach
+	result.Discounts = toDiscounts(reply.Coupons)
+	result.Detail = &reply
+	result.Raw = reply.params
+	result.CompletedTime, _ = time.ParseInLocation("20060102150405", reply.CompletedTime, time.Local)
+	result.Wechat.OpenID = reply.OpenID
+	return result, nil
+}
+
+// Close 关闭订单，订单已关闭或不存在时视为关闭成功，订单已支付时返回错误
+func (c *Client) Close(merchantOrderNo string) error {
+	return c.CloseContext(context.Background(), merchantOrderNo)
+}
+
+// CloseContext 同 Close，ctx 取消后停止请求及重试
+func (c *Client) CloseContext(ctx context.Context, merchantOrderNo string) error {
+	req := OrderQueryRequest{
+		APPID: c.appid, MerchantID: c.payOption.MerchantID,
+		OutTradeNo: merchantOrderNo,
+	}
+	var reply struct {
+		XMLName xml.Name `xml:"xml"`
+	}
+	err := c.retry(ctx, func() error {
+		req.Noncestr = c.genNonceStr(24)
+		c.makePaySign(&req)
+		return c.post(ctx, c.httpClient, wx_pay_close_url, &req, &reply)
+	})
+	if e, ok := err.(*Error); ok && (e.Code == "ORDERCLOSED" || e.Code == "ORDERNOTEXIST") {
+		return nil
+	}
+	return err
+}
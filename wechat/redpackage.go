@@ -4,10 +4,11 @@ package wechat
 
 import (
 	"bytes"
+	"context"
 	"encoding/xml"
 	"fmt"
-	"net/http"
 	"net/url"
+	"strconv"
 	"time"
 
 	"github.com/shengzhi/payment"
@@ -27,12 +28,14 @@ type SendRedPackRequest struct {
 	Amount       int32    `xml:"total_amount" sign:"total_amount"`               // 付款金额，单位分
 	Num          int      `xml:"total_num" sign:"total_num"`                     // 红包发放总人数 total_num=1
 	Wishing      string   `xml:"wishing" sign:"wishing"`                         // 红包祝福语
-	ClientIP     string   `xml:"client_ip" sign:"client_ip"`                     // 调用接口的机器Ip地址
+	ClientIP     string   `xml:"client_ip,omitempty" sign:"client_ip"`           // 调用接口的机器Ip地址，裂变红包及小程序红包无此参数
 	ActName      string   `xml:"act_name" sign:"act_name"`                       // 活动名称
 	Remark       string   `xml:"remark" sign:"remark"`                           // 备注信息
 	SceneID      string   `xml:"scene_id,omitempty" sign:"scene_id"`             // 发放红包使用场景，红包金额大于200时必传 PRODUCT_1:商品促销 PRODUCT_2:抽奖 PRODUCT_3:虚拟物品兑奖 PRODUCT_4:企业内部福利 PRODUCT_5:渠道分润 PRODUCT_6:保险回馈 PRODUCT_7:彩票派奖 PRODUCT_8:税务刮奖
 	RiskInfo     RiskInfo `xml:"risk_info,omitempty" sign:"risk_info"`           // 活动信息
 	ConsumeMchID string   `xml:"consume_mch_id,omitempty" sign:"consume_mch_id"` // 资金授权商户号
+	AmtType      string   `xml:"amt_type,omitempty" sign:"amt_type"`             // 裂变红包金额设置方式，ALL_RAND 全部随机
+	NotifyWay    string   `xml:"notify_way,omitempty" sign:"notify_way"`         // 小程序红包通知用户形式，MINI_PROGRAM_JSAPI
 }
 
 func (r *SendRedPackRequest) setSign(sign string) { r.Sign = sign }
@@ -45,9 +48,8 @@ type RiskInfo struct {
 	ClientVersion string
 }
 
-// MarshalXML xml encoding
-func (ri RiskInfo) MarshalXML(e *xml.Encoder, start xml.StartElement) error {
-	var data string
+// String URL编码的活动信息，与XML中发送的值一致，签名时使用该值
+func (ri RiskInfo) String() string {
 	var buf bytes.Buffer
 	if !ri.PostTime.IsZero() {
 		fmt.Fprintf(&buf, "posttime=%d&", ri.PostTime.Unix())
@@ -61,11 +63,16 @@ func (ri RiskInfo) MarshalXML(e *xml.Encoder, start xml.StartElement) error {
 	if ri.ClientVersion != "" {
 		fmt.Fprintf(&buf, "clientversion=%s&", ri.ClientVersion)
 	}
-	if buf.Len() > 0 {
-		buf.Truncate(buf.Len() - 1)
-		data = url.QueryEscape(buf.String())
+	if buf.Len() == 0 {
+		return ""
 	}
-	return e.EncodeElement(data, start)
+	buf.Truncate(buf.Len() - 1)
+	return url.QueryEscape(buf.String())
+}
+
+// MarshalXML xml encoding
+func (ri RiskInfo) MarshalXML(e *xml.Encoder, start xml.StartElement) error {
+	return e.EncodeElement(ri.String(), start)
 }
 
 // SendRedPackageReply 红包发送响应
@@ -89,13 +96,30 @@ type SendRedPackageReply struct {
 // SendRedPack 发放红包
 func (c *Client) SendRedPack(r payment.RedPackageRequest) (payment.RedPackageResponse, error) {
 	const uri = "https://api.mch.weixin.qq.com/mmpaymkttransfers/sendredpack"
+	var result payment.RedPackageResponse
+	req := c.redPackRequest(r)
+	req.ClientIP = r.ClientIP
+	var reply SendRedPackageReply
+	if err := c.sendRedPack(uri, req, &reply); err != nil {
+		return result, err
+	}
+	result.OrderNo = reply.OrderNo
+	result.PlatOrderNo = reply.SendListID
+	result.WXAppID = reply.AppID
+	result.TotalAmount = reply.Amount
+	result.WXOpenID = reply.OpenID
+	return result, nil
+}
+
+// redPackRequest 红包发送请求的公共参数
+func (c *Client) redPackRequest(r payment.RedPackageRequest) SendRedPackRequest {
 	req := SendRedPackRequest{
 		APPID: r.WXAppID, OpenID: r.WXOpenID,
-		Noncestr: c.genNonceStr(24), SignType: "MD5",
+		SignType:   "MD5",
 		MerchantID: c.payOption.MerchantID,
 		OrderNo:    r.OrderNo,
 		SendName:   r.MerchantName, Amount: r.TotalAmount, Num: r.TotalNum,
-		Wishing: r.Wishing, ClientIP: r.ClientIP,
+		Wishing: r.Wishing,
 		ActName: r.ActiveName,
 		SceneID: string(r.Scene),
 	}
@@ -103,36 +127,160 @@ func (c *Client) SendRedPack(r payment.RedPackageRequest) (payment.RedPackageRes
 	req.RiskInfo.DeviceID = r.DeviceID
 	req.RiskInfo.Mobile = r.Mobile
 	req.RiskInfo.ClientVersion = r.ClientVersion
-	c.makePaySign(&req)
+	return req
+}
 
-	var buf bytes.Buffer
-	coder := xml.NewEncoder(&buf)
-	coder.Encode(req)
+// sendRedPack 发送红包，系统繁忙等错误以原商户订单号重试，订单号相同的请求不会重复发放
+func (c *Client) sendRedPack(uri string, req SendRedPackRequest, reply interface{}) error {
+	return c.retry(context.Background(), func() error {
+		req.Noncestr = c.genNonceStr(24)
+		c.makePaySign(&req)
+		return c.postXML(context.Background(), c.certClient, uri, &req, reply, false)
+	})
+}
 
+// SendGroupRedPack 发放裂变红包，红包发放给 WXOpenID 指定的种子用户，由其分享给好友领取，
+// 金额随机分配，TotalNum 为3至20人
+func (c *Client) SendGroupRedPack(r payment.RedPackageRequest) (payment.RedPackageResponse, error) {
+	const uri = "https://api.mch.weixin.qq.com/mmpaymkttransfers/sendgroupredpack"
 	var result payment.RedPackageResponse
-	client := &http.Client{
-		Transport: &http.Transport{TLSClientConfig: c.tlsCfg},
+	if r.TotalNum < 3 || r.TotalNum > 20 {
+		return result, fmt.Errorf("Payment: group red pack total_num must be between 3 and 20")
 	}
-	res, err := client.Post(uri, "application/xml", &buf)
-	if err != nil {
-		return result, err
-	}
-	defer res.Body.Close()
+	req := c.redPackRequest(r)
+	req.AmtType = "ALL_RAND"
 	var reply SendRedPackageReply
-	err = xml.NewDecoder(res.Body).Decode(&reply)
-	if err != nil {
-		return result, fmt.Errorf("Payment: decode xml to struct error:%v", err)
+	if err := c.sendRedPack(uri, req, &reply); err != nil {
+		return result, err
 	}
-	if reply.ReturnCode != "SUCCESS" {
-		return result, fmt.Errorf("Payment: %s-%s", reply.ReturnCode, reply.ReturnMsg)
+	result.OrderNo = reply.OrderNo
+	result.PlatOrderNo = reply.SendListID
+	result.WXAppID = reply.AppID
+	result.TotalAmount = reply.Amount
+	result.WXOpenID = reply.OpenID
+	return result, nil
+}
+
+// MiniProgramRedPack 小程序红包发放结果
+type MiniProgramRedPack struct {
+	payment.RedPackageResponse
+	Package string                   // 红包详情，用于小程序 wx.sendBizRedPacket
+	Params  MiniProgramRedPackParams // wx.sendBizRedPacket 参数
+}
+
+// MiniProgramRedPackParams 小程序 wx.sendBizRedPacket 参数
+type MiniProgramRedPackParams struct {
+	TimeStamp string `json:"timeStamp"`
+	NonceStr  string `json:"nonceStr"`
+	Package   string `json:"package"`
+	SignType  string `json:"signType"`
+	PaySign   string `json:"paySign"`
+}
+
+// SendMiniProgramRedPack 发放小程序红包，返回的 Params 交由小程序调用 wx.sendBizRedPacket 拆红包
+func (c *Client) SendMiniProgramRedPack(r payment.RedPackageRequest) (MiniProgramRedPack, error) {
+	const uri = "https://api.mch.weixin.qq.com/mmpaymkttransfers/sendminiprogramhb"
+	var result MiniProgramRedPack
+	req := c.redPackRequest(r)
+	req.Num = 1
+	req.NotifyWay = "MINI_PROGRAM_JSAPI"
+	var reply struct {
+		SendRedPackageReply
+		Package string `xml:"package"`
 	}
-	if reply.ResultCode == "FAIL" {
-		return result, fmt.Errorf("Payment:%s-%s", reply.ErrCode, reply.ErrDesc)
+	if err := c.sendRedPack(uri, req, &reply); err != nil {
+		return result, err
 	}
 	result.OrderNo = reply.OrderNo
 	result.PlatOrderNo = reply.SendListID
 	result.WXAppID = reply.AppID
 	result.TotalAmount = reply.Amount
 	result.WXOpenID = reply.OpenID
+	result.Package = reply.Package
+	result.Params = c.miniProgramRedPackParams(r.WXAppID, reply.Package)
 	return result, nil
 }
+
+// miniProgramRedPackParams 生成 wx.sendBizRedPacket 参数，package 经URL编码后参与签名
+func (c *Client) miniProgramRedPackParams(appID, pkg string) MiniProgramRedPackParams {
+	params := MiniProgramRedPackParams{
+		TimeStamp: strconv.FormatInt(time.Now().Unix(), 10),
+		NonceStr:  c.genNonceStr(24),
+		Package:   pkg,
+		SignType:  SignTypeMD5,
+	}
+	params.PaySign = Sign(map[string]string{
+		"appId":     appID,
+		"timeStamp": params.TimeStamp,
+		"nonceStr":  params.NonceStr,
+		"package":   url.QueryEscape(pkg),
+	}, c.secret, SignTypeMD5)
+	return params
+}
+
+// 红包状态
+const (
+	RedPackStatusSending   = "SENDING"   // 发放中
+	RedPackStatusSent      = "SENT"      // 已发放待领取
+	RedPackStatusFailed    = "FAILED"    // 发放失败
+	RedPackStatusReceived  = "RECEIVED"  // 已领取
+	RedPackStatusRefunding = "RFUND_ING" // 退款中
+	RedPackStatusRefund    = "REFUND"    // 已退款，红包过期未领取时退回商户
+)
+
+// RedPackQueryRequest 红包查询请求
+type RedPackQueryRequest struct {
+	XMLName    xml.Name `xml:"xml"`
+	APPID      string   `xml:"appid" sign:"appid"`
+	MerchantID string   `xml:"mch_id" sign:"mch_id"`
+	Noncestr   string   `xml:"nonce_str" sign:"nonce_str"`
+	Sign       string   `xml:"sign"`
+	OrderNo    string   `xml:"mch_billno" sign:"mch_billno"`
+	BillType   string   `xml:"bill_type" sign:"bill_type"` // MCHT 通过商户订单号查询
+}
+
+func (r *RedPackQueryRequest) setSign(sign string) { r.Sign = sign }
+
+// RedPackInfo 红包查询结果，金额单位：分
+type RedPackInfo struct {
+	XMLName      xml.Name          `xml:"xml"`
+	OrderNo      string            `xml:"mch_billno"`
+	MerchantID   string            `xml:"mch_id"`
+	DetailID     string            `xml:"detail_id"` // 红包单号
+	Status       string            `xml:"status"`
+	SendType     string            `xml:"send_type"` // API、UPLOAD、ACTIVITY
+	Type         string            `xml:"hb_type"`   // GROUP 裂变红包，NORMAL 普通红包
+	TotalNum     int               `xml:"total_num"`
+	TotalAmount  int32             `xml:"total_amount"`
+	Reason       string            `xml:"reason"` // 发放失败原因
+	SendTime     string            `xml:"send_time"`
+	RefundTime   string            `xml:"refund_time"`
+	RefundAmount int32             `xml:"refund_amount"`
+	Wishing      string            `xml:"wishing"`
+	Remark       string            `xml:"remark"`
+	ActName      string            `xml:"act_name"`
+	Receivers    []RedPackReceiver `xml:"hblist>hbinfo"` // 领取红包的用户，裂变红包为多个
+}
+
+// RedPackReceiver 红包领取用户
+type RedPackReceiver struct {
+	OpenID   string `xml:"openid"`
+	Amount   int32  `xml:"amount"`
+	RecvTime string `xml:"rcv_time"`
+}
+
+// QueryRedPack 按商户订单号查询红包状态及领取用户，appID 为发放红包的公众账号ID，为空时使用客户端的 appid
+func (c *Client) QueryRedPack(appID, orderNo string) (RedPackInfo, error) {
+	const uri = "https://api.mch.weixin.qq.com/mmpaymkttransfers/gethbinfo"
+	if appID == "" {
+		appID = c.appid
+	}
+	req := RedPackQueryRequest{APPID: appID, MerchantID: c.payOption.MerchantID, OrderNo: orderNo, BillType: "MCHT"}
+	var reply RedPackInfo
+	err := c.retry(context.Background(), func() error {
+		req.Noncestr = c.genNonceStr(24)
+		c.makePaySign(&req)
+		return c.postXML(context.Background(), c.certClient, uri, &req, &reply, false)
+	})
+	return reply, err
+}
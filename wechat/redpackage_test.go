@@ -0,0 +1,185 @@
+package wechat
+
+import (
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/shengzhi/payment"
+)
+
+func TestSendRedPack(t *testing.T) {
+	success := map[string]string{
+		"return_code": "SUCCESS", "result_code": "SUCCESS", "mch_billno": "RP1", "wxappid": "wx2421b1c4370ec43b",
+		"re_openid": "oUpF8uMuAJO_M2pxb1Q9zNjWeS6o", "total_amount": "100", "send_listid": "1000041701201411111234567890",
+	}
+	systemBusy := map[string]string{"return_code": "SUCCESS", "result_code": "FAIL", "err_code": "SYSTEMERROR", "err_code_des": "系统繁忙"}
+	notEnough := map[string]string{"return_code": "SUCCESS", "result_code": "FAIL", "err_code": "NOTENOUGH", "err_code_des": "帐号余额不足"}
+	tests := []struct {
+		name     string
+		replies  []map[string]string // 依次返回的应答，超出时返回最后一个
+		attempts int
+		wantCode string
+	}{
+		{name: "success", replies: []map[string]string{success}, attempts: 1},
+		{name: "retry system error", replies: []map[string]string{systemBusy, systemBusy, success}, attempts: 3},
+		{name: "business error", replies: []map[string]string{notEnough}, attempts: 1, wantCode: "NOTENOUGH"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var billNos []string
+			nonces := make(map[string]bool)
+			c := newTestClient(t, func(req *http.Request) (*http.Response, error) {
+				body, _ := ioutil.ReadAll(req.Body)
+				params, err := ParseParams(body)
+				if err != nil {
+					return nil, err
+				}
+				if !xmlMap(params).verify(testSecret) || nonces[params["nonce_str"]] {
+					t.Errorf("request not signed with a new nonce: %s", body)
+				}
+				if params["risk_info"] == "" {
+					t.Errorf("request without risk_info: %s", body)
+				}
+				nonces[params["nonce_str"]] = true
+				billNos = append(billNos, params["mch_billno"])
+				reply := tt.replies[len(tt.replies)-1]
+				if len(billNos) <= len(tt.replies) {
+					reply = tt.replies[len(billNos)-1]
+				}
+				return xmlReply(reply), nil
+			}, WithRetryPolicy(payment.RetryPolicy{MaxAttempts: 3, BaseDelay: time.Millisecond, MaxDelay: time.Millisecond}))
+			result, err := c.SendRedPack(payment.RedPackageRequest{
+				OrderNo: "RP1", WXAppID: "wx2421b1c4370ec43b", WXOpenID: "oUpF8uMuAJO_M2pxb1Q9zNjWeS6o",
+				MerchantName: "测试商户", TotalAmount: 100, TotalNum: 1, Wishing: "恭喜发财", ActiveName: "测试活动", ClientIP: "127.0.0.1",
+				Mobile: "13800000000", DeviceID: "ios 11&2", ClientVersion: "1.0",
+			})
+			if len(billNos) != tt.attempts {
+				t.Fatalf("got %d attempts, want %d", len(billNos), tt.attempts)
+			}
+			for _, no := range billNos {
+				if no != "RP1" {
+					t.Fatalf("retry with bill no %s, want RP1", no)
+				}
+			}
+			if tt.wantCode != "" {
+				var e *Error
+				if !errors.As(err, &e) || e.Code != tt.wantCode {
+					t.Fatalf("got error %v, want %s", err, tt.wantCode)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if result.OrderNo != "RP1" || result.PlatOrderNo != success["send_listid"] || result.TotalAmount != 100 {
+				t.Fatalf("unexpected result %+v", result)
+			}
+		})
+	}
+}
+
+func TestRiskInfoString(t *testing.T) {
+	ri := RiskInfo{PostTime: time.Unix(1500000000, 0), Mobile: "13800000000", DeviceID: "ios 11&2"}
+	want := url.QueryEscape("posttime=1500000000&mobile=13800000000&deviceid=ios 11&2")
+	if got := ri.String(); got != want {
+		t.Fatalf("got %s, want %s", got, want)
+	}
+	// 签名使用的值与 XML 中发送的值一致
+	req := SendRedPackRequest{RiskInfo: ri}
+	if got := structToSignMap(&req)["risk_info"]; got != want {
+		t.Fatalf("signed risk_info %s, want %s", got, want)
+	}
+	if (RiskInfo{}).String() != "" {
+		t.Fatal("empty risk info should encode to empty string")
+	}
+}
+
+func TestSendGroupRedPackTotalNum(t *testing.T) {
+	for _, num := range []int{2, 3, 20, 21} {
+		requests := 0
+		c := newTestClient(t, func(req *http.Request) (*http.Response, error) {
+			requests++
+			body, _ := ioutil.ReadAll(req.Body)
+			params, err := ParseParams(body)
+			if err != nil {
+				return nil, err
+			}
+			if params["amt_type"] != "ALL_RAND" || !xmlMap(params).verify(testSecret) {
+				t.Errorf("unexpected request %s", body)
+			}
+			return xmlReply(map[string]string{"return_code": "SUCCESS", "result_code": "SUCCESS", "mch_billno": "RP1", "total_amount": "300"}), nil
+		})
+		_, err := c.SendGroupRedPack(payment.RedPackageRequest{OrderNo: "RP1", WXAppID: "wx2421b1c4370ec43b", TotalAmount: 300, TotalNum: num})
+		valid := num >= 3 && num <= 20
+		if (err == nil) != valid || (requests == 1) != valid {
+			t.Fatalf("total_num %d: got error %v after %d requests", num, err, requests)
+		}
+	}
+}
+
+func TestSendMiniProgramRedPack(t *testing.T) {
+	pkg := "sendid=242e8abd163d300019b2cae74ba8e8c06e3f0e51ab84d16b3c80decd22a5b672&ver=8&sign=4110d649a5aef52dd6b95654ddf91ca7d5411ac159ace4e1a766b7d3967a1c3dfe1d256811445a4abda2d9cfa4a9b377a829258bd00d90313c6c346f2349fe9d&mchid=11475856&spid=11475856"
+	c := newTestClient(t, func(req *http.Request) (*http.Response, error) {
+		body, _ := ioutil.ReadAll(req.Body)
+		params, err := ParseParams(body)
+		if err != nil {
+			return nil, err
+		}
+		if params["notify_way"] != "MINI_PROGRAM_JSAPI" || params["total_num"] != "1" || !xmlMap(params).verify(testSecret) {
+			t.Errorf("unexpected request %s", body)
+		}
+		return xmlReply(map[string]string{"return_code": "SUCCESS", "result_code": "SUCCESS", "mch_billno": "RP1", "package": pkg}), nil
+	})
+	result, err := c.SendMiniProgramRedPack(payment.RedPackageRequest{OrderNo: "RP1", WXAppID: "wx2421b1c4370ec43b", TotalAmount: 100, TotalNum: 5})
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := result.Params
+	if result.Package != pkg || p.Package != pkg || p.SignType != SignTypeMD5 {
+		t.Fatalf("unexpected result %+v", result)
+	}
+	// paySign 不含 signType，package 经URL编码后参与签名
+	want := Sign(map[string]string{
+		"appId": "wx2421b1c4370ec43b", "timeStamp": p.TimeStamp, "nonceStr": p.NonceStr, "package": url.QueryEscape(pkg),
+	}, testSecret, SignTypeMD5)
+	if p.PaySign != want {
+		t.Fatalf("got paySign %s, want %s", p.PaySign, want)
+	}
+}
+
+func TestQueryRedPack(t *testing.T) {
+	reply := `<xml><return_code>SUCCESS</return_code><result_code>SUCCESS</result_code><mch_billno>RP1</mch_billno>` +
+		`<mch_id>1900000109</mch_id><detail_id>1000000000201503283103439304</detail_id><status>RECEIVED</status>` +
+		`<send_type>API</send_type><hb_type>GROUP</hb_type><total_num>3</total_num><total_amount>300</total_amount>` +
+		`<send_time>2015-04-21 20:00:00</send_time><hblist>` +
+		`<hbinfo><openid>o1</openid><amount>100</amount><rcv_time>2015-04-21 20:00:10</rcv_time></hbinfo>` +
+		`<hbinfo><openid>o2</openid><amount>200</amount><rcv_time>2015-04-21 20:01:10</rcv_time></hbinfo>` +
+		`</hblist></xml>`
+	c := newTestClient(t, func(req *http.Request) (*http.Response, error) {
+		body, _ := ioutil.ReadAll(req.Body)
+		params, err := ParseParams(body)
+		if err != nil {
+			return nil, err
+		}
+		if req.URL.Path != "/mmpaymkttransfers/gethbinfo" || params["appid"] != "wx2421b1c4370ec43b" ||
+			params["mch_billno"] != "RP1" || params["bill_type"] != "MCHT" || !xmlMap(params).verify(testSecret) {
+			t.Errorf("unexpected request %s %s", req.URL, body)
+		}
+		return &http.Response{StatusCode: http.StatusOK, Body: ioutil.NopCloser(strings.NewReader(reply))}, nil
+	})
+	info, err := c.QueryRedPack("", "RP1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Status != RedPackStatusReceived || info.Type != "GROUP" || info.TotalAmount != 300 || len(info.Receivers) != 2 {
+		t.Fatalf("unexpected info %+v", info)
+	}
+	if r := info.Receivers[1]; r.OpenID != "o2" || r.Amount != 200 || r.RecvTime != "2015-04-21 20:01:10" {
+		t.Fatalf("unexpected receiver %+v", r)
+	}
+}
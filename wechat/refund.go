@@ -1,17 +1,24 @@
 package wechat
 
 import (
-	"bytes"
+	"context"
+	"encoding/json"
 	"encoding/xml"
-	"errors"
 	"fmt"
-	"log"
-	"net/http"
+	"strconv"
+	"time"
 
 	"github.com/shengzhi/payment"
 )
 
-var ErrRefundRetry = errors.New("WX server error, please retry")
+// ErrRefundRetry 退款重试后仍系统繁忙，需使用相同的退款单号重新提交
+var ErrRefundRetry error = retryError("WX server error, please retry")
+
+// retryError 可重试的错误
+type retryError string
+
+func (e retryError) Error() string   { return string(e) }
+func (e retryError) Temporary() bool { return true }
 
 const wx_pay_refund_url = "https://api.mch.weixin.qq.com/secapi/pay/refund"
 
@@ -22,16 +29,46 @@ type RefundRequest struct {
 	Noncestr      string   `xml:"nonce_str" sign:"nonce_str"`
 	Sign          string   `xml:"sign"`
 	SignType      string   `xml:"sign_type" sign:"sign_type"`
-	TransactionID string   `xml:"transaction_id" sign:"transaction_id"`
-	OutTradeNo    string   `xml:"out_trade_no" sign:"out_trade_no"`
+	TransactionID string   `xml:"transaction_id,omitempty" sign:"transaction_id"`
+	OutTradeNo    string   `xml:"out_trade_no,omitempty" sign:"out_trade_no"`
 	OutRefundNo   string   `xml:"out_refund_no" sign:"out_refund_no"`
 	OrderFee      int32    `xml:"total_fee" sign:"total_fee"`
 	RefundFee     int32    `xml:"refund_fee" sign:"refund_fee"`
 	Currency      string   `xml:"refund_fee_type" sign:"refund_fee_type"`
 	Reason        string   `xml:"refund_desc" sign:"refund_desc"`
+	RefundAccount string   `xml:"refund_account,omitempty" sign:"refund_account"` // 退款资金来源
+	Detail        string   `xml:"detail,omitempty" sign:"detail"`                 // 单品优惠退款商品明细JSON
 	NotifyURL     string   `xml:"notify_url" sign:"notify_url"`
 }
 
+// refundGoodsDetail 单品优惠退款商品明细
+type refundGoodsDetail struct {
+	GoodsID        string `json:"goods_id"`
+	WXPayGoodsID   string `json:"wxpay_goods_id,omitempty"`
+	GoodsName      string `json:"goods_name,omitempty"`
+	RefundAmount   int32  `json:"refund_amount"`
+	RefundQuantity int    `json:"refund_quantity"`
+	Price          int32  `json:"price"`
+}
+
+// refundDetail 商品明细转换为 detail 参数
+func refundDetail(items []payment.RefundItem) (string, error) {
+	if len(items) == 0 {
+		return "", nil
+	}
+	var detail struct {
+		GoodsDetail []refundGoodsDetail `json:"goods_detail"`
+	}
+	for _, item := range items {
+		detail.GoodsDetail = append(detail.GoodsDetail, refundGoodsDetail{
+			GoodsID: item.GoodsID, WXPayGoodsID: item.PlatGoodsID, GoodsName: item.Name,
+			RefundAmount: item.RefundAmount, RefundQuantity: item.Quantity, Price: item.Price,
+		})
+	}
+	data, err := json.Marshal(detail)
+	return string(data), err
+}
+
 func (r *RefundRequest) setSign(sign string) { r.Sign = sign }
 
 type RefundResponse struct {
@@ -59,51 +96,156 @@ type RefundResponse struct {
 	CashRefundFee       int32    `xml:"cash_refund_fee" sign:"cash_refund_fee"`
 }
 
-func (r RefundResponse) getSign() string { return r.Sign }
-
+// Refund 退款，系统繁忙等错误按重试策略使用相同的退款单号重试，仍失败时返回 ErrRefundRetry
 func (c *Client) Refund(req payment.RefundRequest) (payment.RefundResponse, error) {
+	return c.RefundContext(context.Background(), req)
+}
+
+// RefundContext 同 Refund，ctx 取消后停止请求及重试
+func (c *Client) RefundContext(ctx context.Context, req payment.RefundRequest) (payment.RefundResponse, error) {
+	var result payment.RefundResponse
+	if req.MerchantOrderNo == "" && req.TransactionID == "" {
+		return result, fmt.Errorf("Payment: out_trade_no or transaction_id is required")
+	}
+	detail, err := refundDetail(req.Items)
+	if err != nil {
+		return result, fmt.Errorf("Payment: marshal refund detail error:%v", err)
+	}
 	refundReq := &RefundRequest{
 		APPID: c.appid, MerchantID: c.payOption.MerchantID,
-		Noncestr: c.genNonceStr(24), SignType: "MD5",
-		OutTradeNo: req.MerchantOrderNo, OutRefundNo: req.MerchantRefundNo,
+		SignType:      "MD5",
+		TransactionID: req.TransactionID,
+		OutTradeNo:    req.MerchantOrderNo, OutRefundNo: req.MerchantRefundNo,
 		OrderFee: req.TotalFee, RefundFee: req.RefundFee,
-		Currency: "CNY", Reason: req.Reason,
-		NotifyURL: req.NotifyURL,
+		Currency: req.Currency, Reason: req.Reason,
+		RefundAccount: string(req.FundsAccount),
+		Detail:        detail,
+		NotifyURL:     req.NotifyURL,
 	}
-	c.makePaySign(refundReq)
-	var buf bytes.Buffer
-	enc := xml.NewEncoder(&buf)
-	if err := enc.Encode(refundReq); err != nil {
-		log.Println(fmt.Errorf("Payment: marshal struct to xml error:%v", err))
+	if refundReq.Currency == "" {
+		refundReq.Currency = c.payOption.FeeType
+	}
+	if refundReq.Currency == "" {
+		refundReq.Currency = "CNY"
 	}
-	var result payment.RefundResponse
 	var refundResp RefundResponse
-	client := &http.Client{
-		Transport: &http.Transport{TLSClientConfig: c.tlsCfg},
+	err = c.retry(ctx, func() error {
+		refundReq.Noncestr = c.genNonceStr(24)
+		c.makePaySign(refundReq)
+		return c.post(ctx, c.certClient, wx_pay_refund_url, refundReq, &refundResp)
+	})
+	if e, ok := err.(*Error); ok && retryable(e) {
+		return result, ErrRefundRetry
 	}
-	res, err := client.Post(wx_pay_refund_url, "application/xml", &buf)
 	if err != nil {
 		return result, err
 	}
-	defer res.Body.Close()
-	err = xml.NewDecoder(res.Body).Decode(&refundResp)
-	if err != nil {
-		return result, fmt.Errorf("Payment: decode xml to struct error:%v", err)
-	}
-	if refundResp.ReturnCode != "SUCCESS" {
-		return result, fmt.Errorf("Payment: %s-%s", refundResp.ReturnCode, refundResp.ReturnMsg)
-	}
-	if refundResp.ResultCode == "FAIL" {
-		switch refundResp.ErrCode {
-		case "SYSTEMERROR", "BIZERR_NEED_RETRY", "FREQUENCY_LIMITED":
-			return result, ErrRefundRetry
-		default:
-			return result, fmt.Errorf("Payment:%s-%s", refundResp.ErrCode, refundResp.ErrDesc)
-		}
-	}
 	result.MerchantOrderNo = refundResp.OutTradeNo
 	result.MerchantRefundNo = refundResp.OutRefundNo
 	result.RefundFee = refundResp.RefundFee
 	result.PlatRefundID = refundResp.RefundID
 	return result, nil
 }
+
+const wx_pay_refund_query_url = "https://api.mch.weixin.qq.com/pay/refundquery"
+
+// RefundQueryRequest 退款查询请求，交易号、商户订单号、商户退款单号、微信退款单号四选一
+type RefundQueryRequest struct {
+	XMLName       xml.Name `xml:"xml"`
+	APPID         string   `xml:"appid" sign:"appid"`
+	MerchantID    string   `xml:"mch_id" sign:"mch_id"`
+	Noncestr      string   `xml:"nonce_str" sign:"nonce_str"`
+	Sign          string   `xml:"sign"`
+	TransactionID string   `xml:"transaction_id,omitempty" sign:"transaction_id"`
+	OutTradeNo    string   `xml:"out_trade_no,omitempty" sign:"out_trade_no"`
+	OutRefundNo   string   `xml:"out_refund_no,omitempty" sign:"out_refund_no"`
+	RefundID      string   `xml:"refund_id,omitempty" sign:"refund_id"`
+}
+
+func (r *RefundQueryRequest) setSign(sign string) { r.Sign = sign }
+
+// RefundQueryReply 退款查询结果
+type RefundQueryReply struct {
+	TransactionID string
+	OutTradeNo    string
+	TotalFee      int64
+	Refunds       []RefundStatus
+}
+
+// RefundStatus 单笔退款状态
+type RefundStatus struct {
+	OutRefundNo         string
+	RefundID            string
+	RefundFee           int64
+	SettlementRefundFee int64
+	Status              string // SUCCESS—退款成功 REFUNDCLOSE—退款关闭 PROCESSING—退款处理中 CHANGE—退款异常
+	RecvAccount         string // 退款入账账户
+	SuccessTime         time.Time
+}
+
+// RefundQuery 按商户退款单号查询退款状态
+func (c *Client) RefundQuery(merchantRefundNo string) (RefundQueryReply, error) {
+	return c.refundQuery(context.Background(), merchantRefundNo)
+}
+
+func (c *Client) refundQuery(ctx context.Context, merchantRefundNo string) (RefundQueryReply, error) {
+	req := RefundQueryRequest{
+		APPID: c.appid, MerchantID: c.payOption.MerchantID,
+		OutRefundNo: merchantRefundNo,
+	}
+	var params xmlMap
+	err := c.retry(ctx, func() error {
+		req.Noncestr = c.genNonceStr(24)
+		c.makePaySign(&req)
+		return c.post(ctx, c.httpClient, wx_pay_refund_query_url, &req, &params)
+	})
+	if err != nil {
+		return RefundQueryReply{}, err
+	}
+	reply := RefundQueryReply{TransactionID: params["transaction_id"], OutTradeNo: params["out_trade_no"]}
+	reply.TotalFee, _ = strconv.ParseInt(params["total_fee"], 10, 64)
+	count, _ := strconv.Atoi(params["refund_count"])
+	for i := 0; i < count; i++ {
+		n := strconv.Itoa(i)
+		status := RefundStatus{
+			OutRefundNo: params["out_refund_no_"+n],
+			RefundID:    params["refund_id_"+n],
+			Status:      params["refund_status_"+n],
+			RecvAccount: params["refund_recv_accout_"+n],
+		}
+		status.RefundFee, _ = strconv.ParseInt(params["refund_fee_"+n], 10, 64)
+		status.SettlementRefundFee, _ = strconv.ParseInt(params["settlement_refund_fee_"+n], 10, 64)
+		status.SuccessTime, _ = time.ParseInLocation("2006-01-02 15:04:05", params["refund_success_time_"+n], time.Local)
+		reply.Refunds = append(reply.Refunds, status)
+	}
+	return reply, nil
+}
+
+// QueryRefund 按商户退款单号查询退款，实现 payment.RefundQuerier
+func (c *Client) QueryRefund(merchantOrderNo, merchantRefundNo string) (payment.RefundNotifyResult, error) {
+	result := payment.RefundNotifyResult{Plat: payment.PayPlatWechat, MerchantOrderNo: merchantOrderNo, MerchantRefundNo: merchantRefundNo}
+	reply, err := c.RefundQuery(merchantRefundNo)
+	if e, ok := err.(*Error); ok && e.Code == "REFUNDNOTEXIST" {
+		return result, payment.ErrRefundNotFound
+	}
+	if err != nil {
+		return result, err
+	}
+	for _, r := range reply.Refunds {
+		if r.OutRefundNo != merchantRefundNo {
+			continue
+		}
+		result.MerchantOrderNo = reply.OutTradeNo
+		result.TransactionID = reply.TransactionID
+		result.TotalAmount = int32(reply.TotalFee)
+		result.RefundID = r.RefundID
+		result.RefundAmount = int32(r.RefundFee)
+		result.SettlementRefundAmount = int32(r.SettlementRefundFee)
+		result.Status = payment.RefundStatus(r.Status)
+		result.RecvAccount = r.RecvAccount
+		result.CompletedTime = r.SuccessTime
+		result.IsSuccess = result.Status == payment.RefundStatusSuccess
+		return result, nil
+	}
+	return result, payment.ErrRefundNotFound
+}
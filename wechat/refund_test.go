@@ -0,0 +1,98 @@
+package wechat
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"testing"
+
+	"github.com/shengzhi/payment"
+)
+
+func TestRefundContext(t *testing.T) {
+	item := payment.RefundItem{GoodsID: "G1", PlatGoodsID: "1001", Name: "测试商品", RefundAmount: 300, Quantity: 1, Price: 300}
+	tests := []struct {
+		name    string
+		req     payment.RefundRequest
+		opts    []OptionFunc
+		want    map[string]string // 期望的请求参数，值为空表示不应携带该参数
+		wantErr bool
+	}{
+		{
+			name: "transaction id only",
+			req:  payment.RefundRequest{TransactionID: "4200001", MerchantRefundNo: "T1-R1", TotalFee: 1000, RefundFee: 300},
+			want: map[string]string{"transaction_id": "4200001", "out_trade_no": "", "out_refund_no": "T1-R1", "total_fee": "1000", "refund_fee": "300"},
+		},
+		{
+			name:    "no order no or transaction id",
+			req:     payment.RefundRequest{MerchantRefundNo: "T1-R1", TotalFee: 1000, RefundFee: 300},
+			wantErr: true,
+		},
+		{
+			name: "request currency",
+			req:  payment.RefundRequest{MerchantOrderNo: "T1", MerchantRefundNo: "T1-R1", TotalFee: 1000, RefundFee: 300, Currency: "USD"},
+			opts: []OptionFunc{WithCurrency("HKD")},
+			want: map[string]string{"out_trade_no": "T1", "transaction_id": "", "refund_fee_type": "USD"},
+		},
+		{
+			name: "client currency",
+			req:  payment.RefundRequest{MerchantOrderNo: "T1", MerchantRefundNo: "T1-R1", TotalFee: 1000, RefundFee: 300},
+			opts: []OptionFunc{WithCurrency("HKD")},
+			want: map[string]string{"refund_fee_type": "HKD"},
+		},
+		{
+			name: "default currency",
+			req:  payment.RefundRequest{MerchantOrderNo: "T1", MerchantRefundNo: "T1-R1", TotalFee: 1000, RefundFee: 300},
+			opts: []OptionFunc{WithCurrency("")},
+			want: map[string]string{"refund_fee_type": "CNY", "refund_account": "", "detail": ""},
+		},
+		{
+			name: "funds account and detail",
+			req: payment.RefundRequest{
+				MerchantOrderNo: "T1", MerchantRefundNo: "T1-R1", TotalFee: 1000, RefundFee: 300,
+				FundsAccount: payment.RefundFundsRecharge, Items: []payment.RefundItem{item},
+			},
+			want: map[string]string{
+				"refund_account": "REFUND_SOURCE_RECHARGE_FUNDS",
+				"detail":         `{"goods_detail":[{"goods_id":"G1","wxpay_goods_id":"1001","goods_name":"测试商品","refund_amount":300,"refund_quantity":1,"price":300}]}`,
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var params map[string]string
+			c := newTestClient(t, func(req *http.Request) (*http.Response, error) {
+				body, _ := ioutil.ReadAll(req.Body)
+				var err error
+				if params, err = ParseParams(body); err != nil {
+					return nil, err
+				}
+				if req.URL.Path != "/secapi/pay/refund" || !xmlMap(params).verify(testSecret) {
+					t.Errorf("unexpected request %s %s", req.URL, body)
+				}
+				return xmlReply(map[string]string{
+					"return_code": "SUCCESS", "result_code": "SUCCESS", "appid": "wx2421b1c4370ec43b", "mch_id": "1900000109",
+					"out_trade_no": "T1", "out_refund_no": params["out_refund_no"], "refund_id": "5000001", "refund_fee": params["refund_fee"],
+				}), nil
+			}, tt.opts...)
+			result, err := c.RefundContext(context.Background(), tt.req)
+			if tt.wantErr {
+				if err == nil || params != nil {
+					t.Fatalf("got error %v, request %v", err, params)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			for k, v := range tt.want {
+				if params[k] != v {
+					t.Errorf("%s = %q, want %q", k, params[k], v)
+				}
+			}
+			if result.MerchantRefundNo != "T1-R1" || result.PlatRefundID != "5000001" || result.RefundFee != tt.req.RefundFee {
+				t.Fatalf("unexpected result %+v", result)
+			}
+		})
+	}
+}
@@ -0,0 +1,85 @@
+// 签名及退款通知加解密，供离线排查签名问题及构造测试通知
+
+package wechat
+
+import (
+	"crypto/aes"
+	"encoding/base64"
+	"encoding/xml"
+	"errors"
+	"strings"
+)
+
+// 签名类型
+const (
+	SignTypeMD5        = "MD5"
+	SignTypeHMACSHA256 = "HMAC-SHA256"
+)
+
+// ParseParams 解析XML报文的全部参数
+func ParseParams(body []byte) (map[string]string, error) {
+	var params xmlMap
+	if err := xml.Unmarshal(body, &params); err != nil {
+		return nil, err
+	}
+	return params, nil
+}
+
+// SignString 签名原串，参数按参数名排序，空值及 sign 参数不参与签名，末尾拼接 key=secret
+func SignString(params map[string]string, secret string) string {
+	sm := make(signMap, len(params))
+	for k, v := range params {
+		if k != "sign" {
+			sm[k] = v
+		}
+	}
+	return string(sm.signString(secret))
+}
+
+// Sign 计算参数签名，signType 为空时使用 MD5
+func Sign(params map[string]string, secret, signType string) string {
+	plainText := []byte(SignString(params, secret))
+	if signType == SignTypeHMACSHA256 {
+		return strings.ToUpper(hmacSHA256(plainText, secret))
+	}
+	return strings.ToUpper(md5Encrypt(plainText))
+}
+
+// DecryptRefundInfo 解密退款通知的 req_info，密钥为商户API密钥的MD5值，返回明文XML
+func DecryptRefundInfo(reqInfo, secret string) ([]byte, error) {
+	cipherTxt, err := base64.StdEncoding.DecodeString(reqInfo)
+	if err != nil {
+		return nil, err
+	}
+	return decryptAES256ECB([]byte(strings.ToLower(md5Encrypt([]byte(secret)))), cipherTxt)
+}
+
+// EncryptRefundInfo 加密退款通知的 req_info 明文XML，用于构造测试通知
+func EncryptRefundInfo(plainTxt []byte, secret string) (string, error) {
+	block, err := aes.NewCipher([]byte(strings.ToLower(md5Encrypt([]byte(secret)))))
+	if err != nil {
+		return "", err
+	}
+	plainTxt = pkcs5Padding(plainTxt[:len(plainTxt):len(plainTxt)], block.BlockSize())
+	cipherTxt := make([]byte, len(plainTxt))
+	NewECBEncrypter(block).CryptBlocks(cipherTxt, plainTxt)
+	return base64.StdEncoding.EncodeToString(cipherTxt), nil
+}
+
+// decryptAES256ECB AES-256-ECB 解密并去除 PKCS#7 填充
+func decryptAES256ECB(key, cipherTxt []byte) ([]byte, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	if len(cipherTxt) == 0 || len(cipherTxt)%block.BlockSize() != 0 {
+		return nil, errors.New("ciphertext is not a multiple of the block size")
+	}
+	plainTxt := make([]byte, len(cipherTxt))
+	NewECBDecrypter(block).CryptBlocks(plainTxt, cipherTxt)
+	padding := int(plainTxt[len(plainTxt)-1])
+	if padding == 0 || padding > block.BlockSize() {
+		return nil, errors.New("invalid padding, key may be wrong")
+	}
+	return plainTxt[:len(plainTxt)-padding], nil
+}
@@ -4,9 +4,9 @@ package wechat
 
 import (
 	"bytes"
+	"context"
 	"encoding/xml"
 	"fmt"
-	"net/http"
 	"time"
 
 	"github.com/shengzhi/payment"
@@ -74,10 +74,7 @@ func (c *Client) Transfer(r payment.TransferRequest) (payment.TransferResponse,
 	coder.Encode(req)
 
 	var result payment.TransferResponse
-	client := &http.Client{
-		Transport: &http.Transport{TLSClientConfig: c.tlsCfg},
-	}
-	res, err := client.Post(uri, "application/xml", &buf)
+	res, err := c.certClient.Post(uri, "application/xml", &buf)
 	if err != nil {
 		return result, err
 	}
@@ -99,3 +96,59 @@ func (c *Client) Transfer(r payment.TransferRequest) (payment.TransferResponse,
 	result.PayTime, _ = time.ParseInLocation("2006-01-02 15:04:05", reply.PayTime, time.Local)
 	return result, nil
 }
+
+// 企业付款状态
+const (
+	TransferStatusSuccess    = "SUCCESS"    // 付款成功
+	TransferStatusFailed     = "FAILED"     // 付款失败
+	TransferStatusProcessing = "PROCESSING" // 处理中
+	TransferStatusBankFail   = "BANK_FAIL"  // 银行退票，付款到银行卡时资金已退回商户
+)
+
+// TransferQueryRequest 企业付款查询请求
+type TransferQueryRequest struct {
+	XMLName    xml.Name `xml:"xml"`
+	APPID      string   `xml:"appid" sign:"appid"`
+	MerchantID string   `xml:"mch_id" sign:"mch_id"`
+	Noncestr   string   `xml:"nonce_str" sign:"nonce_str"`
+	Sign       string   `xml:"sign"`
+	OrderNo    string   `xml:"partner_trade_no" sign:"partner_trade_no"`
+}
+
+func (r *TransferQueryRequest) setSign(sign string) { r.Sign = sign }
+
+// TransferQueryReply 企业付款查询响应
+type TransferQueryReply struct {
+	XMLName      xml.Name `xml:"xml"`
+	OrderNo      string   `xml:"partner_trade_no"`
+	AppID        string   `xml:"appid"`
+	MerchantID   string   `xml:"mch_id"`
+	WXOrderNo    string   `xml:"detail_id"` // 付款单号
+	Status       string   `xml:"status"`    // SUCCESS、FAILED、PROCESSING
+	Reason       string   `xml:"reason"`    // 失败原因
+	OpenID       string   `xml:"openid"`
+	UserName     string   `xml:"transfer_name"`
+	Amount       int32    `xml:"payment_amount"`
+	TransferTime string   `xml:"transfer_time"` // 发起付款时间
+	PayTime      string   `xml:"payment_time"`  // 付款成功时间
+	Desc         string   `xml:"desc"`
+}
+
+// TransferQuery 按商户付款单号查询企业付款到零钱的结果，付款单不存在时返回 Code 为 NOT_FOUND 的 *Error；
+// 付款请求超时等结果未知时，应查询确认后再决定是否以原商户付款单号重新付款
+func (c *Client) TransferQuery(orderNo string) (TransferQueryReply, error) {
+	return c.TransferQueryContext(context.Background(), orderNo)
+}
+
+// TransferQueryContext 同 TransferQuery，ctx 取消后停止请求及重试
+func (c *Client) TransferQueryContext(ctx context.Context, orderNo string) (TransferQueryReply, error) {
+	const uri = "https://api.mch.weixin.qq.com/mmpaymkttransfers/gettransferinfo"
+	req := TransferQueryRequest{APPID: c.appid, MerchantID: c.payOption.MerchantID, OrderNo: orderNo}
+	var reply TransferQueryReply
+	err := c.retry(ctx, func() error {
+		req.Noncestr = c.genNonceStr(24)
+		c.makePaySign(&req)
+		return c.postXML(ctx, c.certClient, uri, &req, &reply, false)
+	})
+	return reply, err
+}
@@ -0,0 +1,79 @@
+package wechat
+
+import (
+	"context"
+	"encoding/xml"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"testing"
+)
+
+func TestTransferQuery(t *testing.T) {
+	tests := []struct {
+		name     string
+		reply    map[string]string
+		wantCode string
+		want     TransferQueryReply
+	}{
+		{
+			name: "success",
+			reply: map[string]string{
+				"return_code": "SUCCESS", "result_code": "SUCCESS", "appid": "wx2421b1c4370ec43b", "mch_id": "1900000109",
+				"partner_trade_no": "T1", "detail_id": "1000000000201503283103439304", "status": "SUCCESS", "openid": "oxTWIuGaIt6gTKsQRLau2M0yL16E",
+				"payment_amount": "100", "transfer_time": "2026-10-18 10:00:00", "payment_time": "2026-10-18 10:00:05", "desc": "理赔",
+			},
+			want: TransferQueryReply{
+				OrderNo: "T1", AppID: "wx2421b1c4370ec43b", MerchantID: "1900000109", WXOrderNo: "1000000000201503283103439304",
+				Status: TransferStatusSuccess, OpenID: "oxTWIuGaIt6gTKsQRLau2M0yL16E", Amount: 100,
+				TransferTime: "2026-10-18 10:00:00", PayTime: "2026-10-18 10:00:05", Desc: "理赔",
+			},
+		},
+		{
+			name:  "failed",
+			reply: map[string]string{"return_code": "SUCCESS", "result_code": "SUCCESS", "partner_trade_no": "T1", "status": "FAILED", "reason": "余额不足"},
+			want:  TransferQueryReply{OrderNo: "T1", Status: TransferStatusFailed, Reason: "余额不足"},
+		},
+		{
+			name:  "processing",
+			reply: map[string]string{"return_code": "SUCCESS", "result_code": "SUCCESS", "partner_trade_no": "T1", "status": "PROCESSING"},
+			want:  TransferQueryReply{OrderNo: "T1", Status: TransferStatusProcessing},
+		},
+		{
+			name:     "not found",
+			reply:    map[string]string{"return_code": "SUCCESS", "result_code": "FAIL", "err_code": "NOT_FOUND", "err_code_des": "指定单号数据不存在"},
+			wantCode: "NOT_FOUND",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := newTestClient(t, func(req *http.Request) (*http.Response, error) {
+				body, _ := ioutil.ReadAll(req.Body)
+				params, err := ParseParams(body)
+				if err != nil {
+					return nil, err
+				}
+				if req.URL.Path != "/mmpaymkttransfers/gettransferinfo" || params["appid"] != "wx2421b1c4370ec43b" ||
+					params["mch_id"] != "1900000109" || params["partner_trade_no"] != "T1" || !xmlMap(params).verify(testSecret) {
+					t.Errorf("unexpected request %s %s", req.URL, body)
+				}
+				return xmlReply(tt.reply), nil
+			})
+			reply, err := c.TransferQueryContext(context.Background(), "T1")
+			if tt.wantCode != "" {
+				var e *Error
+				if !errors.As(err, &e) || e.Code != tt.wantCode {
+					t.Fatalf("got error %v, want %s", err, tt.wantCode)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			reply.XMLName = xml.Name{}
+			if reply != tt.want {
+				t.Fatalf("got %+v, want %+v", reply, tt.want)
+			}
+		})
+	}
+}